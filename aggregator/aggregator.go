@@ -0,0 +1,279 @@
+package aggregator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+)
+
+// MergeFunc makes the body of a summary Item out of the bodies of the Items
+// it stands for, oldest first.
+type MergeFunc func(c gregor.Category, bodies []gregor.Body) (gregor.Body, error)
+
+// Rule says how Items in one category are aggregated.
+type Rule struct {
+	// Window is how long after the first Item of a burst later Items are
+	// still folded into the same summary.
+	Window time.Duration
+
+	// Merge makes the summary's body. If it's nil, the summary gets the
+	// body of the newest Item.
+	Merge MergeFunc
+}
+
+// burst is a run of Items for one user and category that arrived within
+// window of start. members are their MsgIDs, in order of arrival, and seen
+// has their hex encodings. summary is nil until the second Item shows up.
+type burst struct {
+	start   time.Time
+	window  time.Duration
+	members []gregor.MsgID
+	seen    map[string]bool
+	bodies  []gregor.Body
+	summary gregor.MsgID
+}
+
+func (b *burst) isOpenAt(t time.Time) bool {
+	return t.Before(b.start.Add(b.window))
+}
+
+// Aggregator is a gregor.MessageConsumer that passes every message on to
+// another consumer, usually a StateMachine, and coalesces bursts of Items
+// in the same category for the same user into a single summary Item. The
+// first Item of a burst is left alone. When a second one arrives within the
+// category's window, a summary Item is created with a body merged from
+// both, and both are dismissed. Later Items in the window are dismissed
+// too, and the summary's body is updated in place to cover them. Only Items
+// for all of a user's devices are aggregated.
+//
+// The MsgIDs of the messages an Aggregator makes are derived from those of
+// the Items that prompted them, so that feeding it the same messages again,
+// say after a restart, produces replays that the StateMachine ignores.
+type Aggregator struct {
+	sync.Mutex
+	next       gregor.MessageConsumer
+	objFactory gregor.ObjFactory
+	clock      clockwork.Clock
+	rules      map[string]Rule
+	bursts     map[string]*burst
+	nextSweep  time.Time
+}
+
+var _ gregor.MessageConsumer = (*Aggregator)(nil)
+
+// NewAggregator makes an Aggregator that passes messages on to next, and
+// aggregates Items in the categories that rules has entries for.
+func NewAggregator(next gregor.MessageConsumer, of gregor.ObjFactory, cl clockwork.Clock, rules map[string]Rule) *Aggregator {
+	return &Aggregator{
+		next:       next,
+		objFactory: of,
+		clock:      cl,
+		rules:      rules,
+		bursts:     make(map[string]*burst),
+	}
+}
+
+// ConsumeMessage passes m on, and then aggregates the Item it creates, if
+// there is one and its category has a rule.
+func (a *Aggregator) ConsumeMessage(m gregor.Message) error {
+	if err := a.next.ConsumeMessage(m); err != nil {
+		return err
+	}
+	ibm := m.ToInBandMessage()
+	if ibm == nil {
+		return nil
+	}
+	sum := ibm.ToStateUpdateMessage()
+	if sum == nil {
+		return nil
+	}
+	i := sum.Creation()
+	if i == nil || i.Category() == nil || i.Metadata().DeviceID() != nil {
+		return nil
+	}
+	rule, ok := a.rules[i.Category().String()]
+	if !ok || rule.Window <= 0 {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	return a.aggregate(i, rule)
+}
+
+func nowIfZero(now, t time.Time) time.Time {
+	if t.IsZero() {
+		return now
+	}
+	return t
+}
+
+func burstKey(i gregor.Item) string {
+	return hex.EncodeToString(i.Metadata().UID().Bytes()) + ":" + i.Category().String()
+}
+
+// sweep forgets bursts whose windows have closed as of now, at most once
+// per the shortest window.
+func (a *Aggregator) sweep(now time.Time) {
+	if now.Before(a.nextSweep) {
+		return
+	}
+	var shortest time.Duration
+	for _, r := range a.rules {
+		if r.Window > 0 && (shortest == 0 || r.Window < shortest) {
+			shortest = r.Window
+		}
+	}
+	for k, b := range a.bursts {
+		if !b.isOpenAt(now) {
+			delete(a.bursts, k)
+		}
+	}
+	a.nextSweep = now.Add(shortest)
+}
+
+func (a *Aggregator) aggregate(i gregor.Item, rule Rule) error {
+	md := i.Metadata()
+	now := nowIfZero(a.clock.Now(), md.CTime())
+	a.sweep(now)
+
+	k := burstKey(i)
+	mid := hex.EncodeToString(md.MsgID().Bytes())
+	b := a.bursts[k]
+	if b == nil || !b.isOpenAt(now) {
+		a.bursts[k] = &burst{
+			start:   now,
+			window:  rule.Window,
+			members: []gregor.MsgID{md.MsgID()},
+			seen:    map[string]bool{mid: true},
+			bodies:  []gregor.Body{i.Body()},
+		}
+		return nil
+	}
+	if b.seen[mid] {
+		return nil
+	}
+	b.members = append(b.members, md.MsgID())
+	b.seen[mid] = true
+	b.bodies = append(b.bodies, i.Body())
+
+	body, err := a.merge(rule, i.Category(), b.bodies)
+	if err != nil {
+		return err
+	}
+	var dtime *time.Time
+	if dt := i.DTime(); dt != nil {
+		dtime = resolve(md.CTime(), now, dt)
+	}
+
+	if b.summary == nil {
+		summary, err := a.deriveMsgID(md.MsgID(), "summary")
+		if err != nil {
+			return err
+		}
+		if err := a.createSummary(i, summary, now, body, dtime); err != nil {
+			return err
+		}
+		b.summary = summary
+		for _, m := range b.members {
+			if err := a.dismiss(i, m, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := a.updateSummary(i, b.summary, now, body, dtime); err != nil {
+		return err
+	}
+	return a.dismiss(i, md.MsgID(), now)
+}
+
+func (a *Aggregator) merge(rule Rule, c gregor.Category, bodies []gregor.Body) (gregor.Body, error) {
+	if rule.Merge == nil {
+		return bodies[len(bodies)-1], nil
+	}
+	return rule.Merge(c, bodies)
+}
+
+// resolve returns the absolute time t stands for, where offsets are
+// relative to ctime, or now if ctime is zero.
+func resolve(ctime, now time.Time, t gregor.TimeOrOffset) *time.Time {
+	if t.Time() != nil {
+		return t.Time()
+	}
+	if t.Offset() != nil {
+		ret := nowIfZero(now, ctime).Add(*t.Offset())
+		return &ret
+	}
+	return nil
+}
+
+// deriveMsgID makes a MsgID for a message prompted by the message m, the
+// same length as m's, unique to the purpose given.
+func (a *Aggregator) deriveMsgID(m gregor.MsgID, purpose string) (gregor.MsgID, error) {
+	h := sha256.New()
+	h.Write([]byte("gregor aggregator " + purpose + "\x00"))
+	h.Write(m.Bytes())
+	sum := h.Sum(nil)
+	n := len(m.Bytes())
+	if n == 0 || n > len(sum) {
+		n = len(sum)
+	}
+	return a.objFactory.MakeMsgID(sum[:n])
+}
+
+func (a *Aggregator) send(ibm gregor.InBandMessage) error {
+	m, err := a.objFactory.MakeMessageFromInBandMessage(ibm)
+	if err != nil {
+		return err
+	}
+	return a.next.ConsumeMessage(m)
+}
+
+// createSummary creates the summary Item with the MsgID summary, in the
+// same category as the Item i, for the same user.
+func (a *Aggregator) createSummary(i gregor.Item, summary gregor.MsgID, now time.Time, body gregor.Body, dtime *time.Time) error {
+	s, err := a.objFactory.MakeItem(i.Metadata().UID(), summary, nil, now, i.Category(), dtime, body)
+	if err != nil {
+		return err
+	}
+	ibm, err := a.objFactory.MakeInBandMessageFromItem(s)
+	if err != nil {
+		return err
+	}
+	return a.send(ibm)
+}
+
+// updateSummary replaces the body and dtime of the summary Item, in
+// response to the Item i.
+func (a *Aggregator) updateSummary(i gregor.Item, summary gregor.MsgID, now time.Time, body gregor.Body, dtime *time.Time) error {
+	md := i.Metadata()
+	id, err := a.deriveMsgID(md.MsgID(), "update")
+	if err != nil {
+		return err
+	}
+	ibm, err := a.objFactory.MakeItemUpdate(md.UID(), id, nil, now, summary, body, dtime)
+	if err != nil {
+		return err
+	}
+	return a.send(ibm)
+}
+
+// dismiss dismisses the Item target, which belongs to the same user as the
+// Item i.
+func (a *Aggregator) dismiss(i gregor.Item, target gregor.MsgID, now time.Time) error {
+	id, err := a.deriveMsgID(target, "dismissal")
+	if err != nil {
+		return err
+	}
+	ibm, err := a.objFactory.MakeDismissalByID(i.Metadata().UID(), id, nil, now, target)
+	if err != nil {
+		return err
+	}
+	return a.send(ibm)
+}
@@ -0,0 +1,90 @@
+package aggregator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	"github.com/keybase/gregor/storage"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func countFollowers(c gregor.Category, bodies []gregor.Body) (gregor.Body, error) {
+	return test.TestObjFactory{}.MakeBody([]byte(fmt.Sprintf("%d new followers", len(bodies))))
+}
+
+func makeCreation(t *testing.T, uid gregor.UID, id string, category string, body string) gregor.Message {
+	of := test.TestObjFactory{}
+	m, _ := of.MakeMsgID([]byte(id))
+	c, _ := of.MakeCategory(category)
+	b, _ := of.MakeBody([]byte(body))
+	i, err := of.MakeItem(uid, m, nil, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func bodies(t *testing.T, sm gregor.StateMachine, uid gregor.UID) []string {
+	st, err := sm.State(uid, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, err := st.Items()
+	require.Nil(t, err, "no error from Items")
+	var ret []string
+	for _, i := range items {
+		ret = append(ret, string(i.Body().Bytes()))
+	}
+	return ret
+}
+
+func TestAggregatorCoalescesBursts(t *testing.T) {
+	of := test.TestObjFactory{}
+	cl := clockwork.NewFakeClock()
+	sm := storage.NewMemEngine(of, cl)
+	a := NewAggregator(sm, of, cl, map[string]Rule{
+		"follower": {Window: time.Minute, Merge: countFollowers},
+	})
+	u1, _ := of.MakeUID([]byte("u1"))
+	u2, _ := of.MakeUID([]byte("u2"))
+
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f1", "follower", "alice")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"alice"}, bodies(t, sm, u1), "a single item is left alone")
+
+	cl.Advance(time.Second)
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f2", "follower", "bob")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"2 new followers"}, bodies(t, sm, u1), "summary replaces both items")
+
+	cl.Advance(time.Second)
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f3", "follower", "carol")), "no error from ConsumeMessage")
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "o1", "other", "unrelated")), "no error from ConsumeMessage")
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u2, "f4", "follower", "dave")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"3 new followers", "unrelated"}, bodies(t, sm, u1), "summary updated in place")
+	require.Equal(t, []string{"dave"}, bodies(t, sm, u2), "other users have their own bursts")
+
+	// Feeding the same item in again changes nothing.
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f3", "follower", "carol")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"3 new followers", "unrelated"}, bodies(t, sm, u1), "replays ignored")
+
+	// Once the window closes, a new burst starts.
+	cl.Advance(time.Minute)
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f5", "follower", "erin")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"3 new followers", "unrelated", "erin"}, bodies(t, sm, u1), "new burst")
+	require.Len(t, a.bursts, 1, "closed bursts are forgotten")
+}
+
+func TestAggregatorDefaultMerge(t *testing.T) {
+	of := test.TestObjFactory{}
+	cl := clockwork.NewFakeClock()
+	sm := storage.NewMemEngine(of, cl)
+	a := NewAggregator(sm, of, cl, map[string]Rule{"follower": {Window: time.Minute}})
+	u1, _ := of.MakeUID([]byte("u1"))
+
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f1", "follower", "alice")), "no error from ConsumeMessage")
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u1, "f2", "follower", "bob")), "no error from ConsumeMessage")
+	require.Equal(t, []string{"bob"}, bodies(t, sm, u1), "newest body wins")
+}
@@ -0,0 +1,328 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrBadBlob is returned by Parse for blobs that aren't in the documented
+// shape.
+type ErrBadBlob string
+
+func (e ErrBadBlob) Error() string { return "bad state blob: " + string(e) }
+
+func badBlob(f string, args ...interface{}) error {
+	return ErrBadBlob(fmt.Sprintf(f, args...))
+}
+
+// Blob is a user's State in the shape of the JSON blob in doc/design.md,
+// keyed by the hex encodings of the Items' MsgIDs:
+//
+//	randomID : {
+//		times : { created : ctime, expires : etime, remind_at : [t1, t2, ...] },
+//		for_device: id,
+//		category : category,
+//		body : {...}
+//	}
+//
+// Maps are marshaled with sorted keys, so a State always renders to the
+// same bytes.
+type Blob map[string]*Entry
+
+// Entry is one Item in a Blob. ForDevice is the hex encoding of the Item's
+// DeviceID, and nil for Items that are for all devices. A Body that's a
+// JSON object, array, number or boolean is embedded as is, compacted, and
+// any other Body is given as a JSON string.
+type Entry struct {
+	Times     Times           `json:"times"`
+	ForDevice *string         `json:"for_device"`
+	Category  string          `json:"category"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// Times are the times of an Entry. Expires is nil for Items that don't
+// expire.
+type Times struct {
+	Created  Time   `json:"created"`
+	Expires  *Time  `json:"expires"`
+	RemindAt []Time `json:"remind_at"`
+}
+
+// Time is a time in a Blob, given as seconds since the epoch, with as many
+// decimal places as it needs.
+type Time time.Time
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	tm := time.Time(t)
+	sec, ns := tm.Unix(), tm.Nanosecond()
+	sign := ""
+	if sec < 0 {
+		sign = "-"
+		sec = -sec
+		if ns > 0 {
+			sec--
+			ns = 1e9 - ns
+		}
+	}
+	s := sign + strconv.FormatInt(sec, 10)
+	if ns > 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
+	}
+	return []byte(s), nil
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if !isDigits(whole) || len(frac) > 9 || (frac != "" && !isDigits(frac)) {
+		return badBlob("bad time %s", b)
+	}
+	sec, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return badBlob("bad time %s", b)
+	}
+	ns, _ := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if neg {
+		sec, ns = -sec, -ns
+	}
+	*t = Time(time.Unix(sec, ns).UTC())
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// toTime resolves t, which may be an offset from ctime. It returns nil if
+// t is empty.
+func toTime(ctime time.Time, t gregor.TimeOrOffset) *time.Time {
+	if t == nil {
+		return nil
+	}
+	if t.Time() != nil {
+		ret := *t.Time()
+		return &ret
+	}
+	if t.Offset() != nil {
+		ret := ctime.Add(*t.Offset())
+		return &ret
+	}
+	return nil
+}
+
+// renderBody renders b as described for Entry.
+func renderBody(b gregor.Body) (json.RawMessage, error) {
+	if b == nil {
+		return json.RawMessage("null"), nil
+	}
+	raw := bytes.TrimSpace(b.Bytes())
+	if len(raw) > 0 && raw[0] != '"' && json.Valid(raw) {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(string(b.Bytes()))
+}
+
+// parseBody undoes renderBody. It returns nil for a null body.
+func parseBody(raw json.RawMessage) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// New makes the Blob for the Items in st. An Item's remind_at times are its
+// NotifyTimes, so they're only there if the StateMachine that made st
+// keeps them with its Items.
+func New(st gregor.State) (Blob, error) {
+	items, err := st.Items()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(Blob)
+	for _, i := range items {
+		md := i.Metadata()
+		ctime := md.CTime()
+		e := &Entry{
+			Times:    Times{Created: Time(ctime), RemindAt: []Time{}},
+			Category: i.Category().String(),
+		}
+		if dt := toTime(ctime, i.DTime()); dt != nil {
+			expires := Time(*dt)
+			e.Times.Expires = &expires
+		}
+		for _, nt := range i.NotifyTimes() {
+			if t := toTime(ctime, nt); t != nil {
+				e.Times.RemindAt = append(e.Times.RemindAt, Time(*t))
+			}
+		}
+		if d := md.DeviceID(); d != nil {
+			s := hex.EncodeToString(d.Bytes())
+			e.ForDevice = &s
+		}
+		if e.Body, err = renderBody(i.Body()); err != nil {
+			return nil, err
+		}
+		ret[hex.EncodeToString(md.MsgID().Bytes())] = e
+	}
+	return ret, nil
+}
+
+// Render renders st as a JSON Blob.
+func Render(st gregor.State) ([]byte, error) {
+	b, err := New(st)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
+
+// Item is an Item parsed from a Blob. ObjFactory.MakeItem has no room for
+// NotifyTimes, so Item adds them to the Item it made from the rest of the
+// Entry.
+type Item struct {
+	gregor.Item
+	RemindAt []time.Time
+}
+
+func (i *Item) NotifyTimes() []gregor.TimeOrOffset {
+	var ret []gregor.TimeOrOffset
+	for _, t := range i.RemindAt {
+		ret = append(ret, timeOrOffset(t))
+	}
+	return ret
+}
+
+var _ gregor.Item = (*Item)(nil)
+
+type timeOrOffset time.Time
+
+func (t timeOrOffset) Time() *time.Time {
+	ret := time.Time(t)
+	return &ret
+}
+func (t timeOrOffset) Offset() *time.Duration { return nil }
+
+type itemsByCTime []*Item
+
+func (l itemsByCTime) Len() int      { return len(l) }
+func (l itemsByCTime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l itemsByCTime) Less(i, j int) bool {
+	a, b := l[i].Metadata(), l[j].Metadata()
+	if !a.CTime().Equal(b.CTime()) {
+		return a.CTime().Before(b.CTime())
+	}
+	return bytes.Compare(a.MsgID().Bytes(), b.MsgID().Bytes()) < 0
+}
+
+// Items makes the Items in b, for the user u, with f. They're sorted by
+// ctime, then by MsgID. JSON bodies come back compacted, and other bodies
+// as the bytes of their strings.
+func (b Blob) Items(u gregor.UID, f gregor.ObjFactory) ([]*Item, error) {
+	var ret []*Item
+	for id, e := range b {
+		if e == nil {
+			return nil, badBlob("empty entry %s", id)
+		}
+		raw, err := hex.DecodeString(id)
+		if err != nil || len(raw) == 0 {
+			return nil, badBlob("bad ID %q", id)
+		}
+		msgID, err := f.MakeMsgID(raw)
+		if err != nil {
+			return nil, err
+		}
+		var devID gregor.DeviceID
+		if e.ForDevice != nil {
+			raw, err := hex.DecodeString(*e.ForDevice)
+			if err != nil || len(raw) == 0 {
+				return nil, badBlob("bad for_device %q in %s", *e.ForDevice, id)
+			}
+			if devID, err = f.MakeDeviceID(raw); err != nil {
+				return nil, err
+			}
+		}
+		cat, err := f.MakeCategory(e.Category)
+		if err != nil {
+			return nil, err
+		}
+		var body gregor.Body
+		raw, err = parseBody(e.Body)
+		if err != nil {
+			return nil, badBlob("bad body in %s: %s", id, err)
+		}
+		if raw != nil {
+			if body, err = f.MakeBody(raw); err != nil {
+				return nil, err
+			}
+		}
+		var dtime *time.Time
+		if e.Times.Expires != nil {
+			t := time.Time(*e.Times.Expires)
+			dtime = &t
+		}
+		i, err := f.MakeItem(u, msgID, devID, time.Time(e.Times.Created), cat, dtime, body)
+		if err != nil {
+			return nil, err
+		}
+		item := &Item{Item: i}
+		for _, t := range e.Times.RemindAt {
+			item.RemindAt = append(item.RemindAt, time.Time(t))
+		}
+		ret = append(ret, item)
+	}
+	sort.Sort(itemsByCTime(ret))
+	return ret, nil
+}
+
+// Parse parses the JSON Blob in data into the Items of the user u, made
+// with f.
+func Parse(u gregor.UID, f gregor.ObjFactory, data []byte) ([]*Item, error) {
+	var b Blob
+	if err := json.Unmarshal(data, &b); err != nil {
+		if _, ok := err.(ErrBadBlob); ok {
+			return nil, err
+		}
+		return nil, ErrBadBlob(err.Error())
+	}
+	if b == nil {
+		return nil, badBlob("not an object")
+	}
+	return b.Items(u, f)
+}
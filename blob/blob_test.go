@@ -0,0 +1,117 @@
+package blob
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func makeItem(t *testing.T, id string, dev string, ctime time.Time, dtime *time.Time, cat string, body string) gregor.Item {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("blob user"))
+	m, _ := of.MakeMsgID([]byte(id))
+	var d gregor.DeviceID
+	if dev != "" {
+		d, _ = of.MakeDeviceID([]byte(dev))
+	}
+	c, _ := of.MakeCategory(cat)
+	b, _ := of.MakeBody([]byte(body))
+	i, err := of.MakeItem(u, m, d, ctime, c, dtime, b)
+	require.Nil(t, err, "no error from MakeItem")
+	return i
+}
+
+const wantBlob = `{` +
+	`"61":{"times":{"created":1400000000,"expires":null,"remind_at":[1400002000.5,1400003000]},` +
+	`"for_device":null,"category":"user.joined","body":{"social_media_name":"bob@twitter","keybase":"kbob"}},` +
+	`"62":{"times":{"created":1400000001.25,"expires":1400086401.25,"remind_at":[]},` +
+	`"for_device":"6465763031","category":"kbfs.tlf","body":"plain text"},` +
+	`"63":{"times":{"created":1400000002,"expires":null,"remind_at":[]},` +
+	`"for_device":null,"category":"misc","body":"\"quoted\""}}`
+
+func TestRenderAndParse(t *testing.T) {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("blob user"))
+	t0 := time.Unix(1400000000, 0)
+	t1 := t0.Add(1250 * time.Millisecond)
+	expires := t1.Add(24 * time.Hour)
+	items := []gregor.Item{
+		&Item{
+			Item:     makeItem(t, "a", "", t0, nil, "user.joined", `{"social_media_name": "bob@twitter", "keybase": "kbob"}`),
+			RemindAt: []time.Time{t0.Add(2000500 * time.Millisecond), t0.Add(3000 * time.Second)},
+		},
+		makeItem(t, "b", "dev01", t1, &expires, "kbfs.tlf", "plain text"),
+		makeItem(t, "c", "", t0.Add(2*time.Second), nil, "misc", `"quoted"`),
+	}
+	st, err := of.MakeState(items)
+	require.Nil(t, err, "no error from MakeState")
+	b, err := Render(st)
+	require.Nil(t, err, "no error from Render")
+	require.Equal(t, wantBlob, string(b), "rendered in the documented shape")
+
+	parsed, err := Parse(u, of, b)
+	require.Nil(t, err, "no error from Parse")
+	require.Equal(t, 3, len(parsed), "all items parsed")
+	require.Equal(t, []byte("a"), parsed[0].Metadata().MsgID().Bytes(), "sorted by ctime")
+	require.True(t, t0.Equal(parsed[0].Metadata().CTime()), "right ctime")
+	require.Equal(t, 2, len(parsed[0].NotifyTimes()), "remind_at times kept")
+	require.True(t, t0.Add(2000500*time.Millisecond).Equal(*parsed[0].NotifyTimes()[0].Time()), "right remind_at")
+	require.Equal(t, `{"social_media_name":"bob@twitter","keybase":"kbob"}`, string(parsed[0].Body().Bytes()), "JSON body compacted")
+	require.Equal(t, []byte("dev01"), parsed[1].Metadata().DeviceID().Bytes(), "right device")
+	require.True(t, expires.Equal(*parsed[1].DTime().Time()), "right expiry")
+	require.Equal(t, "plain text", string(parsed[1].Body().Bytes()), "text body")
+	require.Nil(t, parsed[2].Metadata().DeviceID(), "for all devices")
+	require.Nil(t, parsed[2].DTime(), "doesn't expire")
+	require.Equal(t, `"quoted"`, string(parsed[2].Body().Bytes()), "string body")
+
+	// Rendering what was parsed gives back the same blob.
+	var again []gregor.Item
+	for _, i := range parsed {
+		again = append(again, i)
+	}
+	st, err = of.MakeState(again)
+	require.Nil(t, err, "no error from MakeState")
+	b, err = Render(st)
+	require.Nil(t, err, "no error from Render")
+	require.Equal(t, wantBlob, string(b), "same blob after a round trip")
+}
+
+func TestTimes(t *testing.T) {
+	for _, s := range []string{"0", "1", "-1", "-0.5", "1400000000.000000001", "-1400000000.25"} {
+		var tm Time
+		require.Nil(t, json.Unmarshal([]byte(s), &tm), "no error from Unmarshal of %s", s)
+		b, err := json.Marshal(tm)
+		require.Nil(t, err, "no error from Marshal")
+		require.Equal(t, s, string(b), "same time")
+	}
+	require.Equal(t, int64(-500000000), time.Time(mustTime(t, "-0.5")).UnixNano(), "right negative time")
+}
+
+func mustTime(t *testing.T, s string) Time {
+	var tm Time
+	require.Nil(t, json.Unmarshal([]byte(s), &tm), "no error from Unmarshal")
+	return tm
+}
+
+func TestParseBad(t *testing.T) {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("blob user"))
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`null`,
+		`{"xx":{"times":{"created":1}}}`,
+		`{"61":null}`,
+		`{"61":{"times":{"created":"yesterday"}}}`,
+		`{"61":{"times":{"created":1e9}}}`,
+		`{"61":{"times":{"created":1.0000000001}}}`,
+		`{"61":{"times":{"created":1},"for_device":"zz"}}`,
+	} {
+		_, err := Parse(u, of, []byte(bad))
+		require.IsType(t, ErrBadBlob(""), err, "bad blob %q", bad)
+	}
+}
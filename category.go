@@ -0,0 +1,44 @@
+package gregor
+
+import "strings"
+
+// Categories are dotted hierarchies, like "user.joined" or
+// "user.proof.broken". Wherever a Category picks out Items, in
+// State.ItemsInCategory and in MsgRanges, one that ends in
+// CategoryWildcard picks out all the categories under its prefix instead:
+// "user.*" matches "user.joined" and "user.proof.broken", but not "user"
+// itself or "username".
+const CategoryWildcard = ".*"
+
+// CategoryPrefix returns the prefix, up to and including its final dot,
+// that all the categories the wildcard p matches start with, or false if p
+// isn't a wildcard.
+func CategoryPrefix(p string) (string, bool) {
+	if !strings.HasSuffix(p, CategoryWildcard) {
+		return "", false
+	}
+	return p[:len(p)-len(CategoryWildcard)+1], true
+}
+
+// CategoryMatches returns true if the category c is picked out by the
+// category p, either because they're the same or because p is a wildcard
+// over c.
+func CategoryMatches(p string, c string) bool {
+	if p == c {
+		return true
+	}
+	prefix, ok := CategoryPrefix(p)
+	return ok && strings.HasPrefix(c, prefix)
+}
+
+// CategoryPatterns returns the categories that match c: c itself and the
+// wildcards over each of its ancestors, from the top down.
+func CategoryPatterns(c string) []string {
+	var ret []string
+	for i, r := range c {
+		if r == '.' {
+			ret = append(ret, c[:i]+CategoryWildcard)
+		}
+	}
+	return append(ret, c)
+}
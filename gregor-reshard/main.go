@@ -0,0 +1,97 @@
+// gregor-reshard moves users between SQL shards after a change to the shard
+// map, such as adding a new shard at the end. Users are copied to their new
+// shard, checked, and then deleted from their old one, so it's safe to run
+// again if interrupted. gregord should be running with the new shard map,
+// or stopped, while this runs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jonboulle/clockwork"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+)
+
+const usageStr = `Usage:
+gregor-reshard -from=<shard map file> -to=<shard map file> [-body-keys=<key file>]
+
+  Moves every user stored on one of the shards in the -from map to the shard
+  the -to map says they belong on, along with their pending reminders and
+  queued out-of-band messages. Shards are the same if they have the same
+  engine and DSN in both maps. If gregord encrypts bodies, -body-keys must
+  give the same keys.
+`
+
+func errorf(f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+f, args...)
+}
+
+func readShardMap(name string) (*storage.ShardMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return storage.ReadShardMap(f)
+}
+
+func readKeyFile(name string) (*storage.KeyFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return storage.ReadKeyFile(f)
+}
+
+func run(from, to, keys string) error {
+	fromMap, err := readShardMap(from)
+	if err != nil {
+		return err
+	}
+	toMap, err := readShardMap(to)
+	if err != nil {
+		return err
+	}
+	of := protocol.ObjFactory{}
+	engs, dbs, err := storage.OpenShardMaps(of, clockwork.NewRealClock(), fromMap, toMap)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		defer db.Close()
+	}
+	if keys != "" {
+		kf, err := readKeyFile(keys)
+		if err != nil {
+			return err
+		}
+		engs[0].SetBodyKeys(kf)
+		engs[1].SetBodyKeys(kf)
+	}
+	logf := func(f string, args ...interface{}) { fmt.Printf(f, args...) }
+	n, err := storage.Reshard(engs[0], engs[1], logf)
+	fmt.Printf("moved %d users\n", n)
+	return err
+}
+
+func main() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageStr) }
+	from := fs.String("from", "", "the shard map users are stored under now")
+	to := fs.String("to", "", "the shard map to move users to")
+	keys := fs.String("body-keys", "", "the key file bodies are encrypted with, if any")
+	fs.Parse(os.Args[1:])
+	if *from == "" || *to == "" || len(fs.Args()) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := run(*from, *to, *keys); err != nil {
+		errorf("%s\n", err)
+		os.Exit(1)
+	}
+}
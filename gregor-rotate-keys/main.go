@@ -0,0 +1,104 @@
+// gregor-rotate-keys re-encrypts the bodies stored in gregor's SQL
+// databases under the current body key, including any stored in the clear,
+// so that older keys can be retired. gregord should already be running with
+// the new key file, or be stopped, while this runs, and it's safe to run
+// again if interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jonboulle/clockwork"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+)
+
+const usageStr = `Usage:
+gregor-rotate-keys -body-keys=<key file> (-shard-map=<shard map file> | -engine=<engine> -dsn=<dsn>)
+
+  Re-encrypts every stored body that isn't encrypted with the last key in
+  the key file, in either every shard in the shard map, or in the single
+  database given by -engine (e.g. "mysql") and -dsn. See "gregord
+  -help-extended" for the format of the key file.
+`
+
+func errorf(f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+f, args...)
+}
+
+func readKeyFile(name string) (*storage.KeyFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return storage.ReadKeyFile(f)
+}
+
+func readShardMap(name string) (*storage.ShardMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return storage.ReadShardMap(f)
+}
+
+// openShardMap opens the shards in the given shard map file, or if it's
+// empty, the one database given by c, as a single-shard map.
+func openShardMap(name string, c storage.ShardConfig) (*storage.ShardedEngine, func(), error) {
+	m := &storage.ShardMap{Shards: []storage.ShardConfig{c}}
+	if name != "" {
+		var err error
+		if m, err = readShardMap(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	eng, dbs, err := m.Open(protocol.ObjFactory{}, clockwork.NewRealClock())
+	if err != nil {
+		return nil, nil, err
+	}
+	closeAll := func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}
+	return eng, closeAll, nil
+}
+
+func run(keys string, shardMap string, c storage.ShardConfig) error {
+	kf, err := readKeyFile(keys)
+	if err != nil {
+		return err
+	}
+	eng, closeAll, err := openShardMap(shardMap, c)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+	eng.SetBodyKeys(kf)
+	n, err := eng.RotateBodyKeys()
+	fmt.Printf("re-encrypted %d bodies\n", n)
+	return err
+}
+
+func main() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usageStr) }
+	keys := fs.String("body-keys", "", "the key file, with the current key last")
+	shardMap := fs.String("shard-map", "", "the shard map of the databases to re-encrypt")
+	engine := fs.String("engine", "", "the database/sql engine of the single database to re-encrypt")
+	dsn := fs.String("dsn", "", "the DSN of the single database to re-encrypt")
+	fs.Parse(os.Args[1:])
+	if *keys == "" || (*shardMap == "") == (*engine == "" || *dsn == "") || len(fs.Args()) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := run(*keys, *shardMap, storage.ShardConfig{Engine: *engine, DSN: *dsn}); err != nil {
+		errorf("%s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	protocol "github.com/keybase/gregor/protocol/go"
+	context "golang.org/x/net/context"
+)
+
+// ErrBadSession is returned when the session server doesn't vouch for a
+// device's token.
+type ErrBadSession string
+
+func (e ErrBadSession) Error() string { return "bad session: " + string(e) }
+
+// sessionTimeout bounds how long we wait for the session server.
+const sessionTimeout = 10 * time.Second
+
+// sessionAuthenticator authenticates devices' tokens by looking them up on
+// the session server, which answers
+//
+//	GET <session-server>/session?token=<token>
+//
+// with 200 and {"uid": "<hex>", "session_id": "<id>"} for a good token, and
+// anything else for a bad one.
+type sessionAuthenticator struct {
+	base   url.URL
+	client *http.Client
+}
+
+func newSessionAuthenticator(u *url.URL) *sessionAuthenticator {
+	base := *u
+	// A bare host:port parses as an opaque URL with the host as its scheme.
+	if base.Host == "" {
+		if p, err := url.Parse("http://" + u.String()); err == nil {
+			base = *p
+		}
+	}
+	return &sessionAuthenticator{base: base, client: &http.Client{Timeout: sessionTimeout}}
+}
+
+type sessionReply struct {
+	UID       string `json:"uid"`
+	SessionID string `json:"session_id"`
+}
+
+func (a *sessionAuthenticator) Authenticate(ctx context.Context, tok protocol.AuthToken) (protocol.UID, protocol.SessionID, error) {
+	u := a.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/session"
+	u.RawQuery = url.Values{"token": {string(tok)}}.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", ErrBadSession(fmt.Sprintf("session server said %s", resp.Status))
+	}
+	var r sessionReply
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, "", ErrBadSession(fmt.Sprintf("bad reply from session server: %s", err))
+	}
+	uid, err := hex.DecodeString(r.UID)
+	if err != nil || len(uid) == 0 {
+		return nil, "", ErrBadSession("no uid from session server")
+	}
+	return protocol.UID(uid), protocol.SessionID(r.SessionID), nil
+}
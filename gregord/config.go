@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
+	"github.com/keybase/gregor/storage"
 	"io/ioutil"
 	"net"
 	"net/url"
@@ -17,16 +18,29 @@ import (
 )
 
 type Options struct {
-	SessionServer *url.URL
-	BindAddress   string
-	MysqlDSN      *url.URL
-	Debug         bool
-	TLSConfig     *tls.Config
+	SessionServer    *url.URL
+	BindAddress      string
+	MysqlDSN         *url.URL
+	Debug            bool
+	TLSConfig        *tls.Config
+	ShardMap         *storage.ShardMap
+	PruneRetention   time.Duration
+	PruneInterval    time.Duration
+	ReminderInterval time.Duration
+	OOBRetention     storage.OOBRetention
+	BodyKeys         storage.KeyProvider
+	StateAddress     string
+	Quotas           storage.Quotas
 }
 
 const usageStr = `Usage:
-gregord -session-server=<uri> -bind-address=[<host>]:<port> [-mysql-dsn=<user:pw@host/dbname>] [-debug]
+gregord -session-server=<uri> -bind-address=[<host>]:<port> [-mysql-dsn=<user:pw@host/dbname>|-shard-map=<file|json>] [-debug]
     [-tls-key=<file|bucket|key>] [-tls-cert=<file|bucket|key>] [-aws-region=<region>] [-s3-config-bucket=<bucket>]
+    [-prune-retention=<duration>] [-prune-interval=<duration>] [-reminder-interval=<duration>]
+    [-oob-retention=<system=duration,...>]
+    [-body-keys=<file|keys>] [-state-address=[<host>]:<port>]
+    [-max-items=<n>] [-max-category-items=<n>] [-max-body-size=<bytes>] [-quota-policy=reject|dismiss-oldest]
+gregord (export|import) ...
 
 Configuring TLS
 
@@ -38,6 +52,104 @@ Configuring TLS
       via the file:/// prefix.
     - via raw values; in this case, specify big ugly strings replete with newlines.
 
+Authentication
+
+  Devices authenticate with a token, which gregord checks with the session
+  server given by -session-server, a URL or a bare host:port, by asking it
+
+    GET <session-server>/session?token=<token>
+
+  The session server answers a good token with 200 and the JSON
+  {"uid": "<hex>", "session_id": "<id>"}, and anything else means the
+  token is bad.
+
+Sharding
+
+  Instead of -mysql-dsn, gregord can spread users over several SQL databases
+  given by -shard-map, either a JSON file or the raw JSON, like:
+
+    {"shards": [{"engine": "mysql", "dsn": "user:pw@tcp(db0:3306)/gregor?parseTime=true"},
+                {"engine": "mysql", "dsn": "user:pw@tcp(db1:3306)/gregor?parseTime=true"}]}
+
+  Users are assigned to shards by a hash of their UID. Use gregor-reshard to
+  move users around after adding shards.
+
+Pruning
+
+  If -mysql-dsn or -shard-map, and -prune-retention are given, gregord periodically deletes
+  items that were dismissed or expired more than -prune-retention ago (e.g.
+  "720h"), along with messages that no longer matter. Devices that have been
+  offline for longer than that will need to fetch their full state rather than
+  replay missed messages. The check runs every -prune-interval (default "1h").
+  Pruning is off by default.
+
+Reminders
+
+  With -mysql-dsn or -shard-map, gregord checks every -reminder-interval
+  (default "1m") for items whose reminders have come due, and broadcasts
+  them to their users' devices. A reminder is only deleted once it's been
+  broadcast to at least one connected device, so one that fails, or whose
+  user has no devices connected, is tried again at the next check. Use
+  -reminder-interval=0 to turn reminders off.
+
+Out-of-band Queues
+
+  Out-of-band messages, like cache invalidations, are normally only sent to
+  devices that are connected at the time. With -mysql-dsn or -shard-map,
+  -oob-retention keeps them around for devices that connect later, for as
+  long as given for each system, like:
+
+    -oob-retention=kbfs.favorites=1h,default=10m
+
+  where "default" covers the systems that aren't listed. A device gets every
+  unexpired message for its user when it connects, even one it's seen before.
+  Expired messages are deleted when pruning. Nothing is kept by default.
+
+Body Encryption
+
+  With -body-keys, gregord encrypts the bodies of the items and out-of-band
+  messages it stores in -mysql-dsn or -shard-map. -body-keys is a file, or
+  the raw contents of one, listing keys by ID, like:
+
+    2016-01 <64 hex digits>
+    2016-07 <64 hex digits>
+
+  New bodies are encrypted with the last key listed, and the others are kept
+  to decrypt older bodies. To rotate keys, add a new one (e.g. from
+  "openssl rand -hex 32") to the end of the file, restart gregord, and run
+  gregor-rotate-keys with the new file to re-encrypt everything else. Bodies
+  are stored in the clear by default.
+
+Quotas
+
+  With -mysql-dsn or -shard-map, gregord can bound how much each user
+  stores: -max-items bounds the number of live items, those that haven't
+  been dismissed or expired, -max-category-items the number in any one
+  category, and -max-body-size the size in bytes of each item's body.
+  Messages that would go over a bound are rejected, and the client gets a
+  quota error back. With -quota-policy=dismiss-oldest, a new item that would
+  go over one of the item bounds dismisses the user's oldest live items to
+  make room instead, starting with those in its own category if that's the
+  bound it hit. Bodies that are too big are always rejected. Nothing is
+  bounded by default.
+
+Viewing State
+
+  With -state-address, gregord also serves users' states over HTTP, as the
+  JSON blobs described in doc/design.md, on:
+
+    GET /state?uid=<hex>[&device=<hex>]
+
+  where the UID and device ID are hex-encoded as they are in the database.
+  It needs -mysql-dsn or -shard-map, and isn't authenticated, so bind it to
+  an address only trusted front-ends and tools can reach.
+
+Exporting and Importing Users
+
+  "gregord export" and "gregord import" copy a user's messages out of the
+  storage given by -mysql-dsn or -shard-map, and into another. See "gregord
+  export -help".
+
 Environment Variables
 
   All of the above flags have environment variable equivalents:
@@ -45,11 +157,22 @@ Environment Variables
     -bind-address or BIND_ADDRESS
     -session-server or SESSION_SERVER
     -mysql-dsn or MYSQL_DSN
+    -shard-map or SHARD_MAP
     -debug or DEBUG
     -tls-key or TLS_KEY
     -tls-cert or TLS_CERT
     -aws-region or AWS_REGION
     -s3-config-bucket or S3_CONFIG_BUCKET
+    -prune-retention or PRUNE_RETENTION
+    -prune-interval or PRUNE_INTERVAL
+    -reminder-interval or REMINDER_INTERVAL
+    -oob-retention or OOB_RETENTION
+    -body-keys or BODY_KEYS
+    -state-address or STATE_ADDRESS
+    -max-items or MAX_ITEMS
+    -max-category-items or MAX_CATEGORY_ITEMS
+    -max-body-size or MAX_BODY_SIZE
+    -quota-policy or QUOTA_POLICY
 `
 
 type ErrBadUsage string
@@ -136,6 +259,62 @@ func parseTLSConfig(raw *rawOpts) (*tls.Config, error) {
 	return makeTLSConfig(cert, key)
 }
 
+func parseShardMap(name string) (*storage.ShardMap, error) {
+	raw, err := readEnvOrFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := storage.ReadShardMap(strings.NewReader(raw))
+	if err != nil {
+		return nil, badConfig("%s", err)
+	}
+	return m, nil
+}
+
+func parseKeyFile(name string) (*storage.KeyFile, error) {
+	raw, err := readEnvOrFile(name)
+	if err != nil {
+		return nil, err
+	}
+	kf, err := storage.ReadKeyFile(strings.NewReader(raw))
+	if err != nil {
+		return nil, badConfig("%s", err)
+	}
+	return kf, nil
+}
+
+// parseDuration parses the duration given for the named flag, where the empty
+// string means zero.
+func parseDuration(name string, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, badUsage("bad %s: %s", name, err)
+	}
+	if d < 0 {
+		return 0, badUsage("bad %s: must not be negative", name)
+	}
+	return d, nil
+}
+
+// parseCount parses the count given for the named flag, where the empty
+// string means zero.
+func parseCount(name string, s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, badUsage("bad %s: %s", name, err)
+	}
+	if n < 0 {
+		return 0, badUsage("bad %s: must not be negative", name)
+	}
+	return n, nil
+}
+
 func (o *Options) Parse(raw *rawOpts) error {
 	if raw.helpExtended {
 		usage()
@@ -165,16 +344,85 @@ func (o *Options) Parse(raw *rawOpts) error {
 
 	o.Debug = raw.debug
 
+	if err = o.parseStorage(raw); err != nil {
+		return err
+	}
+
+	if o.TLSConfig, err = parseTLSConfig(raw); err != nil {
+		return err
+	}
+
+	if o.PruneRetention, err = parseDuration("prune-retention", raw.pruneRetention); err != nil {
+		return err
+	}
+	if o.PruneInterval, err = parseDuration("prune-interval", raw.pruneInterval); err != nil {
+		return err
+	}
+	if o.PruneRetention > 0 && o.PruneInterval == 0 {
+		return badUsage("prune-interval must be positive if pruning")
+	}
+
+	if o.ReminderInterval, err = parseDuration("reminder-interval", raw.reminderInterval); err != nil {
+		return err
+	}
+
+	if o.OOBRetention, err = storage.ParseOOBRetention(raw.oobRetention); err != nil {
+		return badUsage("%s", err)
+	}
+
+	if raw.stateAddress != "" {
+		if _, _, err := net.SplitHostPort(raw.stateAddress); err != nil {
+			return badUsage("bad state-address: %s", err)
+		}
+		if o.MysqlDSN == nil && o.ShardMap == nil {
+			return badUsage("state-address needs a mysql-dsn or a shard-map")
+		}
+		o.StateAddress = raw.stateAddress
+	}
+
+	return nil
+}
+
+// parseStorage parses the options that say where and how gregord stores
+// its state.
+func (o *Options) parseStorage(raw *rawOpts) error {
+	var err error
 	if raw.mysqlDSN != "" {
 		if o.MysqlDSN, err = url.Parse(raw.mysqlDSN); err != nil {
 			return badUsage("Error parsing mysql DSN: %s", err)
 		}
 	}
 
-	if o.TLSConfig, err = parseTLSConfig(raw); err != nil {
-		return err
+	if raw.shardMap != "" {
+		if o.MysqlDSN != nil {
+			return badUsage("can't specify both a mysql-dsn and a shard-map")
+		}
+		if o.ShardMap, err = parseShardMap(raw.shardMap); err != nil {
+			return err
+		}
+	}
+
+	if raw.bodyKeys != "" {
+		if o.BodyKeys, err = parseKeyFile(raw.bodyKeys); err != nil {
+			return err
+		}
 	}
 
+	if o.Quotas.MaxItems, err = parseCount("max-items", raw.maxItems); err != nil {
+		return err
+	}
+	if o.Quotas.MaxItemsPerCategory, err = parseCount("max-category-items", raw.maxCategoryItems); err != nil {
+		return err
+	}
+	if o.Quotas.MaxBodySize, err = parseCount("max-body-size", raw.maxBodySize); err != nil {
+		return err
+	}
+	if o.Quotas.Policy, err = storage.ParseQuotaPolicy(raw.quotaPolicy); err != nil {
+		return badUsage("%s", err)
+	}
+	if !o.Quotas.IsZero() && o.MysqlDSN == nil && o.ShardMap == nil {
+		return badUsage("quotas need a mysql-dsn or a shard-map")
+	}
 	return nil
 }
 
@@ -211,14 +459,32 @@ type rawOpts struct {
 	sessionServerURI string
 	bindAddress      string
 	mysqlDSN         string
+	shardMap         string
 	debug            bool
 	tlsKey           string
 	tlsCert          string
 	awsRegion        string
 	configBucket     string
+	pruneRetention   string
+	pruneInterval    string
+	reminderInterval string
+	oobRetention     string
+	bodyKeys         string
+	stateAddress     string
+	maxItems         string
+	maxCategoryItems string
+	maxBodySize      string
+	quotaPolicy      string
 	helpExtended     bool
 }
 
+func envOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
 func ParseOptions(argv []string) (*Options, error) {
 	return parseOptions(argv, false)
 }
@@ -238,11 +504,22 @@ func parseOptions(argv []string, quiet bool) (*Options, error) {
 	fs.StringVar(&raw.sessionServerURI, "session-server", os.Getenv("SESSION_SERVER"), "host:port of the session server")
 	fs.StringVar(&raw.bindAddress, "bind-address", os.Getenv("BIND_ADDRESS"), "hostname:port to bind to")
 	fs.StringVar(&raw.mysqlDSN, "mysql-dsn", os.Getenv("MYSQL_DSN"), "user:pw@host/dbname for MySQL")
+	fs.StringVar(&raw.shardMap, "shard-map", os.Getenv("SHARD_MAP"), "file or raw JSON describing SQL shards")
 	fs.BoolVar(&raw.debug, "debug", false, "turn on debugging")
 	fs.StringVar(&raw.tlsKey, "tls-key", os.Getenv("TLS_KEY"), "file or S3 bucket or raw TLS key")
 	fs.StringVar(&raw.tlsCert, "tls-cert", os.Getenv("TLS_CERT"), "file or S3 bucket or raw TLS Cert")
 	fs.StringVar(&raw.awsRegion, "aws-region", os.Getenv("AWS_REGION"), "AWS region if running on AWS")
 	fs.StringVar(&raw.configBucket, "s3-config-bucket", os.Getenv("S3_CONFIG_BUCKET"), "where our S3 configs are stored")
+	fs.StringVar(&raw.pruneRetention, "prune-retention", os.Getenv("PRUNE_RETENTION"), "how long to keep dismissed items around; 0 to never prune")
+	fs.StringVar(&raw.pruneInterval, "prune-interval", envOrDefault("PRUNE_INTERVAL", "1h"), "how often to prune")
+	fs.StringVar(&raw.reminderInterval, "reminder-interval", envOrDefault("REMINDER_INTERVAL", "1m"), "how often to check for reminders that are due; 0 to never")
+	fs.StringVar(&raw.oobRetention, "oob-retention", os.Getenv("OOB_RETENTION"), "how long to queue out-of-band messages for, by system")
+	fs.StringVar(&raw.bodyKeys, "body-keys", os.Getenv("BODY_KEYS"), "file or raw list of keys to encrypt stored bodies with")
+	fs.StringVar(&raw.stateAddress, "state-address", os.Getenv("STATE_ADDRESS"), "hostname:port to serve state blobs over HTTP on")
+	fs.StringVar(&raw.maxItems, "max-items", os.Getenv("MAX_ITEMS"), "most live items each user can have; 0 for no limit")
+	fs.StringVar(&raw.maxCategoryItems, "max-category-items", os.Getenv("MAX_CATEGORY_ITEMS"), "most live items each user can have in a category; 0 for no limit")
+	fs.StringVar(&raw.maxBodySize, "max-body-size", os.Getenv("MAX_BODY_SIZE"), "largest body an item can have, in bytes; 0 for no limit")
+	fs.StringVar(&raw.quotaPolicy, "quota-policy", os.Getenv("QUOTA_POLICY"), "what to do with items over quota: reject or dismiss-oldest")
 	fs.BoolVar(&raw.helpExtended, "help-extended", false, "get more help")
 
 	if err := fs.Parse(argv[1:]); err != nil {
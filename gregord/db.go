@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+)
+
+// openDB opens the MySQL database given in the options, if any, and brings
+// its schema up to date. It returns a nil DB if none was configured.
+func openDB(o *Options) (*sql.DB, error) {
+	if o.MysqlDSN == nil {
+		return nil, nil
+	}
+
+	// We need parseTime=true so that the storage engine gets time.Time
+	// values back from MySQL.
+	dsn := *o.MysqlDSN
+	query := dsn.Query()
+	query.Set("parseTime", "true")
+	dsn.RawQuery = query.Encode()
+
+	db, err := sql.Open("mysql", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.Migrate(db, "mysql"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openStateMachine opens the storage given in the options, either a single
+// MySQL database or a set of shards, set up to queue out-of-band messages,
+// encrypt bodies and enforce quotas as configured. It returns a nil
+// StateMachine if none was configured, and a list of databases to close
+// when done.
+func openStateMachine(o *Options, cl clockwork.Clock) (gregor.StateMachine, []*sql.DB, error) {
+	of := protocol.ObjFactory{}
+	if o.ShardMap != nil {
+		eng, dbs, err := o.ShardMap.Open(of, cl)
+		if err != nil {
+			return nil, nil, err
+		}
+		eng.SetOOBRetention(o.OOBRetention)
+		if o.BodyKeys != nil {
+			eng.SetBodyKeys(o.BodyKeys)
+		}
+		eng.SetQuotas(o.Quotas)
+		return eng, dbs, nil
+	}
+	db, err := openDB(o)
+	if err != nil || db == nil {
+		return nil, nil, err
+	}
+	eng, err := storage.NewSQLEngineFor("mysql", db, of, cl)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	eng.SetOOBRetention(o.OOBRetention)
+	if o.BodyKeys != nil {
+		eng.SetBodyKeys(o.BodyKeys)
+	}
+	eng.SetQuotas(o.Quotas)
+	return eng, []*sql.DB{db}, nil
+}
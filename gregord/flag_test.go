@@ -37,9 +37,73 @@ func TestUsage(t *testing.T) {
 		"--tls-cert", "bye", "--s3-config-bucket", "foo"}, ebu, "you must provide an AWS Region and a Config bucket")
 	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--tls-key", "hi",
 		"--tls-cert", "file:///does/not/exist"}, ErrBadConfig(""), "no such file or directory")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--prune-retention", "forever"},
+		ebu, "bad prune-retention")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--prune-interval", "-1h"},
+		ebu, "bad prune-interval: must not be negative")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--reminder-interval", "soon"},
+		ebu, "bad reminder-interval")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--prune-retention", "720h",
+		"--prune-interval", "0"}, ebu, "prune-interval must be positive")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--mysql-dsn", "a@b/c",
+		"--shard-map", `{"shards": [{"engine": "mysql", "dsn": "a@b/c"}]}`}, ebu, "can't specify both")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--shard-map", `{"shards": []}`},
+		ErrBadConfig(""), "no shards")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--oob-retention", "kbfs.favorites"},
+		ebu, "bad out-of-band retention")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--body-keys", "k1 00ff"},
+		ErrBadConfig(""), "bad key file")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--state-address", ":4001"},
+		ebu, "state-address needs a mysql-dsn")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--mysql-dsn", "a@b/c",
+		"--state-address", "4001"}, ebu, "bad state-address")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--max-items", "1000"},
+		ebu, "quotas need a mysql-dsn")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--mysql-dsn", "a@b/c",
+		"--max-body-size", "-1"}, ebu, "bad max-body-size: must not be negative")
+	testBadUsage(t, []string{"gregor", "--bind-address", ":4000", "--session-server", "localhost", "--mysql-dsn", "a@b/c",
+		"--max-items", "1000", "--quota-policy", "drop"}, ebu, "bad quota policy")
 
 	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000",
+		"--shard-map", `{"shards": [{"engine": "mysql", "dsn": "a@b/c"}]}`})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000", "--prune-retention", "720h"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000", "--reminder-interval", "0"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000",
+		"--oob-retention", "kbfs.favorites=1h,default=10m"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000",
+		"--body-keys", "k1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000",
+		"--mysql-dsn", "a@b/c", "--state-address", "127.0.0.1:4001"})
+	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", ":4000", "--mysql-dsn", "a@b/c",
+		"--max-items", "1000", "--max-category-items", "100", "--max-body-size", "65536", "--quota-policy", "dismiss-oldest"})
 	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", "127.0.0.1:4000"})
 	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", "0.0.0.0:4000"})
 	testGoodUsage(t, []string{"gregor", "--session-server", "localhost", "--bind-address", "localhost:4000"})
 }
+
+func TestTransferUsage(t *testing.T) {
+	bad := func(args []string, msg string) {
+		opts, err := parseTransferOptions(args, true)
+		require.Nil(t, opts, "no options returned")
+		require.IsType(t, ErrBadUsage(""), err, "right type")
+		require.Contains(t, err.Error(), msg, "bad msg")
+	}
+	good := func(args []string) *transferOptions {
+		opts, err := parseTransferOptions(args, true)
+		require.Nil(t, err, "no error")
+		return opts
+	}
+	bad([]string{"gregord", "export", "--uid", "aabb"}, "need a mysql-dsn or a shard-map")
+	bad([]string{"gregord", "export", "--mysql-dsn", "a@b/c"}, "bad uid")
+	bad([]string{"gregord", "export", "--mysql-dsn", "a@b/c", "--uid", "xyz"}, "bad uid")
+	bad([]string{"gregord", "export", "--mysql-dsn", "a@b/c", "--uid", "aabb", "file"}, "no non-flag arguments")
+	bad([]string{"gregord", "import", "--mysql-dsn", "a@b/c"}, "no files")
+	bad([]string{"gregord", "import", "--mysql-dsn", "a@b/c", "--uid", "aabb", "file"}, "only for export")
+
+	opts := good([]string{"gregord", "export", "--mysql-dsn", "a@b/c", "--uid", "aabb", "--out", "user.json"})
+	require.Equal(t, []byte{0xaa, 0xbb}, opts.UID.Bytes(), "uid")
+	require.Equal(t, "user.json", opts.Out, "out")
+	opts = good([]string{"gregord", "import", "--shard-map", `{"shards": [{"engine": "mysql", "dsn": "a@b/c"}]}`, "a.json", "b.json"})
+	require.Equal(t, []string{"a.json", "b.json"}, opts.Files, "files")
+}
@@ -1,23 +1,61 @@
 package main
 
 import (
-	"net"
 	"os"
-)
-
-type dummy struct{}
 
-func (d dummy) Serve(l net.Listener) error {
-	return nil
-}
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+)
 
 func main() {
+	if len(os.Args) > 1 && isTransferCmd(os.Args[1]) {
+		opts, err := parseTransferOptions(os.Args, false)
+		if err != nil {
+			errorf("%s\n", err)
+			os.Exit(2)
+		}
+		if err := runTransfer(opts); err != nil {
+			errorf("%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	opts, err := ParseOptions(os.Args)
 	if err != nil {
 		errorf("%s\n", err)
 		os.Exit(2)
 	}
-	err = newMainServer(opts, dummy{}).listenAndServe()
+	cl := clockwork.NewRealClock()
+	sm, dbs, err := openStateMachine(opts, cl)
+	if err != nil {
+		errorf("%s\n", err)
+		os.Exit(2)
+	}
+	for _, db := range dbs {
+		defer db.Close()
+	}
+	if sm == nil {
+		// Without a database, state only lasts as long as the process.
+		sm = storage.NewMemEngine(protocol.ObjFactory{}, cl)
+	}
+	if p, ok := sm.(gregor.Pruner); ok && opts.PruneRetention > 0 {
+		j := newPruneJob(p, cl, opts.PruneRetention, opts.PruneInterval)
+		go j.run()
+		defer j.shutdown()
+	}
+	srv := startRPCServer(sm, newSessionAuthenticator(opts.SessionServer))
+	defer srv.Shutdown()
+	if s := newReminderScheduler(sm, srv, cl, opts.ReminderInterval); s != nil {
+		go s.Run()
+		defer s.Shutdown()
+	}
+	if opts.StateAddress != "" {
+		go serveState(opts.StateAddress, sm)
+	}
+	err = newMainServer(opts, listenLoop{srv: srv}).listenAndServe()
 	if err != nil {
 		errorf("%s\n", err)
 		os.Exit(2)
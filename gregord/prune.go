@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+)
+
+// pruneJob periodically prunes a storage engine of everything that was
+// dismissed or expired more than retention ago.
+type pruneJob struct {
+	p         gregor.Pruner
+	clock     clockwork.Clock
+	retention time.Duration
+	interval  time.Duration
+	closeCh   chan struct{}
+}
+
+func newPruneJob(p gregor.Pruner, cl clockwork.Clock, retention, interval time.Duration) *pruneJob {
+	return &pruneJob{
+		p:         p,
+		clock:     cl,
+		retention: retention,
+		interval:  interval,
+		closeCh:   make(chan struct{}),
+	}
+}
+
+func (j *pruneJob) prune() error {
+	return j.p.Prune(j.clock.Now().Add(-j.retention))
+}
+
+// run prunes once every interval until shutdown() is called.
+func (j *pruneJob) run() {
+	for {
+		select {
+		case <-j.clock.After(j.interval):
+			if err := j.prune(); err != nil {
+				log.Printf("prune error: %s", err)
+			}
+		case <-j.closeCh:
+			return
+		}
+	}
+}
+
+func (j *pruneJob) shutdown() {
+	close(j.closeCh)
+}
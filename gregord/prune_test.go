@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+type mockPruner struct {
+	ch chan time.Time
+}
+
+func (m mockPruner) Prune(before time.Time) error {
+	m.ch <- before
+	return nil
+}
+
+func TestPruneJob(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	p := mockPruner{ch: make(chan time.Time)}
+	j := newPruneJob(p, cl, 24*time.Hour, time.Hour)
+	go j.run()
+	defer j.shutdown()
+
+	cl.BlockUntil(1)
+	cl.Advance(time.Hour)
+	require.Equal(t, cl.Now().Add(-24*time.Hour), <-p.ch, "pruned everything older than a day")
+
+	cl.BlockUntil(1)
+	cl.Advance(time.Hour)
+	require.Equal(t, cl.Now().Add(-24*time.Hour), <-p.ch, "pruned again an hour later")
+}
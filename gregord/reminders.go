@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/reminder"
+)
+
+// newReminderScheduler makes a Scheduler that fires the reminders stored in
+// sm every interval, broadcasting their Items through out. It returns nil
+// if sm doesn't store reminders or interval isn't positive.
+func newReminderScheduler(sm gregor.StateMachine, out gregor.NetworkInterfaceOutgoing, cl clockwork.Clock, interval time.Duration) *reminder.Scheduler {
+	rs, ok := sm.(gregor.ReminderStore)
+	if !ok || interval <= 0 {
+		return nil
+	}
+	return reminder.NewScheduler(rs, out, protocol.ObjFactory{}, cl, interval)
+}
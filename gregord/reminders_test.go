@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// mockReminderStore is a StateMachine with one reminder stored, which it
+// sends on deleted once it's been deleted.
+type mockReminderStore struct {
+	gregor.StateMachine
+	r       gregor.Reminder
+	deleted chan gregor.Reminder
+}
+
+func (m *mockReminderStore) Reminders(before time.Time) ([]gregor.Reminder, error) {
+	if m.r == nil || m.r.RemindTime().After(before) {
+		return nil, nil
+	}
+	return []gregor.Reminder{m.r}, nil
+}
+
+func (m *mockReminderStore) DeleteReminder(r gregor.Reminder) error {
+	m.r = nil
+	m.deleted <- r
+	return nil
+}
+
+func TestReminderScheduler(t *testing.T) {
+	of := protocol.ObjFactory{}
+	cl := clockwork.NewFakeClock()
+	u, _ := of.MakeUID([]byte("reminder user"))
+	m, _ := of.MakeMsgID([]byte("r1"))
+	d, _ := of.MakeDeviceID([]byte("reminder device"))
+	c, _ := of.MakeCategory("reminders")
+	b, _ := of.MakeBody([]byte("remember"))
+	i, err := of.MakeItem(u, m, d, cl.Now(), c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	r, err := of.MakeReminder(i, cl.Now().Add(time.Hour))
+	require.Nil(t, err, "no error from MakeReminder")
+
+	rs := &mockReminderStore{StateMachine: storage.NewMemEngine(of, cl), r: r, deleted: make(chan gregor.Reminder, 1)}
+	require.Nil(t, newReminderScheduler(struct{ gregor.StateMachine }{rs}, nil, cl, time.Minute), "no scheduler without a ReminderStore")
+	require.Nil(t, newReminderScheduler(rs, nil, cl, 0), "no scheduler without an interval")
+
+	ss := startSessionServer(u)
+	defer ss.Close()
+	srv, l := startTestGregord(t, rs, ss)
+	defer srv.Shutdown()
+	defer l.Close()
+	s := newReminderScheduler(rs, srv, cl, time.Minute)
+	require.NotNil(t, s, "a scheduler")
+	go s.Run()
+	defer s.Shutdown()
+
+	// With none of the user's devices connected, the reminder is kept.
+	cl.BlockUntil(1)
+	cl.Advance(time.Hour)
+	cl.BlockUntil(1)
+	require.Equal(t, 0, len(rs.deleted), "not deleted without a device to get it")
+
+	dev := newTestClient(t, l)
+	defer dev.conn.Close()
+	require.Nil(t, dev.authenticate(testToken), "no error from authenticate")
+	// The connection is added in the background, so keep checking.
+	for i := 0; i < 100; i++ {
+		cl.Advance(time.Minute)
+		select {
+		case fired := <-rs.deleted:
+			require.Equal(t, r, fired, "the reminder was deleted")
+			received := dev.received()
+			require.Equal(t, 1, len(received), "the reminder was broadcast")
+			require.Equal(t, m.Bytes(), received[0].ToInBandMessage().ToStateUpdateMessage().Creation().Metadata().MsgID().Bytes(), "the reminder's item")
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("reminder never fired")
+}
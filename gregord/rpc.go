@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+
+	gregor "github.com/keybase/gregor"
+	"github.com/keybase/gregor/rpc"
+	context "golang.org/x/net/context"
+)
+
+// consumer hands the messages that the RPC server receives to a
+// StateMachine.
+type consumer struct {
+	sm gregor.StateMachine
+}
+
+func (c consumer) ConsumeMessage(ctx context.Context, m gregor.Message) error {
+	return c.sm.ConsumeMessage(m)
+}
+
+var _ gregor.NetworkInterfaceIncoming = consumer{}
+
+// startRPCServer starts the serve loop of an RPC server that authenticates
+// devices with auth, consumes the messages they send into sm, and
+// broadcasts messages to users' connected devices. If sm queues
+// out-of-band messages, devices get the ones queued for their user as they
+// connect. Call its Shutdown() to stop it.
+func startRPCServer(sm gregor.StateMachine, auth rpc.Authenticator) *rpc.Server {
+	srv := rpc.NewServer()
+	srv.SetAuthenticator(auth)
+	if q, ok := sm.(gregor.OutOfBandQueue); ok {
+		srv.SetOutOfBandQueue(q)
+	}
+	go srv.Serve(consumer{sm: sm})
+	return srv
+}
+
+// listenLoop is the main loop that accepts devices' connections for an
+// RPC server.
+type listenLoop struct {
+	srv *rpc.Server
+}
+
+func (l listenLoop) Serve(n net.Listener) error {
+	return l.srv.ListenLoop(n)
+}
+
+var _ gregor.MainLoopServer = listenLoop{}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	framed "github.com/keybase/go-framed-msgpack-rpc"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/rpc"
+	"github.com/keybase/gregor/storage"
+	"github.com/stretchr/testify/require"
+	context "golang.org/x/net/context"
+)
+
+const testToken = "good token"
+
+// startSessionServer starts a session server that vouches for testToken
+// as the user u.
+func startSessionServer(u gregor.UID) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/session" || r.URL.Query().Get("token") != testToken {
+			http.Error(w, "no such session", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(sessionReply{UID: hex.EncodeToString(u.Bytes()), SessionID: "s1"})
+	}))
+}
+
+// startTestGregord starts an RPC server for sm that authenticates devices
+// with the session server at ss, listening on a local port. Shut down the
+// server and close the listener when done.
+func startTestGregord(t *testing.T, sm gregor.StateMachine, ss *httptest.Server) (*rpc.Server, net.Listener) {
+	u, err := url.Parse(ss.URL)
+	require.Nil(t, err, "no error from Parse")
+	srv := startRPCServer(sm, newSessionAuthenticator(u))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, "no error from Listen")
+	go listenLoop{srv: srv}.Serve(l)
+	return srv, l
+}
+
+// testClient is a device connected to a test gregord, which records the
+// messages broadcast to it.
+type testClient struct {
+	conn net.Conn
+	cli  *framed.Client
+
+	sync.Mutex
+	broadcasts []protocol.Message
+}
+
+func newTestClient(t *testing.T, l net.Listener) *testClient {
+	conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	require.Nil(t, err, "no error from Dial")
+	xprt := framed.NewTransport(conn, nil, nil)
+	c := &testClient{conn: conn, cli: framed.NewClient(xprt, rpc.ErrorUnwrapper{})}
+	require.Nil(t, framed.NewServer(xprt, nil).Register(protocol.OutgoingProtocol(c)), "no error from Register")
+	return c
+}
+
+func (c *testClient) BroadcastMessage(ctx context.Context, m protocol.Message) error {
+	c.Lock()
+	defer c.Unlock()
+	c.broadcasts = append(c.broadcasts, m)
+	return nil
+}
+
+// received returns the messages broadcast to c so far.
+func (c *testClient) received() []protocol.Message {
+	c.Lock()
+	defer c.Unlock()
+	return append([]protocol.Message(nil), c.broadcasts...)
+}
+
+func (c *testClient) authenticate(tok protocol.AuthToken) error {
+	return protocol.AuthClient{Cli: c.cli}.Authenticate(context.Background(), tok)
+}
+
+func (c *testClient) consume(m protocol.Message) error {
+	return protocol.IncomingClient{Cli: c.cli}.ConsumeMessage(context.Background(), m)
+}
+
+func TestSessionAuthenticator(t *testing.T) {
+	u := protocol.UID("session user")
+	ss := startSessionServer(u)
+	defer ss.Close()
+
+	base, err := url.Parse(ss.URL)
+	require.Nil(t, err, "no error from Parse")
+	a := newSessionAuthenticator(base)
+	uid, sess, err := a.Authenticate(context.Background(), testToken)
+	require.Nil(t, err, "no error for a good token")
+	require.Equal(t, u, uid, "the session's user")
+	require.Equal(t, protocol.SessionID("s1"), sess, "the session's ID")
+	_, _, err = a.Authenticate(context.Background(), "bad token")
+	require.IsType(t, ErrBadSession(""), err, "error for a bad token")
+
+	// A bare host:port, as in -session-server=localhost:30000, is taken
+	// to be an HTTP server.
+	bare, err := url.Parse("localhost:" + base.Port())
+	require.Nil(t, err, "no error from Parse")
+	_, _, err = newSessionAuthenticator(bare).Authenticate(context.Background(), testToken)
+	require.Nil(t, err, "no error with a bare host:port")
+}
+
+func TestListenLoop(t *testing.T) {
+	u := protocol.UID("listen user")
+	ss := startSessionServer(u)
+	defer ss.Close()
+	srv, l := startTestGregord(t, nil, ss)
+	defer srv.Shutdown()
+	defer l.Close()
+
+	bad := newTestClient(t, l)
+	defer bad.conn.Close()
+	require.NotNil(t, bad.authenticate("bad token"), "error for a bad token")
+
+	c := newTestClient(t, l)
+	defer c.conn.Close()
+	require.Nil(t, c.authenticate(testToken), "no error for a good token")
+}
+
+func TestQueuedOutOfBand(t *testing.T) {
+	u := protocol.UID("oob user")
+	ss := startSessionServer(u)
+	defer ss.Close()
+	of := protocol.ObjFactory{}
+	sm := storage.NewMemEngine(of, clockwork.NewRealClock())
+	sm.SetOOBRetention(storage.OOBRetention{BySystem: map[string]time.Duration{"kbfs.favorites": time.Hour}})
+	srv, l := startTestGregord(t, sm, ss)
+	defer srv.Shutdown()
+	defer l.Close()
+
+	// Queue a message while no devices are connected.
+	sys, _ := of.MakeSystem("kbfs.favorites")
+	b, _ := of.MakeBody([]byte("favorites changed"))
+	oobm, err := of.MakeOutOfBandMessage(u, sys, b)
+	require.Nil(t, err, "no error from MakeOutOfBandMessage")
+	m, err := of.MakeMessageFromOutOfBandMessage(oobm)
+	require.Nil(t, err, "no error from MakeMessageFromOutOfBandMessage")
+	require.Nil(t, sm.ConsumeMessage(m), "no error from ConsumeMessage")
+
+	c := newTestClient(t, l)
+	defer c.conn.Close()
+	require.Nil(t, c.authenticate(testToken), "no error for a good token")
+	var received []protocol.Message
+	for i := 0; i < 100 && len(received) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		received = c.received()
+	}
+	require.Equal(t, 1, len(received), "the queued message was delivered on connect")
+	require.Equal(t, []byte("favorites changed"), received[0].ToOutOfBandMessage().Body().Bytes(), "the queued message's body")
+}
+
+func TestConsumeStampsHLC(t *testing.T) {
+	u := protocol.UID("hlc user")
+	ss := startSessionServer(u)
+	defer ss.Close()
+	of := protocol.ObjFactory{}
+	sm := storage.NewMemEngine(of, clockwork.NewRealClock())
+	srv, l := startTestGregord(t, sm, ss)
+	defer srv.Shutdown()
+	defer l.Close()
+
+	c := newTestClient(t, l)
+	defer c.conn.Close()
+	require.Nil(t, c.authenticate(testToken), "no error for a good token")
+
+	// The device sends an Item without an HLC of its own.
+	since := protocol.TimeOrOffset{Time_: protocol.ToTime(time.Now())}
+	msgID, _ := of.MakeMsgID([]byte("unstamped"))
+	cat, _ := of.MakeCategory("foos")
+	b, _ := of.MakeBody([]byte("no hlc"))
+	i, err := of.MakeItem(u, msgID, nil, time.Time{}, cat, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	require.True(t, gregor.HLCOf(ibm.Metadata()).IsZero(), "not stamped yet")
+	m, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	require.Nil(t, c.consume(m.(protocol.Message)), "no error from ConsumeMessage")
+
+	msgs, err := sm.InBandMessagesSince(u, nil, since)
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, 1, len(msgs), "the message was stored")
+	require.Equal(t, msgID.Bytes(), msgs[0].Metadata().MsgID().Bytes(), "the device's message")
+	require.False(t, gregor.HLCOf(msgs[0].Metadata()).IsZero(), "stamped with an HLC on the way in")
+}
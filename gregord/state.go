@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	gregor "github.com/keybase/gregor"
+	"github.com/keybase/gregor/blob"
+	protocol "github.com/keybase/gregor/protocol/go"
+)
+
+// stateHandler serves users' States as JSON blobs, on GET /state?uid=<hex>,
+// with an optional device=<hex> to see the State as that device does. The
+// UID and DeviceID are hex-encoded as they're stored in the database, and
+// as for_device is in the blob.
+type stateHandler struct {
+	sm gregor.StateMachine
+}
+
+func newStateHandler(sm gregor.StateMachine) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/state", stateHandler{sm: sm})
+	return mux
+}
+
+// decodeHexParam decodes the query parameter name of r. It returns nil if
+// it's not there, and false if it's not valid.
+func decodeHexParam(r *http.Request, name string) ([]byte, bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, true
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil && len(b) > 0
+}
+
+func (h stateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := decodeHexParam(r, "uid")
+	if !ok || u == nil {
+		http.Error(w, "need a hex uid", http.StatusBadRequest)
+		return
+	}
+	d, ok := decodeHexParam(r, "device")
+	if !ok {
+		http.Error(w, "bad device", http.StatusBadRequest)
+		return
+	}
+	var dev gregor.DeviceID
+	if d != nil {
+		dev = protocol.DeviceID(d)
+	}
+	st, err := h.sm.State(protocol.UID(u), dev, nil)
+	if err != nil {
+		log.Printf("state error for %x: %s", u, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	b, err := blob.Render(st)
+	if err != nil {
+		log.Printf("state error for %x: %s", u, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// serveState serves the state blobs of sm on addr until it fails.
+func serveState(addr string, sm gregor.StateMachine) {
+	if err := http.ListenAndServe(addr, newStateHandler(sm)); err != nil {
+		log.Printf("state server error: %s", err)
+	}
+}
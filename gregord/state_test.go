@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/keybase/gregor/blob"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateHandler(t *testing.T) {
+	of := protocol.ObjFactory{}
+	cl := clockwork.NewFakeClockAt(time.Unix(1400000000, 0))
+	sm := storage.NewMemEngine(of, cl)
+	u, _ := of.MakeUID([]byte("state user"))
+	m, _ := of.MakeMsgID([]byte("item"))
+	c, _ := of.MakeCategory("user.joined")
+	b, _ := of.MakeBody([]byte(`{"keybase":"kbob"}`))
+	i, err := of.MakeItem(u, m, nil, cl.Now(), c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	require.Nil(t, sm.ConsumeMessage(msg), "no error from ConsumeMessage")
+
+	srv := httptest.NewServer(newStateHandler(sm))
+	defer srv.Close()
+	get := func(query string) (int, string) {
+		res, err := http.Get(srv.URL + "/state?" + query)
+		require.Nil(t, err, "no error from Get")
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.Nil(t, err, "no error reading the response")
+		return res.StatusCode, string(body)
+	}
+
+	uid := "uid=" + hex.EncodeToString(u.Bytes())
+	code, body := get(uid)
+	require.Equal(t, http.StatusOK, code, "found the state")
+	require.Equal(t, `{"6974656d":{"times":{"created":1400000000,"expires":null,"remind_at":[]},`+
+		`"for_device":null,"category":"user.joined","body":{"keybase":"kbob"}}}`, body, "right blob")
+	items, err := blob.Parse(u, of, []byte(body))
+	require.Nil(t, err, "no error from Parse")
+	require.Equal(t, 1, len(items), "one item")
+	require.Equal(t, m, items[0].Metadata().MsgID(), "right item")
+
+	code, body = get(uid + "&device=" + hex.EncodeToString([]byte("some device")))
+	require.Equal(t, http.StatusOK, code, "found the state for a device")
+	require.Contains(t, body, "6974656d", "item for all devices is there")
+
+	code, body = get("uid=" + hex.EncodeToString([]byte("nobody")))
+	require.Equal(t, http.StatusOK, code, "found an empty state")
+	require.Equal(t, "{}", body, "nothing for other users")
+
+	code, _ = get("")
+	require.Equal(t, http.StatusBadRequest, code, "need a uid")
+	code, _ = get(uid + "&device=zz")
+	require.Equal(t, http.StatusBadRequest, code, "need a hex device")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
+	"github.com/keybase/gregor/storage"
+)
+
+const transferUsageStr = `Usage:
+gregord export [-mysql-dsn=<user:pw@host/dbname>|-shard-map=<file|json>] [-body-keys=<file|keys>] -uid=<hex> [-out=<file>]
+gregord import [-mysql-dsn=<user:pw@host/dbname>|-shard-map=<file|json>] [-body-keys=<file|keys>] <file>...
+
+  export writes the message log of the user with the given UID, hex-encoded
+  as it is in the database, to -out or to stdout, in a versioned JSON
+  format. import adds the messages in such files to the given storage with
+  their original times, which leaves each user with the same state there as
+  where they were exported from. Use them to move users between databases,
+  or to hand users their data. The storage flags, and their environment
+  variables, are as for running gregord.
+`
+
+var errNoExporter = errors.New("storage can't export or import users")
+
+// transferOptions are the options for the export and import subcommands.
+type transferOptions struct {
+	Options
+	Cmd   string
+	UID   gregor.UID
+	Out   string
+	Files []string
+}
+
+func isTransferCmd(cmd string) bool {
+	return cmd == "export" || cmd == "import"
+}
+
+// parseTransferOptions parses the options for the subcommand argv[1].
+func parseTransferOptions(argv []string, quiet bool) (*transferOptions, error) {
+	fs := flag.NewFlagSet(argv[0]+" "+argv[1], flag.ContinueOnError)
+	fs.Usage = func() { warnf("%s", transferUsageStr) }
+	if quiet {
+		fs.Usage = func() {}
+		fs.SetOutput(ioutil.Discard)
+	}
+	var raw rawOpts
+	fs.StringVar(&raw.mysqlDSN, "mysql-dsn", os.Getenv("MYSQL_DSN"), "user:pw@host/dbname for MySQL")
+	fs.StringVar(&raw.shardMap, "shard-map", os.Getenv("SHARD_MAP"), "file or raw JSON describing SQL shards")
+	fs.StringVar(&raw.bodyKeys, "body-keys", os.Getenv("BODY_KEYS"), "file or raw list of keys to encrypt stored bodies with")
+	uid := fs.String("uid", "", "hex-encoded UID of the user to export")
+	out := fs.String("out", "", "file to export to, instead of stdout")
+
+	if err := fs.Parse(argv[2:]); err != nil {
+		return nil, err
+	}
+
+	ret := &transferOptions{Cmd: argv[1]}
+	if err := ret.parseStorage(&raw); err != nil {
+		return nil, err
+	}
+	if ret.MysqlDSN == nil && ret.ShardMap == nil {
+		return nil, badUsage("need a mysql-dsn or a shard-map to %s", ret.Cmd)
+	}
+
+	if ret.Cmd == "import" {
+		if *uid != "" || *out != "" {
+			return nil, badUsage("uid and out are only for export")
+		}
+		if len(fs.Args()) == 0 {
+			return nil, badUsage("no files to import")
+		}
+		ret.Files = fs.Args()
+		return ret, nil
+	}
+
+	if len(fs.Args()) != 0 {
+		return nil, badUsage("no non-flag arguments expected")
+	}
+	// The UID is given as it's stored, so it's used as is rather than made
+	// with the ObjFactory.
+	b, err := hex.DecodeString(*uid)
+	if err != nil || len(b) == 0 {
+		return nil, badUsage("bad uid %q", *uid)
+	}
+	ret.UID = protocol.UID(b)
+	ret.Out = *out
+	return ret, nil
+}
+
+// runTransfer runs the export or import subcommand given by o.
+func runTransfer(o *transferOptions) error {
+	sm, dbs, err := openStateMachine(&o.Options, clockwork.NewRealClock())
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		defer db.Close()
+	}
+	ue, ok := sm.(storage.UserExporter)
+	if !ok {
+		return errNoExporter
+	}
+	if o.Cmd == "export" {
+		return exportUser(ue, o.UID, o.Out)
+	}
+	for _, name := range o.Files {
+		if err := importUser(ue, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportUser(ue storage.UserExporter, u gregor.UID, out string) error {
+	e, err := ue.Export(u)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		return storage.WriteUserExport(os.Stdout, e)
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteUserExport(f, e); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importUser(ue storage.UserExporter, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	e, err := storage.ReadUserExport(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if err := ue.Import(e); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	warnf("imported %d messages for %s from %s\n", len(e.Messages), e.UID, name)
+	return nil
+}
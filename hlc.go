@@ -0,0 +1,140 @@
+package gregor
+
+import (
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp. Its top 48 bits are a wall
+// clock time in milliseconds since the Unix epoch, and its bottom 16 a
+// logical counter that orders events within the same millisecond, or
+// after one seen from a clock that's ahead of ours. HLCs compare as
+// integers, and an HLClock never issues one lower than any it's issued
+// or observed, so messages stamped with them are ordered causally even
+// when the wall clocks that stamped them disagree. The zero HLC means a
+// message wasn't stamped.
+type HLC uint64
+
+const hlcLogicalBits = 16
+
+// NewHLC makes the HLC for the given wall clock time in milliseconds and
+// logical counter.
+func NewHLC(wall int64, logical uint16) HLC {
+	return HLC(uint64(wall)<<hlcLogicalBits | uint64(logical))
+}
+
+// HLCFromTime returns the lowest HLC at the wall clock time t, which is
+// how messages that weren't stamped with an HLC are ordered.
+func HLCFromTime(t time.Time) HLC {
+	if t.IsZero() {
+		return 0
+	}
+	return NewHLC(t.UnixNano()/int64(time.Millisecond), 0)
+}
+
+// Time returns the wall clock part of h.
+func (h HLC) Time() time.Time {
+	ms := int64(h >> hlcLogicalBits)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// Logical returns the logical counter part of h.
+func (h HLC) Logical() uint16 { return uint16(h) }
+
+// IsZero returns true if h is the zero HLC.
+func (h HLC) IsZero() bool { return h == 0 }
+
+// HLClock issues HLCs. Servers and clients each keep one, use Now to
+// stamp the messages they send, and Observe the HLCs on those they
+// receive. It's safe for concurrent use.
+type HLClock struct {
+	sync.Mutex
+	now  func() time.Time
+	last HLC
+
+	// MaxDrift bounds how far ahead of our wall clock an observed HLC can
+	// be. Observe ignores HLCs from further ahead, so that one bad clock
+	// can't drag everyone else's into the future. 0 means no bound.
+	MaxDrift time.Duration
+}
+
+// NewHLClock makes an HLClock that reads the wall clock time from now.
+func NewHLClock(now func() time.Time) *HLClock {
+	return &HLClock{now: now}
+}
+
+// Now returns an HLC higher than any c has issued or observed, and no
+// lower than the wall clock time.
+func (c *HLClock) Now() HLC {
+	c.Lock()
+	defer c.Unlock()
+	return c.advance(0)
+}
+
+// Observe moves c past h, an HLC on a message from elsewhere, so that
+// anything c stamps from now on is ordered after it. It returns false,
+// leaving c alone, if h is further ahead of c's wall clock than MaxDrift.
+func (c *HLClock) Observe(h HLC) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.MaxDrift > 0 && h.Time().After(c.now().Add(c.MaxDrift)) {
+		return false
+	}
+	c.advance(h)
+	return true
+}
+
+// advance moves c past both its last HLC and h, and returns the new HLC.
+func (c *HLClock) advance(h HLC) HLC {
+	if h < c.last {
+		h = c.last
+	}
+	if pt := HLCFromTime(c.now()); pt > h {
+		c.last = pt
+	} else {
+		c.last = h + 1
+	}
+	return c.last
+}
+
+// HLCMetadata is implemented by Metadata that can carry an HLC.
+type HLCMetadata interface {
+	Metadata
+	HLC() HLC
+}
+
+// HLCSetter is implemented by InBandMessages that can be stamped with an
+// HLC.
+type HLCSetter interface {
+	SetHLC(h HLC)
+}
+
+// HLCOf returns the HLC md was stamped with, or zero if it wasn't.
+func HLCOf(md Metadata) HLC {
+	if hmd, ok := md.(HLCMetadata); ok {
+		return hmd.HLC()
+	}
+	return 0
+}
+
+// OrderingHLC returns the HLC that orders the message with Metadata md
+// and the given ctime: the one it was stamped with, or the lowest at
+// ctime if it wasn't stamped.
+func OrderingHLC(md Metadata, ctime time.Time) HLC {
+	if h := HLCOf(md); !h.IsZero() {
+		return h
+	}
+	return HLCFromTime(ctime)
+}
+
+// StampHLC stamps m with an HLC from c if it doesn't have one yet. If it
+// does, c observes it, unless it's too far ahead, in which case m is
+// stamped again. Messages that can't be stamped are left alone.
+func StampHLC(c *HLClock, m InBandMessage) {
+	if h := HLCOf(m.Metadata()); !h.IsZero() && c.Observe(h) {
+		return
+	}
+	if s, ok := m.(HLCSetter); ok {
+		s.SetHLC(c.Now())
+	}
+}
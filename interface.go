@@ -63,6 +63,7 @@ type StateUpdateMessage interface {
 	MessageWithMetadata
 	Creation() Item
 	Dismissal() Dismissal
+	Update() ItemUpdate
 }
 
 type StateSyncMessage interface {
@@ -88,18 +89,48 @@ type Item interface {
 	Category() Category
 }
 
+type Reminder interface {
+	Item() Item
+	RemindTime() time.Time
+}
+
 type MsgRange interface {
 	EndTime() TimeOrOffset
 	Category() Category
 }
 
+// MsgIDForDevice names the Item created by the message MsgID, as seen by
+// the device DeviceID.
+type MsgIDForDevice interface {
+	MsgID() MsgID
+	DeviceID() DeviceID
+}
+
 type Dismissal interface {
 	MsgIDsToDismiss() []MsgID
 	RangesToDismiss() []MsgRange
+	// MsgIDsToDismissForDevice returns Items to dismiss for a single device
+	// each. The Items stay in the State of every other device, including
+	// those added later, so an Item broadcast to all of a user's devices
+	// can be dismissed on each of them separately.
+	MsgIDsToDismissForDevice() []MsgIDForDevice
+}
+
+// ItemUpdate changes the Body and/or DTime of the Item created by the
+// message MsgID in place, so clients can show it as the same Item. A nil
+// Body or DTime leaves that field as it is. When several updates change the
+// same field of an Item, the one with the latest ctime wins, whatever order
+// they arrive in; an update older than the Item itself has no effect.
+type ItemUpdate interface {
+	MsgID() MsgID
+	Body() Body
+	DTime() TimeOrOffset
 }
 
 type State interface {
 	Items() ([]Item, error)
+	// ItemsInCategory returns the Items in the category c, or under it if
+	// it's a wildcard like "user.*". See CategoryWildcard.
 	ItemsInCategory(c Category) ([]Item, error)
 }
 
@@ -138,19 +169,115 @@ type StateMachine interface {
 	InBandMessagesSince(u UID, d DeviceID, t TimeOrOffset) ([]InBandMessage, error)
 }
 
+// InBandMessagePager is implemented by StateMachines that can return a
+// user's messages in bounded chunks, so that devices that have been offline
+// for a long time can catch up without fetching everything at once.
+type InBandMessagePager interface {
+	// InBandMessagesPage returns up to limit of the messages that
+	// InBandMessagesSince(u, d, t) would, ordered by their OrderingHLC and
+	// then MsgID, and starting after the given cursor if it's non-nil. It
+	// also returns an opaque cursor for fetching the next page, which is
+	// nil once there's nothing left. The cursor marks the HLC and MsgID of
+	// the last message returned, so messages stamped with a lower HLC that
+	// arrive after it was made aren't in later pages.
+	InBandMessagesPage(u UID, d DeviceID, t TimeOrOffset, cursor []byte, limit int) ([]InBandMessage, []byte, error)
+}
+
+// SyncCheckpointer is implemented by StateMachines that store
+// StateSyncMessages, so that devices can use them as checkpoints.
+type SyncCheckpointer interface {
+	// InBandMessagesSinceSync returns the messages that InBandMessagesSince
+	// would for the user u on device d, starting from the ctime of the
+	// StateSyncMessage with the MsgID sync, and leaving out that message
+	// itself. Messages with the same ctime as the marker are included even
+	// if they came before it, so a device might see some messages again.
+	InBandMessagesSinceSync(u UID, d DeviceID, sync MsgID) ([]InBandMessage, error)
+}
+
+// CategoryStater is implemented by StateMachines that can fetch the part of
+// a user's State in one category, or under one wildcard, without going
+// through the rest.
+type CategoryStater interface {
+	// StateInCategory returns the State that State(u, d, t) would, but with
+	// only the Items that its ItemsInCategory(c) would return.
+	StateInCategory(u UID, d DeviceID, t TimeOrOffset, c Category) (State, error)
+}
+
+// StateDiffer is implemented by StateMachines that can tell a device how a
+// user's State changed between two times, so that it can catch up without
+// fetching the whole State or replaying every message in between.
+type StateDiffer interface {
+	// StateDiff returns the Items that are in the State of the user u on
+	// device d at time to but weren't at time from, and the MsgIDs of the
+	// Items that were in it at from but aren't at to. Items that came and
+	// went in between are in neither, and neither are Items that stayed in
+	// the State but were updated in place. from and to are as for State.
+	StateDiff(u UID, d DeviceID, from, to TimeOrOffset) (added []Item, removed []MsgID, err error)
+}
+
+// OutOfBandQueue is implemented by StateMachines that hold on to the
+// OutOfBandMessages they consume for a while, so that devices that were
+// offline when a message was broadcast can still get it when they next
+// connect.
+type OutOfBandQueue interface {
+	// QueuedOutOfBandMessages returns the messages queued for the user u
+	// that haven't expired yet, oldest first. Messages stay queued until
+	// they expire, so a device can get the same message more than once.
+	QueuedOutOfBandMessages(u UID) ([]OutOfBandMessage, error)
+}
+
+// ReminderStore is implemented by StateMachines that keep track of the
+// NotifyTimes of the Items they store, so that the user can be reminded
+// of those Items later on.
+type ReminderStore interface {
+	// Reminders returns all reminders, across all users, that are due at
+	// or before the given time, and whose Items haven't been dismissed.
+	Reminders(before time.Time) ([]Reminder, error)
+
+	// DeleteReminder marks the reminder r as delivered, so that it won't
+	// be returned by subsequent calls to Reminders.
+	DeleteReminder(r Reminder) error
+}
+
+// Pruner is implemented by StateMachines that can permanently forget
+// Items and messages that no longer matter.
+type Pruner interface {
+	// Prune deletes Items that were dismissed or expired at or before the
+	// given time, and the messages from before then that no longer affect
+	// any live Item. Dismissals and updates of Items that haven't arrived,
+	// and range dismissals, which might cover Items that haven't arrived,
+	// are kept for OrphanRetention longer, so that Items that arrive late
+	// are still dismissed or updated. InBandMessagesSince can't replay
+	// history from before the most recent prune.
+	Prune(before time.Time) error
+}
+
+// OrphanRetention is how much longer than other messages a Pruner keeps
+// the dismissals and updates that might still apply to Items that haven't
+// arrived yet. An Item that arrives even later than that might come back
+// to life.
+const OrphanRetention = 7 * 24 * time.Hour
+
 type ObjFactory interface {
 	MakeUID(b []byte) (UID, error)
 	MakeMsgID(b []byte) (MsgID, error)
 	MakeDeviceID(b []byte) (DeviceID, error)
 	MakeBody(b []byte) (Body, error)
 	MakeCategory(s string) (Category, error)
+	MakeSystem(s string) (System, error)
 	MakeItem(u UID, msgid MsgID, deviceid DeviceID, ctime time.Time, c Category, dtime *time.Time, body Body) (Item, error)
 	MakeDismissalByRange(uid UID, msgid MsgID, devid DeviceID, ctime time.Time, c Category, d time.Time) (InBandMessage, error)
 	MakeDismissalByID(uid UID, msgid MsgID, devid DeviceID, ctime time.Time, d MsgID) (InBandMessage, error)
+	MakeDismissalByIDForDevice(uid UID, msgid MsgID, devid DeviceID, ctime time.Time, d MsgID, dd DeviceID) (InBandMessage, error)
+	MakeItemUpdate(uid UID, msgid MsgID, devid DeviceID, ctime time.Time, target MsgID, body Body, dtime *time.Time) (InBandMessage, error)
 	MakeStateSyncMessage(uid UID, msgid MsgID, devid DeviceID, ctime time.Time) (InBandMessage, error)
 	MakeState(i []Item) (State, error)
 	MakeMetadata(uid UID, msgid MsgID, devid DeviceID, ctime time.Time, i InBandMsgType) (Metadata, error)
 	MakeInBandMessageFromItem(i Item) (InBandMessage, error)
+	MakeMessageFromInBandMessage(i InBandMessage) (Message, error)
+	MakeMessageFromOutOfBandMessage(o OutOfBandMessage) (Message, error)
+	MakeReminder(i Item, t time.Time) (Reminder, error)
+	MakeOutOfBandMessage(uid UID, system System, body Body) (OutOfBandMessage, error)
 }
 
 type NetworkInterfaceIncoming interface {
@@ -18,6 +18,7 @@ type Metadata struct {
 	Ctime_         Time     `codec:"ctime" json:"ctime"`
 	DeviceID_      DeviceID `codec:"deviceID" json:"deviceID"`
 	InBandMsgType_ int      `codec:"inBandMsgType" json:"inBandMsgType"`
+	Hlc_           HLC      `codec:"hlc" json:"hlc"`
 }
 
 type InBandMessage struct {
@@ -26,9 +27,10 @@ type InBandMessage struct {
 }
 
 type StateUpdateMessage struct {
-	Md_        Metadata   `codec:"md" json:"md"`
-	Creation_  *Item      `codec:"creation,omitempty" json:"creation,omitempty"`
-	Dismissal_ *Dismissal `codec:"dismissal,omitempty" json:"dismissal,omitempty"`
+	Md_        Metadata    `codec:"md" json:"md"`
+	Creation_  *Item       `codec:"creation,omitempty" json:"creation,omitempty"`
+	Dismissal_ *Dismissal  `codec:"dismissal,omitempty" json:"dismissal,omitempty"`
+	Update_    *ItemUpdate `codec:"update,omitempty" json:"update,omitempty"`
 }
 
 type StateSyncMessage struct {
@@ -40,9 +42,21 @@ type MsgRange struct {
 	Category_ Category     `codec:"category" json:"category"`
 }
 
+type MsgIDForDevice struct {
+	MsgID_    MsgID    `codec:"msgID" json:"msgID"`
+	DeviceID_ DeviceID `codec:"deviceID" json:"deviceID"`
+}
+
 type Dismissal struct {
-	MsgIDs_ []MsgID    `codec:"msgIDs" json:"msgIDs"`
-	Ranges_ []MsgRange `codec:"ranges" json:"ranges"`
+	MsgIDs_     []MsgID          `codec:"msgIDs" json:"msgIDs"`
+	Ranges_     []MsgRange       `codec:"ranges" json:"ranges"`
+	ForDevices_ []MsgIDForDevice `codec:"forDevices" json:"forDevices"`
+}
+
+type ItemUpdate struct {
+	MsgID_ MsgID         `codec:"msgID" json:"msgID"`
+	Body_  *Body         `codec:"body,omitempty" json:"body,omitempty"`
+	Dtime_ *TimeOrOffset `codec:"dtime,omitempty" json:"dtime,omitempty"`
 }
 
 type Item struct {
@@ -71,6 +85,7 @@ type MsgID []byte
 type DeviceID []byte
 type Body []byte
 type Time int64
+type HLC int64
 type CommonInterface interface {
 }
 
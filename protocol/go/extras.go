@@ -32,8 +32,8 @@ func (t TimeOrOffset) Offset() *time.Duration {
 	return &d
 }
 
-func (s StateSyncMessage) Metadata() gregor.Metadata {
-	return s.Md_
+func (s *StateSyncMessage) Metadata() gregor.Metadata {
+	return &s.Md_
 }
 
 func (m MsgRange) EndTime() gregor.TimeOrOffset {
@@ -60,13 +60,24 @@ func (d Dismissal) MsgIDsToDismiss() []gregor.MsgID {
 	return ret
 }
 
+func (d Dismissal) MsgIDsToDismissForDevice() []gregor.MsgIDForDevice {
+	var ret []gregor.MsgIDForDevice
+	for _, m := range d.ForDevices_ {
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func (m MsgIDForDevice) MsgID() gregor.MsgID       { return m.MsgID_ }
+func (m MsgIDForDevice) DeviceID() gregor.DeviceID { return m.DeviceID_ }
+
 type ItemAndMetadata struct {
 	md *Metadata
 	i  *Item
 }
 
 func (m Metadata) UID() gregor.UID                   { return m.Uid_ }
-func (i ItemAndMetadata) Metadata() gregor.Metadata  { return *i.md }
+func (i ItemAndMetadata) Metadata() gregor.Metadata  { return i.md }
 func (i ItemAndMetadata) Body() gregor.Body          { return i.i.Body_ }
 func (i ItemAndMetadata) Category() gregor.Category  { return i.i.Category_ }
 func (i ItemAndMetadata) DTime() gregor.TimeOrOffset { return i.i.Dtime_ }
@@ -78,20 +89,49 @@ func (i ItemAndMetadata) NotifyTimes() []gregor.TimeOrOffset {
 	return ret
 }
 
-func (s StateUpdateMessage) Metadata() gregor.Metadata { return s.Md_ }
-func (s StateUpdateMessage) Creation() gregor.Item {
-	if s.Creation_ != nil {
+type Reminder struct {
+	item       ItemAndMetadata
+	remindTime time.Time
+}
+
+func (r Reminder) Item() gregor.Item     { return r.item }
+func (r Reminder) RemindTime() time.Time { return r.remindTime }
+
+func (s *StateUpdateMessage) Metadata() gregor.Metadata { return &s.Md_ }
+func (s *StateUpdateMessage) Creation() gregor.Item {
+	if s.Creation_ == nil {
 		return nil
 	}
 	return ItemAndMetadata{md: &s.Md_, i: s.Creation_}
 }
 func (s StateUpdateMessage) Dismissal() gregor.Dismissal {
-	if s.Dismissal_ != nil {
+	if s.Dismissal_ == nil {
 		return nil
 	}
 	return s.Dismissal_
 }
 
+func (s StateUpdateMessage) Update() gregor.ItemUpdate {
+	if s.Update_ == nil {
+		return nil
+	}
+	return s.Update_
+}
+
+func (u ItemUpdate) MsgID() gregor.MsgID { return u.MsgID_ }
+func (u ItemUpdate) Body() gregor.Body {
+	if u.Body_ == nil {
+		return nil
+	}
+	return *u.Body_
+}
+func (u ItemUpdate) DTime() gregor.TimeOrOffset {
+	if u.Dtime_ == nil {
+		return nil
+	}
+	return *u.Dtime_
+}
+
 func (i InBandMessage) Merge(i2 gregor.InBandMessage) error {
 	t2, ok := i2.(InBandMessage)
 	if !ok {
@@ -100,35 +140,62 @@ func (i InBandMessage) Merge(i2 gregor.InBandMessage) error {
 	if i.StateSync_ != nil || t2.StateSync_ != nil {
 		return errors.New("Cannot merge sync messages")
 	}
+	if i.StateUpdate_ == nil {
+		return errors.New("Cannot merge into an empty message")
+	}
 	return i.StateUpdate_.Merge(t2.StateUpdate_)
 }
 
-func (s StateUpdateMessage) Merge(s2 *StateUpdateMessage) error {
+// Merge adds what s2 creates, dismisses and updates to s.
+func (s *StateUpdateMessage) Merge(s2 *StateUpdateMessage) error {
+	if s2 == nil {
+		return nil
+	}
 	if s.Creation_ != nil && s2.Creation_ != nil {
 		return errors.New("clash of creations")
 	}
 	if s.Creation_ == nil {
 		s.Creation_ = s2.Creation_
 	}
-	if s.Dismissal_ == nil {
-		s.Dismissal_ = s2.Dismissal_
-	} else if s.Dismissal_ != nil {
+	if s.Dismissal_ == nil && s2.Dismissal_ != nil {
+		// Copy s2's dismissal, so that merging more into s later doesn't
+		// change s2.
+		s.Dismissal_ = &Dismissal{}
+	}
+	if s2.Dismissal_ != nil {
 		s.Dismissal_.MsgIDs_ = append(s.Dismissal_.MsgIDs_, s2.Dismissal_.MsgIDs_...)
 		s.Dismissal_.Ranges_ = append(s.Dismissal_.Ranges_, s2.Dismissal_.Ranges_...)
+		s.Dismissal_.ForDevices_ = append(s.Dismissal_.ForDevices_, s2.Dismissal_.ForDevices_...)
+	}
+	if s.Update_ != nil && s2.Update_ != nil {
+		return errors.New("clash of updates")
+	}
+	if s.Update_ == nil {
+		s.Update_ = s2.Update_
 	}
 	return nil
 }
 
 func (i InBandMessage) Metadata() gregor.Metadata {
 	if i.StateUpdate_ != nil {
-		return i.StateUpdate_.Md_
+		return &i.StateUpdate_.Md_
 	}
 	if i.StateSync_ != nil {
-		return i.StateSync_.Md_
+		return &i.StateSync_.Md_
 	}
 	return nil
 }
 
+// SetHLC stamps the message's Metadata with h.
+func (i InBandMessage) SetHLC(h gregor.HLC) {
+	if i.StateUpdate_ != nil {
+		i.StateUpdate_.Md_.Hlc_ = HLC(h)
+	}
+	if i.StateSync_ != nil {
+		i.StateSync_.Md_.Hlc_ = HLC(h)
+	}
+}
+
 func (i InBandMessage) ToStateSyncMessage() gregor.StateSyncMessage {
 	if i.StateSync_ == nil {
 		return nil
@@ -145,9 +212,17 @@ func (i InBandMessage) ToStateUpdateMessage() gregor.StateUpdateMessage {
 
 func (m Metadata) MsgID() gregor.MsgID                 { return m.MsgID_ }
 func (m Metadata) CTime() time.Time                    { return FromTime(m.Ctime_) }
-func (m Metadata) SetCTime(t time.Time)                { m.Ctime_ = ToTime(t) }
-func (m Metadata) DeviceID() gregor.DeviceID           { return m.DeviceID_ }
+func (m *Metadata) SetCTime(t time.Time)               { m.Ctime_ = ToTime(t) }
 func (m Metadata) InBandMsgType() gregor.InBandMsgType { return gregor.InBandMsgType(m.InBandMsgType_) }
+func (m Metadata) HLC() gregor.HLC                     { return gregor.HLC(m.Hlc_) }
+
+// DeviceID returns nil for messages meant for all devices.
+func (m Metadata) DeviceID() gregor.DeviceID {
+	if len(m.DeviceID_) == 0 {
+		return nil
+	}
+	return m.DeviceID_
+}
 
 func (o OutOfBandMessage) Body() gregor.Body     { return o.Body_ }
 func (o OutOfBandMessage) System() gregor.System { return o.System_ }
@@ -179,8 +254,10 @@ func (s State) Items() ([]gregor.Item, error) {
 	return ret, nil
 }
 
+// InCategory returns true if i is in the category c, or under it if c is a
+// wildcard.
 func (i ItemAndMetadata) InCategory(c Category) bool {
-	return i.i.Category_.Eq(c)
+	return gregor.CategoryMatches(c.String(), i.i.Category_.String())
 }
 
 func (s State) ItemsInCategory(gc gregor.Category) ([]gregor.Item, error) {
@@ -232,13 +309,18 @@ var _ gregor.System = System("")
 var _ gregor.Body = Body{}
 var _ gregor.Category = Category("")
 var _ gregor.TimeOrOffset = TimeOrOffset{}
-var _ gregor.Metadata = Metadata{}
-var _ gregor.StateSyncMessage = StateSyncMessage{}
+var _ gregor.Metadata = (*Metadata)(nil)
+var _ gregor.HLCMetadata = (*Metadata)(nil)
+var _ gregor.StateSyncMessage = (*StateSyncMessage)(nil)
 var _ gregor.MsgRange = MsgRange{}
 var _ gregor.Dismissal = Dismissal{}
+var _ gregor.MsgIDForDevice = MsgIDForDevice{}
+var _ gregor.ItemUpdate = ItemUpdate{}
 var _ gregor.Item = ItemAndMetadata{}
-var _ gregor.StateUpdateMessage = StateUpdateMessage{}
+var _ gregor.Reminder = Reminder{}
+var _ gregor.StateUpdateMessage = (*StateUpdateMessage)(nil)
 var _ gregor.InBandMessage = InBandMessage{}
+var _ gregor.HLCSetter = InBandMessage{}
 var _ gregor.OutOfBandMessage = OutOfBandMessage{}
 var _ gregor.Message = Message{}
 var _ gregor.State = State{}
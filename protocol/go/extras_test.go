@@ -0,0 +1,96 @@
+package gregor1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateUpdateMessageAccessors(t *testing.T) {
+	of := ObjFactory{}
+	u, _ := of.MakeUID([]byte("protocol user"))
+	dev, _ := of.MakeDeviceID([]byte("protocol device"))
+	m, _ := of.MakeMsgID([]byte("m1"))
+	d, _ := of.MakeMsgID([]byte("d1"))
+	c, _ := of.MakeCategory("protocol")
+	b, _ := of.MakeBody([]byte("body"))
+
+	i, err := of.MakeItem(u, m, dev, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	sum := ibm.ToStateUpdateMessage()
+	require.True(t, sum.Creation() != nil, "creation has a Creation")
+	require.Equal(t, "body", string(sum.Creation().Body().Bytes()), "right body")
+	require.True(t, sum.Dismissal() == nil, "creation has no Dismissal")
+	require.True(t, sum.Update() == nil, "creation has no Update")
+
+	ibm, err = of.MakeDismissalByID(u, d, dev, time.Time{}, m)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	sum = ibm.ToStateUpdateMessage()
+	require.True(t, sum.Creation() == nil, "dismissal has no Creation")
+	require.True(t, sum.Dismissal() != nil, "dismissal has a Dismissal")
+	require.Equal(t, 1, len(sum.Dismissal().MsgIDsToDismiss()), "one MsgID dismissed")
+}
+
+func TestStateUpdateMessageMerge(t *testing.T) {
+	of := ObjFactory{}
+	u, _ := of.MakeUID([]byte("protocol user"))
+	dev, _ := of.MakeDeviceID([]byte("protocol device"))
+	m, _ := of.MakeMsgID([]byte("m1"))
+	d1, _ := of.MakeMsgID([]byte("d1"))
+	d2, _ := of.MakeMsgID([]byte("d2"))
+	c, _ := of.MakeCategory("protocol")
+	b, _ := of.MakeBody([]byte("body"))
+
+	// A creation merged with an update carries both.
+	i, err := of.MakeItem(u, m, dev, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	up, err := of.MakeItemUpdate(u, m, dev, time.Time{}, d1, b, nil)
+	require.Nil(t, err, "no error from MakeItemUpdate")
+	require.Nil(t, ibm.Merge(up), "no error from Merge")
+	sum := ibm.ToStateUpdateMessage()
+	require.True(t, sum.Creation() != nil, "merged message keeps its Creation")
+	require.True(t, sum.Update() != nil, "merged message gets the Update")
+	require.Equal(t, d1.Bytes(), sum.Update().MsgID().Bytes(), "right update target")
+	require.NotNil(t, ibm.Merge(up), "error from merging a second update")
+
+	// Merging a dismissal into a message without one, and then another
+	// dismissal into that, adds up their MsgIDs.
+	dis1, err := of.MakeDismissalByID(u, d1, dev, time.Time{}, m)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	dis2, err := of.MakeDismissalByID(u, d1, dev, time.Time{}, d2)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	require.Nil(t, ibm.Merge(dis1), "no error from Merge")
+	require.Nil(t, ibm.Merge(dis2), "no error from Merge")
+	require.Equal(t, 2, len(ibm.ToStateUpdateMessage().Dismissal().MsgIDsToDismiss()), "both MsgIDs dismissed")
+
+	// Merging a message without a dismissal into one with one leaves it be.
+	require.Nil(t, dis1.Merge(up), "no error from Merge")
+	require.Equal(t, 1, len(dis1.ToStateUpdateMessage().Dismissal().MsgIDsToDismiss()), "dismissal unchanged")
+}
+
+func TestSetCTime(t *testing.T) {
+	of := ObjFactory{}
+	u, _ := of.MakeUID([]byte("protocol user"))
+	m, _ := of.MakeMsgID([]byte("m1"))
+	c, _ := of.MakeCategory("protocol")
+	b, _ := of.MakeBody([]byte("body"))
+	now := time.Now().Round(time.Millisecond)
+
+	i, err := of.MakeItem(u, m, nil, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	ibm.Metadata().SetCTime(now)
+	require.True(t, now.Equal(ibm.Metadata().CTime()), "the message's ctime was set")
+	require.True(t, now.Equal(ibm.ToStateUpdateMessage().Creation().Metadata().CTime()), "the creation shares the message's Metadata")
+
+	s, err := of.MakeStateSyncMessage(u, m, nil, time.Time{})
+	require.Nil(t, err, "no error from MakeStateSyncMessage")
+	s.Metadata().SetCTime(now)
+	require.True(t, now.Equal(s.ToStateSyncMessage().Metadata().CTime()), "the sync message's ctime was set")
+}
@@ -17,6 +17,7 @@ func (o ObjFactory) MakeDeviceID(b []byte) (gregor.DeviceID, error) {
 }
 func (o ObjFactory) MakeBody(b []byte) (gregor.Body, error)         { return Body(b), nil }
 func (o ObjFactory) MakeCategory(s string) (gregor.Category, error) { return Category(s), nil }
+func (o ObjFactory) MakeSystem(s string) (gregor.System, error)     { return System(s), nil }
 
 func castUID(uid gregor.UID) (UID, error) {
 	ret, ok := uid.(UID)
@@ -26,7 +27,12 @@ func castUID(uid gregor.UID) (UID, error) {
 	return ret, nil
 }
 
+// castDeviceID casts d, where a nil DeviceID, for messages meant for all
+// devices, is the empty one.
 func castDeviceID(d gregor.DeviceID) (DeviceID, error) {
+	if d == nil {
+		return nil, nil
+	}
 	ret, ok := d.(DeviceID)
 	if !ok {
 		return DeviceID(""), fmt.Errorf("Bad Device ID; wrong type")
@@ -42,6 +48,14 @@ func castItem(i gregor.Item) (ItemAndMetadata, error) {
 	return ret, nil
 }
 
+func castInBandMessage(i gregor.InBandMessage) (InBandMessage, error) {
+	ret, ok := i.(InBandMessage)
+	if !ok {
+		return InBandMessage{}, fmt.Errorf("Bad InBandMessage; wrong type")
+	}
+	return ret, nil
+}
+
 func timeToTimeOrOffset(timeIn *time.Time) TimeOrOffset {
 	var timeOut Time
 	if timeIn != nil && !timeIn.IsZero() {
@@ -128,11 +142,55 @@ func (o ObjFactory) MakeDismissalByID(uid gregor.UID, msgid gregor.MsgID, devid
 	}, nil
 }
 
-func (o ObjFactory) MakeStateSyncMessage(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time) (gregor.InBandMessage, error) {
+func (o ObjFactory) MakeDismissalByIDForDevice(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, d gregor.MsgID, dd gregor.DeviceID) (gregor.InBandMessage, error) {
 	md, err := o.makeMetadata(uid, msgid, devid, ctime, gregor.InBandMsgTypeUpdate)
 	if err != nil {
 		return nil, err
 	}
+	dd2, err := castDeviceID(dd)
+	if err != nil {
+		return nil, err
+	}
+	return InBandMessage{
+		StateUpdate_: &StateUpdateMessage{
+			Md_: md,
+			Dismissal_: &Dismissal{
+				ForDevices_: []MsgIDForDevice{{
+					MsgID_:    MsgID(d.Bytes()),
+					DeviceID_: dd2,
+				}},
+			},
+		},
+	}, nil
+}
+
+func (o ObjFactory) MakeItemUpdate(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, target gregor.MsgID, body gregor.Body, dtime *time.Time) (gregor.InBandMessage, error) {
+	md, err := o.makeMetadata(uid, msgid, devid, ctime, gregor.InBandMsgTypeUpdate)
+	if err != nil {
+		return nil, err
+	}
+	u := &ItemUpdate{MsgID_: MsgID(target.Bytes())}
+	if body != nil {
+		b := Body(body.Bytes())
+		u.Body_ = &b
+	}
+	if dtime != nil {
+		d := timeToTimeOrOffset(dtime)
+		u.Dtime_ = &d
+	}
+	return InBandMessage{
+		StateUpdate_: &StateUpdateMessage{
+			Md_:     md,
+			Update_: u,
+		},
+	}, nil
+}
+
+func (o ObjFactory) MakeStateSyncMessage(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time) (gregor.InBandMessage, error) {
+	md, err := o.makeMetadata(uid, msgid, devid, ctime, gregor.InBandMsgTypeSync)
+	if err != nil {
+		return nil, err
+	}
 	return InBandMessage{
 		StateSync_: &StateSyncMessage{
 			Md_: md,
@@ -153,7 +211,11 @@ func (o ObjFactory) MakeState(items []gregor.Item) (gregor.State, error) {
 }
 
 func (o ObjFactory) MakeMetadata(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, i gregor.InBandMsgType) (gregor.Metadata, error) {
-	return o.makeMetadata(uid, msgid, devid, ctime, gregor.InBandMsgTypeUpdate)
+	md, err := o.makeMetadata(uid, msgid, devid, ctime, i)
+	if err != nil {
+		return nil, err
+	}
+	return &md, nil
 }
 
 func (o ObjFactory) MakeInBandMessageFromItem(i gregor.Item) (gregor.InBandMessage, error) {
@@ -169,4 +231,44 @@ func (o ObjFactory) MakeInBandMessageFromItem(i gregor.Item) (gregor.InBandMessa
 	}, nil
 }
 
+func (o ObjFactory) MakeMessageFromInBandMessage(i gregor.InBandMessage) (gregor.Message, error) {
+	ibm, err := castInBandMessage(i)
+	if err != nil {
+		return nil, err
+	}
+	return Message{Ibm_: &ibm}, nil
+}
+
+func (o ObjFactory) MakeMessageFromOutOfBandMessage(m gregor.OutOfBandMessage) (gregor.Message, error) {
+	oobm, ok := m.(OutOfBandMessage)
+	if !ok {
+		return nil, fmt.Errorf("Bad OutOfBandMessage; wrong type")
+	}
+	return Message{Oobm_: &oobm}, nil
+}
+
+func (o ObjFactory) MakeReminder(i gregor.Item, t time.Time) (gregor.Reminder, error) {
+	ourItem, err := castItem(i)
+	if err != nil {
+		return nil, err
+	}
+	return Reminder{item: ourItem, remindTime: t}, nil
+}
+
+func (o ObjFactory) MakeOutOfBandMessage(uid gregor.UID, system gregor.System, body gregor.Body) (gregor.OutOfBandMessage, error) {
+	uid2, err := castUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	var b Body
+	if body != nil {
+		b = Body(body.Bytes())
+	}
+	return OutOfBandMessage{
+		Uid_:    uid2,
+		System_: System(system.String()),
+		Body_:   b,
+	}, nil
+}
+
 var _ gregor.ObjFactory = ObjFactory{}
@@ -0,0 +1,31 @@
+package gregor
+
+import "fmt"
+
+// The quotas that a StateMachine can enforce, as named by ErrQuotaExceeded.
+const (
+	// QuotaItems bounds the number of live Items each user can have.
+	QuotaItems = "items"
+	// QuotaCategoryItems bounds the number of live Items each user can
+	// have in any one category.
+	QuotaCategoryItems = "category items"
+	// QuotaBodySize bounds the size of each Item's Body, in bytes.
+	QuotaBodySize = "body size"
+)
+
+// ErrQuotaExceeded is returned by StateMachines that enforce quotas when
+// consuming a message would take its user over one of them. Quota is the
+// name of the quota, and Limit is the most it allows. Category is the
+// category the Item was in, for QuotaCategoryItems.
+type ErrQuotaExceeded struct {
+	Quota    string
+	Limit    int
+	Category string
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	if e.Category != "" {
+		return fmt.Sprintf("%s quota of %d exceeded in %s", e.Quota, e.Limit, e.Category)
+	}
+	return fmt.Sprintf("%s quota of %d exceeded", e.Quota, e.Limit)
+}
@@ -0,0 +1,239 @@
+package reconcile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// DefaultBucketWidth is the bucket width used when none is given.
+const DefaultBucketWidth = time.Hour
+
+// Bucket summarizes the messages a replica has for a user whose ctimes fall
+// in one time bucket: how many there are, and a hash of their MsgIDs.
+type Bucket struct {
+	Count int    `json:"count"`
+	Hash  []byte `json:"hash"`
+}
+
+// Digest summarizes the messages a replica has for a user, bucketed by
+// ctime, so that two replicas can find out where they differ by swapping
+// a few bytes per bucket instead of their whole message logs. Buckets are
+// keyed by the ctime in nanoseconds since the Unix epoch divided by Width,
+// and empty buckets are left out.
+type Digest struct {
+	Width   time.Duration    `json:"width"`
+	Buckets map[int64]Bucket `json:"buckets"`
+}
+
+// bucketOf returns the bucket that a message with the given ctime falls in.
+func bucketOf(ctime time.Time, width time.Duration) int64 {
+	ns := ctime.UnixNano()
+	b := ns / int64(width)
+	if ns < 0 && ns%int64(width) != 0 {
+		b--
+	}
+	return b
+}
+
+// bucketStart returns the earliest ctime in the bucket b, in UTC.
+func bucketStart(b int64, width time.Duration) time.Time {
+	return time.Unix(0, b*int64(width)).UTC()
+}
+
+type msgIDs [][]byte
+
+func (l msgIDs) Len() int           { return len(l) }
+func (l msgIDs) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l msgIDs) Less(i, j int) bool { return bytes.Compare(l[i], l[j]) < 0 }
+
+// hashMsgIDs hashes the MsgIDs ids, in an order that doesn't depend on the
+// order they were given in.
+func hashMsgIDs(ids [][]byte) []byte {
+	sorted := make(msgIDs, len(ids))
+	copy(sorted, ids)
+	sort.Sort(sorted)
+	h := sha256.New()
+	var n [8]byte
+	for _, id := range sorted {
+		binary.BigEndian.PutUint64(n[:], uint64(len(id)))
+		h.Write(n[:])
+		h.Write(id)
+	}
+	return h.Sum(nil)
+}
+
+// replica is one side of a reconciliation: the messages a StateMachine has
+// for a user, grouped by bucket.
+type replica struct {
+	sm      gregor.StateMachine
+	width   time.Duration
+	buckets map[int64][]gregor.InBandMessage
+}
+
+func newReplica(sm gregor.StateMachine, u gregor.UID, width time.Duration) (*replica, error) {
+	msgs, err := sm.InBandMessagesSince(u, nil, timeOrOffset(time.Time{}))
+	if err != nil {
+		return nil, err
+	}
+	r := &replica{sm: sm, width: width, buckets: make(map[int64][]gregor.InBandMessage)}
+	for _, m := range msgs {
+		b := bucketOf(m.Metadata().CTime(), width)
+		r.buckets[b] = append(r.buckets[b], m)
+	}
+	return r, nil
+}
+
+func (r *replica) digest() *Digest {
+	d := &Digest{Width: r.width, Buckets: make(map[int64]Bucket)}
+	for b, msgs := range r.buckets {
+		var ids [][]byte
+		for _, m := range msgs {
+			ids = append(ids, m.Metadata().MsgID().Bytes())
+		}
+		d.Buckets[b] = Bucket{Count: len(ids), Hash: hashMsgIDs(ids)}
+	}
+	return d
+}
+
+// missing returns the messages in the buckets bs that r has and other
+// doesn't, in the order r returned them.
+func (r *replica) missing(other *replica, bs []int64) []gregor.InBandMessage {
+	var ret []gregor.InBandMessage
+	for _, b := range bs {
+		have := make(map[string]bool)
+		for _, m := range other.buckets[b] {
+			have[string(m.Metadata().MsgID().Bytes())] = true
+		}
+		for _, m := range r.buckets[b] {
+			if !have[string(m.Metadata().MsgID().Bytes())] {
+				ret = append(ret, m)
+			}
+		}
+	}
+	return ret
+}
+
+// MakeDigest makes the Digest of the messages sm has for the user u, with
+// buckets width wide, or DefaultBucketWidth wide if width isn't positive.
+func MakeDigest(sm gregor.StateMachine, u gregor.UID, width time.Duration) (*Digest, error) {
+	if width <= 0 {
+		width = DefaultBucketWidth
+	}
+	r, err := newReplica(sm, u, width)
+	if err != nil {
+		return nil, err
+	}
+	return r.digest(), nil
+}
+
+// Diff returns the buckets, in order, that differ between d and other,
+// including those that only one of them has messages in. Digests of
+// different widths can't be compared bucket by bucket, so if the widths
+// differ, every bucket in either is returned.
+func (d *Digest) Diff(other *Digest) []int64 {
+	seen := make(map[int64]bool)
+	var ret []int64
+	add := func(b int64) {
+		if !seen[b] {
+			seen[b] = true
+			ret = append(ret, b)
+		}
+	}
+	for b, x := range d.Buckets {
+		if y, ok := other.Buckets[b]; !ok || d.Width != other.Width || x.Count != y.Count || !bytes.Equal(x.Hash, y.Hash) {
+			add(b)
+		}
+	}
+	for b := range other.Buckets {
+		if _, ok := d.Buckets[b]; !ok || d.Width != other.Width {
+			add(b)
+		}
+	}
+	sort.Sort(buckets(ret))
+	return ret
+}
+
+type buckets []int64
+
+func (l buckets) Len() int           { return len(l) }
+func (l buckets) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l buckets) Less(i, j int) bool { return l[i] < l[j] }
+
+// Result says how a call to Reconcile went.
+type Result struct {
+	// Buckets are the starts of the buckets whose digests differed.
+	Buckets []time.Time
+	// AToB and BToA are the numbers of messages copied each way.
+	AToB int
+	BToA int
+}
+
+// Reconcile brings two replicas of the user u's messages back in line
+// after they've diverged, say a client that missed some messages or a
+// shard that was down for a while. It digests the messages each of a and
+// b has, with buckets width wide, and then, only in the buckets where the
+// digests differ, consumes the messages that one has and the other doesn't
+// into the other, keeping their MsgIDs and ctimes. Since gregor's messages
+// commute, a and b then have the same State, whatever order the copies
+// were consumed in.
+//
+// Both replicas only report the messages that InBandMessagesSince does, so
+// the creation of an Item that's been dismissed on one side is left out
+// of its digest, and might be copied to the other side even though it's
+// already there. That's harmless, since replays are no-ops, but it means
+// the digests of two replicas with the same State don't always match.
+func Reconcile(of gregor.ObjFactory, u gregor.UID, a, b gregor.StateMachine, width time.Duration) (*Result, error) {
+	if width <= 0 {
+		width = DefaultBucketWidth
+	}
+	ra, err := newReplica(a, u, width)
+	if err != nil {
+		return nil, err
+	}
+	rb, err := newReplica(b, u, width)
+	if err != nil {
+		return nil, err
+	}
+	diff := ra.digest().Diff(rb.digest())
+	res := &Result{}
+	for _, bk := range diff {
+		res.Buckets = append(res.Buckets, bucketStart(bk, width))
+	}
+	toB, toA := ra.missing(rb, diff), rb.missing(ra, diff)
+	if res.AToB, err = consume(of, b, toB); err != nil {
+		return res, err
+	}
+	if res.BToA, err = consume(of, a, toA); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// consume consumes msgs into sm, and returns how many it got through.
+func consume(of gregor.ObjFactory, sm gregor.StateMachine, msgs []gregor.InBandMessage) (int, error) {
+	for n, ibm := range msgs {
+		m, err := of.MakeMessageFromInBandMessage(ibm)
+		if err != nil {
+			return n, err
+		}
+		if err := sm.ConsumeMessage(m); err != nil {
+			return n, err
+		}
+	}
+	return len(msgs), nil
+}
+
+type timeOrOffset time.Time
+
+func (t timeOrOffset) Time() *time.Time {
+	ret := time.Time(t)
+	return &ret
+}
+func (t timeOrOffset) Offset() *time.Duration { return nil }
+
+var _ gregor.TimeOrOffset = timeOrOffset{}
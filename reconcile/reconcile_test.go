@@ -0,0 +1,122 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	"github.com/keybase/gregor/storage"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func makeCreation(t *testing.T, u gregor.UID, id string, ctime time.Time) gregor.Message {
+	of := test.TestObjFactory{}
+	m, _ := of.MakeMsgID([]byte(id))
+	c, _ := of.MakeCategory("reconcile")
+	b, _ := of.MakeBody([]byte(id))
+	i, err := of.MakeItem(u, m, nil, ctime, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func makeDismissal(t *testing.T, u gregor.UID, id string, ctime time.Time, target string) gregor.Message {
+	of := test.TestObjFactory{}
+	m, _ := of.MakeMsgID([]byte(id))
+	d, _ := of.MakeMsgID([]byte(target))
+	ibm, err := of.MakeDismissalByID(u, m, nil, ctime, d)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func bodies(t *testing.T, sm gregor.StateMachine, u gregor.UID) []string {
+	st, err := sm.State(u, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, err := st.Items()
+	require.Nil(t, err, "no error from Items")
+	var ret []string
+	for _, i := range items {
+		ret = append(ret, string(i.Body().Bytes()))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_reconcile")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	of := test.TestObjFactory{}
+	cl := clockwork.NewFakeClock()
+	a := storage.NewMemEngine(of, cl)
+	b, err := storage.NewKVEngine(filepath.Join(dir, "gregor.kv"), of, cl)
+	require.Nil(t, err, "no error from NewKVEngine")
+	defer b.Close()
+	u, _ := of.MakeUID([]byte("reconcile user"))
+	other, _ := of.MakeUID([]byte("other user"))
+
+	t0 := cl.Now().Truncate(time.Hour)
+	both := func(m gregor.Message) {
+		require.Nil(t, a.ConsumeMessage(m), "no error from ConsumeMessage")
+		require.Nil(t, b.ConsumeMessage(m), "no error from ConsumeMessage")
+	}
+	both(makeCreation(t, u, "c1", t0.Add(time.Minute)))
+	both(makeCreation(t, u, "c2", t0.Add(2*time.Minute)))
+	both(makeCreation(t, u, "c3", t0.Add(3*time.Hour)))
+
+	// b missed a1, and a missed b1 and the dismissal of c1. o1 belongs to
+	// another user, so it shouldn't be copied.
+	require.Nil(t, a.ConsumeMessage(makeCreation(t, u, "a1", t0.Add(5*time.Hour))), "no error from ConsumeMessage")
+	require.Nil(t, b.ConsumeMessage(makeCreation(t, u, "b1", t0.Add(3*time.Hour+time.Minute))), "no error from ConsumeMessage")
+	require.Nil(t, b.ConsumeMessage(makeDismissal(t, u, "d1", t0.Add(4*time.Minute), "c1")), "no error from ConsumeMessage")
+	require.Nil(t, b.ConsumeMessage(makeCreation(t, other, "o1", t0.Add(5*time.Hour))), "no error from ConsumeMessage")
+	cl.Advance(6 * time.Hour)
+
+	da, err := MakeDigest(a, u, time.Hour)
+	require.Nil(t, err, "no error from MakeDigest")
+	db, err := MakeDigest(b, u, time.Hour)
+	require.Nil(t, err, "no error from MakeDigest")
+	require.Equal(t, 3, len(da.Diff(db)), "three buckets differ")
+	buf, err := json.Marshal(db)
+	require.Nil(t, err, "no error from Marshal")
+	var parsed Digest
+	require.Nil(t, json.Unmarshal(buf, &parsed), "no error from Unmarshal")
+	require.Equal(t, da.Diff(db), da.Diff(&parsed), "digests survive being sent over the wire")
+	require.Equal(t, 3, len(da.Diff(&Digest{Width: time.Minute, Buckets: db.Buckets})), "different widths differ everywhere")
+
+	res, err := Reconcile(of, u, a, b, time.Hour)
+	require.Nil(t, err, "no error from Reconcile")
+	require.Equal(t, []time.Time{t0, t0.Add(3 * time.Hour), t0.Add(5 * time.Hour)}, res.Buckets, "the buckets that differed")
+	// c1 is copied to b, where it's a replay, since b doesn't report it.
+	require.Equal(t, 2, res.AToB, "a1 and c1 copied to b")
+	require.Equal(t, 2, res.BToA, "b1 and d1 copied to a")
+	require.Equal(t, []string{"a1", "b1", "c2", "c3"}, bodies(t, a, u), "a caught up")
+	require.Equal(t, []string{"a1", "b1", "c2", "c3"}, bodies(t, b, u), "b caught up")
+	require.Equal(t, []string(nil), bodies(t, a, other), "other users left alone")
+
+	res, err = Reconcile(of, u, a, b, time.Hour)
+	require.Nil(t, err, "no error from Reconcile")
+	require.Equal(t, &Result{}, res, "nothing left to copy")
+}
+
+func TestBucketOf(t *testing.T) {
+	for _, ns := range []int64{-2, -1, 0, 1, 3599999999999, 3600000000000, -3600000000000, -3600000000001} {
+		tm := time.Unix(0, ns)
+		b := bucketOf(tm, time.Hour)
+		require.False(t, tm.Before(bucketStart(b, time.Hour)), "%d is in its bucket", ns)
+		require.True(t, tm.Before(bucketStart(b+1, time.Hour)), "%d is before the next bucket", ns)
+	}
+}
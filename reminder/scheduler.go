@@ -0,0 +1,88 @@
+package reminder
+
+import (
+	"log"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	context "golang.org/x/net/context"
+)
+
+// Scheduler periodically polls a gregor.ReminderStore for reminders that
+// have come due, and broadcasts the corresponding Items to the user's
+// devices via a gregor.NetworkInterfaceOutgoing. Reminders are deleted from
+// the store once they've been successfully broadcast, and retried on the next
+// poll otherwise.
+type Scheduler struct {
+	rs         gregor.ReminderStore
+	out        gregor.NetworkInterfaceOutgoing
+	objFactory gregor.ObjFactory
+	clock      clockwork.Clock
+	interval   time.Duration
+	closeCh    chan struct{}
+}
+
+// NewScheduler makes a new Scheduler that checks rs for due reminders every
+// interval. You must call Run() for it to do anything.
+func NewScheduler(rs gregor.ReminderStore, out gregor.NetworkInterfaceOutgoing, of gregor.ObjFactory, cl clockwork.Clock, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		rs:         rs,
+		out:        out,
+		objFactory: of,
+		clock:      cl,
+		interval:   interval,
+		closeCh:    make(chan struct{}),
+	}
+}
+
+func (s *Scheduler) logError(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("reminder scheduler %s error: %s", prefix, err)
+}
+
+func (s *Scheduler) fire(r gregor.Reminder) error {
+	ibm, err := s.objFactory.MakeInBandMessageFromItem(r.Item())
+	if err != nil {
+		return err
+	}
+	m, err := s.objFactory.MakeMessageFromInBandMessage(ibm)
+	if err != nil {
+		return err
+	}
+	if err := s.out.BroadcastMessage(context.Background(), m); err != nil {
+		return err
+	}
+	return s.rs.DeleteReminder(r)
+}
+
+// fireDue broadcasts all reminders that are due as of now.
+func (s *Scheduler) fireDue() error {
+	rems, err := s.rs.Reminders(s.clock.Now())
+	if err != nil {
+		return err
+	}
+	for _, r := range rems {
+		s.logError("fire", s.fire(r))
+	}
+	return nil
+}
+
+// Run polls for and fires reminders until Shutdown() is called.
+func (s *Scheduler) Run() error {
+	for {
+		s.logError("fireDue", s.fireDue())
+		select {
+		case <-s.clock.After(s.interval):
+		case <-s.closeCh:
+			return nil
+		}
+	}
+}
+
+// Shutdown tells the scheduler to stop its Run loop.
+func (s *Scheduler) Shutdown() {
+	close(s.closeCh)
+}
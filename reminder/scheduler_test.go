@@ -0,0 +1,107 @@
+package reminder
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+	context "golang.org/x/net/context"
+)
+
+type mockStore struct {
+	rems []gregor.Reminder
+}
+
+func (m *mockStore) Reminders(before time.Time) ([]gregor.Reminder, error) {
+	var ret []gregor.Reminder
+	for _, r := range m.rems {
+		if !r.RemindTime().After(before) {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+func (m *mockStore) DeleteReminder(r gregor.Reminder) error {
+	for i, r2 := range m.rems {
+		if r2 == r {
+			m.rems = append(m.rems[:i], m.rems[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("reminder not found")
+}
+
+type mockOutgoing struct {
+	broadcasts []gregor.Message
+	fail       bool
+}
+
+func (m *mockOutgoing) BroadcastMessage(c context.Context, msg gregor.Message) error {
+	if m.fail {
+		return errors.New("broadcast failed")
+	}
+	m.broadcasts = append(m.broadcasts, msg)
+	return nil
+}
+
+func makeReminder(t *testing.T, of gregor.ObjFactory, body string, tm time.Time) gregor.Reminder {
+	uid, _ := of.MakeUID([]byte("uid"))
+	msgID, _ := of.MakeMsgID([]byte(body))
+	c, _ := of.MakeCategory("foos")
+	b, _ := of.MakeBody([]byte(body))
+	i, err := of.MakeItem(uid, msgID, nil, tm, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	r, err := of.MakeReminder(i, tm)
+	require.Nil(t, err, "no error from MakeReminder")
+	return r
+}
+
+func TestSchedulerFiresDueReminders(t *testing.T) {
+	of := test.TestObjFactory{}
+	cl := clockwork.NewFakeClock()
+	rs := &mockStore{rems: []gregor.Reminder{
+		makeReminder(t, of, "r1", cl.Now().Add(time.Second)),
+		makeReminder(t, of, "r2", cl.Now().Add(time.Minute)),
+	}}
+	out := &mockOutgoing{}
+	s := NewScheduler(rs, out, of, cl, time.Second)
+
+	require.Nil(t, s.fireDue(), "no error from fireDue")
+	require.Len(t, out.broadcasts, 0, "nothing due yet")
+
+	cl.Advance(time.Second)
+	require.Nil(t, s.fireDue(), "no error from fireDue")
+	require.Len(t, out.broadcasts, 1, "r1 fired")
+	body := out.broadcasts[0].ToInBandMessage().ToStateUpdateMessage().Creation().Body()
+	require.Equal(t, []byte("r1"), body.Bytes(), "right item broadcast")
+	require.Len(t, rs.rems, 1, "r1 deleted after firing")
+
+	// A failed broadcast leaves the reminder in place to retry later.
+	cl.Advance(time.Minute)
+	out.fail = true
+	require.Nil(t, s.fireDue(), "no error from fireDue")
+	require.Len(t, rs.rems, 1, "r2 kept after failed broadcast")
+	out.fail = false
+	require.Nil(t, s.fireDue(), "no error from fireDue")
+	require.Len(t, out.broadcasts, 2, "r2 fired")
+	require.Len(t, rs.rems, 0, "r2 deleted after firing")
+}
+
+func TestSchedulerRun(t *testing.T) {
+	of := test.TestObjFactory{}
+	cl := clockwork.NewFakeClock()
+	rs := &mockStore{}
+	out := &mockOutgoing{}
+	s := NewScheduler(rs, out, of, cl, time.Second)
+
+	doneCh := make(chan error)
+	go func() { doneCh <- s.Run() }()
+	cl.BlockUntil(1)
+	s.Shutdown()
+	require.Nil(t, <-doneCh, "no error from Run")
+}
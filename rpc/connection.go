@@ -25,8 +25,8 @@ type connection struct {
 }
 
 func newConnection(c net.Conn, parent *Server) (*connection, error) {
-	// TODO: logging and error wrapping mechanisms.
-	xprt := rpc.NewTransport(c, nil, nil)
+	// TODO: logging mechanism.
+	xprt := rpc.NewTransport(c, nil, WrapError)
 
 	conn := &connection{
 		c:      c,
@@ -60,8 +60,7 @@ func (c *connection) ConsumeMessage(ctx context.Context, m protocol.Message) err
 }
 
 func (c *connection) startRPCServer() error {
-	// TODO: error wrapping mechanism
-	srv := rpc.NewServer(c.xprt, nil)
+	srv := rpc.NewServer(c.xprt, WrapError)
 
 	prots := []rpc.Protocol{
 		protocol.AuthProtocol(c),
@@ -1,6 +1,11 @@
 package rpc
 
-import "strings"
+import (
+	"errors"
+	"strings"
+
+	gregor "github.com/keybase/gregor"
+)
 
 // IsSocketClosedError returns true if e looks like an error due
 // to the socket being closed.
@@ -8,3 +13,64 @@ import "strings"
 func IsSocketClosedError(e error) bool {
 	return strings.HasSuffix(e.Error(), "use of closed network connection")
 }
+
+// The codes in a Status.
+const (
+	StatusOK            = 0
+	StatusGeneric       = 1
+	StatusQuotaExceeded = 2
+)
+
+// Status is how the server sends errors back over RPC, so that clients
+// can tell what kind of error they got. Desc is the error's message, and
+// the rest is filled in for StatusQuotaExceeded, from the
+// gregor.ErrQuotaExceeded.
+type Status struct {
+	Code     int    `codec:"code" json:"code"`
+	Desc     string `codec:"desc" json:"desc"`
+	Quota    string `codec:"quota" json:"quota"`
+	Limit    int    `codec:"limit" json:"limit"`
+	Category string `codec:"category" json:"category"`
+}
+
+// WrapError turns err into the Status sent back to the client.
+func WrapError(err error) interface{} {
+	if err == nil {
+		return nil
+	}
+	var qe gregor.ErrQuotaExceeded
+	if errors.As(err, &qe) {
+		return Status{
+			Code:     StatusQuotaExceeded,
+			Desc:     err.Error(),
+			Quota:    qe.Quota,
+			Limit:    qe.Limit,
+			Category: qe.Category,
+		}
+	}
+	return Status{Code: StatusGeneric, Desc: err.Error()}
+}
+
+// ErrorUnwrapper turns the Statuses sent by WrapError back into errors.
+// Clients should use it, since the server's errors aren't plain strings.
+type ErrorUnwrapper struct{}
+
+// MakeArg implements rpc.ErrorUnwrapper.
+func (ErrorUnwrapper) MakeArg() interface{} { return &Status{} }
+
+// UnwrapError implements rpc.ErrorUnwrapper. It returns a
+// gregor.ErrQuotaExceeded for StatusQuotaExceeded.
+func (ErrorUnwrapper) UnwrapError(arg interface{}) (appError error, dispatchError error) {
+	s, ok := arg.(*Status)
+	if !ok {
+		return nil, ErrBadCast
+	}
+	switch s.Code {
+	case StatusOK:
+		return nil, nil
+	case StatusQuotaExceeded:
+		return gregor.ErrQuotaExceeded{Quota: s.Quota, Limit: s.Limit, Category: s.Category}, nil
+	default:
+		return errors.New(s.Desc), nil
+	}
+}
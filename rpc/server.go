@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"net"
+	"time"
 
 	"github.com/jonboulle/clockwork"
 	gregor "github.com/keybase/gregor"
@@ -16,6 +17,10 @@ import (
 // gregor to protocol.
 var ErrBadCast = errors.New("bad cast from gregor type to protocol type")
 
+// ErrNoRecipients is returned by BroadcastMessage when none of the user's
+// devices are connected, so nothing got the message.
+var ErrNoRecipients = errors.New("no connected devices to broadcast to")
+
 type connectionID int
 
 type messageArgs struct {
@@ -43,6 +48,14 @@ type Server struct {
 	auth  Authenticator
 	clock clockwork.Clock
 
+	// hlc stamps the in-band messages the server consumes, as described
+	// for consume.
+	hlc *gregor.HLClock
+
+	// oobq, if set, has the OutOfBandMessages to send to devices when they
+	// connect
+	oobq gregor.OutOfBandQueue
+
 	// key is the Hex-encoding of the binary UIDs
 	users map[string](*perUIDServer)
 
@@ -58,8 +71,8 @@ type Server struct {
 	nextConnectionID connectionID
 }
 
-// NewServer creates a Server.  You must call ListenLoop(...) and Serve(...)
-// for it to be functional.
+// NewServer creates a Server.  You must call SetAuthenticator(...),
+// ListenLoop(...) and Serve(...) for it to be functional.
 func NewServer() *Server {
 	s := &Server{
 		clock:           clockwork.NewRealClock(),
@@ -72,10 +85,31 @@ func NewServer() *Server {
 		closeCh:         make(chan struct{}),
 		confirmCh:       make(chan confirmUIDShutdownArgs),
 	}
+	s.hlc = gregor.NewHLClock(func() time.Time { return s.clock.Now() })
+	s.hlc.MaxDrift = maxHLCDrift
 
 	return s
 }
 
+// maxHLCDrift bounds how far ahead of the server's clock the HLCs on
+// clients' messages can be before the server stamps them again.
+const maxHLCDrift = time.Minute
+
+// SetOutOfBandQueue makes the server send the OutOfBandMessages queued in q
+// to each device of a user when it connects, so that devices that were
+// offline when they were broadcast still get them. Since messages stay
+// queued until they expire, a device may get the same message more than
+// once. It must be called before Serve.
+func (s *Server) SetOutOfBandQueue(q gregor.OutOfBandQueue) {
+	s.oobq = q
+}
+
+// SetAuthenticator makes the server authenticate devices' tokens with a.
+// It must be called before ListenLoop.
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.auth = a
+}
+
 func (s *Server) uidKey(u gregor.UID) (string, error) {
 	tuid, ok := u.(protocol.UID)
 	if !ok {
@@ -113,7 +147,7 @@ func (s *Server) addUIDConnection(c *connection) error {
 	}
 
 	if usrv == nil {
-		usrv = newPerUIDServer(c.uid, s.confirmCh, s.closeCh)
+		usrv = newPerUIDServer(c.uid, s.oobq, s.confirmCh, s.closeCh)
 		if err := s.setPerUIDServer(c.uid, usrv); err != nil {
 			return err
 		}
@@ -171,7 +205,8 @@ func (s *Server) logError(prefix string, err error) {
 	log.Printf("%s error: %s", prefix, err)
 }
 
-// BroadcastMessage implements gregor.NetworkInterfaceOutgoing.
+// BroadcastMessage implements gregor.NetworkInterfaceOutgoing. It returns
+// ErrNoRecipients if none of the user's devices are connected.
 func (s *Server) BroadcastMessage(c context.Context, m gregor.Message) error {
 	tm, ok := m.(protocol.Message)
 	if !ok {
@@ -187,16 +222,22 @@ func (s *Server) sendBroadcast(c context.Context, m protocol.Message) error {
 	if err != nil {
 		return err
 	}
-	// Nothing to do...
 	if srv == nil {
-		return nil
+		return ErrNoRecipients
 	}
 	retCh := make(chan error)
 	srv.sendBroadcastCh <- messageArgs{c, m, retCh}
 	return <-retCh
 }
 
+// consume hands m to the NetworkInterfaceIncoming. In-band messages that
+// clients didn't stamp with an HLC are stamped with the server's, and the
+// server's HLClock observes those they did, so that the messages it stamps
+// later are ordered after them.
 func (s *Server) consume(c context.Context, m protocol.Message) error {
+	if m.Ibm_ != nil {
+		gregor.StampHLC(s.hlc, m.Ibm_)
+	}
 	retCh := make(chan error)
 	args := messageArgs{c, m, retCh}
 	s.consumeCh <- args
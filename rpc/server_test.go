@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	rpc "github.com/keybase/go-framed-msgpack-rpc"
 	"github.com/keybase/gregor"
@@ -32,16 +34,35 @@ func (m mockAuth) Authenticate(_ context.Context, tok protocol.AuthToken) (proto
 
 type mockConsumer struct {
 	consumed []gregor.Message
+	err      error
 }
 
 func (m *mockConsumer) ConsumeMessage(ctx context.Context, msg gregor.Message) error {
+	if m.err != nil {
+		return m.err
+	}
 	m.consumed = append(m.consumed, msg)
 	return nil
 }
 
+type mockQueue struct {
+	queued []gregor.OutOfBandMessage
+}
+
+func (m *mockQueue) QueuedOutOfBandMessages(u gregor.UID) ([]gregor.OutOfBandMessage, error) {
+	return m.queued, nil
+}
+
 func startTestServer(x gregor.NetworkInterfaceIncoming) (*Server, net.Listener) {
+	return startTestServerWithQueue(x, nil)
+}
+
+func startTestServerWithQueue(x gregor.NetworkInterfaceIncoming, q gregor.OutOfBandQueue) (*Server, net.Listener) {
 	s := NewServer()
-	s.auth = mockAuth{}
+	s.SetAuthenticator(mockAuth{})
+	if q != nil {
+		s.SetOutOfBandQueue(q)
+	}
 	l := newLocalListener()
 	go s.Serve(x)
 	go s.ListenLoop(l)
@@ -58,10 +79,14 @@ func newLocalListener() net.Listener {
 	return l
 }
 
+// client is a test client. Messages are broadcast to it in the background,
+// so broadcasts and shutdown are guarded by the mutex.
 type client struct {
-	conn       net.Conn
-	tr         rpc.Transporter
-	cli        *rpc.Client
+	conn net.Conn
+	tr   rpc.Transporter
+	cli  *rpc.Client
+
+	sync.Mutex
 	broadcasts []protocol.Message
 	shutdown   bool
 }
@@ -76,7 +101,7 @@ func newClient(addr net.Addr) *client {
 	x := &client{
 		conn: c,
 		tr:   t,
-		cli:  rpc.NewClient(t, nil),
+		cli:  rpc.NewClient(t, ErrorUnwrapper{}),
 	}
 
 	srv := rpc.NewServer(t, nil)
@@ -91,7 +116,16 @@ func (c *client) Shutdown() {
 	c.conn.Close()
 	// this is required as closing the connection only closes one direction
 	// and there is a race in figuring out that the whole connection is closed.
+	c.Lock()
 	c.shutdown = true
+	c.Unlock()
+}
+
+// received returns the messages broadcast to c so far.
+func (c *client) received() []protocol.Message {
+	c.Lock()
+	defer c.Unlock()
+	return append([]protocol.Message(nil), c.broadcasts...)
 }
 
 func (c *client) AuthClient() protocol.AuthClient {
@@ -103,6 +137,8 @@ func (c *client) IncomingClient() protocol.IncomingClient {
 }
 
 func (c *client) BroadcastMessage(ctx context.Context, m protocol.Message) error {
+	c.Lock()
+	defer c.Unlock()
 	if c.shutdown {
 		return io.EOF
 	}
@@ -185,8 +221,47 @@ func TestBroadcast(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(c.broadcasts) != 1 {
-		t.Errorf("client broadcasts received: %d, expected 1", len(c.broadcasts))
+	if len(c.received()) != 1 {
+		t.Errorf("client broadcasts received: %d, expected 1", len(c.received()))
+	}
+}
+
+func TestBroadcastNoRecipients(t *testing.T) {
+	s, l := startTestServer(nil)
+	defer l.Close()
+	defer s.Shutdown()
+
+	m := newOOBMessage(goodUID, "sys", nil)
+	if err := s.BroadcastMessage(context.TODO(), m); err != ErrNoRecipients {
+		t.Errorf("broadcast error: %v, expected %v", err, ErrNoRecipients)
+	}
+}
+
+func TestDeliverQueued(t *testing.T) {
+	q := &mockQueue{queued: []gregor.OutOfBandMessage{*newOOBMessage(goodUID, "kbfs.favorites", protocol.Body("hi")).Oobm_}}
+	s, l := startTestServerWithQueue(nil, q)
+	defer l.Close()
+	defer s.Shutdown()
+
+	c := newClient(l.Addr())
+	defer c.Shutdown()
+	if err := c.AuthClient().Authenticate(context.TODO(), goodToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued message is delivered once the connection has been added,
+	// which happens in the background.
+	var received []protocol.Message
+	for i := 0; i < 100 && len(received) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		received = c.received()
+	}
+	if len(received) != 1 {
+		t.Fatalf("client broadcasts received: %d, expected 1", len(received))
+	}
+	oobm := received[0].ToOutOfBandMessage()
+	if oobm == nil || oobm.System().String() != "kbfs.favorites" || string(oobm.Body().Bytes()) != "hi" {
+		t.Errorf("client got %+v, expected the queued message", received[0])
 	}
 }
 
@@ -211,6 +286,67 @@ func TestConsume(t *testing.T) {
 	}
 }
 
+func TestConsumeStampsHLC(t *testing.T) {
+	mc := &mockConsumer{}
+	s, l := startTestServer(mc)
+	defer l.Close()
+	defer s.Shutdown()
+
+	c := newClient(l.Addr())
+	defer c.Shutdown()
+	if err := c.AuthClient().Authenticate(context.TODO(), goodToken); err != nil {
+		t.Fatal(err)
+	}
+
+	unstamped := newUpdateMessage(goodUID)
+	stamped := newUpdateMessage(goodUID)
+	ahead := gregor.HLCFromTime(time.Now().Add(10 * time.Second))
+	stamped.Ibm_.StateUpdate_.Md_.Hlc_ = protocol.HLC(ahead)
+	for _, m := range []protocol.Message{stamped, unstamped} {
+		if err := c.IncomingClient().ConsumeMessage(context.TODO(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(mc.consumed) != 2 {
+		t.Fatalf("consumer messages received: %d, expected 2", len(mc.consumed))
+	}
+	first := gregor.HLCOf(mc.consumed[0].ToInBandMessage().Metadata())
+	second := gregor.HLCOf(mc.consumed[1].ToInBandMessage().Metadata())
+	if first != ahead {
+		t.Errorf("client's HLC: %d, expected %d", first, ahead)
+	}
+	if second <= ahead {
+		t.Errorf("server's HLC: %d, expected more than %d", second, ahead)
+	}
+}
+
+func TestConsumeErrors(t *testing.T) {
+	mc := &mockConsumer{}
+	s, l := startTestServer(mc)
+	defer l.Close()
+	defer s.Shutdown()
+
+	c := newClient(l.Addr())
+	defer c.Shutdown()
+	if err := c.AuthClient().Authenticate(context.TODO(), goodToken); err != nil {
+		t.Fatal(err)
+	}
+
+	qe := gregor.ErrQuotaExceeded{Quota: gregor.QuotaCategoryItems, Limit: 10, Category: "user.joined"}
+	mc.err = qe
+	err := c.IncomingClient().ConsumeMessage(context.TODO(), newUpdateMessage(goodUID))
+	if err != qe {
+		t.Errorf("consume error: %#v, expected %#v", err, qe)
+	}
+
+	mc.err = errors.New("disk full")
+	err = c.IncomingClient().ConsumeMessage(context.TODO(), newUpdateMessage(goodUID))
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("consume error: %v, expected disk full", err)
+	}
+}
+
 func TestCloseOne(t *testing.T) {
 	s, l := startTestServer(nil)
 	defer l.Close()
@@ -239,8 +375,8 @@ func TestCloseOne(t *testing.T) {
 	}
 
 	// make sure it didn't receive the broadcast
-	if len(c.broadcasts) != 0 {
-		t.Errorf("c broadcasts: %d, expected 0", len(c.broadcasts))
+	if len(c.received()) != 0 {
+		t.Errorf("c broadcasts: %d, expected 0", len(c.received()))
 	}
 
 	// and the user server should be deleted:
@@ -285,13 +421,13 @@ func TestCloseConnect(t *testing.T) {
 	}
 
 	// c1 shouldn't have received the broadcast:
-	if len(c1.broadcasts) != 0 {
-		t.Errorf("c1 broadcasts: %d, expected 0", len(c1.broadcasts))
+	if len(c1.received()) != 0 {
+		t.Errorf("c1 broadcasts: %d, expected 0", len(c1.received()))
 	}
 
 	// c2 should have received the broadcast:
-	if len(c2.broadcasts) != 1 {
-		t.Errorf("c2 broadcasts: %d, expected 1", len(c2.broadcasts))
+	if len(c2.received()) != 1 {
+		t.Errorf("c2 broadcasts: %d, expected 1", len(c2.received()))
 	}
 }
 
@@ -330,13 +466,13 @@ func TestCloseConnect2(t *testing.T) {
 	}
 
 	// c1 shouldn't have received the broadcast:
-	if len(c1.broadcasts) != 0 {
-		t.Errorf("c1 broadcasts: %d, expected 0", len(c1.broadcasts))
+	if len(c1.received()) != 0 {
+		t.Errorf("c1 broadcasts: %d, expected 0", len(c1.received()))
 	}
 
 	// c2 shouldn't have received the broadcast:
-	if len(c2.broadcasts) != 0 {
-		t.Errorf("c2 broadcasts: %d, expected 0", len(c2.broadcasts))
+	if len(c2.received()) != 0 {
+		t.Errorf("c2 broadcasts: %d, expected 0", len(c2.received()))
 	}
 }
 
@@ -6,9 +6,12 @@ import (
 	"io"
 	"log"
 	"strings"
+	"time"
 
 	rpc "github.com/keybase/go-framed-msgpack-rpc"
+	gregor "github.com/keybase/gregor"
 	protocol "github.com/keybase/gregor/protocol/go"
+	context "golang.org/x/net/context"
 )
 
 type connectionArgs struct {
@@ -20,6 +23,7 @@ type perUIDServer struct {
 	uid        protocol.UID
 	conns      map[connectionID]*connection
 	lastConnID connectionID
+	oobq       gregor.OutOfBandQueue
 
 	parentConfirmCh chan confirmUIDShutdownArgs
 	newConnectionCh chan *connectionArgs
@@ -29,10 +33,11 @@ type perUIDServer struct {
 	shutdownCh      chan struct{}
 }
 
-func newPerUIDServer(uid protocol.UID, parentConfirmCh chan confirmUIDShutdownArgs, shutdownCh chan struct{}) *perUIDServer {
+func newPerUIDServer(uid protocol.UID, oobq gregor.OutOfBandQueue, parentConfirmCh chan confirmUIDShutdownArgs, shutdownCh chan struct{}) *perUIDServer {
 	s := &perUIDServer{
 		uid:             uid,
 		conns:           make(map[connectionID]*connection),
+		oobq:            oobq,
 		newConnectionCh: make(chan *connectionArgs, 1),
 		sendBroadcastCh: make(chan messageArgs, 1),
 		tryShutdownCh:   make(chan bool, 1), // buffered so it can receive inside serve()
@@ -80,10 +85,47 @@ func (s *perUIDServer) addConn(a *connectionArgs) error {
 	a.c.xprt.AddCloseListener(s.closeListenCh)
 	s.conns[a.id] = a.c
 	s.lastConnID = a.id
+	return s.deliverQueued(a.c, a.id)
+}
+
+// deliverQueuedTimeout bounds how long a new connection can hold up the
+// user's other connections while it gets its queued messages.
+const deliverQueuedTimeout = 10 * time.Second
+
+// deliverQueued sends the out-of-band messages queued for the user to the
+// newly added connection conn, giving up on it after deliverQueuedTimeout.
+func (s *perUIDServer) deliverQueued(conn *connection, id connectionID) error {
+	if s.oobq == nil {
+		return nil
+	}
+	msgs, err := s.oobq.QueuedOutOfBandMessages(s.uid)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliverQueuedTimeout)
+	defer cancel()
+	oc := protocol.OutgoingClient{Cli: rpc.NewClient(conn.xprt, nil)}
+	for _, m := range msgs {
+		oobm, ok := m.(protocol.OutOfBandMessage)
+		if !ok {
+			return ErrBadCast
+		}
+		log.Printf("uid %x delivering queued %s message to %d", s.uid, oobm.System_, id)
+		if err := oc.BroadcastMessage(ctx, protocol.Message{Oobm_: &oobm}); err != nil {
+			if s.isConnDown(err) {
+				s.removeConnection(conn, id)
+			}
+			return err
+		}
+	}
 	return nil
 }
 
 func (s *perUIDServer) broadcast(a messageArgs) {
+	if len(s.conns) == 0 {
+		a.retCh <- ErrNoRecipients
+		return
+	}
 	var errMsgs []string
 	for id, conn := range s.conns {
 		log.Printf("uid %x broadcast to %d", s.uid, id)
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// BodyKeySize is the size of the keys a KeyProvider hands out, which are
+// used for AES-256.
+const BodyKeySize = 32
+
+// ErrBadKeyFile is returned for key files that don't make sense.
+type ErrBadKeyFile string
+
+func (e ErrBadKeyFile) Error() string { return "bad key file: " + string(e) }
+
+// ErrUnknownBodyKey is returned when a body was encrypted with a key that
+// the KeyProvider doesn't have.
+type ErrUnknownBodyKey string
+
+func (e ErrUnknownBodyKey) Error() string { return "unknown body key: " + string(e) }
+
+// ErrBadBodyEnvelope is returned when an encrypted body is corrupt, or
+// doesn't decrypt with the key it says it was encrypted with.
+var ErrBadBodyEnvelope = errors.New("bad encrypted body")
+
+// ErrNoBodyKeys is returned when asked to rotate body keys on an engine
+// that doesn't have any.
+var ErrNoBodyKeys = errors.New("no body keys configured")
+
+// KeyProvider supplies the master keys that Item and OutOfBandMessage bodies
+// are encrypted with at rest. Keys are identified by short IDs, which are
+// stored next to each encrypted body so that old keys can be retired after
+// RotateBodyKeys has re-encrypted everything under the current one.
+type KeyProvider interface {
+	// CurrentBodyKey returns the key that new bodies should be encrypted
+	// with, and its ID.
+	CurrentBodyKey() (id string, key []byte, err error)
+
+	// BodyKey returns the key with the given ID, or ErrUnknownBodyKey.
+	BodyKey(id string) ([]byte, error)
+}
+
+// KeyFile is a KeyProvider for keys kept in a local file, typically read
+// from something like:
+//
+//	# id  key (hex-encoded, 32 bytes)
+//	2016-01 8c2e...
+//	2016-07 41fa...
+//
+// The last key in the file is the current one, so keys are rotated by
+// appending a new one, restarting gregord, and then running
+// gregor-rotate-keys. Old keys can be removed once that's done.
+type KeyFile struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ReadKeyFile reads and checks a key file from r.
+func ReadKeyFile(r io.Reader) (*KeyFile, error) {
+	ret := &KeyFile{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, ErrBadKeyFile("expected an ID and a key on each line")
+		}
+		id := fields[0]
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != BodyKeySize {
+			return nil, ErrBadKeyFile("key " + id + " isn't 32 hex-encoded bytes")
+		}
+		if _, found := ret.keys[id]; found {
+			return nil, ErrBadKeyFile("key " + id + " is given twice")
+		}
+		ret.keys[id] = key
+		ret.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if ret.current == "" {
+		return nil, ErrBadKeyFile("no keys")
+	}
+	return ret, nil
+}
+
+func (k *KeyFile) CurrentBodyKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *KeyFile) BodyKey(id string) ([]byte, error) {
+	key, found := k.keys[id]
+	if !found {
+		return nil, ErrUnknownBodyKey(id)
+	}
+	return key, nil
+}
+
+var _ KeyProvider = (*KeyFile)(nil)
+
+// BodyKeyRotator is implemented by engines that can encrypt the bodies they
+// store.
+type BodyKeyRotator interface {
+	SetBodyKeys(kp KeyProvider)
+	RotateBodyKeys() (int, error)
+}
+
+var _ BodyKeyRotator = (*SQLEngine)(nil)
+var _ BodyKeyRotator = (*ShardedEngine)(nil)
+
+// Encrypted bodies are enveloped: each is encrypted with its own random data
+// key, and the data key is in turn encrypted with the master key given by
+// the ID stored next to it. An envelope is laid out as:
+//
+//	version | nonce | data key encrypted with master key | nonce | body encrypted with data key
+//
+// with AES-256-GCM throughout. The master key's ID is authenticated along
+// with the data key, so an envelope can't be passed off as another key's.
+const bodyEnvelopeVersion byte = 1
+
+func gcmFor(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmSeal(key []byte, dst []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, err := gcmFor(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// gcmOpen opens the first n bytes of sealed, or all of it if n is negative,
+// and returns whatever of sealed follows them too.
+func gcmOpen(key []byte, sealed []byte, n int, ad []byte) ([]byte, []byte, error) {
+	aead, err := gcmFor(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns := aead.NonceSize()
+	if n < 0 {
+		n = len(sealed)
+	}
+	if len(sealed) < n || n < ns+aead.Overhead() {
+		return nil, nil, ErrBadBodyEnvelope
+	}
+	plaintext, err := aead.Open(nil, sealed[:ns], sealed[ns:n], ad)
+	if err != nil {
+		return nil, nil, ErrBadBodyEnvelope
+	}
+	return plaintext, sealed[n:], nil
+}
+
+// wrappedKeySize is the size of an encrypted data key in an envelope.
+const wrappedKeySize = 12 + BodyKeySize + 16
+
+// sealBody encrypts body under the current key from kp, and returns the
+// key's ID along with the envelope.
+func sealBody(kp KeyProvider, body []byte) (string, []byte, error) {
+	id, master, err := kp.CurrentBodyKey()
+	if err != nil {
+		return "", nil, err
+	}
+	dataKey := make([]byte, BodyKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, err
+	}
+	ret := []byte{bodyEnvelopeVersion}
+	if ret, err = gcmSeal(master, ret, dataKey, []byte(id)); err != nil {
+		return "", nil, err
+	}
+	if ret, err = gcmSeal(dataKey, ret, body, []byte{bodyEnvelopeVersion}); err != nil {
+		return "", nil, err
+	}
+	return id, ret, nil
+}
+
+// openBody decrypts an envelope made by sealBody with the key id.
+func openBody(kp KeyProvider, id string, envelope []byte) ([]byte, error) {
+	if kp == nil {
+		return nil, ErrUnknownBodyKey(id)
+	}
+	if len(envelope) == 0 || envelope[0] != bodyEnvelopeVersion {
+		return nil, ErrBadBodyEnvelope
+	}
+	master, err := kp.BodyKey(id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, rest, err := gcmOpen(master, envelope[1:], wrappedKeySize, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := gcmOpen(dataKey, rest, -1, []byte{bodyEnvelopeVersion})
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return body, nil
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+const testKeyFile = `
+# Test keys; never use these for real.
+k1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f
+k2 202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f
+`
+
+func readTestKeyFile(t *testing.T, s string) *KeyFile {
+	kf, err := ReadKeyFile(strings.NewReader(s))
+	require.Nil(t, err, "no error from ReadKeyFile")
+	return kf
+}
+
+func TestReadKeyFile(t *testing.T) {
+	kf := readTestKeyFile(t, testKeyFile)
+	id, key, err := kf.CurrentBodyKey()
+	require.Nil(t, err, "no error from CurrentBodyKey")
+	require.Equal(t, "k2", id, "the last key is current")
+	require.Equal(t, byte(0x20), key[0], "current key")
+	key, err = kf.BodyKey("k1")
+	require.Nil(t, err, "no error from BodyKey")
+	require.Equal(t, byte(0x00), key[0], "old key")
+	_, err = kf.BodyKey("k3")
+	require.IsType(t, ErrUnknownBodyKey(""), err, "unknown key")
+
+	for _, bad := range []string{"", "# nothing\n", "k1\n", "k1 00ff\n", "k1 zz\n",
+		"k1 " + strings.Repeat("00", 32) + "\nk1 " + strings.Repeat("11", 32) + "\n"} {
+		_, err = ReadKeyFile(strings.NewReader(bad))
+		require.IsType(t, ErrBadKeyFile(""), err, "bad key file %q", bad)
+	}
+}
+
+func TestBodyEnvelope(t *testing.T) {
+	kf := readTestKeyFile(t, testKeyFile)
+	id, sealed, err := sealBody(kf, []byte("hello"))
+	require.Nil(t, err, "no error from sealBody")
+	require.Equal(t, "k2", id, "sealed with the current key")
+	require.False(t, strings.Contains(string(sealed), "hello"), "body isn't in the clear")
+	body, err := openBody(kf, id, sealed)
+	require.Nil(t, err, "no error from openBody")
+	require.Equal(t, "hello", string(body), "round trip")
+
+	_, err = openBody(kf, "k1", sealed)
+	require.Equal(t, ErrBadBodyEnvelope, err, "wrong key")
+	sealed[len(sealed)-1] ^= 1
+	_, err = openBody(kf, id, sealed)
+	require.Equal(t, ErrBadBodyEnvelope, err, "tampered body")
+	_, err = openBody(nil, id, sealed)
+	require.IsType(t, ErrUnknownBodyKey(""), err, "no keys")
+
+	_, sealed, err = sealBody(kf, []byte{})
+	require.Nil(t, err, "no error sealing an empty body")
+	body, err = openBody(kf, id, sealed)
+	require.Nil(t, err, "no error opening an empty body")
+	require.Equal(t, 0, len(body), "empty body")
+}
+
+// countBodyKeys counts the bodies stored in each table that are encrypted
+// with each key, where "" is in the clear.
+func countBodyKeys(t *testing.T, db *sql.DB) map[string]int {
+	ret := make(map[string]int)
+	for _, bt := range bodyTables {
+		rows, err := db.Query("SELECT body_key FROM " + bt.table + " WHERE body IS NOT NULL")
+		require.Nil(t, err, "no error from Query")
+		for rows.Next() {
+			var id sql.NullString
+			require.Nil(t, rows.Scan(&id), "no error from Scan")
+			ret[id.String]++
+		}
+		require.Nil(t, rows.Err(), "no error from rows")
+		rows.Close()
+	}
+	return ret
+}
+
+func newTestSQLEngine(t *testing.T, db *sql.DB, cl clockwork.Clock, kp KeyProvider) *SQLEngine {
+	eng, err := NewSQLEngineFor("sqlite3", db, test.TestObjFactory{}, cl)
+	require.Nil(t, err, "no error from NewSQLEngineFor")
+	eng.SetOOBRetention(testOOBRetention)
+	if kp != nil {
+		eng.SetBodyKeys(kp)
+	}
+	return eng
+}
+
+func TestSQLEngineBodyEncryption(t *testing.T) {
+	name := "./gregor_bodykeys.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := createDb("sqlite3", name)
+	if db != nil {
+		defer db.Close()
+	}
+	require.Nil(t, err, "no error from createDb")
+
+	cl := clockwork.NewFakeClock()
+	eng := newTestSQLEngine(t, db, cl, readTestKeyFile(t, testKeyFile))
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	test.TestStateMachineOutOfBand(t, eng, cl)
+
+	counts := countBodyKeys(t, db)
+	require.Equal(t, 0, counts[""], "nothing stored in the clear")
+	require.NotEqual(t, 0, counts["k2"], "bodies encrypted with the current key")
+
+	// An engine without the keys can't read the bodies back.
+	users, err := eng.Users()
+	require.Nil(t, err, "no error from Users")
+	require.NotEqual(t, 0, len(users), "some users")
+	_, err = newTestSQLEngine(t, db, cl, nil).State(users[0], nil, nil)
+	var unknown ErrUnknownBodyKey
+	require.True(t, errors.As(err, &unknown), "can't decrypt without keys")
+}
+
+// stateBodies returns the bodies of the Items in the State of each of users.
+func stateBodies(t *testing.T, sm gregor.StateMachine, users []gregor.UID) []string {
+	var ret []string
+	for _, u := range users {
+		st, err := sm.State(u, nil, nil)
+		require.Nil(t, err, "no error from State")
+		items, err := st.Items()
+		require.Nil(t, err, "no error from Items")
+		for _, i := range items {
+			ret = append(ret, string(i.Body().Bytes()))
+		}
+	}
+	return ret
+}
+
+func TestSQLEngineRotateBodyKeys(t *testing.T) {
+	name := "./gregor_rotate.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := createDb("sqlite3", name)
+	if db != nil {
+		defer db.Close()
+	}
+	require.Nil(t, err, "no error from createDb")
+
+	// Store some bodies in the clear, and some under k1, and then rotate
+	// everything to k2.
+	cl := clockwork.NewFakeClock()
+	plain := newTestSQLEngine(t, db, cl, nil)
+	_, err = plain.RotateBodyKeys()
+	require.Equal(t, ErrNoBodyKeys, err, "can't rotate without keys")
+	test.TestStateMachineAllDevices(t, plain, cl)
+	k1 := newTestSQLEngine(t, db, cl, readTestKeyFile(t, testKeyFile[:strings.Index(testKeyFile, "k2")]))
+	test.TestStateMachineItemUpdate(t, k1, cl)
+	require.Nil(t, k1.ConsumeMessage(makeOutOfBand(t, "kbfs.favorites", "queued")), "no error from ConsumeMessage")
+	counts := countBodyKeys(t, db)
+	require.NotEqual(t, 0, counts[""], "some bodies in the clear")
+	require.NotEqual(t, 0, counts["k1"], "some bodies under k1")
+
+	users, err := plain.Users()
+	require.Nil(t, err, "no error from Users")
+	before := stateBodies(t, newTestSQLEngine(t, db, cl, readTestKeyFile(t, testKeyFile)), users)
+
+	eng := newTestSQLEngine(t, db, cl, readTestKeyFile(t, testKeyFile))
+	n, err := eng.RotateBodyKeys()
+	require.Nil(t, err, "no error from RotateBodyKeys")
+	require.Equal(t, counts[""]+counts["k1"], n, "everything re-encrypted")
+	require.Equal(t, map[string]int{"k2": n}, countBodyKeys(t, db), "everything under k2")
+
+	n, err = eng.RotateBodyKeys()
+	require.Nil(t, err, "no error from a second RotateBodyKeys")
+	require.Equal(t, 0, n, "nothing left to do")
+
+	// k1 is no longer needed.
+	k2 := newTestSQLEngine(t, db, cl, readTestKeyFile(t, testKeyFile[strings.Index(testKeyFile, "k2"):]))
+	require.Equal(t, before, stateBodies(t, k2, users), "same bodies after rotation")
+	oobms, err := k2.QueuedOutOfBandMessages(makeOutOfBand(t, "", "").ToOutOfBandMessage().UID())
+	require.Nil(t, err, "no error from QueuedOutOfBandMessages")
+	require.Equal(t, 1, len(oobms), "queued message")
+	require.Equal(t, "queued", string(oobms[0].Body().Bytes()), "queued message body")
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+)
+
+// bindType is the style of placeholder that an engine expects for query
+// parameters. All of our queries are written with ?-style placeholders, and
+// rewritten by rebind as needed.
+type bindType int
+
+const (
+	bindQuestion bindType = iota // MySQL and SQLite: ?, ?, ...
+	bindDollar                   // PostgreSQL: $1, $2, ...
+)
+
+// rebind rewrites the ?-style placeholders in q into the given style. Our
+// queries never contain a literal '?', so there's no need to parse out
+// quoted strings.
+func rebind(bt bindType, q string) string {
+	if bt != bindDollar {
+		return q
+	}
+	var b bytes.Buffer
+	n := 0
+	for {
+		i := strings.IndexByte(q, '?')
+		if i < 0 {
+			break
+		}
+		n++
+		b.WriteString(q[:i])
+		b.WriteString("$" + strconv.Itoa(n))
+		q = q[i+1:]
+	}
+	b.WriteString(q)
+	return b.String()
+}
+
+// dialect ties together the parts of SQLEngine that differ from one database
+// engine to the next: how times are written into queries, and the DDL
+// for the columns they're stored in. The two have to agree for timeScanner
+// to read back what sqlTimeWriter wrote. adopt, if set, fixes up the
+// tables of an unversioned database before it's recorded as version 1.
+type dialect struct {
+	stw        sqlTimeWriter
+	bt         bindType
+	migrations []migration
+	adopt      func(tx *sql.Tx) error
+}
+
+// dialects maps database/sql driver names to their dialects.
+var dialects = map[string]dialect{
+	"mysql":    {stw: mysqlTimeWriter{}, bt: bindQuestion, migrations: mysqlMigrations},
+	"sqlite3":  {stw: sqliteTimeWriter{}, bt: bindQuestion, migrations: sqliteMigrations, adopt: adoptSQLite},
+	"postgres": {stw: postgresTimeWriter{}, bt: bindDollar, migrations: postgresMigrations},
+}
+
+func lookupDialect(engine string) (dialect, error) {
+	d, ok := dialects[engine]
+	if !ok {
+		return dialect{}, ErrUnknownEngine(engine)
+	}
+	return d, nil
+}
+
+// NewSQLEngineFor makes a new SQLEngine on top of d, which must have been
+// opened with the given database/sql driver name and set up with Migrate.
+func NewSQLEngineFor(engine string, d *sql.DB, of gregor.ObjFactory, cl clockwork.Clock) (*SQLEngine, error) {
+	dl, err := lookupDialect(engine)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewSQLEngine(d, of, dl.stw, cl)
+	ret.bt = dl.bt
+	return ret, nil
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// UserExportFormat and UserExportVersion identify the files written by
+// WriteUserExport. The version is bumped whenever the format changes in a
+// way that older readers wouldn't understand.
+const (
+	UserExportFormat  = "gregor-user-export"
+	UserExportVersion = 1
+)
+
+// ErrBadUserExport is returned for exports that can't be read or imported.
+type ErrBadUserExport string
+
+func (e ErrBadUserExport) Error() string { return "bad user export: " + string(e) }
+
+// UserExport is a user's message log, as kept by a storage engine: every
+// creation, dismissal, update and sync message it still has for them, with
+// their original ctimes and HLCs, in HLC order. Importing it into another
+// engine reproduces the user's State there. Items are exported as they
+// stand, so their notify times are only those that haven't come due yet,
+// and an engine that doesn't keep original messages exports an Item's
+// current DTime and Body. Out-of-band messages still queued for the user come along
+// in OutOfBand, from engines that queue them.
+type UserExport struct {
+	Format    string       `json:"format"`
+	Version   int          `json:"version"`
+	UID       string       `json:"uid"`
+	Exported  time.Time    `json:"exported"`
+	Messages  []*msgRecord `json:"messages"`
+	OutOfBand []*oobRecord `json:"oob,omitempty"`
+}
+
+// UserExporter is implemented by engines that can export a user's message
+// log, and import one exported from another engine. Messages that are
+// already there are taken as replays, so importing fails with
+// ErrMsgIDConflict if they differ. Queued out-of-band messages that are
+// already there are skipped, and engines that don't queue them ignore them.
+type UserExporter interface {
+	Export(u gregor.UID) (*UserExport, error)
+	Import(e *UserExport) error
+}
+
+var _ UserExporter = (*MemEngine)(nil)
+var _ UserExporter = (*SQLEngine)(nil)
+var _ UserExporter = (*KVEngine)(nil)
+var _ UserExporter = (*ShardedEngine)(nil)
+
+// msgRecordsByHLC orders messages by the HLCs that order them in the log,
+// and then by MsgID.
+type msgRecordsByHLC [](*msgRecord)
+
+func (l msgRecordsByHLC) Len() int      { return len(l) }
+func (l msgRecordsByHLC) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l msgRecordsByHLC) Less(i, j int) bool {
+	hi, hj := gregor.OrderingHLC(l[i], l[i].CTime_), gregor.OrderingHLC(l[j], l[j].CTime_)
+	if hi != hj {
+		return hi < hj
+	}
+	return bytes.Compare(l[i].MsgID_, l[j].MsgID_) < 0
+}
+
+// newUserExport makes the export of the messages msgs for the user u, as of
+// now.
+func newUserExport(u gregor.UID, now time.Time, msgs [](*msgRecord)) *UserExport {
+	sort.Sort(msgRecordsByHLC(msgs))
+	return &UserExport{
+		Format:   UserExportFormat,
+		Version:  UserExportVersion,
+		UID:      hexEnc(u),
+		Exported: now,
+		Messages: msgs,
+	}
+}
+
+// uid returns the user e is for. It must already have been checked.
+func (e *UserExport) uid() gregor.UID {
+	b, _ := hex.DecodeString(e.UID)
+	return recBytes(b)
+}
+
+// check returns an error unless e is an export we know how to import, all
+// for the one user.
+func (e *UserExport) check() error {
+	if e.Format != UserExportFormat {
+		return ErrBadUserExport(fmt.Sprintf("not a user export (format %q)", e.Format))
+	}
+	if e.Version != UserExportVersion {
+		return ErrBadUserExport(fmt.Sprintf("unknown version %d", e.Version))
+	}
+	if b, err := hex.DecodeString(e.UID); err != nil || len(b) == 0 {
+		return ErrBadUserExport(fmt.Sprintf("bad UID %q", e.UID))
+	}
+	for _, m := range e.Messages {
+		switch {
+		case m == nil:
+			return ErrBadUserExport("empty message")
+		case hexEnc(m.UID_) != e.UID:
+			return ErrBadUserExport(fmt.Sprintf("message %s is for another user", hexEnc(m.MsgID_)))
+		case len(m.MsgID_) == 0:
+			return ErrBadUserExport("message without a MsgID")
+		case m.CTime_.IsZero():
+			return ErrBadUserExport(fmt.Sprintf("message %s has no ctime", hexEnc(m.MsgID_)))
+		}
+	}
+	for _, o := range e.OutOfBand {
+		switch {
+		case o == nil:
+			return ErrBadUserExport("empty out-of-band message")
+		case hexEnc(o.UID_) != e.UID:
+			return ErrBadUserExport("out-of-band message for another user")
+		case len(o.System_) == 0:
+			return ErrBadUserExport("out-of-band message without a system")
+		}
+	}
+	return nil
+}
+
+// WriteUserExport writes e to w as JSON.
+func WriteUserExport(w io.Writer, e *UserExport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(e)
+}
+
+// ReadUserExport reads an export written by WriteUserExport from r, and
+// checks that it can be imported.
+func ReadUserExport(r io.Reader) (*UserExport, error) {
+	var e UserExport
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, ErrBadUserExport(err.Error())
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
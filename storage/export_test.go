@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTripExport writes e out and reads it back in.
+func roundTripExport(t *testing.T, e *UserExport) *UserExport {
+	var buf bytes.Buffer
+	require.Nil(t, WriteUserExport(&buf, e), "no error from WriteUserExport")
+	ret, err := ReadUserExport(&buf)
+	require.Nil(t, err, "no error from ReadUserExport")
+	return ret
+}
+
+// dumpStates renders the State of the user that e is for, as seen by each
+// device mentioned in e and by all devices, as of the time of each message
+// in e and now.
+func dumpStates(t *testing.T, sm gregor.StateMachine, e *UserExport) []string {
+	devs := []gregor.DeviceID{nil}
+	times := []*time.Time{nil}
+	for _, m := range e.Messages {
+		if m.DeviceID_ != nil {
+			devs = append(devs, m.DeviceID_)
+		}
+		if m.Dismissal_ != nil {
+			for _, fd := range m.Dismissal_.ForDevices_ {
+				devs = append(devs, fd.DeviceID_)
+			}
+		}
+		ctime := m.CTime_
+		times = append(times, &ctime)
+	}
+	var ret []string
+	for _, d := range devs {
+		for _, tm := range times {
+			var at gregor.TimeOrOffset
+			if tm != nil {
+				at = timeOrOffset(*tm)
+			}
+			st, err := sm.State(e.uid(), d, at)
+			require.Nil(t, err, "no error from State")
+			items, err := st.Items()
+			require.Nil(t, err, "no error from Items")
+			for _, i := range items {
+				md := i.Metadata()
+				ret = append(ret, fmt.Sprintf("%x %v %x %s %s %q", msgIDBytes(d), tm, md.MsgID().Bytes(),
+					md.CTime().UTC(), i.Category(), i.Body().Bytes()))
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestUserExportRoundTrip(t *testing.T) {
+	name := "./gregor_export.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := createDb("sqlite3", name)
+	if db != nil {
+		defer db.Close()
+	}
+	require.Nil(t, err, "no error from createDb")
+	dir, err := ioutil.TempDir("", "gregor_export")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	cl := clockwork.NewFakeClock()
+	mem := NewMemEngine(test.TestObjFactory{}, cl)
+	test.TestStateMachineAllDevices(t, mem, cl)
+	test.TestStateMachinePerDevice(t, mem, cl)
+	test.TestStateMachineReminders(t, mem, cl)
+	test.TestStateMachineReorder(t, mem, cl)
+	test.TestStateMachineSync(t, mem, cl)
+	test.TestStateMachineDeviceDismissal(t, mem, cl)
+	test.TestStateMachineItemUpdate(t, mem, cl)
+	require.Nil(t, mem.ConsumeMessage(makePendingUpdate(t)), "no error from ConsumeMessage")
+
+	sqlEng := newTestSQLEngine(t, db, cl, nil)
+	kv := newTestKVEngine(t, filepath.Join(dir, "gregor.kv"), cl)
+	defer kv.Close()
+	users, err := mem.Users()
+	require.Nil(t, err, "no error from Users")
+	require.NotEqual(t, 0, len(users), "some users")
+	for _, u := range users {
+		e, err := mem.Export(u)
+		require.Nil(t, err, "no error from Export")
+		require.NotEqual(t, 0, len(e.Messages), "some messages")
+		e = roundTripExport(t, e)
+		want := dumpStates(t, mem, e)
+
+		// MemEngine to SQLEngine and KVEngine.
+		require.Nil(t, sqlEng.Import(e), "no error from Import")
+		require.Equal(t, want, dumpStates(t, sqlEng, e), "same states in SQL")
+		require.Nil(t, kv.Import(e), "no error from Import")
+		require.Equal(t, want, dumpStates(t, kv, e), "same states in KV")
+
+		// And back from SQLEngine to a fresh MemEngine.
+		fromSQL, err := sqlEng.Export(u)
+		require.Nil(t, err, "no error from Export")
+		require.Equal(t, len(e.Messages), len(fromSQL.Messages), "same messages from SQL")
+		fromSQL = roundTripExport(t, fromSQL)
+		mem2 := NewMemEngine(test.TestObjFactory{}, cl)
+		require.Nil(t, mem2.Import(fromSQL), "no error from Import")
+		require.Equal(t, want, dumpStates(t, mem2, e), "same states after SQL")
+
+		// Importing the same messages again changes nothing.
+		require.Nil(t, sqlEng.Import(e), "no error from a second Import")
+		require.Equal(t, want, dumpStates(t, sqlEng, e), "same states after a second Import")
+	}
+}
+
+func TestReadUserExport(t *testing.T) {
+	mem := NewMemEngine(test.TestObjFactory{}, clockwork.NewFakeClock())
+	require.Nil(t, mem.ConsumeMessage(makeCreation(t, "r1", "a")), "no error from ConsumeMessage")
+	u, _ := test.TestObjFactory{}.MakeUID([]byte("replay user"))
+	e, err := mem.Export(u)
+	require.Nil(t, err, "no error from Export")
+	var buf bytes.Buffer
+	require.Nil(t, WriteUserExport(&buf, e), "no error from WriteUserExport")
+	good := buf.String()
+
+	for _, bad := range []string{
+		"",
+		"[]",
+		strings.Replace(good, UserExportFormat, "gregor-something-else", 1),
+		strings.Replace(good, `"version": 1`, `"version": 2`, 1),
+		strings.Replace(good, `"uid": "`, `"uid": "00`, 1),
+		strings.Replace(good, `"uid": "`, `"uid": "x`, 1),
+	} {
+		_, err := ReadUserExport(strings.NewReader(bad))
+		require.IsType(t, ErrBadUserExport(""), err, "bad export %q", bad)
+	}
+}
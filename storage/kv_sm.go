@@ -0,0 +1,730 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrBadKVRecord is returned when a KVEngine finds a record in its file that
+// doesn't make sense.
+type ErrBadKVRecord string
+
+func (e ErrBadKVRecord) Error() string { return "bad key-value record: " + string(e) }
+
+// KVEngine is a StateMachine kept in a single file by an embedded, pure-Go
+// key-value store, for clients that want their state to survive restarts
+// without a database server or cgo. Each user's records are kept together
+// under keys that start with their UID, in these buckets:
+//
+//	messages    uid/ctime/msgid  every in-band message, in ctime order
+//	msgids      uid/msgid        the ctime of each message, to find it by ID
+//	items       uid/msgid        each Item, with its dismissals and updates
+//	dismissals  uid/msgid        dismissals of Items that may not exist yet
+//	ranges      uid/msgid        the ranges dismissed by each message
+//	updates     uid/msgid/msgid  updates to Items that don't exist yet
+//
+// Out-of-band messages aren't kept. Use SetQuotas to bound how many Items
+// each user can have.
+type KVEngine struct {
+	db         *bolt.DB
+	objFactory gregor.ObjFactory
+	clock      clockwork.Clock
+	quotas     Quotas
+}
+
+var (
+	kvMessages   = []byte("messages")
+	kvMsgIDs     = []byte("msgids")
+	kvItems      = []byte("items")
+	kvDismissals = []byte("dismissals")
+	kvRanges     = []byte("ranges")
+	kvUpdates    = []byte("updates")
+
+	kvBuckets = [][]byte{kvMessages, kvMsgIDs, kvItems, kvDismissals, kvRanges, kvUpdates}
+)
+
+var _ gregor.StateMachine = (*KVEngine)(nil)
+var _ gregor.InBandMessagePager = (*KVEngine)(nil)
+var _ gregor.SyncCheckpointer = (*KVEngine)(nil)
+var _ gregor.StateDiffer = (*KVEngine)(nil)
+var _ gregor.CategoryStater = (*KVEngine)(nil)
+
+// NewKVEngine opens the KVEngine kept in the file at path, creating it if
+// need be. Only one KVEngine can have a file open at once. Call Close when
+// done with it.
+func NewKVEngine(path string, f gregor.ObjFactory, cl clockwork.Clock) (*KVEngine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range kvBuckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &KVEngine{db: db, objFactory: f, clock: cl}, nil
+}
+
+// Close closes the engine's file. The engine mustn't be used afterwards.
+func (k *KVEngine) Close() error {
+	return k.db.Close()
+}
+
+// kvItem is an Item as it's kept in the items bucket: the message that
+// created it, and what's happened to it since.
+type kvItem struct {
+	Msg  *msgRecord    `json:"msg"`
+	Item *itemSnapshot `json:"item"`
+}
+
+// kvDismissal is a dismissal by MsgID, for all devices and for single
+// devices, keyed by their hex-encoded DeviceIDs. Only the earliest of each
+// is kept.
+type kvDismissal struct {
+	DTime   *time.Time           `json:"dtime,omitempty"`
+	Devices map[string]time.Time `json:"devices,omitempty"`
+}
+
+// kvUserKey makes a key for the user u out of parts. The UID and every part
+// but the last are prefixed with their lengths, so that keys with the same
+// leading parts share a prefix, and keys sharing a prefix sort by the last
+// part as is. Pass an empty last part to make a prefix to scan.
+func kvUserKey(u gregor.UID, parts ...[]byte) []byte {
+	parts = append([][]byte{u.Bytes()}, parts...)
+	var ret []byte
+	for j, p := range parts {
+		if j < len(parts)-1 {
+			var n [2]byte
+			binary.BigEndian.PutUint16(n[:], uint16(len(p)))
+			ret = append(ret, n[:]...)
+		}
+		ret = append(ret, p...)
+	}
+	return ret
+}
+
+// kvTime encodes t so that encoded times sort in order.
+func kvTime(t time.Time) []byte {
+	var ret [8]byte
+	binary.BigEndian.PutUint64(ret[:], uint64(t.UnixNano())^(1<<63))
+	return ret[:]
+}
+
+func kvPut(b *bolt.Bucket, key []byte, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, raw)
+}
+
+// kvGet reads the value at key into v, and returns false if there isn't one.
+func kvGet(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	raw := b.Get(key)
+	if raw == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, ErrBadKVRecord(fmt.Sprintf("%x: %v", key, err))
+	}
+	return true, nil
+}
+
+// kvScan calls fn on each key and value in b that starts with prefix, in
+// order. fn mustn't change b; collect the changes and make them after.
+func kvScan(b *bolt.Bucket, prefix []byte, fn func(key, v []byte) error) error {
+	c := b.Cursor()
+	for key, v := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, v = c.Next() {
+		if err := fn(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KVEngine) getItem(tx *bolt.Tx, u gregor.UID, m gregor.MsgID) (*kvItem, *item, error) {
+	var ki kvItem
+	found, err := kvGet(tx.Bucket(kvItems), kvUserKey(u, msgIDBytes(m)), &ki)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	i, err := ki.toItem()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ki, i, nil
+}
+
+func (ki *kvItem) toItem() (*item, error) {
+	if ki.Msg == nil || ki.Msg.Creation() == nil || ki.Item == nil {
+		return nil, ErrBadKVRecord("item without a creation")
+	}
+	return ki.Item.toItem(ki.Msg.Creation()), nil
+}
+
+func (k *KVEngine) putItem(tx *bolt.Tx, u gregor.UID, ki *kvItem, i *item) error {
+	ki.Item = newItemSnapshot(i)
+	return kvPut(tx.Bucket(kvItems), kvUserKey(u, msgIDBytes(ki.Msg.MsgID())), ki)
+}
+
+func (k *KVEngine) ConsumeMessage(m gregor.Message) error {
+	ibm := m.ToInBandMessage()
+	if ibm == nil {
+		return nil
+	}
+	u := gregor.UIDFromMessage(m)
+	return k.db.Update(func(tx *bolt.Tx) error {
+		if err := k.enforceQuotas(tx, u, ibm); err != nil {
+			return err
+		}
+		return k.consumeInBandMessage(tx, u, ibm)
+	})
+}
+
+// SetQuotas sets the quotas that the engine enforces as it consumes
+// messages. It should be called before the engine is used.
+func (k *KVEngine) SetQuotas(q Quotas) {
+	k.quotas = q
+}
+
+// enforceQuotas checks msg against the engine's quotas, and consumes any
+// dismissals needed to make room for it, in the same transaction.
+func (k *KVEngine) enforceQuotas(tx *bolt.Tx, u gregor.UID, msg gregor.InBandMessage) error {
+	if !k.quotas.appliesTo(msg) {
+		return nil
+	}
+	if replay, err := k.isReplay(tx, u, msg.Metadata(), messageDigest(msg)); err != nil || replay {
+		// consumeInBandMessage deals with these.
+		return nil
+	}
+	user, err := k.userIn(tx, u)
+	if err != nil {
+		return err
+	}
+	now := k.clock.Now()
+	ds, err := k.quotas.check(k.objFactory, now, userLiveItems{u: user, f: k.objFactory, now: now}, msg)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if err := k.consumeInBandMessage(tx, u, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KVEngine) consumeInBandMessage(tx *bolt.Tx, u gregor.UID, msg gregor.InBandMessage) error {
+	digest := messageDigest(msg)
+	if replay, err := k.isReplay(tx, u, msg.Metadata(), digest); err != nil || replay {
+		return err
+	}
+	now := k.clock.Now()
+	if md := msg.Metadata(); md.CTime().IsZero() {
+		md.SetCTime(now)
+	}
+	ctime := nowIfZero(now, msg.Metadata().CTime())
+	rec := newMsgRecord(msg, ctime)
+	mid := msgIDBytes(rec.MsgID())
+	logged := loggedMsgSnapshot{Msg: rec, CTime: ctime, Digest: digest}
+	if err := kvPut(tx.Bucket(kvMessages), kvUserKey(u, kvTime(ctime), mid), logged); err != nil {
+		return err
+	}
+	if err := tx.Bucket(kvMsgIDs).Put(kvUserKey(u, mid), kvTime(ctime)); err != nil {
+		return err
+	}
+
+	sum := rec.ToStateUpdateMessage()
+	if sum == nil {
+		return nil
+	}
+	if sum.Creation() != nil {
+		if err := k.consumeCreation(tx, u, rec, now); err != nil {
+			return err
+		}
+	}
+	if sum.Dismissal() != nil {
+		if err := k.consumeDismissal(tx, u, mid, sum.Dismissal(), ctime, rec.HLC()); err != nil {
+			return err
+		}
+	}
+	if sum.Update() != nil {
+		if err := k.consumeUpdate(tx, u, sum.Update(), rec.MsgID(), ctime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isReplay returns true if we've already consumed a message with the given
+// MsgID and digest, or ErrMsgIDConflict if we've consumed a different
+// message with the same MsgID.
+func (k *KVEngine) isReplay(tx *bolt.Tx, u gregor.UID, md gregor.Metadata, digest string) (bool, error) {
+	if md.MsgID() == nil {
+		return false, nil
+	}
+	logged, err := k.findLogged(tx, u, md.MsgID())
+	if err != nil || logged == nil {
+		return false, err
+	}
+	if logged.Digest != digest {
+		return false, ErrMsgIDConflict{UID: md.UID(), MsgID: md.MsgID()}
+	}
+	return true, nil
+}
+
+// findLogged returns the message with the MsgID m, or nil if there isn't one.
+func (k *KVEngine) findLogged(tx *bolt.Tx, u gregor.UID, m gregor.MsgID) (*loggedMsgSnapshot, error) {
+	ctime := tx.Bucket(kvMsgIDs).Get(kvUserKey(u, m.Bytes()))
+	if ctime == nil {
+		return nil, nil
+	}
+	var ret loggedMsgSnapshot
+	found, err := kvGet(tx.Bucket(kvMessages), kvUserKey(u, ctime, m.Bytes()), &ret)
+	if err != nil {
+		return nil, err
+	}
+	if !found || ret.Msg == nil {
+		return nil, ErrBadKVRecord(fmt.Sprintf("message %s isn't where its ID says", hexEnc(m)))
+	}
+	return &ret, nil
+}
+
+// consumeCreation adds the Item rec creates, and applies whatever updates
+// and dismissals of it arrived first.
+func (k *KVEngine) consumeCreation(tx *bolt.Tx, u gregor.UID, rec *msgRecord, now time.Time) error {
+	c := rec.Creation()
+	i := newItem(now, c)
+	mid := msgIDBytes(rec.MsgID())
+
+	updates := tx.Bucket(kvUpdates)
+	var applied [][]byte
+	err := kvScan(updates, kvUserKey(u, mid, nil), func(key, v []byte) error {
+		var up appliedUpdate
+		if err := json.Unmarshal(v, &up); err != nil {
+			return ErrBadKVRecord(fmt.Sprintf("update %x: %v", key, err))
+		}
+		i.applyUpdate(&up)
+		applied = append(applied, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range applied {
+		if err := updates.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	var d kvDismissal
+	if _, err := kvGet(tx.Bucket(kvDismissals), kvUserKey(u, mid), &d); err != nil {
+		return err
+	}
+	if d.DTime != nil {
+		i.dismissAt(*d.DTime)
+	}
+	for dev, dtime := range d.Devices {
+		i.dismissForDeviceAt(dev, dtime)
+	}
+
+	err = kvScan(tx.Bucket(kvRanges), kvUserKey(u, nil), func(key, v []byte) error {
+		var rs []dismissedRangeSnapshot
+		if err := json.Unmarshal(v, &rs); err != nil {
+			return ErrBadKVRecord(fmt.Sprintf("ranges %x: %v", key, err))
+		}
+		for _, r := range rs {
+			if gregor.CategoryMatches(r.Category, c.Category().String()) && r.toRange().covers(i.ctime, i.hlc) {
+				i.dismissAt(r.DTime)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return k.putItem(tx, u, &kvItem{Msg: rec}, i)
+}
+
+// updateDismissal applies fn to the dismissal of the MsgID m, and to its
+// Item if it's arrived.
+func (k *KVEngine) updateDismissal(tx *bolt.Tx, u gregor.UID, m gregor.MsgID, fn func(*kvDismissal, *item)) error {
+	b := tx.Bucket(kvDismissals)
+	key := kvUserKey(u, m.Bytes())
+	var d kvDismissal
+	if _, err := kvGet(b, key, &d); err != nil {
+		return err
+	}
+	ki, i, err := k.getItem(tx, u, m)
+	if err != nil {
+		return err
+	}
+	fn(&d, i)
+	if err := kvPut(b, key, d); err != nil {
+		return err
+	}
+	if i == nil {
+		return nil
+	}
+	return k.putItem(tx, u, ki, i)
+}
+
+func (k *KVEngine) consumeDismissal(tx *bolt.Tx, u gregor.UID, mid []byte, d gregor.Dismissal, dtime time.Time, h gregor.HLC) error {
+	for _, id := range d.MsgIDsToDismiss() {
+		err := k.updateDismissal(tx, u, id, func(d *kvDismissal, i *item) {
+			if d.DTime == nil || dtime.Before(*d.DTime) {
+				d.DTime = &dtime
+			}
+			if i != nil {
+				i.dismissAt(dtime)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, fd := range d.MsgIDsToDismissForDevice() {
+		if fd.MsgID() == nil || fd.DeviceID() == nil {
+			continue
+		}
+		dev := hex.EncodeToString(fd.DeviceID().Bytes())
+		err := k.updateDismissal(tx, u, fd.MsgID(), func(d *kvDismissal, i *item) {
+			if t, found := d.Devices[dev]; !found || dtime.Before(t) {
+				if d.Devices == nil {
+					d.Devices = make(map[string]time.Time)
+				}
+				d.Devices[dev] = dtime
+			}
+			if i != nil {
+				i.dismissForDeviceAt(dev, dtime)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if rs := d.RangesToDismiss(); len(rs) > 0 {
+		return k.dismissRanges(tx, u, mid, rs, dtime, h)
+	}
+	return nil
+}
+
+// dismissRanges records the ranges rs dismissed by the message mid, for
+// Items that arrive later, and dismisses the Items in them now.
+func (k *KVEngine) dismissRanges(tx *bolt.Tx, u gregor.UID, mid []byte, rs []gregor.MsgRange, dtime time.Time, h gregor.HLC) error {
+	var snaps []dismissedRangeSnapshot
+	for _, r := range rs {
+		end := toTime(dtime, r.EndTime())
+		snaps = append(snaps, dismissedRangeSnapshot{
+			Category: r.Category().String(),
+			End:      end,
+			HLC:      rangeHLC(end, dtime, h),
+			DTime:    dtime,
+		})
+	}
+	if err := kvPut(tx.Bucket(kvRanges), kvUserKey(u, mid), snaps); err != nil {
+		return err
+	}
+
+	var dismissed []*kvItem
+	var items [](*item)
+	err := kvScan(tx.Bucket(kvItems), kvUserKey(u, nil), func(key, v []byte) error {
+		var ki kvItem
+		if err := json.Unmarshal(v, &ki); err != nil {
+			return ErrBadKVRecord(fmt.Sprintf("item %x: %v", key, err))
+		}
+		i, err := ki.toItem()
+		if err != nil {
+			return err
+		}
+		for _, r := range snaps {
+			if gregor.CategoryMatches(r.Category, i.item.Category().String()) && r.toRange().covers(i.ctime, i.hlc) {
+				i.dismissAt(dtime)
+				dismissed = append(dismissed, &ki)
+				items = append(items, i)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for j, ki := range dismissed {
+		if err := k.putItem(tx, u, ki, items[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumeUpdate applies the update up, from the message m, to its Item, or
+// keeps it until the Item arrives.
+func (k *KVEngine) consumeUpdate(tx *bolt.Tx, u gregor.UID, up gregor.ItemUpdate, m gregor.MsgID, ctime time.Time) error {
+	if up.MsgID() == nil {
+		return nil
+	}
+	au := newAppliedUpdate(up, m, ctime)
+	ki, i, err := k.getItem(tx, u, up.MsgID())
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		return kvPut(tx.Bucket(kvUpdates), kvUserKey(u, up.MsgID().Bytes(), msgIDBytes(m)), au)
+	}
+	i.applyUpdate(au)
+	return k.putItem(tx, u, ki, i)
+}
+
+type itemsByCTime [](*item)
+
+func (l itemsByCTime) Len() int      { return len(l) }
+func (l itemsByCTime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l itemsByCTime) Less(i, j int) bool {
+	if !l[i].ctime.Equal(l[j].ctime) {
+		return l[i].ctime.Before(l[j].ctime)
+	}
+	return bytes.Compare(msgIDBytes(l[i].item.Metadata().MsgID()), msgIDBytes(l[j].item.Metadata().MsgID())) < 0
+}
+
+// itemsByHLC orders items by their HLCs, so that items with the same ctime
+// come in the order they arrived, as they do in the MemEngine.
+type itemsByHLC [](*item)
+
+func (l itemsByHLC) Len() int      { return len(l) }
+func (l itemsByHLC) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l itemsByHLC) Less(i, j int) bool {
+	if l[i].hlc != l[j].hlc {
+		return l[i].hlc < l[j].hlc
+	}
+	return bytes.Compare(msgIDBytes(l[i].item.Metadata().MsgID()), msgIDBytes(l[j].item.Metadata().MsgID())) < 0
+}
+
+// user loads the Items of the user u, in HLC order, as a user that can
+// answer questions about their State.
+func (k *KVEngine) user(u gregor.UID) (*user, error) {
+	var ret *user
+	err := k.db.View(func(tx *bolt.Tx) (err error) {
+		ret, err = k.userIn(tx, u)
+		return err
+	})
+	return ret, err
+}
+
+// userIn is user, within the transaction tx.
+func (k *KVEngine) userIn(tx *bolt.Tx, u gregor.UID) (*user, error) {
+	var items [](*item)
+	err := kvScan(tx.Bucket(kvItems), kvUserKey(u, nil), func(key, v []byte) error {
+		var ki kvItem
+		if err := json.Unmarshal(v, &ki); err != nil {
+			return ErrBadKVRecord(fmt.Sprintf("item %x: %v", key, err))
+		}
+		i, err := ki.toItem()
+		if err != nil {
+			return err
+		}
+		items = append(items, i)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(itemsByHLC(items))
+	ret := &user{items: items}
+	ret.reindex()
+	return ret, nil
+}
+
+func (k *KVEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
+	user, err := k.user(u)
+	if err != nil {
+		return nil, err
+	}
+	return user.state(k.clock.Now(), k.objFactory, d, t)
+}
+
+func (k *KVEngine) StateInCategory(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) (gregor.State, error) {
+	user, err := k.user(u)
+	if err != nil {
+		return nil, err
+	}
+	return user.stateInCategory(k.clock.Now(), k.objFactory, d, t, c)
+}
+
+func (k *KVEngine) StateDiff(u gregor.UID, d gregor.DeviceID, from, to gregor.TimeOrOffset) ([]gregor.Item, []gregor.MsgID, error) {
+	user, err := k.user(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user.stateDiff(k.clock.Now(), k.objFactory, d, from, to)
+}
+
+// loggedMsg looks up the Items the logged message ls created or updated.
+func (k *KVEngine) loggedMsg(tx *bolt.Tx, u gregor.UID, ls *loggedMsgSnapshot) (loggedMsg, error) {
+	ret := loggedMsg{m: ls.Msg, ctime: ls.CTime, hlc: gregor.OrderingHLC(ls.Msg, ls.CTime), digest: ls.Digest}
+	var err error
+	if ls.Msg.Creation() != nil {
+		if _, ret.i, err = k.getItem(tx, u, ls.Msg.MsgID()); err != nil {
+			return ret, err
+		}
+	}
+	if up := ls.Msg.Update(); up != nil && up.MsgID() != nil {
+		if _, ret.target, err = k.getItem(tx, u, up.MsgID()); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+// inBandMessages returns up to limit of the messages for the device d since
+// t, or all of them if limit is 0, starting after c if it's non-nil, along
+// with the cursor of the last one.
+func (k *KVEngine) inBandMessages(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c *msgCursor, limit int) ([]gregor.InBandMessage, *msgCursor, error) {
+	now := k.clock.Now()
+	var msgs []loggedMsg
+	err := k.db.View(func(tx *bolt.Tx) error {
+		prefix := kvUserKey(u, nil)
+		cur := tx.Bucket(kvMessages).Cursor()
+		for key, v := cur.Seek(kvUserKey(u, kvTime(toTime(now, t)), nil)); key != nil && bytes.HasPrefix(key, prefix); key, v = cur.Next() {
+			var ls loggedMsgSnapshot
+			if err := json.Unmarshal(v, &ls); err != nil || ls.Msg == nil {
+				return ErrBadKVRecord(fmt.Sprintf("message %x: %v", key, err))
+			}
+			msg, err := k.loggedMsg(tx, u, &ls)
+			if err != nil {
+				return err
+			}
+			if !isMessageForDevice(msg.m, d) || msg.isDismissedForDeviceAt(d, now) {
+				continue
+			}
+			if msg.m, err = ls.Msg.export(k.objFactory); err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The messages are keyed by ctime, so they have to be put in HLC order
+	// before we can tell where the page starts.
+	sort.Sort(loggedMsgsByHLC(msgs))
+	var ret []gregor.InBandMessage
+	var last *msgCursor
+	for _, msg := range msgs {
+		if limit > 0 && len(ret) == limit {
+			break
+		}
+		mid := msg.m.Metadata().MsgID()
+		if c != nil && c.isBefore(msg.hlc, mid) {
+			continue
+		}
+		ret = append(ret, msg.m)
+		last = newMsgCursor(msg.hlc, mid)
+	}
+	return ret, last, nil
+}
+
+func (k *KVEngine) InBandMessagesSince(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) ([]gregor.InBandMessage, error) {
+	msgs, _, err := k.inBandMessages(u, d, t, nil, 0)
+	return msgs, err
+}
+
+func (k *KVEngine) InBandMessagesPage(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, cursor []byte, limit int) ([]gregor.InBandMessage, []byte, error) {
+	if limit <= 0 {
+		return nil, nil, ErrBadPageLimit
+	}
+	c, err := decodeMsgCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs, last, err := k.inBandMessages(u, d, t, c, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msgs, nextCursor(len(msgs), limit, last), nil
+}
+
+func (k *KVEngine) InBandMessagesSinceSync(u gregor.UID, d gregor.DeviceID, sync gregor.MsgID) ([]gregor.InBandMessage, error) {
+	var marker *loggedMsgSnapshot
+	err := k.db.View(func(tx *bolt.Tx) error {
+		var err error
+		marker, err = k.findLogged(tx, u, sync)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if marker == nil || marker.Msg.ToStateSyncMessage() == nil {
+		return nil, ErrUnknownSyncMarker{UID: u, MsgID: sync}
+	}
+	msgs, _, err := k.inBandMessages(u, d, timeOrOffset(marker.CTime), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return withoutMsgID(msgs, sync), nil
+}
+
+// Export returns the messages in u's log, with the notify times of their
+// Items that haven't come due yet.
+func (k *KVEngine) Export(u gregor.UID) (*UserExport, error) {
+	var msgs [](*msgRecord)
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return kvScan(tx.Bucket(kvMessages), kvUserKey(u, nil), func(key, v []byte) error {
+			var ls loggedMsgSnapshot
+			if err := json.Unmarshal(v, &ls); err != nil || ls.Msg == nil {
+				return ErrBadKVRecord(fmt.Sprintf("message %x: %v", key, err))
+			}
+			if ls.Msg.Creation_ != nil {
+				_, i, err := k.getItem(tx, u, ls.Msg.MsgID())
+				if err != nil {
+					return err
+				}
+				if i != nil {
+					ls.Msg.setNotifyTimes(i.notifyTimes)
+				}
+			}
+			msgs = append(msgs, ls.Msg)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newUserExport(u, k.clock.Now(), msgs), nil
+}
+
+// Import consumes the messages in e, as if they'd just arrived with their
+// original ctimes, all at once.
+func (k *KVEngine) Import(e *UserExport) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	uid := e.uid()
+	return k.db.Update(func(tx *bolt.Tx) error {
+		for _, rec := range e.Messages {
+			if err := k.consumeInBandMessage(tx, uid, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
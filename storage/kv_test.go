@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKVEngine(t *testing.T, path string, cl clockwork.Clock) *KVEngine {
+	eng, err := NewKVEngine(path, test.TestObjFactory{}, cl)
+	require.Nil(t, err, "no error from NewKVEngine")
+	return eng
+}
+
+// dumpKVEngine renders the states and messages of users in k as a list of
+// strings, so that they can be compared across a restart.
+func dumpKVEngine(t *testing.T, k *KVEngine, users []gregor.UID) []string {
+	ret := stateBodies(t, k, users)
+	for _, u := range users {
+		msgs, err := k.InBandMessagesSince(u, nil, timeOrOffset(time.Time{}))
+		require.Nil(t, err, "no error from InBandMessagesSince")
+		for _, msg := range msgs {
+			ret = append(ret, string(msg.Metadata().MsgID().Bytes()))
+		}
+	}
+	return ret
+}
+
+func TestKVEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_kv")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gregor.kv")
+
+	cl := clockwork.NewFakeClock()
+	eng := newTestKVEngine(t, path, cl)
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReplay(t, eng, cl)
+	test.TestStateMachineReorder(t, eng, cl)
+	test.TestStateMachinePaging(t, eng, cl)
+	test.TestStateMachineSync(t, eng, cl)
+	test.TestStateMachineStateDiff(t, eng, cl)
+	test.TestStateMachineCategories(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	test.TestStateMachineHLC(t, eng, cl)
+	testReplayConflict(t, eng)
+	testQuotas(t, eng, cl)
+	require.Nil(t, eng.ConsumeMessage(makePendingUpdate(t)), "no error from ConsumeMessage")
+
+	// Everything is still there after a restart, including the update to
+	// an Item that hasn't arrived yet.
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("replay user"))
+	uu, _ := of.MakeUID([]byte("update user"))
+	users := []gregor.UID{u, uu}
+	want := dumpKVEngine(t, eng, users)
+	require.NotEmpty(t, want, "something to keep")
+	_, err = NewKVEngine(path, of, cl)
+	require.NotNil(t, err, "file is locked while open")
+	require.Nil(t, eng.Close(), "no error from Close")
+
+	reopened := newTestKVEngine(t, path, cl)
+	defer reopened.Close()
+	require.Equal(t, want, dumpKVEngine(t, reopened, users), "same state after a restart")
+
+	target, _ := of.MakeMsgID([]byte("missing"))
+	cat, _ := of.MakeCategory("foos")
+	b, _ := of.MakeBody([]byte("original"))
+	c, err := of.MakeItem(uu, target, nil, time.Time{}, cat, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(c)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	require.Nil(t, reopened.ConsumeMessage(msg), "no error from ConsumeMessage")
+	require.Equal(t, []string{"pending"}, stateBodies(t, reopened, []gregor.UID{uu}), "pending update applied")
+}
@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrNotDurable is returned when asking a MemEngine that wasn't made with
+// NewDurableMemEngine to snapshot itself.
+var ErrNotDurable = errors.New("MemEngine isn't durable")
+
+// ErrBadWAL is returned when a durable MemEngine's write-ahead log or
+// snapshot is corrupt, other than by a write that was cut short.
+type ErrBadWAL string
+
+func (e ErrBadWAL) Error() string { return "bad write-ahead log: " + string(e) }
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+
+	snapshotVersion = 1
+)
+
+// DurableOptions configures a MemEngine that survives restarts.
+type DurableOptions struct {
+	// Dir is where the snapshot and write-ahead log are kept. It's created
+	// if it doesn't exist yet.
+	Dir string
+
+	// SnapshotEvery is how many log entries to write before taking a new
+	// snapshot and starting over with an empty log. 0 means snapshots are
+	// only taken on calls to Snapshot or Close.
+	SnapshotEvery int
+
+	// Sync, if true, syncs each log entry to disk before it's applied.
+	// Otherwise entries can be lost if the machine (but not the process)
+	// crashes.
+	Sync bool
+}
+
+// walOp is the kind of mutation recorded in a walEntry.
+type walOp string
+
+const (
+	walOpMessage        walOp = "msg"
+	walOpDeleteReminder walOp = "delete_reminder"
+	walOpPrune          walOp = "prune"
+	walOpDeleteUser     walOp = "delete_user"
+	walOpTrimLog        walOp = "trim_log"
+	walOpOutOfBand      walOp = "oob"
+)
+
+// walEntry is a single line in the write-ahead log. Which of its fields are
+// set depends on Op.
+type walEntry struct {
+	Seq   uint64     `json:"seq"`
+	Op    walOp      `json:"op"`
+	UID   recBytes   `json:"uid,omitempty"`
+	Msg   *msgRecord `json:"msg,omitempty"`
+	MsgID recBytes   `json:"msgid,omitempty"`
+	Time  time.Time  `json:"time,omitempty"`
+	Limit int        `json:"limit,omitempty"`
+	OOB   *oobRecord `json:"oob,omitempty"`
+}
+
+// memWAL is the write-ahead log of a durable MemEngine. Every mutation is
+// appended to it before it's applied, and it's emptied whenever a snapshot
+// is taken.
+type memWAL struct {
+	opts DurableOptions
+	f    *os.File
+	seq  uint64
+	n    int
+}
+
+// itemSnapshot is the state of a logged message's Item beyond what's in
+// the message itself. Pruned is set if the Item itself was pruned, but the
+// message is still needed.
+type itemSnapshot struct {
+	CTime        time.Time            `json:"ctime"`
+	DTime        *time.Time           `json:"dtime,omitempty"`
+	NotifyTimes  []time.Time          `json:"ntimes,omitempty"`
+	DeviceDTimes map[string]time.Time `json:"device_dtimes,omitempty"`
+	BodyUpdate   *appliedUpdate       `json:"body_update,omitempty"`
+	DTimeUpdate  *appliedUpdate       `json:"dtime_update,omitempty"`
+	Pruned       bool                 `json:"pruned,omitempty"`
+}
+
+// newItemSnapshot records the state of the item i.
+func newItemSnapshot(i *item) *itemSnapshot {
+	return &itemSnapshot{
+		CTime:        i.ctime,
+		DTime:        i.dtime,
+		NotifyTimes:  i.notifyTimes,
+		DeviceDTimes: i.deviceDtimes,
+		BodyUpdate:   i.bodyUpdate,
+		DTimeUpdate:  i.dtimeUpdate,
+	}
+}
+
+// toItem restores the item created by c whose state s records.
+func (s *itemSnapshot) toItem(c gregor.Item) *item {
+	return &item{
+		item:         c,
+		ctime:        s.CTime,
+		hlc:          gregor.OrderingHLC(c.Metadata(), s.CTime),
+		dtime:        s.DTime,
+		notifyTimes:  s.NotifyTimes,
+		deviceDtimes: s.DeviceDTimes,
+		bodyUpdate:   s.BodyUpdate,
+		dtimeUpdate:  s.DTimeUpdate,
+	}
+}
+
+type loggedMsgSnapshot struct {
+	Msg    *msgRecord    `json:"msg"`
+	CTime  time.Time     `json:"ctime"`
+	Digest string        `json:"digest"`
+	Item   *itemSnapshot `json:"item,omitempty"`
+}
+
+type dismissedRangeSnapshot struct {
+	Category string     `json:"category"`
+	End      time.Time  `json:"end"`
+	HLC      gregor.HLC `json:"hlc,omitempty"`
+	DTime    time.Time  `json:"dtime"`
+}
+
+func (r dismissedRangeSnapshot) toRange() dismissedRange {
+	return dismissedRange{category: r.Category, end: r.End, hlc: r.HLC, dtime: r.DTime}
+}
+
+type userSnapshot struct {
+	Log                 []loggedMsgSnapshot             `json:"log"`
+	DismissedIDs        map[string]time.Time            `json:"dismissed_ids,omitempty"`
+	DismissedRanges     []dismissedRangeSnapshot        `json:"dismissed_ranges,omitempty"`
+	DismissedForDevices map[string]map[string]time.Time `json:"dismissed_for_devices,omitempty"`
+	PendingUpdates      map[string][](*appliedUpdate)   `json:"pending_updates,omitempty"`
+	OutOfBand           [](*oobRecord)                  `json:"oob,omitempty"`
+}
+
+// memSnapshot is everything in a MemEngine, as of the log entry Seq.
+type memSnapshot struct {
+	Version int                      `json:"version"`
+	Seq     uint64                   `json:"seq"`
+	Users   map[string]*userSnapshot `json:"users"`
+}
+
+// NewDurableMemEngine makes a MemEngine that keeps a write-ahead log and
+// periodic snapshots in the directory o.Dir, and recovers whatever state
+// they hold. A write that was cut short by a crash is discarded. Call Close
+// when done with it.
+func NewDurableMemEngine(f gregor.ObjFactory, cl clockwork.Clock, o DurableOptions) (*MemEngine, error) {
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return nil, err
+	}
+	m := NewMemEngine(f, cl)
+	seq, err := m.loadSnapshot(filepath.Join(o.Dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	wal, err := m.recoverWAL(o, seq)
+	if err != nil {
+		return nil, err
+	}
+	m.wal = wal
+	return m, nil
+}
+
+// Snapshot writes all of the engine's state to disk and empties its
+// write-ahead log, so that the next recovery is quicker.
+func (m *MemEngine) Snapshot() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.wal == nil {
+		return ErrNotDurable
+	}
+	return m.snapshot()
+}
+
+// Close takes a final snapshot, if the engine is durable, and closes its
+// write-ahead log. The engine mustn't be used afterwards.
+func (m *MemEngine) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.wal == nil {
+		return nil
+	}
+	err := m.snapshot()
+	if cerr := m.wal.f.Close(); err == nil {
+		err = cerr
+	}
+	m.wal = nil
+	return err
+}
+
+// logOp appends the entry e to the write-ahead log, if there is one. It must
+// be called with the lock held, before e is applied.
+func (m *MemEngine) logOp(e walEntry) error {
+	if m.wal == nil {
+		return nil
+	}
+	e.Seq = m.wal.seq + 1
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := m.wal.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if m.wal.opts.Sync {
+		if err := m.wal.f.Sync(); err != nil {
+			return err
+		}
+	}
+	m.wal.seq = e.Seq
+	m.wal.n++
+	return nil
+}
+
+// maybeSnapshot takes a snapshot if enough log entries have been written
+// since the last one. It must be called with the lock held, after the last
+// entry was applied.
+func (m *MemEngine) maybeSnapshot() error {
+	if m.wal == nil || m.wal.opts.SnapshotEvery <= 0 || m.wal.n < m.wal.opts.SnapshotEvery {
+		return nil
+	}
+	return m.snapshot()
+}
+
+func (m *MemEngine) snapshot() error {
+	b, err := json.Marshal(m.makeSnapshot())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.wal.opts.Dir, snapshotFile)
+	if err := writeFileAtomic(path, b); err != nil {
+		return err
+	}
+	if err := m.wal.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := m.wal.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	m.wal.n = 0
+	return nil
+}
+
+// writeFileAtomic writes b to path such that a crash leaves either the old
+// contents or the new ones.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *MemEngine) makeSnapshot() *memSnapshot {
+	s := &memSnapshot{
+		Version: snapshotVersion,
+		Seq:     m.wal.seq,
+		Users:   make(map[string]*userSnapshot),
+	}
+	for k, u := range m.users {
+		us := &userSnapshot{
+			DismissedIDs:        u.dismissedIDs,
+			DismissedForDevices: u.dismissedForDevices,
+			PendingUpdates:      u.pendingUpdates,
+			OutOfBand:           u.oob,
+		}
+		live := make(map[*item]bool)
+		for _, i := range u.items {
+			live[i] = true
+		}
+		for _, msg := range u.log {
+			ls := loggedMsgSnapshot{
+				Msg:    newMsgRecord(msg.m, msg.ctime),
+				CTime:  msg.ctime,
+				Digest: msg.digest,
+			}
+			if msg.i != nil {
+				ls.Item = newItemSnapshot(msg.i)
+				ls.Item.Pruned = !live[msg.i]
+			}
+			us.Log = append(us.Log, ls)
+		}
+		for _, r := range u.dismissedRs {
+			us.DismissedRanges = append(us.DismissedRanges, dismissedRangeSnapshot{
+				Category: r.category,
+				End:      r.end,
+				HLC:      r.hlc,
+				DTime:    r.dtime,
+			})
+		}
+		s.Users[k] = us
+	}
+	return s
+}
+
+// loadSnapshot restores the engine from the snapshot at path, if there is
+// one, and returns the sequence number of the last log entry it reflects.
+func (m *MemEngine) loadSnapshot(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var s memSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return 0, ErrBadWAL(fmt.Sprintf("%s: %v", path, err))
+	}
+	if s.Version != snapshotVersion {
+		return 0, ErrBadWAL(fmt.Sprintf("%s: unknown version %d", path, s.Version))
+	}
+	for k, us := range s.Users {
+		u := newUser()
+		if us.DismissedIDs != nil {
+			u.dismissedIDs = us.DismissedIDs
+		}
+		if us.DismissedForDevices != nil {
+			u.dismissedForDevices = us.DismissedForDevices
+		}
+		if us.PendingUpdates != nil {
+			u.pendingUpdates = us.PendingUpdates
+		}
+		for _, ls := range us.Log {
+			if ls.Msg == nil {
+				return 0, ErrBadWAL(fmt.Sprintf("%s: logged message without a message", path))
+			}
+			var i *item
+			if ls.Item != nil {
+				c := ls.Msg.Creation()
+				if c == nil {
+					return 0, ErrBadWAL(fmt.Sprintf("%s: item without a creation", path))
+				}
+				i = ls.Item.toItem(c)
+				if !ls.Item.Pruned {
+					u.items = append(u.items, i)
+				}
+			}
+			u.log = append(u.log, loggedMsg{m: ls.Msg, ctime: ls.CTime, hlc: gregor.OrderingHLC(ls.Msg, ls.CTime), i: i, digest: ls.Digest})
+		}
+		for _, r := range us.DismissedRanges {
+			u.dismissedRs = append(u.dismissedRs, r.toRange())
+		}
+		u.oob = us.OutOfBand
+		u.reindex()
+		u.relinkUpdates()
+		m.users[k] = u
+	}
+	return s.Seq, nil
+}
+
+// recoverWAL applies the entries in the write-ahead log that came after the
+// snapshot at seq, and opens the log for appending. A partial entry at the
+// end of the log, from a write that was interrupted, is truncated away.
+func (m *MemEngine) recoverWAL(o DurableOptions, seq uint64) (*memWAL, error) {
+	path := filepath.Join(o.Dir, walFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	wal := &memWAL{opts: o, f: f, seq: seq}
+	good, err := m.replayWAL(wal, path)
+	if err == nil {
+		err = f.Truncate(good)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// replayWAL applies wal's entries and returns the offset just past the last
+// complete one.
+func (m *MemEngine) replayWAL(wal *memWAL, path string) (int64, error) {
+	r := bufio.NewReader(wal.f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left over is an entry we never finished writing,
+			// and so never applied.
+			return good, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		good += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return 0, ErrBadWAL(fmt.Sprintf("%s: %v", path, err))
+		}
+		if e.Seq <= wal.seq {
+			continue
+		}
+		if err := m.applyWALEntry(e); err != nil {
+			return 0, err
+		}
+		wal.seq = e.Seq
+		wal.n++
+	}
+}
+
+func (m *MemEngine) applyWALEntry(e walEntry) error {
+	switch e.Op {
+	case walOpMessage:
+		if e.Msg == nil {
+			return ErrBadWAL(fmt.Sprintf("entry %d has no message", e.Seq))
+		}
+		return m.consumeInBandMessage(e.Msg.UID(), e.Msg)
+	case walOpDeleteReminder:
+		m.deleteReminder(e.UID, e.MsgID, e.Time)
+	case walOpPrune:
+		m.prune(e.Time)
+	case walOpDeleteUser:
+		delete(m.users, hex.EncodeToString(e.UID))
+	case walOpTrimLog:
+		if u, ok := m.users[hex.EncodeToString(e.UID)]; ok {
+			u.trimLog(e.Time, e.Limit)
+		}
+	case walOpOutOfBand:
+		if e.OOB == nil {
+			return ErrBadWAL(fmt.Sprintf("entry %d has no out-of-band message", e.Seq))
+		}
+		m.getUser(e.OOB.UID_).queueOOB(e.OOB.CTime, e.OOB)
+	default:
+		return ErrBadWAL(fmt.Sprintf("entry %d has unknown op %q", e.Seq, e.Op))
+	}
+	return nil
+}
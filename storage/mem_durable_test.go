@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+// dumpMemEngine renders everything that can be asked of m as a list of
+// strings, so that two engines can be compared.
+func dumpMemEngine(t *testing.T, m *MemEngine) []string {
+	var ret []string
+	uids, err := m.Users()
+	require.Nil(t, err, "no error from Users")
+	for _, u := range uids {
+		st, err := m.State(u, nil, nil)
+		require.Nil(t, err, "no error from State")
+		items, err := st.Items()
+		require.Nil(t, err, "no error from Items")
+		for _, i := range items {
+			md := i.Metadata()
+			ret = append(ret, fmt.Sprintf("item %x %x %s %s %q", md.UID().Bytes(), md.MsgID().Bytes(),
+				md.CTime().UTC(), i.Category(), i.Body().Bytes()))
+		}
+		msgs, err := m.InBandMessagesSince(u, nil, timeOrOffset(time.Time{}))
+		require.Nil(t, err, "no error from InBandMessagesSince")
+		for _, msg := range msgs {
+			md := msg.Metadata()
+			ret = append(ret, fmt.Sprintf("msg %x %x %d", md.UID().Bytes(), md.MsgID().Bytes(), md.InBandMsgType()))
+		}
+		oobs, err := m.QueuedOutOfBandMessages(u)
+		require.Nil(t, err, "no error from QueuedOutOfBandMessages")
+		for _, oobm := range oobs {
+			ret = append(ret, fmt.Sprintf("oob %x %s %q", oobm.UID().Bytes(), oobm.System(), oobm.Body().Bytes()))
+		}
+	}
+	for k, u := range m.users {
+		for _, i := range u.items {
+			for dev, dtime := range i.deviceDtimes {
+				ret = append(ret, fmt.Sprintf("device dismissal %s %x %s %s", k, i.item.Metadata().MsgID().Bytes(), dev, dtime.UTC()))
+			}
+			if et := i.etime(); et != nil {
+				ret = append(ret, fmt.Sprintf("etime %s %x %s", k, i.item.Metadata().MsgID().Bytes(), et.UTC()))
+			}
+		}
+		for id, ups := range u.pendingUpdates {
+			for _, up := range ups {
+				ret = append(ret, fmt.Sprintf("pending update %s %s %x %s %q", k, id, []byte(up.MsgID), up.CTime.UTC(), []byte(up.Body)))
+			}
+		}
+	}
+	rs, err := m.Reminders(m.clock.Now().Add(24 * 365 * time.Hour))
+	require.Nil(t, err, "no error from Reminders")
+	for _, r := range rs {
+		md := r.Item().Metadata()
+		ret = append(ret, fmt.Sprintf("reminder %x %x %s", md.UID().Bytes(), md.MsgID().Bytes(), r.RemindTime().UTC()))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// makePendingUpdate makes an update to an Item that never arrives.
+func makePendingUpdate(t *testing.T) gregor.Message {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("update user"))
+	m, _ := of.MakeMsgID([]byte("update"))
+	target, _ := of.MakeMsgID([]byte("missing"))
+	b, _ := of.MakeBody([]byte("pending"))
+	ibm, err := of.MakeItemUpdate(u, m, nil, time.Time{}, target, b, nil)
+	require.Nil(t, err, "no error from MakeItemUpdate")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func newTestDurableMemEngine(t *testing.T, cl clockwork.Clock, o DurableOptions) *MemEngine {
+	m, err := NewDurableMemEngine(test.TestObjFactory{}, cl, o)
+	require.Nil(t, err, "no error from NewDurableMemEngine")
+	return m
+}
+
+func TestDurableMemEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_durable")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	cl := clockwork.NewFakeClock()
+	o := DurableOptions{Dir: dir, SnapshotEvery: 10}
+	eng := newTestDurableMemEngine(t, cl, o)
+	eng.SetOOBRetention(testOOBRetention)
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachinePrune(t, eng, cl)
+	test.TestStateMachineReplay(t, eng, cl)
+	test.TestStateMachineReorder(t, eng, cl)
+	test.TestStateMachinePaging(t, eng, cl)
+	test.TestStateMachineSync(t, eng, cl)
+	test.TestStateMachineStateDiff(t, eng, cl)
+	test.TestStateMachineCategories(t, eng, cl)
+	test.TestStateMachineOutOfBand(t, eng, cl)
+	test.TestStateMachineDeviceDismissal(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	testReplayConflict(t, eng)
+	require.Nil(t, eng.ConsumeMessage(makeOutOfBand(t, "kbfs.favorites", "queued")), "no error from ConsumeMessage")
+	require.Nil(t, eng.ConsumeMessage(makePendingUpdate(t)), "no error from ConsumeMessage")
+	want := dumpMemEngine(t, eng)
+	require.NotEmpty(t, want, "something to recover")
+
+	// Recover from the last snapshot plus the log, as if we'd crashed.
+	crashed := newTestDurableMemEngine(t, cl, o)
+	require.Equal(t, want, dumpMemEngine(t, crashed), "same state after a crash")
+
+	// And from a clean shutdown.
+	require.Nil(t, eng.Close(), "no error from Close")
+	require.Nil(t, crashed.Close(), "no error from Close")
+	reopened := newTestDurableMemEngine(t, cl, o)
+	defer reopened.Close()
+	require.Equal(t, want, dumpMemEngine(t, reopened), "same state after Close")
+	require.Equal(t, 0, reopened.wal.n, "log is empty after Close")
+}
+
+func TestDurableMemEngineLogOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_durable")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	cl := clockwork.NewFakeClock()
+	o := DurableOptions{Dir: dir, Sync: true}
+	eng := newTestDurableMemEngine(t, cl, o)
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachinePrune(t, eng, cl)
+	want := dumpMemEngine(t, eng)
+	_, err = os.Stat(filepath.Join(dir, snapshotFile))
+	require.True(t, os.IsNotExist(err), "no snapshot yet")
+
+	recovered := newTestDurableMemEngine(t, cl, o)
+	require.Equal(t, want, dumpMemEngine(t, recovered), "same state from the log alone")
+	require.Nil(t, recovered.Snapshot(), "no error from Snapshot")
+	require.Equal(t, ErrNotDurable, NewMemEngine(test.TestObjFactory{}, cl).Snapshot(), "plain MemEngines can't snapshot")
+}
+
+func TestDurableMemEnginePartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_durable")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	cl := clockwork.NewFakeClock()
+	o := DurableOptions{Dir: dir}
+	eng := newTestDurableMemEngine(t, cl, o)
+	require.Nil(t, eng.ConsumeMessage(makeCreation(t, "r1", "a")), "no error from ConsumeMessage")
+	require.Nil(t, eng.ConsumeMessage(makeCreation(t, "r2", "b")), "no error from ConsumeMessage")
+	want := dumpMemEngine(t, eng)
+
+	// Crash halfway through writing the next entry.
+	walPath := filepath.Join(dir, walFile)
+	fi, err := os.Stat(walPath)
+	require.Nil(t, err, "no error from Stat")
+	_, err = eng.wal.f.Write([]byte(`{"seq":3,"op":"ms`))
+	require.Nil(t, err, "no error writing a partial entry")
+
+	recovered := newTestDurableMemEngine(t, cl, o)
+	require.Equal(t, want, dumpMemEngine(t, recovered), "partial entry ignored")
+	fi2, err := os.Stat(walPath)
+	require.Nil(t, err, "no error from Stat")
+	require.Equal(t, fi.Size(), fi2.Size(), "partial entry truncated")
+
+	// We can carry on from where we left off.
+	require.Nil(t, recovered.ConsumeMessage(makeCreation(t, "r3", "c")), "no error from ConsumeMessage")
+	want = dumpMemEngine(t, recovered)
+	require.Nil(t, recovered.wal.f.Close(), "no error closing the log")
+	require.Equal(t, want, dumpMemEngine(t, newTestDurableMemEngine(t, cl, o)), "new entry recovered")
+
+	// A corrupt entry that isn't at the end is an error, rather than
+	// something to silently skip over.
+	b, err := ioutil.ReadFile(walPath)
+	require.Nil(t, err, "no error reading the log")
+	b = append([]byte("garbage\n"), b...)
+	require.Nil(t, ioutil.WriteFile(walPath, b, 0600), "no error writing the log")
+	_, err = NewDurableMemEngine(test.TestObjFactory{}, cl, o)
+	require.IsType(t, ErrBadWAL(""), err, "corrupt log")
+}
+
+func TestDurableMemEngineMaxLogLen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gregor_durable")
+	require.Nil(t, err, "no error from TempDir")
+	defer os.RemoveAll(dir)
+
+	cl := clockwork.NewFakeClock()
+	o := DurableOptions{Dir: dir}
+	eng := newTestDurableMemEngine(t, cl, o)
+	testMaxLogLen(t, eng, cl)
+	want := dumpMemEngine(t, eng)
+
+	// Trimming is replayed from the log, even without a bound set.
+	cl.Advance(time.Hour)
+	require.Equal(t, want, dumpMemEngine(t, newTestDurableMemEngine(t, cl, o)), "same state after a crash")
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// The types in this file are how a durable MemEngine writes messages to
+// disk, as JSON. They implement the gregor interfaces themselves, so that
+// messages read back from disk can be used as is, whatever ObjFactory the
+// engine was created with.
+
+type recBytes []byte
+
+func (b recBytes) Bytes() []byte { return b }
+
+type recString string
+
+func (s recString) String() string { return string(s) }
+
+func toRecBytes(b byter) recBytes {
+	if b == nil {
+		return nil
+	}
+	return recBytes(b.Bytes())
+}
+
+type timeOrOffsetRecord struct {
+	Time_   *time.Time     `json:"time,omitempty"`
+	Offset_ *time.Duration `json:"offset,omitempty"`
+}
+
+func (t *timeOrOffsetRecord) Time() *time.Time       { return t.Time_ }
+func (t *timeOrOffsetRecord) Offset() *time.Duration { return t.Offset_ }
+
+func newTimeOrOffsetRecord(t gregor.TimeOrOffset) *timeOrOffsetRecord {
+	if t == nil || (t.Time() == nil && t.Offset() == nil) {
+		return nil
+	}
+	return &timeOrOffsetRecord{Time_: t.Time(), Offset_: t.Offset()}
+}
+
+// toTimeOrOffset returns t as a gregor.TimeOrOffset, taking care that a nil
+// record becomes a nil interface.
+func (t *timeOrOffsetRecord) toTimeOrOffset() gregor.TimeOrOffset {
+	if t == nil {
+		return nil
+	}
+	return t
+}
+
+type itemRecord struct {
+	Category_    recString             `json:"category"`
+	Body_        recBytes              `json:"body"`
+	DTime_       *timeOrOffsetRecord   `json:"dtime,omitempty"`
+	NotifyTimes_ []*timeOrOffsetRecord `json:"ntimes,omitempty"`
+}
+
+type rangeRecord struct {
+	Category_ recString           `json:"category"`
+	EndTime_  *timeOrOffsetRecord `json:"end"`
+}
+
+func (r rangeRecord) Category() gregor.Category    { return r.Category_ }
+func (r rangeRecord) EndTime() gregor.TimeOrOffset { return r.EndTime_.toTimeOrOffset() }
+
+type msgIDForDeviceRecord struct {
+	MsgID_    recBytes `json:"msgid"`
+	DeviceID_ recBytes `json:"devid"`
+}
+
+func (m msgIDForDeviceRecord) MsgID() gregor.MsgID       { return m.MsgID_ }
+func (m msgIDForDeviceRecord) DeviceID() gregor.DeviceID { return m.DeviceID_ }
+
+type dismissalRecord struct {
+	MsgIDs_     []recBytes             `json:"msgids,omitempty"`
+	Ranges_     []rangeRecord          `json:"ranges,omitempty"`
+	ForDevices_ []msgIDForDeviceRecord `json:"for_devices,omitempty"`
+}
+
+func (d *dismissalRecord) MsgIDsToDismiss() []gregor.MsgID {
+	var ret []gregor.MsgID
+	for _, id := range d.MsgIDs_ {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+func (d *dismissalRecord) RangesToDismiss() []gregor.MsgRange {
+	var ret []gregor.MsgRange
+	for _, r := range d.Ranges_ {
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func (d *dismissalRecord) MsgIDsToDismissForDevice() []gregor.MsgIDForDevice {
+	var ret []gregor.MsgIDForDevice
+	for _, m := range d.ForDevices_ {
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// itemUpdateRecord is an ItemUpdate. Body_ is written even if it's empty,
+// since a nil Body leaves the Item's body alone.
+type itemUpdateRecord struct {
+	MsgID_ recBytes            `json:"msgid"`
+	Body_  recBytes            `json:"body"`
+	DTime_ *timeOrOffsetRecord `json:"dtime,omitempty"`
+}
+
+func (u *itemUpdateRecord) MsgID() gregor.MsgID        { return u.MsgID_ }
+func (u *itemUpdateRecord) DTime() gregor.TimeOrOffset { return u.DTime_.toTimeOrOffset() }
+
+func (u *itemUpdateRecord) Body() gregor.Body {
+	if u.Body_ == nil {
+		return nil
+	}
+	return u.Body_
+}
+
+// msgRecord is an InBandMessage, and its Metadata, as written to disk.
+type msgRecord struct {
+	UID_       recBytes             `json:"uid"`
+	MsgID_     recBytes             `json:"msgid"`
+	DeviceID_  recBytes             `json:"devid,omitempty"`
+	CTime_     time.Time            `json:"ctime"`
+	MsgType_   gregor.InBandMsgType `json:"mtype"`
+	HLC_       gregor.HLC           `json:"hlc,omitempty"`
+	Creation_  *itemRecord          `json:"creation,omitempty"`
+	Dismissal_ *dismissalRecord     `json:"dismissal,omitempty"`
+	Update_    *itemUpdateRecord    `json:"update,omitempty"`
+}
+
+// newMsgRecord makes a record of m, which arrived at ctime.
+func newMsgRecord(m gregor.InBandMessage, ctime time.Time) *msgRecord {
+	md := m.Metadata()
+	ret := &msgRecord{
+		UID_:      toRecBytes(md.UID()),
+		MsgID_:    toRecBytes(md.MsgID()),
+		DeviceID_: toRecBytes(md.DeviceID()),
+		CTime_:    ctime,
+		MsgType_:  md.InBandMsgType(),
+		HLC_:      gregor.HLCOf(md),
+	}
+	sum := m.ToStateUpdateMessage()
+	if sum == nil {
+		if m.ToStateSyncMessage() != nil {
+			ret.MsgType_ = gregor.InBandMsgTypeSync
+		}
+		return ret
+	}
+	if c := sum.Creation(); c != nil {
+		ir := &itemRecord{
+			Category_: recString(c.Category().String()),
+			Body_:     toRecBytes(c.Body()),
+			DTime_:    newTimeOrOffsetRecord(c.DTime()),
+		}
+		for _, nt := range c.NotifyTimes() {
+			ir.NotifyTimes_ = append(ir.NotifyTimes_, newTimeOrOffsetRecord(nt))
+		}
+		ret.Creation_ = ir
+	}
+	if d := sum.Dismissal(); d != nil {
+		dr := &dismissalRecord{}
+		for _, id := range d.MsgIDsToDismiss() {
+			dr.MsgIDs_ = append(dr.MsgIDs_, toRecBytes(id))
+		}
+		for _, r := range d.RangesToDismiss() {
+			dr.Ranges_ = append(dr.Ranges_, rangeRecord{
+				Category_: recString(r.Category().String()),
+				EndTime_:  newTimeOrOffsetRecord(r.EndTime()),
+			})
+		}
+		for _, m := range d.MsgIDsToDismissForDevice() {
+			dr.ForDevices_ = append(dr.ForDevices_, msgIDForDeviceRecord{
+				MsgID_:    toRecBytes(m.MsgID()),
+				DeviceID_: toRecBytes(m.DeviceID()),
+			})
+		}
+		ret.Dismissal_ = dr
+	}
+	if u := sum.Update(); u != nil {
+		ret.Update_ = &itemUpdateRecord{
+			MsgID_: toRecBytes(u.MsgID()),
+			Body_:  toRecBytes(u.Body()),
+			DTime_: newTimeOrOffsetRecord(u.DTime()),
+		}
+	}
+	return ret
+}
+
+func (m *msgRecord) UID() gregor.UID                     { return m.UID_ }
+func (m *msgRecord) MsgID() gregor.MsgID                 { return m.MsgID_ }
+func (m *msgRecord) CTime() time.Time                    { return m.CTime_ }
+func (m *msgRecord) SetCTime(t time.Time)                { m.CTime_ = t }
+func (m *msgRecord) InBandMsgType() gregor.InBandMsgType { return m.MsgType_ }
+func (m *msgRecord) HLC() gregor.HLC                     { return m.HLC_ }
+func (m *msgRecord) SetHLC(h gregor.HLC)                 { m.HLC_ = h }
+func (m *msgRecord) Metadata() gregor.Metadata           { return m }
+
+func (m *msgRecord) DeviceID() gregor.DeviceID {
+	if m.DeviceID_ == nil {
+		return nil
+	}
+	return m.DeviceID_
+}
+
+func (m *msgRecord) ToStateUpdateMessage() gregor.StateUpdateMessage {
+	if m.MsgType_ == gregor.InBandMsgTypeSync {
+		return nil
+	}
+	return m
+}
+
+func (m *msgRecord) ToStateSyncMessage() gregor.StateSyncMessage {
+	if m.MsgType_ != gregor.InBandMsgTypeSync {
+		return nil
+	}
+	return m
+}
+
+func (m *msgRecord) Creation() gregor.Item {
+	if m.Creation_ == nil {
+		return nil
+	}
+	return recordItem{m}
+}
+
+func (m *msgRecord) Dismissal() gregor.Dismissal {
+	if m.Dismissal_ == nil {
+		return nil
+	}
+	return m.Dismissal_
+}
+
+func (m *msgRecord) Update() gregor.ItemUpdate {
+	if m.Update_ == nil {
+		return nil
+	}
+	return m.Update_
+}
+
+// setNotifyTimes replaces the notify times of the Item that m creates with
+// ts.
+func (m *msgRecord) setNotifyTimes(ts []time.Time) {
+	m.Creation_.NotifyTimes_ = nil
+	for _, t := range ts {
+		m.Creation_.NotifyTimes_ = append(m.Creation_.NotifyTimes_, newTimeOrOffsetRecord(timeOrOffset(t)))
+	}
+}
+
+// dismissal returns the dismissal m carries, adding one if it doesn't yet.
+func (m *msgRecord) dismissal() *dismissalRecord {
+	if m.Dismissal_ == nil {
+		m.Dismissal_ = &dismissalRecord{}
+	}
+	return m.Dismissal_
+}
+
+func (m *msgRecord) Merge(m2 gregor.InBandMessage) error {
+	return errors.New("can't merge stored messages")
+}
+
+// export makes an InBandMessage with the given ObjFactory out of m. Like
+// the messages read back from SQL, Item DTimes and range ends are made
+// absolute. It's
+// stamped with m's HLC if f's messages can carry one.
+func (m *msgRecord) export(f gregor.ObjFactory) (gregor.InBandMessage, error) {
+	ret, err := m.exportUnstamped(f)
+	if err != nil || ret == nil {
+		return ret, err
+	}
+	if s, ok := ret.(gregor.HLCSetter); ok && m.HLC_ != 0 {
+		s.SetHLC(m.HLC_)
+	}
+	return ret, nil
+}
+
+func (m *msgRecord) exportUnstamped(f gregor.ObjFactory) (gregor.InBandMessage, error) {
+	uid, err := f.MakeUID(m.UID_)
+	if err != nil {
+		return nil, err
+	}
+	msgID, err := f.MakeMsgID(m.MsgID_)
+	if err != nil {
+		return nil, err
+	}
+	var devID gregor.DeviceID
+	if m.DeviceID_ != nil {
+		if devID, err = f.MakeDeviceID(m.DeviceID_); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case m.Creation_ != nil:
+		c := m.Creation()
+		category, err := f.MakeCategory(c.Category().String())
+		if err != nil {
+			return nil, err
+		}
+		body, err := f.MakeBody(m.Creation_.Body_)
+		if err != nil {
+			return nil, err
+		}
+		var dtime *time.Time
+		if c.DTime() != nil {
+			t := toTime(m.CTime_, c.DTime())
+			dtime = &t
+		}
+		i, err := f.MakeItem(uid, msgID, devID, m.CTime_, category, dtime, body)
+		if err != nil {
+			return nil, err
+		}
+		return f.MakeInBandMessageFromItem(i)
+	case m.Dismissal_ != nil && len(m.Dismissal_.Ranges_)+len(m.Dismissal_.MsgIDs_)+len(m.Dismissal_.ForDevices_) > 0:
+		return m.exportDismissal(f, uid, msgID, devID)
+	case m.Update_ != nil:
+		target, err := f.MakeMsgID(m.Update_.MsgID_)
+		if err != nil {
+			return nil, err
+		}
+		var body gregor.Body
+		if m.Update_.Body_ != nil {
+			if body, err = f.MakeBody(m.Update_.Body_); err != nil {
+				return nil, err
+			}
+		}
+		var dtime *time.Time
+		if dt := m.Update_.DTime(); dt != nil {
+			t := toTime(m.CTime_, dt)
+			dtime = &t
+		}
+		return f.MakeItemUpdate(uid, msgID, devID, m.CTime_, target, body, dtime)
+	case m.MsgType_ == gregor.InBandMsgTypeSync:
+		return f.MakeStateSyncMessage(uid, msgID, devID, m.CTime_)
+	}
+	return nil, nil
+}
+
+// exportDismissal makes the dismissal m carries with f, which can only make
+// dismissals of one thing at a time, by merging one for each thing that m
+// dismisses.
+func (m *msgRecord) exportDismissal(f gregor.ObjFactory, uid gregor.UID, msgID gregor.MsgID, devID gregor.DeviceID) (gregor.InBandMessage, error) {
+	var ret gregor.InBandMessage
+	add := func(ibm gregor.InBandMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		if ret == nil {
+			ret = ibm
+			return nil
+		}
+		return ret.Merge(ibm)
+	}
+	for _, r := range m.Dismissal_.Ranges_ {
+		category, err := f.MakeCategory(string(r.Category_))
+		if err != nil {
+			return nil, err
+		}
+		if err := add(f.MakeDismissalByRange(uid, msgID, devID, m.CTime_, category, toTime(m.CTime_, r.EndTime()))); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range m.Dismissal_.MsgIDs_ {
+		d, err := f.MakeMsgID(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(f.MakeDismissalByID(uid, msgID, devID, m.CTime_, d)); err != nil {
+			return nil, err
+		}
+	}
+	for _, fd := range m.Dismissal_.ForDevices_ {
+		d, err := f.MakeMsgID(fd.MsgID_)
+		if err != nil {
+			return nil, err
+		}
+		dd, err := f.MakeDeviceID(fd.DeviceID_)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(f.MakeDismissalByIDForDevice(uid, msgID, devID, m.CTime_, d, dd)); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// recordItem is the Item created by a msgRecord.
+type recordItem struct {
+	m *msgRecord
+}
+
+func (i recordItem) Metadata() gregor.Metadata  { return i.m }
+func (i recordItem) Category() gregor.Category  { return i.m.Creation_.Category_ }
+func (i recordItem) Body() gregor.Body          { return i.m.Creation_.Body_ }
+func (i recordItem) DTime() gregor.TimeOrOffset { return i.m.Creation_.DTime_.toTimeOrOffset() }
+func (i recordItem) NotifyTimes() []gregor.TimeOrOffset {
+	var ret []gregor.TimeOrOffset
+	for _, nt := range i.m.Creation_.NotifyTimes_ {
+		ret = append(ret, nt.toTimeOrOffset())
+	}
+	return ret
+}
+
+var _ gregor.InBandMessage = (*msgRecord)(nil)
+var _ gregor.StateUpdateMessage = (*msgRecord)(nil)
+var _ gregor.StateSyncMessage = (*msgRecord)(nil)
+var _ gregor.Item = recordItem{}
+var _ gregor.ItemUpdate = (*itemUpdateRecord)(nil)
+
+// appliedUpdate is an ItemUpdate as applied to an Item, stamped with the
+// MsgID and ctime of the message that carried it, and with its dtime
+// resolved relative to that ctime. Updates are ordered by ctime, with ties
+// broken by MsgID.
+type appliedUpdate struct {
+	MsgID recBytes   `json:"msgid"`
+	CTime time.Time  `json:"ctime"`
+	Body  recBytes   `json:"body"`
+	DTime *time.Time `json:"dtime,omitempty"`
+}
+
+func newAppliedUpdate(u gregor.ItemUpdate, msgid gregor.MsgID, ctime time.Time) *appliedUpdate {
+	ret := &appliedUpdate{
+		MsgID: toRecBytes(msgid),
+		CTime: ctime,
+		Body:  toRecBytes(u.Body()),
+	}
+	if dt := u.DTime(); dt != nil && (dt.Time() != nil || dt.Offset() != nil) {
+		t := toTime(ctime, dt)
+		ret.DTime = &t
+	}
+	return ret
+}
+
+// supersedes returns true if a comes after b.
+func (a *appliedUpdate) supersedes(b *appliedUpdate) bool {
+	if !a.CTime.Equal(b.CTime) {
+		return a.CTime.After(b.CTime)
+	}
+	return bytes.Compare(a.MsgID, b.MsgID) > 0
+}
+
+// oobRecord is an OutOfBandMessage queued for delivery, along with when it
+// arrived and when it expires.
+type oobRecord struct {
+	UID_    recBytes  `json:"uid"`
+	System_ recString `json:"system"`
+	Body_   recBytes  `json:"body,omitempty"`
+	CTime   time.Time `json:"ctime"`
+	ETime   time.Time `json:"etime"`
+}
+
+func newOOBRecord(m gregor.OutOfBandMessage, ctime, etime time.Time) *oobRecord {
+	ret := &oobRecord{
+		UID_:  toRecBytes(m.UID()),
+		Body_: toRecBytes(m.Body()),
+		CTime: ctime,
+		ETime: etime,
+	}
+	if s := m.System(); s != nil {
+		ret.System_ = recString(s.String())
+	}
+	return ret
+}
+
+// sameAs returns true if o and p are the same queued message. The ctimes
+// are compared to the microsecond, which is as much as SQL engines keep.
+func (o *oobRecord) sameAs(p *oobRecord) bool {
+	return bytes.Equal(o.UID_, p.UID_) && o.System_ == p.System_ && bytes.Equal(o.Body_, p.Body_) &&
+		o.CTime.Truncate(time.Microsecond).Equal(p.CTime.Truncate(time.Microsecond))
+}
+
+func (o *oobRecord) UID() gregor.UID       { return o.UID_ }
+func (o *oobRecord) System() gregor.System { return o.System_ }
+func (o *oobRecord) Body() gregor.Body     { return o.Body_ }
+
+// export makes an OutOfBandMessage with the given ObjFactory out of o.
+func (o *oobRecord) export(f gregor.ObjFactory) (gregor.OutOfBandMessage, error) {
+	uid, err := f.MakeUID(o.UID_)
+	if err != nil {
+		return nil, err
+	}
+	system, err := f.MakeSystem(string(o.System_))
+	if err != nil {
+		return nil, err
+	}
+	body, err := f.MakeBody(o.Body_)
+	if err != nil {
+		return nil, err
+	}
+	return f.MakeOutOfBandMessage(uid, system, body)
+}
+
+var _ gregor.OutOfBandMessage = (*oobRecord)(nil)
@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"encoding/hex"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,15 +12,23 @@ import (
 )
 
 // MemEngine is an implementation of a gregor StateMachine that just keeps
-// all incoming messages in a hash table, with one entry per user. It doesn't
-// do anything fancy w/r/t indexing Items, so just iterates over all of them
-// every time a dismissal or a state dump comes in. Used mainly for testing
-// when SQLite isn't available.
+// all incoming messages in a hash table, with one entry per user. Each user's
+// Items are indexed by MsgID and by category, so dismissals only touch the
+// Items they target, but state dumps still iterate over all of them. By
+// default everything is lost when the process exits; see NewDurableMemEngine
+// for one that keeps a write-ahead log. Use SetMaxLogLen to bound how much
+// history is kept for each user, SetOOBRetention to queue OutOfBandMessages
+// for devices that are offline, and SetQuotas to bound how many Items each
+// user can have.
 type MemEngine struct {
 	sync.Mutex
-	objFactory gregor.ObjFactory
-	clock      clockwork.Clock
-	users      map[string](*user)
+	objFactory   gregor.ObjFactory
+	clock        clockwork.Clock
+	users        map[string](*user)
+	wal          *memWAL
+	maxLogLen    int
+	oobRetention OOBRetention
+	quotas       Quotas
 }
 
 // NewMemEngine makes a new MemEngine with the given object factory and the
@@ -32,37 +41,195 @@ func NewMemEngine(f gregor.ObjFactory, cl clockwork.Clock) *MemEngine {
 	}
 }
 
+// SetMaxLogLen bounds the number of messages kept in each user's log to n,
+// or lifts the bound if n is 0. Once a log grows past n, messages whose Items
+// have been dismissed or have expired are dropped first, along with their
+// Items, and then messages that don't create Items, oldest first. Messages
+// with live Items are never dropped, so a user with more than n live Items
+// can still have more than n messages logged. Dropped messages are no longer
+// returned by InBandMessagesSince or recognized as replays.
+func (m *MemEngine) SetMaxLogLen(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.maxLogLen = n
+}
+
+// SetOOBRetention sets how long OutOfBandMessages are queued for. Messages
+// already queued keep the expiry they were given when they arrived.
+func (m *MemEngine) SetOOBRetention(r OOBRetention) {
+	m.Lock()
+	defer m.Unlock()
+	m.oobRetention = r
+}
+
+// SetQuotas sets the quotas that the engine enforces as it consumes
+// messages.
+func (m *MemEngine) SetQuotas(q Quotas) {
+	m.Lock()
+	defer m.Unlock()
+	m.quotas = q
+}
+
 var _ gregor.StateMachine = (*MemEngine)(nil)
 
+var _ gregor.ReminderStore = (*MemEngine)(nil)
+
+var _ gregor.Pruner = (*MemEngine)(nil)
+
+var _ gregor.InBandMessagePager = (*MemEngine)(nil)
+
+var _ gregor.SyncCheckpointer = (*MemEngine)(nil)
+
+var _ gregor.StateDiffer = (*MemEngine)(nil)
+
+var _ gregor.CategoryStater = (*MemEngine)(nil)
+
+var _ gregor.OutOfBandQueue = (*MemEngine)(nil)
+
 // item is a wrapper around a Gregor item interface, with the ctime
-// it arrived at, and the optional dtime at which it was dismissed. Note there's
+// it arrived at, the HLC that orders it, and the optional dtime at which it
+// was dismissed. Note there's
 // another Dtime internal to item that can be interpreted relative to the ctime
-// of the wrapper object.
+// of the wrapper object. notifyTimes are the item's NotifyTimes, resolved
+// relative to ctime, less those that have already been delivered.
+// deviceDtimes holds the times it was dismissed for single devices, keyed
+// by the hex encoding of their DeviceIDs. bodyUpdate and dtimeUpdate are the
+// updates that last replaced the item's Body and DTime, if any.
 type item struct {
-	item  gregor.Item
-	ctime time.Time
-	dtime *time.Time
+	item         gregor.Item
+	ctime        time.Time
+	hlc          gregor.HLC
+	dtime        *time.Time
+	notifyTimes  []time.Time
+	deviceDtimes map[string]time.Time
+	bodyUpdate   *appliedUpdate
+	dtimeUpdate  *appliedUpdate
 }
 
 // loggedMsg is a message that we've logged on arrival into this state machine
 // store. When it comes in, we stamp it with the current time, and also associate
-// it with an item if there's one to speak of.
+// it with an item if there's one to speak of. hlc orders it in the log. We keep
+// its digest to recognize replays. target is the item an update message
+// changed, if it's been seen.
 type loggedMsg struct {
-	m     gregor.InBandMessage
-	ctime time.Time
-	i     *item
+	m      gregor.InBandMessage
+	ctime  time.Time
+	hlc    gregor.HLC
+	i      *item
+	digest string
+	target *item
+}
+
+// dismissedRange records a range dismissal, so that it can be applied to
+// items that show up after it. hlc, if it's set, is a second bound on the
+// range, as described for rangeHLC.
+type dismissedRange struct {
+	category string
+	end      time.Time
+	hlc      gregor.HLC
+	dtime    time.Time
+}
+
+// rangeHLC returns the HLC bound of a range ending at end, dismissed by a
+// message stamped with h at dtime. A range that ends at or after the time it
+// was dismissed means everything up to then, and since items stamped by a
+// clock that's ahead of the dismisser's can have ctimes after the end, it
+// also covers everything the dismisser's HLC is ahead of, which is
+// everything it had seen. Other ranges, and those dismissed by messages
+// without HLCs, only go by their end.
+func rangeHLC(end time.Time, dtime time.Time, h gregor.HLC) gregor.HLC {
+	if end.Before(dtime) {
+		return 0
+	}
+	return h
+}
+
+// covers returns true if the item with the given ctime and HLC falls within
+// the range, leaving aside its category.
+func (r dismissedRange) covers(ctime time.Time, h gregor.HLC) bool {
+	return isBeforeOrSame(ctime, r.end) || (!r.hlc.IsZero() && h <= r.hlc)
 }
 
 // user consists of a list of items (some of which might be dismissed) and
-// and an unpruned log of all incoming messages.
+// and a log of incoming messages, which is only trimmed by pruning or when
+// it grows too long. It also remembers all the dismissals it's seen, in case
+// their items arrive late. byMsgID and byCategory index items, the latter
+// under their categories and the wildcards over them, and logged maps the
+// MsgIDs in log to their positions in it. oob holds the
+// OutOfBandMessages queued for the user, in order of arrival.
+// dismissedForDevices maps MsgIDs to the devices they were dismissed for,
+// and when. pendingUpdates holds updates to items that haven't arrived yet,
+// by their MsgIDs.
 type user struct {
-	items [](*item)
-	log   []loggedMsg
+	items               [](*item)
+	log                 []loggedMsg
+	dismissedIDs        map[string]time.Time
+	dismissedRs         []dismissedRange
+	dismissedForDevices map[string]map[string]time.Time
+	pendingUpdates      map[string][](*appliedUpdate)
+	byMsgID             map[string]*item
+	byCategory          map[string][](*item)
+	logged              map[string]int
+	oob                 [](*oobRecord)
 }
 
 func newUser() *user {
-	return &user{
-		items: make([](*item), 0),
+	u := &user{
+		items:               make([](*item), 0),
+		dismissedIDs:        make(map[string]time.Time),
+		dismissedForDevices: make(map[string]map[string]time.Time),
+		pendingUpdates:      make(map[string][](*appliedUpdate)),
+	}
+	u.reindex()
+	return u
+}
+
+// indexItem adds i to the user's item indexes.
+func (u *user) indexItem(i *item) {
+	u.byMsgID[msgIDtoString(i.item.Metadata().MsgID())] = i
+	for _, c := range gregor.CategoryPatterns(i.item.Category().String()) {
+		u.byCategory[c] = append(u.byCategory[c], i)
+	}
+}
+
+// indexLogged adds the jth entry in the log to the user's index of logged
+// messages.
+func (u *user) indexLogged(j int) {
+	if mid := u.log[j].m.Metadata().MsgID(); mid != nil {
+		u.logged[msgIDtoString(mid)] = j
+	}
+}
+
+// findLogged returns the logged message with the given MsgID, or nil if
+// there isn't one.
+func (u *user) findLogged(m gregor.MsgID) *loggedMsg {
+	if j, found := u.logged[msgIDtoString(m)]; found {
+		return &u.log[j]
+	}
+	return nil
+}
+
+// relinkUpdates points the logged update messages at the items they
+// changed, if those items are still around.
+func (u *user) relinkUpdates() {
+	for j, msg := range u.log {
+		if sum := msg.m.ToStateUpdateMessage(); sum != nil && sum.Update() != nil && sum.Update().MsgID() != nil {
+			u.log[j].target = u.findItem(sum.Update().MsgID())
+		}
+	}
+}
+
+// reindex rebuilds all of the user's indexes from scratch, after items or
+// log entries have been removed.
+func (u *user) reindex() {
+	u.byMsgID = make(map[string]*item)
+	u.byCategory = make(map[string][](*item))
+	u.logged = make(map[string]int)
+	for _, i := range u.items {
+		u.indexItem(i)
+	}
+	for j := range u.log {
+		u.indexLogged(j)
 	}
 }
 
@@ -71,16 +238,65 @@ func (i item) isDismissedAt(t time.Time) bool {
 	if i.dtime != nil && isBeforeOrSame(*i.dtime, t) {
 		return true
 	}
-	if dt := i.item.DTime(); dt != nil && isBeforeOrSame(toTime(i.ctime, dt), t) {
+	if et := i.etime(); et != nil && isBeforeOrSame(*et, t) {
 		return true
 	}
 	return false
 }
 
+// etime returns the time item i expires, as set by its latest update or by
+// the item itself, or nil if it doesn't.
+func (i item) etime() *time.Time {
+	if i.dtimeUpdate != nil {
+		return i.dtimeUpdate.DTime
+	}
+	if dt := i.item.DTime(); dt != nil && (dt.Time() != nil || dt.Offset() != nil) {
+		t := toTime(i.ctime, dt)
+		return &t
+	}
+	return nil
+}
+
+// body returns the item's Body, as set by its latest update or by the item
+// itself.
+func (i item) body() gregor.Body {
+	if i.bodyUpdate != nil {
+		return i.bodyUpdate.Body
+	}
+	return i.item.Body()
+}
+
+// isDismissedForDeviceAt returns true if item i is dismissed at time t,
+// either for all devices or just for the device d. A nil d stands for all
+// devices.
+func (i item) isDismissedForDeviceAt(d gregor.DeviceID, t time.Time) bool {
+	if i.isDismissedAt(t) {
+		return true
+	}
+	if d == nil {
+		return false
+	}
+	dtime, found := i.deviceDtimes[hex.EncodeToString(d.Bytes())]
+	return found && isBeforeOrSame(dtime, t)
+}
+
 // isDismissedAt returns true if the log message has an associated item
 // and that item was dismissed at time t.
 func (m loggedMsg) isDismissedAt(t time.Time) bool {
-	return m.i != nil && m.i.isDismissedAt(t)
+	return (m.i != nil && m.i.isDismissedAt(t)) || (m.target != nil && m.target.isDismissedAt(t))
+}
+
+// isDismissedForDeviceAt returns true if the log message has an associated
+// item and that item was dismissed for the device d at time t.
+func (m loggedMsg) isDismissedForDeviceAt(d gregor.DeviceID, t time.Time) bool {
+	return (m.i != nil && m.i.isDismissedForDeviceAt(d, t)) ||
+		(m.target != nil && m.target.isDismissedForDeviceAt(d, t))
+}
+
+// isLiveAt returns true if the log message created or updated an item that
+// hasn't been dismissed as of time t.
+func (m loggedMsg) isLiveAt(t time.Time) bool {
+	return (m.i != nil && !m.i.isDismissedAt(t)) || (m.target != nil && !m.target.isDismissedAt(t))
 }
 
 // export the item i to a generic gregor.Item interface. Basically just return
@@ -88,19 +304,188 @@ func (m loggedMsg) isDismissedAt(t time.Time) bool {
 // then use the ctime we stamped on the message when it arrived.
 func (i item) export(f gregor.ObjFactory) (gregor.Item, error) {
 	md := i.item.Metadata()
-	return f.MakeItem(md.UID(), md.MsgID(), md.DeviceID(), i.ctime, i.item.Category(), i.dtime, i.item.Body())
+	return f.MakeItem(md.UID(), md.MsgID(), md.DeviceID(), i.ctime, i.item.Category(), i.dtime, i.body())
+}
+
+// newItem makes the item for i, which arrived at now if it doesn't have a
+// ctime of its own.
+func newItem(now time.Time, i gregor.Item) *item {
+	ret := &item{item: i, ctime: nowIfZero(now, i.Metadata().CTime())}
+	ret.hlc = gregor.OrderingHLC(i.Metadata(), ret.ctime)
+	for _, t := range i.NotifyTimes() {
+		if t == nil {
+			continue
+		}
+		ret.notifyTimes = append(ret.notifyTimes, toTime(ret.ctime, t))
+	}
+	return ret
 }
 
 // addItem adds an item for this user
 func (u *user) addItem(now time.Time, i gregor.Item) *item {
-	newItem := &item{item: i, ctime: nowIfZero(now, i.Metadata().CTime())}
+	newItem := newItem(now, i)
 	u.items = append(u.items, newItem)
+	u.indexItem(newItem)
+	u.applyEarlierUpdates(newItem)
+	u.applyEarlierDismissals(newItem)
 	return newItem
 }
 
-// logMessage logs a message for this user and potentially associates an item
-func (u *user) logMessage(t time.Time, m gregor.InBandMessage, i *item) {
-	u.log = append(u.log, loggedMsg{m, t, i})
+// applyEarlierUpdates applies the updates we've already seen to the
+// newly-added item i, and links them to it in the log.
+func (u *user) applyEarlierUpdates(i *item) {
+	mid := msgIDtoString(i.item.Metadata().MsgID())
+	for _, up := range u.pendingUpdates[mid] {
+		i.applyUpdate(up)
+		if msg := u.findLogged(up.MsgID); msg != nil {
+			msg.target = i
+		}
+	}
+	delete(u.pendingUpdates, mid)
+}
+
+// applyUpdate replaces the item's body and dtime with those in up, unless
+// they were already replaced by a later update, or up is older than the
+// item itself.
+func (i *item) applyUpdate(up *appliedUpdate) {
+	if up.CTime.Before(i.ctime) {
+		return
+	}
+	if up.Body != nil && (i.bodyUpdate == nil || up.supersedes(i.bodyUpdate)) {
+		i.bodyUpdate = up
+	}
+	if up.DTime != nil && (i.dtimeUpdate == nil || up.supersedes(i.dtimeUpdate)) {
+		i.dtimeUpdate = up
+	}
+}
+
+// updateItem applies up to the item with the MsgID target, and returns it.
+// If there's no such item yet, up is kept until it arrives, and nil is
+// returned.
+func (u *user) updateItem(target gregor.MsgID, up *appliedUpdate) *item {
+	s := msgIDtoString(target)
+	if i := u.byMsgID[s]; i != nil {
+		i.applyUpdate(up)
+		return i
+	}
+	u.pendingUpdates[s] = append(u.pendingUpdates[s], up)
+	return nil
+}
+
+// applyEarlierDismissals dismisses the newly-added item i if we've already
+// seen a dismissal that targets it, which happens when messages arrive out
+// of order.
+func (u *user) applyEarlierDismissals(i *item) {
+	mid := msgIDtoString(i.item.Metadata().MsgID())
+	if dtime, found := u.dismissedIDs[mid]; found {
+		i.dismissAt(dtime)
+	}
+	for dev, dtime := range u.dismissedForDevices[mid] {
+		i.dismissForDeviceAt(dev, dtime)
+	}
+	for _, r := range u.dismissedRs {
+		if gregor.CategoryMatches(r.category, i.item.Category().String()) && r.covers(i.ctime, i.hlc) {
+			i.dismissAt(r.dtime)
+		}
+	}
+}
+
+// dismissAt dismisses the item as of time t, unless it was already dismissed
+// before then.
+func (i *item) dismissAt(t time.Time) {
+	if i.dtime == nil || t.Before(*i.dtime) {
+		i.dtime = &t
+	}
+}
+
+// dismissForDeviceAt dismisses the item for the device with the hex-encoded
+// DeviceID dev as of time t, unless it was already dismissed for it before
+// then.
+func (i *item) dismissForDeviceAt(dev string, t time.Time) {
+	if dtime, found := i.deviceDtimes[dev]; found && !t.Before(dtime) {
+		return
+	}
+	if i.deviceDtimes == nil {
+		i.deviceDtimes = make(map[string]time.Time)
+	}
+	i.deviceDtimes[dev] = t
+}
+
+// deleteNotifyTime removes t from the item's list of outstanding notify times.
+func (i *item) deleteNotifyTime(t time.Time) {
+	for j, nt := range i.notifyTimes {
+		if nt.Equal(t) {
+			i.notifyTimes = append(i.notifyTimes[:j], i.notifyTimes[j+1:]...)
+			return
+		}
+	}
+}
+
+// logMessage logs a message for this user and potentially associates an item,
+// or the item the message updated. Messages that came with a ctime keep it;
+// the rest are stamped with t.
+func (u *user) logMessage(t time.Time, m gregor.InBandMessage, i *item, target *item, digest string) {
+	ctime := nowIfZero(t, m.Metadata().CTime())
+	u.log = append(u.log, loggedMsg{m, ctime, gregor.OrderingHLC(m.Metadata(), ctime), i, digest, target})
+	u.indexLogged(len(u.log) - 1)
+}
+
+// trimLog drops entries from the log, as described for SetMaxLogLen, until
+// there are no more than max of them, treating now as the current time.
+func (u *user) trimLog(now time.Time, max int) {
+	excess := len(u.log) - max
+	if excess <= 0 {
+		return
+	}
+	drop := make(map[int]bool)
+	for j, msg := range u.log {
+		if excess > 0 && msg.isDismissedAt(now) {
+			drop[j] = true
+			excess--
+		}
+	}
+	for j, msg := range u.log {
+		if excess > 0 && msg.i == nil && msg.target == nil && !drop[j] {
+			drop[j] = true
+			excess--
+		}
+	}
+
+	dropItems := make(map[*item]bool)
+	var log []loggedMsg
+	for j, msg := range u.log {
+		if !drop[j] {
+			log = append(log, msg)
+		} else if msg.i != nil {
+			dropItems[msg.i] = true
+		}
+	}
+	u.log = log
+	var items [](*item)
+	for _, i := range u.items {
+		if !dropItems[i] {
+			items = append(items, i)
+		}
+	}
+	u.items = items
+	u.reindex()
+}
+
+// isReplay returns true if we've already logged a message with the given
+// MsgID and digest, or ErrMsgIDConflict if we've logged a different message
+// with the same MsgID.
+func (u *user) isReplay(md gregor.Metadata, digest string) (bool, error) {
+	if md.MsgID() == nil {
+		return false, nil
+	}
+	logged := u.findLogged(md.MsgID())
+	if logged == nil {
+		return false, nil
+	}
+	if logged.digest != digest {
+		return false, ErrMsgIDConflict{UID: md.UID(), MsgID: md.MsgID()}
+	}
+	return true, nil
 }
 
 func msgIDtoString(m gregor.MsgID) string {
@@ -108,13 +493,34 @@ func msgIDtoString(m gregor.MsgID) string {
 }
 
 func (u *user) dismissMsgIDs(now time.Time, ids []gregor.MsgID) {
-	set := make(map[string]struct{})
-	for _, i := range ids {
-		set[msgIDtoString(i)] = struct{}{}
+	for _, id := range ids {
+		s := msgIDtoString(id)
+		if dtime, found := u.dismissedIDs[s]; !found || now.Before(dtime) {
+			u.dismissedIDs[s] = now
+		}
+		if i := u.byMsgID[s]; i != nil {
+			i.dismissAt(now)
+		}
 	}
-	for _, i := range u.items {
-		if _, found := set[msgIDtoString(i.item.Metadata().MsgID())]; found {
-			i.dtime = &now
+}
+
+func (u *user) dismissMsgIDsForDevices(now time.Time, fds []gregor.MsgIDForDevice) {
+	for _, fd := range fds {
+		if fd.MsgID() == nil || fd.DeviceID() == nil {
+			continue
+		}
+		s := msgIDtoString(fd.MsgID())
+		dev := hex.EncodeToString(fd.DeviceID().Bytes())
+		devs := u.dismissedForDevices[s]
+		if devs == nil {
+			devs = make(map[string]time.Time)
+			u.dismissedForDevices[s] = devs
+		}
+		if dtime, found := devs[dev]; !found || now.Before(dtime) {
+			devs[dev] = now
+		}
+		if i := u.byMsgID[s]; i != nil {
+			i.dismissForDeviceAt(dev, now)
 		}
 	}
 }
@@ -139,13 +545,24 @@ func toTime(now time.Time, t gregor.TimeOrOffset) time.Time {
 	return now
 }
 
-func (u *user) dismissRanges(now time.Time, rs []gregor.MsgRange) {
-	for _, i := range u.items {
-		for _, r := range rs {
-			if r.Category().String() == i.item.Category().String() &&
-				isBeforeOrSame(i.ctime, toTime(now, r.EndTime())) {
-				i.dtime = &now
-				break
+// dismissRanges dismisses the ranges rs as of now, for a message stamped
+// with the HLC h.
+func (u *user) dismissRanges(now time.Time, h gregor.HLC, rs []gregor.MsgRange) {
+	var drs []dismissedRange
+	for _, r := range rs {
+		end := toTime(now, r.EndTime())
+		drs = append(drs, dismissedRange{
+			category: r.Category().String(),
+			end:      end,
+			hlc:      rangeHLC(end, now, h),
+			dtime:    now,
+		})
+	}
+	u.dismissedRs = append(u.dismissedRs, drs...)
+	for _, r := range drs {
+		for _, i := range u.byCategory[r.category] {
+			if r.covers(i.ctime, i.hlc) {
+				i.dismissAt(now)
 			}
 		}
 	}
@@ -165,41 +582,123 @@ func isBeforeOrSame(a, b time.Time) bool {
 	return !b.Before(a)
 }
 
+// isInStateAt returns true if item i is in the State of device d at time t.
+func (i item) isInStateAt(d gregor.DeviceID, t time.Time) bool {
+	did := i.item.Metadata().DeviceID()
+	if d != nil && did != nil && !bytes.Equal(did.Bytes(), d.Bytes()) {
+		return false
+	}
+	return !t.Before(i.ctime) && !i.isDismissedForDeviceAt(d, t)
+}
+
 func (u *user) state(now time.Time, f gregor.ObjFactory, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
-	var items []gregor.Item
+	return stateOf(u.items, now, f, d, t)
+}
+
+// stateInCategory returns the part of the State in the category c, using
+// the category index.
+func (u *user) stateInCategory(now time.Time, f gregor.ObjFactory, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) (gregor.State, error) {
+	return stateOf(u.byCategory[c.String()], now, f, d, t)
+}
+
+// stateOf returns the State of device d at time t made of those of items
+// that are in it.
+func stateOf(items [](*item), now time.Time, f gregor.ObjFactory, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
+	var ret []gregor.Item
 	if t == nil {
 		t = timeOrOffset(now)
 	}
-	for _, i := range u.items {
-		md := i.item.Metadata()
-		did := md.DeviceID()
-		if d != nil && did != nil && !bytes.Equal(did.Bytes(), d.Bytes()) {
+	for _, i := range items {
+		if !i.isInStateAt(d, toTime(now, t)) {
 			continue
 		}
-		if toTime(now, t).Before(i.ctime) {
-			continue
+		exported, err := i.export(f)
+		if err != nil {
+			return nil, err
 		}
-		if i.isDismissedAt(toTime(now, t)) {
-			continue
+		ret = append(ret, exported)
+	}
+	return f.MakeState(ret)
+}
+
+// userLiveItems answers Quotas.check's questions about the user u's live
+// items as of now from the user's item indexes.
+type userLiveItems struct {
+	u   *user
+	f   gregor.ObjFactory
+	now time.Time
+}
+
+var _ liveItems = userLiveItems{}
+
+// candidates returns the user's items, live or not, or just those in the
+// category c if inCategory is true.
+func (l userLiveItems) candidates(c string, inCategory bool) [](*item) {
+	if inCategory {
+		return l.u.byCategory[c]
+	}
+	return l.u.items
+}
+
+func (l userLiveItems) count(c string, inCategory bool) (int, error) {
+	n := 0
+	for _, i := range l.candidates(c, inCategory) {
+		if i.isInStateAt(nil, l.now) {
+			n++
 		}
-		exported, err := i.export(f)
+	}
+	return n, nil
+}
+
+func (l userLiveItems) oldest(n int, c string, inCategory bool) ([]gregor.Item, error) {
+	var live [](*item)
+	for _, i := range l.candidates(c, inCategory) {
+		if i.isInStateAt(nil, l.now) {
+			live = append(live, i)
+		}
+	}
+	sort.Sort(itemsByCTime(live))
+	if len(live) > n {
+		live = live[:n]
+	}
+	var ret []gregor.Item
+	for _, i := range live {
+		exported, err := i.export(l.f)
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, exported)
+		ret = append(ret, exported)
 	}
-	return f.MakeState(items)
+	return ret, nil
 }
 
-func isMessageForDevice(m gregor.InBandMessage, d gregor.DeviceID) bool {
-	sum := m.ToStateUpdateMessage()
-	if sum == nil {
-		return true
+// stateDiff returns the items that are in the State of device d at time to
+// but weren't at from, and the MsgIDs of those that were at from but aren't
+// at to.
+func (u *user) stateDiff(now time.Time, f gregor.ObjFactory, d gregor.DeviceID, from, to gregor.TimeOrOffset) ([]gregor.Item, []gregor.MsgID, error) {
+	var added []gregor.Item
+	var removed []gregor.MsgID
+	for _, i := range u.items {
+		was, is := i.isInStateAt(d, toTime(now, from)), i.isInStateAt(d, toTime(now, to))
+		switch {
+		case is && !was:
+			exported, err := i.export(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			added = append(added, exported)
+		case was && !is:
+			removed = append(removed, i.item.Metadata().MsgID())
+		}
 	}
+	return added, removed, nil
+}
+
+func isMessageForDevice(m gregor.InBandMessage, d gregor.DeviceID) bool {
 	if d == nil {
 		return true
 	}
-	did := sum.Metadata().DeviceID()
+	did := m.Metadata().DeviceID()
 	if did == nil {
 		return true
 	}
@@ -209,8 +708,10 @@ func isMessageForDevice(m gregor.InBandMessage, d gregor.DeviceID) bool {
 	return false
 }
 
-func (u *user) replayLog(now time.Time, d gregor.DeviceID, t gregor.TimeOrOffset) []gregor.InBandMessage {
-	var ret []gregor.InBandMessage
+// replayLog returns the messages in the log for device d since time t, in
+// HLC order.
+func (u *user) replayLog(now time.Time, d gregor.DeviceID, t gregor.TimeOrOffset) []loggedMsg {
+	var ret []loggedMsg
 	for _, msg := range u.log {
 		if !isMessageForDevice(msg.m, d) {
 			continue
@@ -218,41 +719,179 @@ func (u *user) replayLog(now time.Time, d gregor.DeviceID, t gregor.TimeOrOffset
 		if msg.ctime.Before(toTime(now, t)) {
 			continue
 		}
-		if msg.isDismissedAt(now) {
+		if msg.isDismissedForDeviceAt(d, now) {
 			continue
 		}
 
-		ret = append(ret, msg.m)
+		ret = append(ret, msg)
 	}
+	sort.Sort(loggedMsgsByHLC(ret))
 	return ret
 }
 
+type loggedMsgsByHLC []loggedMsg
+
+func (l loggedMsgsByHLC) Len() int      { return len(l) }
+func (l loggedMsgsByHLC) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l loggedMsgsByHLC) Less(i, j int) bool {
+	if l[i].hlc != l[j].hlc {
+		return l[i].hlc < l[j].hlc
+	}
+	return bytes.Compare(msgIDBytes(l[i].m.Metadata().MsgID()), msgIDBytes(l[j].m.Metadata().MsgID())) < 0
+}
+
+// replayLogPage returns up to limit of the messages replayLog would, in
+// cursor order, starting after c if it's non-nil.
+func (u *user) replayLogPage(now time.Time, d gregor.DeviceID, t gregor.TimeOrOffset, c *msgCursor, limit int) ([]gregor.InBandMessage, []byte) {
+	msgs := u.replayLog(now, d, t)
+	var ret []gregor.InBandMessage
+	var last *msgCursor
+	for _, msg := range msgs {
+		if len(ret) == limit {
+			break
+		}
+		mid := msg.m.Metadata().MsgID()
+		if c != nil && c.isBefore(msg.hlc, mid) {
+			continue
+		}
+		ret = append(ret, msg.m)
+		last = newMsgCursor(msg.hlc, mid)
+	}
+	return ret, nextCursor(len(ret), limit, last)
+}
+
 func (m *MemEngine) consumeInBandMessage(uid gregor.UID, msg gregor.InBandMessage) error {
 	user := m.getUser(uid)
+	digest := messageDigest(msg)
+	if replay, err := user.isReplay(msg.Metadata(), digest); err != nil || replay {
+		return err
+	}
 	now := m.clock.Now()
-	var i *item
+	if md := msg.Metadata(); md.CTime().IsZero() {
+		md.SetCTime(now)
+	}
+	if m.wal != nil {
+		rec := newMsgRecord(msg, nowIfZero(now, msg.Metadata().CTime()))
+		if err := m.logOp(walEntry{Op: walOpMessage, Msg: rec}); err != nil {
+			return err
+		}
+	}
+	var i, target *item
 	var err error
 	switch {
 	case msg.ToStateUpdateMessage() != nil:
-		i, err = m.consumeStateUpdateMessage(user, now, msg.ToStateUpdateMessage())
+		i, target, err = m.consumeStateUpdateMessage(user, now, msg.ToStateUpdateMessage())
 	default:
 	}
-	user.logMessage(now, msg, i)
+	user.logMessage(now, msg, i, target, digest)
 	return err
 }
 
+// queueOOB adds r to the user's queue of out-of-band messages, dropping any
+// that have expired as of now.
+func (u *user) queueOOB(now time.Time, r *oobRecord) {
+	var oob [](*oobRecord)
+	for _, q := range u.oob {
+		if q.ETime.After(now) {
+			oob = append(oob, q)
+		}
+	}
+	u.oob = append(oob, r)
+}
+
+// hasOOB returns true if r is already queued for u.
+func (u *user) hasOOB(r *oobRecord) bool {
+	for _, q := range u.oob {
+		if q.sameAs(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// consumeOutOfBandMessage queues msg if its System has a retention set, and
+// otherwise ignores it.
+func (m *MemEngine) consumeOutOfBandMessage(msg gregor.OutOfBandMessage) error {
+	ttl := m.oobRetention.For(msg.System())
+	if ttl <= 0 || msg.UID() == nil {
+		return nil
+	}
+	now := m.clock.Now()
+	r := newOOBRecord(msg, now, now.Add(ttl))
+	if err := m.logOp(walEntry{Op: walOpOutOfBand, OOB: r}); err != nil {
+		return err
+	}
+	m.getUser(msg.UID()).queueOOB(now, r)
+	return nil
+}
+
 func (m *MemEngine) ConsumeMessage(msg gregor.Message) error {
 	m.Lock()
 	defer m.Unlock()
 
 	switch {
 	case msg.ToInBandMessage() != nil:
-		return m.consumeInBandMessage(gregor.UIDFromMessage(msg), msg.ToInBandMessage())
+		uid := gregor.UIDFromMessage(msg)
+		if err := m.enforceQuotas(uid, msg.ToInBandMessage()); err != nil {
+			return err
+		}
+		if err := m.consumeInBandMessage(uid, msg.ToInBandMessage()); err != nil {
+			return err
+		}
+		if err := m.trimLog(uid); err != nil {
+			return err
+		}
+		return m.maybeSnapshot()
+	case msg.ToOutOfBandMessage() != nil:
+		if err := m.consumeOutOfBandMessage(msg.ToOutOfBandMessage()); err != nil {
+			return err
+		}
+		return m.maybeSnapshot()
 	default:
 		return nil
 	}
 }
 
+// enforceQuotas checks msg against the engine's quotas, and consumes any
+// dismissals needed to make room for it.
+func (m *MemEngine) enforceQuotas(uid gregor.UID, msg gregor.InBandMessage) error {
+	if !m.quotas.appliesTo(msg) {
+		return nil
+	}
+	u := m.getUser(uid)
+	if replay, err := u.isReplay(msg.Metadata(), messageDigest(msg)); err != nil || replay {
+		// consumeInBandMessage deals with these.
+		return nil
+	}
+	now := m.clock.Now()
+	ds, err := m.quotas.check(m.objFactory, now, userLiveItems{u: u, f: m.objFactory, now: now}, msg)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if err := m.consumeInBandMessage(uid, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimLog trims the user u's log if it's grown longer than the engine's
+// bound.
+func (m *MemEngine) trimLog(uid gregor.UID) error {
+	u := m.getUser(uid)
+	if m.maxLogLen <= 0 || len(u.log) <= m.maxLogLen {
+		return nil
+	}
+	now := m.clock.Now()
+	e := walEntry{Op: walOpTrimLog, UID: toRecBytes(uid), Time: now, Limit: m.maxLogLen}
+	if err := m.logOp(e); err != nil {
+		return err
+	}
+	u.trimLog(now, m.maxLogLen)
+	return nil
+}
+
 func uidToString(u gregor.UID) string {
 	return hex.EncodeToString(u.Bytes())
 }
@@ -273,32 +912,46 @@ func (m *MemEngine) consumeCreation(u *user, now time.Time, i gregor.Item) (*ite
 	return newItem, nil
 }
 
-func (m *MemEngine) consumeDismissal(u *user, now time.Time, d gregor.Dismissal, ctime time.Time) error {
-	dtime := nowIfZero(now, ctime)
+func (m *MemEngine) consumeDismissal(u *user, now time.Time, d gregor.Dismissal, md gregor.Metadata) error {
+	dtime := nowIfZero(now, md.CTime())
 	if ids := d.MsgIDsToDismiss(); ids != nil {
 		u.dismissMsgIDs(dtime, ids)
 	}
 	if r := d.RangesToDismiss(); r != nil {
-		u.dismissRanges(dtime, r)
+		u.dismissRanges(dtime, gregor.HLCOf(md), r)
+	}
+	if fds := d.MsgIDsToDismissForDevice(); fds != nil {
+		u.dismissMsgIDsForDevices(dtime, fds)
 	}
 	return nil
 }
 
-func (m *MemEngine) consumeStateUpdateMessage(u *user, now time.Time, msg gregor.StateUpdateMessage) (*item, error) {
+// consumeUpdate applies the update up, from the message with Metadata md,
+// and returns the item it changed, if that's arrived yet.
+func (m *MemEngine) consumeUpdate(u *user, now time.Time, up gregor.ItemUpdate, md gregor.Metadata) *item {
+	if up.MsgID() == nil {
+		return nil
+	}
+	return u.updateItem(up.MsgID(), newAppliedUpdate(up, md.MsgID(), nowIfZero(now, md.CTime())))
+}
+
+func (m *MemEngine) consumeStateUpdateMessage(u *user, now time.Time, msg gregor.StateUpdateMessage) (*item, *item, error) {
 	var err error
-	var i *item
+	var i, target *item
 	if msg.Creation() != nil {
 		if i, err = m.consumeCreation(u, now, msg.Creation()); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	if msg.Dismissal() != nil {
-		md := msg.Metadata()
-		if err = m.consumeDismissal(u, now, msg.Dismissal(), md.CTime()); err != nil {
-			return nil, err
+		if err = m.consumeDismissal(u, now, msg.Dismissal(), msg.Metadata()); err != nil {
+			return nil, nil, err
 		}
 	}
-	return i, nil
+	if msg.Update() != nil {
+		target = m.consumeUpdate(u, now, msg.Update(), msg.Metadata())
+	}
+	return i, target, nil
 }
 
 func (m *MemEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
@@ -308,10 +961,348 @@ func (m *MemEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset
 	return user.state(m.clock.Now(), m.objFactory, d, t)
 }
 
+func (m *MemEngine) StateInCategory(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) (gregor.State, error) {
+	m.Lock()
+	defer m.Unlock()
+	user := m.getUser(u)
+	return user.stateInCategory(m.clock.Now(), m.objFactory, d, t, c)
+}
+
+func (m *MemEngine) StateDiff(u gregor.UID, d gregor.DeviceID, from, to gregor.TimeOrOffset) ([]gregor.Item, []gregor.MsgID, error) {
+	m.Lock()
+	defer m.Unlock()
+	user := m.getUser(u)
+	return user.stateDiff(m.clock.Now(), m.objFactory, d, from, to)
+}
+
+// reminders returns the reminders for this user's undismissed items that are
+// due at or before the given time.
+func (u *user) reminders(now time.Time, f gregor.ObjFactory, before time.Time) ([]gregor.Reminder, error) {
+	var ret []gregor.Reminder
+	for _, i := range u.items {
+		if i.isDismissedAt(now) {
+			continue
+		}
+		for _, nt := range i.notifyTimes {
+			if !isBeforeOrSame(nt, before) {
+				continue
+			}
+			exported, err := i.export(f)
+			if err != nil {
+				return nil, err
+			}
+			r, err := f.MakeReminder(exported, nt)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+func (u *user) findItem(m gregor.MsgID) *item {
+	return u.byMsgID[msgIDtoString(m)]
+}
+
+type remindersByTime []gregor.Reminder
+
+func (r remindersByTime) Len() int           { return len(r) }
+func (r remindersByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r remindersByTime) Less(i, j int) bool { return r[i].RemindTime().Before(r[j].RemindTime()) }
+
+func (m *MemEngine) Reminders(before time.Time) ([]gregor.Reminder, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := m.clock.Now()
+	var ret []gregor.Reminder
+	for _, u := range m.users {
+		rs, err := u.reminders(now, m.objFactory, before)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rs...)
+	}
+	sort.Sort(remindersByTime(ret))
+	return ret, nil
+}
+
+func (m *MemEngine) DeleteReminder(r gregor.Reminder) error {
+	m.Lock()
+	defer m.Unlock()
+	md := r.Item().Metadata()
+	e := walEntry{
+		Op:    walOpDeleteReminder,
+		UID:   toRecBytes(md.UID()),
+		MsgID: toRecBytes(md.MsgID()),
+		Time:  r.RemindTime(),
+	}
+	if err := m.logOp(e); err != nil {
+		return err
+	}
+	m.deleteReminder(md.UID(), md.MsgID(), r.RemindTime())
+	return m.maybeSnapshot()
+}
+
+func (m *MemEngine) deleteReminder(u gregor.UID, msgID gregor.MsgID, t time.Time) {
+	if i := m.getUser(u).findItem(msgID); i != nil {
+		i.deleteNotifyTime(t)
+	}
+}
+
+// prune drops items that were dismissed or expired at or before the given
+// time, logged messages from before then that no longer refer to a live
+// item, dismissals of pruned items from before then, and out-of-band
+// messages that expired by then. Dismissals and updates of items that never
+// arrived, and range dismissals, are dropped once they're from before
+// gregor.OrphanRetention earlier. It returns true if nothing is left for
+// this user.
+func (u *user) prune(before time.Time) bool {
+	orphanBefore := before.Add(-gregor.OrphanRetention)
+	// byMsgID still indexes the items from before the prune until the
+	// reindex below, which is how we tell pruned items from missing ones.
+	expired := func(id string, dtime time.Time) bool {
+		return isBeforeOrSame(dtime, before) && (u.byMsgID[id] != nil || isBeforeOrSame(dtime, orphanBefore))
+	}
+
+	var items [](*item)
+	for _, i := range u.items {
+		if !i.isDismissedAt(before) {
+			items = append(items, i)
+		}
+	}
+	u.items = items
+
+	var log []loggedMsg
+	for _, msg := range u.log {
+		if msg.ctime.After(before) || msg.isLiveAt(before) {
+			log = append(log, msg)
+		}
+	}
+	u.log = log
+
+	for id, dtime := range u.dismissedIDs {
+		if expired(id, dtime) {
+			delete(u.dismissedIDs, id)
+		}
+	}
+	var rs []dismissedRange
+	for _, r := range u.dismissedRs {
+		if r.dtime.After(orphanBefore) {
+			rs = append(rs, r)
+		}
+	}
+	u.dismissedRs = rs
+	for id, devs := range u.dismissedForDevices {
+		for dev, dtime := range devs {
+			if expired(id, dtime) {
+				delete(devs, dev)
+			}
+		}
+		if len(devs) == 0 {
+			delete(u.dismissedForDevices, id)
+		}
+	}
+	for id, ups := range u.pendingUpdates {
+		var keep [](*appliedUpdate)
+		for _, up := range ups {
+			if up.CTime.After(orphanBefore) {
+				keep = append(keep, up)
+			}
+		}
+		if len(keep) == 0 {
+			delete(u.pendingUpdates, id)
+		} else {
+			u.pendingUpdates[id] = keep
+		}
+	}
+	u.reindex()
+
+	var oob [](*oobRecord)
+	for _, q := range u.oob {
+		if q.ETime.After(before) {
+			oob = append(oob, q)
+		}
+	}
+	u.oob = oob
+
+	return len(u.items) == 0 && len(u.log) == 0 && len(u.dismissedIDs) == 0 && len(u.dismissedRs) == 0 &&
+		len(u.dismissedForDevices) == 0 && len(u.pendingUpdates) == 0 && len(u.oob) == 0
+}
+
+// Prune permanently forgets Items that were dismissed or expired at or before
+// the given time, along with any messages from before then that no longer
+// affect live Items, and queued out-of-band messages that have expired. The
+// dismissals and updates of Items that never arrived are kept for
+// gregor.OrphanRetention longer.
+func (m *MemEngine) Prune(before time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.logOp(walEntry{Op: walOpPrune, Time: before}); err != nil {
+		return err
+	}
+	m.prune(before)
+	return m.maybeSnapshot()
+}
+
+func (m *MemEngine) prune(before time.Time) {
+	for k, u := range m.users {
+		if u.prune(before) {
+			delete(m.users, k)
+		}
+	}
+}
+
+// Users returns all the users that have anything stored.
+func (m *MemEngine) Users() ([]gregor.UID, error) {
+	m.Lock()
+	defer m.Unlock()
+	var ret []gregor.UID
+	for k := range m.users {
+		b, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, err
+		}
+		u, err := m.objFactory.MakeUID(b)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+// DeleteUser forgets everything stored for the user u.
+func (m *MemEngine) DeleteUser(u gregor.UID) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.logOp(walEntry{Op: walOpDeleteUser, UID: toRecBytes(u)}); err != nil {
+		return err
+	}
+	delete(m.users, uidToString(u))
+	return m.maybeSnapshot()
+}
+
 func (m *MemEngine) InBandMessagesSince(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) ([]gregor.InBandMessage, error) {
 	m.Lock()
 	defer m.Unlock()
 	user := m.getUser(u)
-	msg := user.replayLog(m.clock.Now(), d, t)
-	return msg, nil
+	var ret []gregor.InBandMessage
+	for _, msg := range user.replayLog(m.clock.Now(), d, t) {
+		ret = append(ret, msg.m)
+	}
+	return ret, nil
+}
+
+// InBandMessagesSinceSync returns the messages since the sync message sync,
+// or ErrUnknownSyncMarker if there's no such sync message for u.
+func (m *MemEngine) InBandMessagesSinceSync(u gregor.UID, d gregor.DeviceID, sync gregor.MsgID) ([]gregor.InBandMessage, error) {
+	m.Lock()
+	defer m.Unlock()
+	user := m.getUser(u)
+	marker := user.findLogged(sync)
+	if marker == nil || marker.m.ToStateSyncMessage() == nil {
+		return nil, ErrUnknownSyncMarker{UID: u, MsgID: sync}
+	}
+	var ret []gregor.InBandMessage
+	for _, msg := range user.replayLog(m.clock.Now(), d, timeOrOffset(marker.ctime)) {
+		ret = append(ret, msg.m)
+	}
+	return withoutMsgID(ret, sync), nil
+}
+
+func (m *MemEngine) InBandMessagesPage(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, cursor []byte, limit int) ([]gregor.InBandMessage, []byte, error) {
+	if limit <= 0 {
+		return nil, nil, ErrBadPageLimit
+	}
+	c, err := decodeMsgCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	msgs, next := m.getUser(u).replayLogPage(m.clock.Now(), d, t, c, limit)
+	return msgs, next, nil
+}
+
+// QueuedOutOfBandMessages returns the out-of-band messages queued for u that
+// haven't expired yet, oldest first.
+func (m *MemEngine) QueuedOutOfBandMessages(u gregor.UID) ([]gregor.OutOfBandMessage, error) {
+	m.Lock()
+	defer m.Unlock()
+	user, ok := m.users[uidToString(u)]
+	if !ok {
+		return nil, nil
+	}
+	now := m.clock.Now()
+	var ret []gregor.OutOfBandMessage
+	for _, q := range user.oob {
+		if !q.ETime.After(now) {
+			continue
+		}
+		oobm, err := q.export(m.objFactory)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, oobm)
+	}
+	return ret, nil
+}
+
+// Export returns the messages in u's log, with the notify times of their
+// Items that haven't come due yet, and the out-of-band messages queued for
+// u that haven't expired.
+func (m *MemEngine) Export(u gregor.UID) (*UserExport, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := m.clock.Now()
+	var msgs [](*msgRecord)
+	var oob [](*oobRecord)
+	if user, ok := m.users[uidToString(u)]; ok {
+		for _, msg := range user.log {
+			rec := newMsgRecord(msg.m, msg.ctime)
+			if msg.i != nil && rec.Creation_ != nil {
+				rec.setNotifyTimes(msg.i.notifyTimes)
+			}
+			msgs = append(msgs, rec)
+		}
+		for _, q := range user.oob {
+			if q.ETime.After(now) {
+				oob = append(oob, q)
+			}
+		}
+	}
+	e := newUserExport(u, now, msgs)
+	e.OutOfBand = oob
+	return e, nil
+}
+
+// Import consumes the messages in e, as if they'd just arrived with their
+// original ctimes.
+func (m *MemEngine) Import(e *UserExport) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	uid := e.uid()
+	for _, rec := range e.Messages {
+		if err := m.consumeInBandMessage(uid, rec); err != nil {
+			return err
+		}
+		if err := m.trimLog(uid); err != nil {
+			return err
+		}
+	}
+	now := m.clock.Now()
+	for _, r := range e.OutOfBand {
+		if !r.ETime.After(now) || m.getUser(uid).hasOOB(r) {
+			continue
+		}
+		if err := m.logOp(walEntry{Op: walOpOutOfBand, OOB: r}); err != nil {
+			return err
+		}
+		m.getUser(uid).queueOOB(now, r)
+	}
+	return m.maybeSnapshot()
 }
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	gregor "github.com/keybase/gregor"
+)
+
+// Rough per-object overheads, in bytes, of the structures a MemEngine keeps
+// for each user, on top of the variable-length data in them. They're
+// estimates meant for capacity planning, not exact accounting.
+const (
+	memItemOverhead      = 96
+	memLogEntryOverhead  = 128
+	memDismissalOverhead = 64
+	memOOBOverhead       = 96
+	memTimeSize          = 24
+)
+
+// MemStats describes what a MemEngine holds for a single user.
+type MemStats struct {
+	// Items is the number of Items stored, including those that have been
+	// dismissed or have expired but haven't been pruned yet.
+	Items int
+
+	// LogEntries is the number of messages in the user's log.
+	LogEntries int
+
+	// Dismissals is the number of dismissals, by MsgID, by range and by
+	// MsgID for a single device, that are remembered in case their Items
+	// arrive late.
+	Dismissals int
+
+	// OutOfBand is the number of OutOfBandMessages queued, including those
+	// that have expired but haven't been pruned yet.
+	OutOfBand int
+
+	// Bytes is an estimate of the memory used for all of the above.
+	Bytes int
+}
+
+// Add returns the sum of s and t.
+func (s MemStats) Add(t MemStats) MemStats {
+	return MemStats{
+		Items:      s.Items + t.Items,
+		LogEntries: s.LogEntries + t.LogEntries,
+		Dismissals: s.Dismissals + t.Dismissals,
+		OutOfBand:  s.OutOfBand + t.OutOfBand,
+		Bytes:      s.Bytes + t.Bytes,
+	}
+}
+
+func byterSize(b byter) int {
+	if b == nil {
+		return 0
+	}
+	return len(b.Bytes())
+}
+
+// messageSize estimates the size of the data in m.
+func messageSize(m gregor.InBandMessage) int {
+	md := m.Metadata()
+	n := byterSize(md.UID()) + byterSize(md.MsgID()) + byterSize(md.DeviceID())
+	sum := m.ToStateUpdateMessage()
+	if sum == nil {
+		return n
+	}
+	if c := sum.Creation(); c != nil {
+		n += len(c.Category().String()) + byterSize(c.Body())
+		n += memTimeSize * (1 + len(c.NotifyTimes()))
+	}
+	if d := sum.Dismissal(); d != nil {
+		for _, id := range d.MsgIDsToDismiss() {
+			n += byterSize(id)
+		}
+		for _, r := range d.RangesToDismiss() {
+			n += len(r.Category().String()) + memTimeSize
+		}
+		for _, fd := range d.MsgIDsToDismissForDevice() {
+			n += byterSize(fd.MsgID()) + byterSize(fd.DeviceID())
+		}
+	}
+	if up := sum.Update(); up != nil {
+		n += byterSize(up.MsgID()) + byterSize(up.Body()) + memTimeSize
+	}
+	return n
+}
+
+// stats returns what's held for this user. An Item's data is counted with
+// the message that created it, since every stored Item has one in the log.
+func (u *user) stats() MemStats {
+	s := MemStats{
+		Items:      len(u.items),
+		LogEntries: len(u.log),
+		Dismissals: len(u.dismissedIDs) + len(u.dismissedRs),
+		OutOfBand:  len(u.oob),
+	}
+	for _, i := range u.items {
+		s.Bytes += memItemOverhead + memTimeSize*len(i.notifyTimes)
+		for dev := range i.deviceDtimes {
+			s.Bytes += memDismissalOverhead + len(dev)
+		}
+	}
+	for _, msg := range u.log {
+		s.Bytes += memLogEntryOverhead + len(msg.digest) + messageSize(msg.m)
+	}
+	for id := range u.dismissedIDs {
+		s.Bytes += memDismissalOverhead + len(id)
+	}
+	for _, r := range u.dismissedRs {
+		s.Bytes += memDismissalOverhead + len(r.category)
+	}
+	for id, devs := range u.dismissedForDevices {
+		s.Dismissals += len(devs)
+		for dev := range devs {
+			s.Bytes += memDismissalOverhead + len(id) + len(dev)
+		}
+	}
+	for _, q := range u.oob {
+		s.Bytes += memOOBOverhead + len(q.UID_) + len(q.System_) + len(q.Body_)
+	}
+	return s
+}
+
+// UserStats returns what the engine holds for the user u.
+func (m *MemEngine) UserStats(u gregor.UID) MemStats {
+	m.Lock()
+	defer m.Unlock()
+	if user, ok := m.users[uidToString(u)]; ok {
+		return user.stats()
+	}
+	return MemStats{}
+}
+
+// Stats returns what the engine holds for each of its users, keyed by the
+// hex encoding of their UIDs.
+func (m *MemEngine) Stats() map[string]MemStats {
+	m.Lock()
+	defer m.Unlock()
+	ret := make(map[string]MemStats)
+	for k, u := range m.users {
+		ret[k] = u.stats()
+	}
+	return ret
+}
@@ -2,13 +2,123 @@ package storage
 
 import (
 	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	protocol "github.com/keybase/gregor/protocol/go"
 	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestMemEngine(t *testing.T) {
 	cl := clockwork.NewFakeClock()
 	eng := NewMemEngine(test.TestObjFactory{}, cl)
+	eng.SetOOBRetention(testOOBRetention)
 	test.TestStateMachineAllDevices(t, eng, cl)
 	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachinePrune(t, eng, cl)
+	test.TestStateMachineReplay(t, eng, cl)
+	test.TestStateMachineReorder(t, eng, cl)
+	test.TestStateMachinePaging(t, eng, cl)
+	test.TestStateMachineSync(t, eng, cl)
+	test.TestStateMachineStateDiff(t, eng, cl)
+	test.TestStateMachineCategories(t, eng, cl)
+	test.TestStateMachineOutOfBand(t, eng, cl)
+	test.TestStateMachineDeviceDismissal(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	test.TestStateMachineHLC(t, eng, cl)
+	testQuotas(t, eng, cl)
+	testReplayConflict(t, eng)
+}
+
+func makeDismissal(t *testing.T, msgID string, target string) gregor.Message {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("replay user"))
+	m, _ := of.MakeMsgID([]byte(msgID))
+	d, _ := of.MakeMsgID([]byte(target))
+	ibm, err := of.MakeDismissalByID(u, m, nil, time.Time{}, d)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func testMaxLogLen(t *testing.T, eng *MemEngine, cl clockwork.FakeClock) {
+	u, _ := test.TestObjFactory{}.MakeUID([]byte("replay user"))
+	logged := func() []string {
+		var ret []string
+		msgs, err := eng.InBandMessagesSince(u, nil, timeOrOffset(time.Time{}))
+		require.Nil(t, err, "no error from InBandMessagesSince")
+		for _, m := range msgs {
+			ret = append(ret, string(m.Metadata().MsgID().Bytes()))
+		}
+		return ret
+	}
+	consume := func(m gregor.Message) {
+		require.Nil(t, eng.ConsumeMessage(m), "no error from ConsumeMessage")
+		cl.Advance(time.Second)
+	}
+
+	eng.SetMaxLogLen(3)
+	consume(makeCreation(t, "r1", "a"))
+	consume(makeCreation(t, "r2", "b"))
+	consume(makeCreation(t, "r3", "c"))
+	consume(makeDismissal(t, "d1", "r1"))
+	require.Equal(t, []string{"r2", "r3", "d1"}, logged(), "dismissed item evicted first")
+	require.Equal(t, 2, eng.UserStats(u).Items, "evicted item dropped")
+
+	consume(makeCreation(t, "r4", "d"))
+	require.Equal(t, []string{"r2", "r3", "r4"}, logged(), "then messages without items")
+
+	consume(makeCreation(t, "r5", "e"))
+	require.Equal(t, []string{"r2", "r3", "r4", "r5"}, logged(), "live items are kept")
+	s := eng.UserStats(u)
+	require.Equal(t, 4, s.Items, "four items")
+	require.Equal(t, 4, s.LogEntries, "four log entries")
+	require.Equal(t, 1, s.Dismissals, "one dismissal remembered")
+	require.True(t, s.Bytes > 0, "some bytes used")
+	require.Equal(t, s, eng.Stats()[uidToString(u)], "same stats from Stats")
+
+	// An evicted message isn't recognized as a replay anymore, but its
+	// dismissal still applies.
+	consume(makeCreation(t, "r1", "a"))
+	st, err := eng.State(u, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, _ := st.Items()
+	require.Equal(t, 4, len(items), "r1 stays dismissed")
+}
+
+func TestMemEngineMaxLogLen(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	eng := NewMemEngine(test.TestObjFactory{}, cl)
+	testMaxLogLen(t, eng, cl)
+	u, _ := test.TestObjFactory{}.MakeUID([]byte("replay user"))
+	require.Nil(t, eng.DeleteUser(u), "no error from DeleteUser")
+	require.Equal(t, MemStats{}, eng.UserStats(u), "nothing left")
+}
+
+func TestMemEngineProtocolItems(t *testing.T) {
+	of := protocol.ObjFactory{}
+	cl := clockwork.NewFakeClock()
+	eng := NewMemEngine(of, cl)
+	u, _ := of.MakeUID([]byte("protocol user"))
+	dev, _ := of.MakeDeviceID([]byte("protocol device"))
+	m, _ := of.MakeMsgID([]byte("p1"))
+	c, _ := of.MakeCategory("protocol")
+	b, _ := of.MakeBody([]byte("body"))
+	i, err := of.MakeItem(u, m, dev, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	require.Nil(t, eng.ConsumeMessage(msg), "no error from ConsumeMessage")
+
+	cl.Advance(time.Second)
+	st, err := eng.State(u, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, err := st.Items()
+	require.Nil(t, err, "no error from Items")
+	require.Equal(t, 1, len(items), "an Item without a DTime doesn't expire")
 }
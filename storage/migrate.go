@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// ErrUnknownEngine is returned when asked to work with a database/sql driver
+// that we don't have a schema for.
+type ErrUnknownEngine string
+
+func (e ErrUnknownEngine) Error() string { return "unknown SQL engine: " + string(e) }
+
+// migration is a single step in bringing a database's schema up to date.
+// Migrations are applied in order of version, each exactly once, and the
+// versions applied are recorded in the schema_version table.
+type migration struct {
+	version int
+	stmts   []string
+}
+
+// crossUserIndexes let Prune find expired items, and Reminders find due
+// reminders, across all users; cleanup_order only helps when looking within
+// a single user. reminder_order isn't in the base schema, since databases
+// adopted as version 1 wouldn't have it.
+var crossUserIndexes = []string{
+	`CREATE INDEX prune_order ON items (dtime)`,
+	`CREATE INDEX reminder_order ON reminders (ntime)`,
+}
+
+// messageDigestColumn lets ConsumeMessage tell exact replays of a message apart
+// from different messages that reuse its MsgID.
+var messageDigestColumn = []string{
+	`ALTER TABLE messages ADD COLUMN digest CHAR(64)`,
+}
+
+// oobIndexes go with the oob_messages tables below. The column is called sys
+// rather than system, which is reserved in MySQL.
+var oobIndexes = []string{
+	`CREATE INDEX oob_user_order ON oob_messages (uid, ctime)`,
+	`CREATE INDEX oob_expiry ON oob_messages (etime)`,
+}
+
+// The oob_messages tables queue OutOfBandMessages for devices that are
+// offline, until etime.
+var mysqlOOBTable = append([]string{
+	`CREATE TABLE oob_messages (
+		id    BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+		uid   CHAR(16) NOT NULL,
+		sys   VARCHAR(128) NOT NULL,
+		body  BLOB,
+		ctime DATETIME(6) NOT NULL,
+		etime DATETIME(6) NOT NULL,
+		PRIMARY KEY(id)
+	)`,
+}, oobIndexes...)
+
+var sqliteOOBTable = append([]string{
+	`CREATE TABLE oob_messages (
+		id    INTEGER PRIMARY KEY AUTOINCREMENT,
+		uid   TEXT NOT NULL,
+		sys   TEXT NOT NULL,
+		body  BLOB,
+		ctime INTEGER NOT NULL,
+		etime INTEGER NOT NULL
+	)`,
+}, oobIndexes...)
+
+var postgresOOBTable = append([]string{
+	`CREATE TABLE oob_messages (
+		id    BIGSERIAL PRIMARY KEY,
+		uid   TEXT NOT NULL,
+		sys   TEXT NOT NULL,
+		body  BYTEA,
+		ctime TIMESTAMP(6) WITH TIME ZONE NOT NULL,
+		etime TIMESTAMP(6) WITH TIME ZONE NOT NULL
+	)`,
+}, oobIndexes...)
+
+// The dismissals_by_device tables record Items dismissed for just one
+// device each, as of dtime. Unlike other dismissals, these can't be applied
+// to the items table, since the Item stays live for other devices.
+var deviceDismissalIndexes = []string{
+	`CREATE INDEX device_dismissal_order ON dismissals_by_device (uid, dmsgid, devid)`,
+}
+
+var mysqlDeviceDismissalTable = append([]string{
+	`CREATE TABLE dismissals_by_device (
+		uid    CHAR(16) NOT NULL,
+		msgid  CHAR(16) NOT NULL,
+		dmsgid CHAR(16) NOT NULL,
+		devid  CHAR(16) NOT NULL,
+		dtime  DATETIME(6) NOT NULL,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid, devid)
+	)`,
+}, deviceDismissalIndexes...)
+
+var sqliteDeviceDismissalTable = append([]string{
+	`CREATE TABLE dismissals_by_device (
+		uid    TEXT NOT NULL,
+		msgid  TEXT NOT NULL,
+		dmsgid TEXT NOT NULL,
+		devid  TEXT NOT NULL,
+		dtime  INTEGER NOT NULL,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid, devid)
+	)`,
+}, deviceDismissalIndexes...)
+
+var postgresDeviceDismissalTable = append([]string{
+	`CREATE TABLE dismissals_by_device (
+		uid    TEXT NOT NULL,
+		msgid  TEXT NOT NULL,
+		dmsgid TEXT NOT NULL,
+		devid  TEXT NOT NULL,
+		dtime  TIMESTAMP(6) WITH TIME ZONE NOT NULL,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid, devid)
+	)`,
+}, deviceDismissalIndexes...)
+
+// The item_updates tables record updates to the Items umsgid, made by the
+// messages msgid. A NULL body or dtime leaves that field of the Item alone.
+// The winning update for each field is applied to the items table as it
+// comes in, but all of them are kept so they can be replayed, and applied
+// to Items that arrive late.
+var itemUpdateIndexes = []string{
+	`CREATE INDEX item_update_order ON item_updates (uid, umsgid)`,
+}
+
+var mysqlItemUpdateTable = append([]string{
+	`CREATE TABLE item_updates (
+		uid    CHAR(16) NOT NULL,
+		msgid  CHAR(16) NOT NULL,
+		umsgid CHAR(16) NOT NULL,
+		body   BLOB,
+		dtime  DATETIME(6),
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+}, itemUpdateIndexes...)
+
+var sqliteItemUpdateTable = append([]string{
+	`CREATE TABLE item_updates (
+		uid    TEXT NOT NULL,
+		msgid  TEXT NOT NULL,
+		umsgid TEXT NOT NULL,
+		body   BLOB,
+		dtime  INTEGER,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+}, itemUpdateIndexes...)
+
+var postgresItemUpdateTable = append([]string{
+	`CREATE TABLE item_updates (
+		uid    TEXT NOT NULL,
+		msgid  TEXT NOT NULL,
+		umsgid TEXT NOT NULL,
+		body   BYTEA,
+		dtime  TIMESTAMP(6) WITH TIME ZONE,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+}, itemUpdateIndexes...)
+
+// bodyKeyColumns record the ID of the key each body was encrypted with, or
+// NULL if it's stored in the clear. See KeyProvider.
+var bodyKeyColumns = []string{
+	`ALTER TABLE items ADD COLUMN body_key VARCHAR(64)`,
+	`ALTER TABLE item_updates ADD COLUMN body_key VARCHAR(64)`,
+	`ALTER TABLE oob_messages ADD COLUMN body_key VARCHAR(64)`,
+}
+
+// rangeDismissalIndex lets Items that arrive late find the range dismissals
+// over their categories, and the wildcards over them. The items table's
+// user_order index already covers dismissing a range of categories.
+var rangeDismissalIndex = []string{
+	`CREATE INDEX range_dismissal_order ON dismissals_by_time (uid, category)`,
+}
+
+// The hlc columns hold the HLC that orders each message, which is the
+// one it was stamped with, or the lowest at its ctime if it wasn't, and
+// the HLC bound of each range dismissal, or 0 if it doesn't have one.
+// Messages from before there were HLCs are ordered by their ctimes, which
+// each dialect has to turn into milliseconds its own way.
+var hlcColumns = []string{
+	`ALTER TABLE messages ADD COLUMN hlc BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE dismissals_by_time ADD COLUMN hlc BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX hlc_order ON messages (uid, hlc)`,
+}
+
+var mysqlHLCColumns = append(hlcColumns,
+	`UPDATE messages SET hlc=(TIMESTAMPDIFF(MICROSECOND, '1970-01-01 00:00:00', ctime) DIV 1000) * 65536`,
+)
+
+var sqliteHLCColumns = append(hlcColumns,
+	`UPDATE messages SET hlc=(ctime / 1000) * 65536`,
+)
+
+var postgresHLCColumns = append(hlcColumns,
+	`UPDATE messages SET hlc=FLOOR(EXTRACT(EPOCH FROM ctime) * 1000)::BIGINT * 65536`,
+)
+
+var mysqlMigrations = []migration{
+	{version: 1, stmts: mysqlBaseSchema},
+	{version: 2, stmts: crossUserIndexes},
+	{version: 3, stmts: messageDigestColumn},
+	{version: 4, stmts: mysqlOOBTable},
+	{version: 5, stmts: mysqlDeviceDismissalTable},
+	{version: 6, stmts: mysqlItemUpdateTable},
+	{version: 7, stmts: bodyKeyColumns},
+	{version: 8, stmts: rangeDismissalIndex},
+	{version: 9, stmts: mysqlHLCColumns},
+}
+
+var sqliteMigrations = []migration{
+	{version: 1, stmts: sqliteBaseSchema},
+	{version: 2, stmts: crossUserIndexes},
+	{version: 3, stmts: messageDigestColumn},
+	{version: 4, stmts: sqliteOOBTable},
+	{version: 5, stmts: sqliteDeviceDismissalTable},
+	{version: 6, stmts: sqliteItemUpdateTable},
+	{version: 7, stmts: bodyKeyColumns},
+	{version: 8, stmts: rangeDismissalIndex},
+	{version: 9, stmts: sqliteHLCColumns},
+}
+
+var postgresMigrations = []migration{
+	{version: 1, stmts: postgresBaseSchema},
+	{version: 2, stmts: crossUserIndexes},
+	{version: 3, stmts: messageDigestColumn},
+	{version: 4, stmts: postgresOOBTable},
+	{version: 5, stmts: postgresDeviceDismissalTable},
+	{version: 6, stmts: postgresItemUpdateTable},
+	{version: 7, stmts: bodyKeyColumns},
+	{version: 8, stmts: rangeDismissalIndex},
+	{version: 9, stmts: postgresHLCColumns},
+}
+
+// migrations returns the ordered list of migrations for the given engine.
+func migrations(engine string) ([]migration, error) {
+	d, err := lookupDialect(engine)
+	if err != nil {
+		return nil, err
+	}
+	return d.migrations, nil
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER NOT NULL,
+	PRIMARY KEY(version)
+)`
+
+// schemaVersion returns the latest migration applied to db, or 0 if none
+// have been.
+func schemaVersion(db *sql.DB) (int, error) {
+	var v sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// hasBaseSchema returns true if db already has the gregor tables in it, as
+// would be the case for a database set up before we had migrations.
+func hasBaseSchema(db *sql.DB) bool {
+	var n int
+	return db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&n) == nil
+}
+
+func recordVersion(tx *sql.Tx, bt bindType, v int) error {
+	_, err := tx.Exec(rebind(bt, "INSERT INTO schema_version(version) VALUES(?)"), v)
+	return err
+}
+
+func applyMigration(db *sql.DB, bt bindType, m migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	for _, stmt := range m.stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return recordVersion(tx, bt, m.version)
+}
+
+// adopt records an unversioned database as being at version 1, after
+// running the dialect's adopt step on it, if it has one.
+func adopt(db *sql.DB, d dialect) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if d.adopt != nil {
+		if err = d.adopt(tx); err != nil {
+			return err
+		}
+	}
+	return recordVersion(tx, d.bt, 1)
+}
+
+// Migrate brings the schema of db, which is driven by the given
+// database/sql engine, up to date by applying any migrations it hasn't seen
+// yet. It never drops existing data, so it's safe to call on every startup.
+// Note that MySQL commits DDL statements implicitly, so a migration that
+// fails partway through might need to be cleaned up by hand.
+func Migrate(db *sql.DB, engine string) error {
+	d, err := lookupDialect(engine)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(schemaVersionTable); err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	// Adopt databases that were bootstrapped from the unversioned schema.
+	if current == 0 && hasBaseSchema(db) {
+		if err := adopt(db, d); err != nil {
+			return err
+		}
+		current = 1
+	}
+
+	for _, m := range d.migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, d.bt, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCantAdopt is returned by Migrate when an unversioned database can't be
+// brought in line with the base schema.
+type ErrCantAdopt string
+
+func (e ErrCantAdopt) Error() string { return "can't adopt unversioned database: " + string(e) }
+
+// sqliteTimeColumns are the time columns of the base schema. Databases set
+// up before we had migrations declared them DATETIME(6), as in MySQL, which
+// makes the SQLite driver read the microseconds that sqliteTimeWriter wrote
+// as seconds.
+var sqliteTimeColumns = []struct {
+	table, column string
+}{
+	{"messages", "ctime"},
+	{"items", "dtime"},
+	{"reminders", "ntime"},
+	{"dismissals_by_time", "dtime"},
+}
+
+// sqliteTimeLayouts are the ways that times might have been written as text
+// into the old DATETIME columns, by hand or by the driver.
+var sqliteTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// adoptSQLite rewrites the tables of an unversioned SQLite database whose
+// time columns are declared DATETIME, so that they match sqliteBaseSchema.
+// SQLite can't change a column's type in place, so each such table is
+// copied into a new one and then swapped in for it. Times that were stored
+// as text are converted to microseconds along the way.
+func adoptSQLite(tx *sql.Tx) error {
+	for _, tc := range sqliteTimeColumns {
+		cols, types, err := sqliteColumns(tx, tc.table)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(strings.ToUpper(types[tc.column]), "DATETIME") {
+			continue
+		}
+		if err := rebuildSQLiteTable(tx, tc.table, cols); err != nil {
+			return err
+		}
+		if err := convertSQLiteTimes(tx, tc.table, tc.column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteColumns returns the columns of table in order, along with their
+// declared types.
+func sqliteColumns(tx *sql.Tx, table string) ([]string, map[string]string, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	types := make(map[string]string)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, nil, err
+		}
+		cols = append(cols, name)
+		types[name] = typ
+	}
+	return cols, types, rows.Err()
+}
+
+// rebuildSQLiteTable replaces table with a copy made from its DDL in
+// sqliteBaseSchema, and recreates its indexes.
+func rebuildSQLiteTable(tx *sql.Tx, table string, cols []string) error {
+	var create string
+	var indexes []string
+	for _, stmt := range sqliteBaseSchema {
+		switch {
+		case strings.Contains(stmt, "CREATE TABLE "+table+" ("):
+			create = strings.Replace(stmt, "CREATE TABLE "+table+" (", "CREATE TABLE "+table+"_adopted (", 1)
+		case strings.Contains(stmt, " ON "+table+" ("):
+			indexes = append(indexes, stmt)
+		}
+	}
+	if create == "" {
+		return ErrCantAdopt("no base schema for table " + table)
+	}
+	colList := strings.Join(cols, ", ")
+	stmts := append([]string{
+		create,
+		fmt.Sprintf("INSERT INTO %s_adopted (%s) SELECT %s FROM %s", table, colList, colList, table),
+		"DROP TABLE " + table,
+		fmt.Sprintf("ALTER TABLE %s_adopted RENAME TO %s", table, table),
+	}, indexes...)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertSQLiteTimes rewrites the times in table.column that were stored as
+// text into microseconds since the epoch.
+func convertSQLiteTimes(tx *sql.Tx, table, column string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE typeof(%s)='text'", column, table, column))
+	if err != nil {
+		return err
+	}
+	converted := make(map[int64]int64)
+	for rows.Next() {
+		var rowid int64
+		var s string
+		if err := rows.Scan(&rowid, &s); err != nil {
+			rows.Close()
+			return err
+		}
+		t, err := parseSQLiteTime(s)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		converted[rowid] = timeInUnix(t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for rowid, t := range converted {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s=? WHERE rowid=?", table, column), t, rowid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSQLiteTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range sqliteTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrCantAdopt("bad time " + strconv.Quote(s))
+}
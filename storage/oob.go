@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrBadOOBRetention is returned when an out-of-band retention spec can't
+// be parsed.
+type ErrBadOOBRetention string
+
+func (e ErrBadOOBRetention) Error() string { return "bad out-of-band retention: " + string(e) }
+
+// OOBRetention says how long an engine queues the OutOfBandMessages it
+// consumes, so that devices that were offline at the time can get them when
+// they next connect. Messages for a System listed in BySystem are kept for
+// as long as it says, and all others for Default. A retention of 0 means
+// messages aren't queued at all, which is the default for everything.
+type OOBRetention struct {
+	Default  time.Duration
+	BySystem map[string]time.Duration
+}
+
+// For returns how long messages for the System s should be kept.
+func (r OOBRetention) For(s gregor.System) time.Duration {
+	if s != nil {
+		if d, ok := r.BySystem[s.String()]; ok {
+			return d
+		}
+	}
+	return r.Default
+}
+
+// IsZero returns true if no messages are queued under r.
+func (r OOBRetention) IsZero() bool {
+	if r.Default > 0 {
+		return false
+	}
+	for _, d := range r.BySystem {
+		if d > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns r in the format ParseOOBRetention reads.
+func (r OOBRetention) String() string {
+	var parts []string
+	if r.Default != 0 {
+		parts = append(parts, "default="+r.Default.String())
+	}
+	var systems []string
+	for s := range r.BySystem {
+		systems = append(systems, s)
+	}
+	sort.Strings(systems)
+	for _, s := range systems {
+		parts = append(parts, s+"="+r.BySystem[s].String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseOOBRetention parses a comma-separated list of system=duration pairs,
+// like "kbfs.favorites=1h,default=10m", where the system "default" sets the
+// retention for systems that aren't listed. An empty string means nothing
+// is queued.
+func ParseOOBRetention(s string) (OOBRetention, error) {
+	var ret OOBRetention
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return OOBRetention{}, ErrBadOOBRetention(fmt.Sprintf("expected system=duration, got %q", part))
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return OOBRetention{}, ErrBadOOBRetention(err.Error())
+		}
+		if d < 0 {
+			return OOBRetention{}, ErrBadOOBRetention(fmt.Sprintf("negative duration for %s", kv[0]))
+		}
+		if kv[0] == "default" {
+			ret.Default = d
+			continue
+		}
+		if ret.BySystem == nil {
+			ret.BySystem = make(map[string]time.Duration)
+		}
+		ret.BySystem[kv[0]] = d
+	}
+	return ret, nil
+}
+
+// oobRetentionSetter is implemented by engines that can queue out-of-band
+// messages.
+type oobRetentionSetter interface {
+	SetOOBRetention(r OOBRetention)
+}
+
+var _ oobRetentionSetter = (*MemEngine)(nil)
+var _ oobRetentionSetter = (*SQLEngine)(nil)
+var _ oobRetentionSetter = (*ShardedEngine)(nil)
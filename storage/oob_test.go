@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+// testOOBRetention is what test.TestStateMachineOutOfBand expects engines
+// to be set up with.
+var testOOBRetention = OOBRetention{BySystem: map[string]time.Duration{"kbfs.favorites": time.Hour}}
+
+func makeOutOfBand(t *testing.T, system string, body string) gregor.Message {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("oob user"))
+	s, _ := of.MakeSystem(system)
+	b, _ := of.MakeBody([]byte(body))
+	oobm, err := of.MakeOutOfBandMessage(u, s, b)
+	require.Nil(t, err, "no error from MakeOutOfBandMessage")
+	msg, err := of.MakeMessageFromOutOfBandMessage(oobm)
+	require.Nil(t, err, "no error from MakeMessageFromOutOfBandMessage")
+	return msg
+}
+
+func TestParseOOBRetention(t *testing.T) {
+	r, err := ParseOOBRetention("kbfs.favorites=1h, default=10m,chat=0s")
+	require.Nil(t, err, "no error from ParseOOBRetention")
+	require.Equal(t, time.Hour, r.For(testSystem("kbfs.favorites")), "listed system")
+	require.Equal(t, time.Duration(0), r.For(testSystem("chat")), "system turned off")
+	require.Equal(t, 10*time.Minute, r.For(testSystem("other")), "default")
+	require.Equal(t, "default=10m0s,chat=0s,kbfs.favorites=1h0m0s", r.String(), "round trip")
+	require.False(t, r.IsZero(), "something is queued")
+
+	r, err = ParseOOBRetention("")
+	require.Nil(t, err, "no error from an empty spec")
+	require.True(t, r.IsZero(), "nothing queued by default")
+	require.Equal(t, time.Duration(0), r.For(testSystem("kbfs.favorites")), "nothing queued by default")
+
+	for _, bad := range []string{"kbfs.favorites", "=1h", "kbfs.favorites=soon", "default=-1h"} {
+		_, err = ParseOOBRetention(bad)
+		require.IsType(t, ErrBadOOBRetention(""), err, "bad spec %q", bad)
+	}
+}
+
+type testSystem string
+
+func (s testSystem) String() string { return string(s) }
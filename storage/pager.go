@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	gregor "github.com/keybase/gregor"
+)
+
+var ErrBadCursor = errors.New("bad message cursor")
+var ErrBadPageLimit = errors.New("page limit must be positive")
+
+// msgCursor is a position in a user's message log, which is ordered by
+// HLC and then MsgID. Clients only ever see it encoded.
+type msgCursor struct {
+	hlc   gregor.HLC
+	msgID []byte
+}
+
+func newMsgCursor(h gregor.HLC, m gregor.MsgID) *msgCursor {
+	return &msgCursor{hlc: h, msgID: msgIDBytes(m)}
+}
+
+func msgIDBytes(m gregor.MsgID) []byte {
+	if m == nil {
+		return nil
+	}
+	return m.Bytes()
+}
+
+func (c *msgCursor) encode() []byte {
+	ret := make([]byte, 8, 8+len(c.msgID))
+	binary.BigEndian.PutUint64(ret, uint64(c.hlc))
+	return append(ret, c.msgID...)
+}
+
+// decodeMsgCursor decodes a cursor returned from a previous page, or
+// returns nil if b is empty, meaning start from the beginning.
+func decodeMsgCursor(b []byte) (*msgCursor, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if len(b) <= 8 {
+		return nil, ErrBadCursor
+	}
+	return &msgCursor{
+		hlc:   gregor.HLC(binary.BigEndian.Uint64(b[:8])),
+		msgID: b[8:],
+	}, nil
+}
+
+// isBefore returns true if the message with the given HLC and MsgID comes
+// at or before the cursor.
+func (c *msgCursor) isBefore(h gregor.HLC, msgID gregor.MsgID) bool {
+	if h != c.hlc {
+		return h < c.hlc
+	}
+	return bytes.Compare(msgIDBytes(msgID), c.msgID) <= 0
+}
+
+// nextCursor returns the cursor for the page after one with n messages,
+// the last of which is at last, or nil if the page wasn't full, so there
+// can't be any more.
+func nextCursor(n int, limit int, last *msgCursor) []byte {
+	if n == 0 || n < limit {
+		return nil
+	}
+	return last.encode()
+}
+
+// InBandMessageIterator walks through a user's messages a page at a time,
+// so that only one page needs to be in memory at once.
+type InBandMessageIterator struct {
+	p        gregor.InBandMessagePager
+	u        gregor.UID
+	d        gregor.DeviceID
+	t        gregor.TimeOrOffset
+	pageSize int
+	page     []gregor.InBandMessage
+	cursor   []byte
+	done     bool
+}
+
+// NewInBandMessageIterator makes an iterator over the messages that
+// InBandMessagesSince(u, d, t) would return, fetching pageSize of them
+// at a time from p.
+func NewInBandMessageIterator(p gregor.InBandMessagePager, u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, pageSize int) *InBandMessageIterator {
+	return &InBandMessageIterator{p: p, u: u, d: d, t: t, pageSize: pageSize}
+}
+
+// Next returns the next message, or nil once there are none left.
+func (it *InBandMessageIterator) Next() (gregor.InBandMessage, error) {
+	for len(it.page) == 0 {
+		if it.done {
+			return nil, nil
+		}
+		page, cursor, err := it.p.InBandMessagesPage(it.u, it.d, it.t, it.cursor, it.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		it.page, it.cursor, it.done = page, cursor, cursor == nil
+	}
+	ret := it.page[0]
+	it.page = it.page[1:]
+	return ret, nil
+}
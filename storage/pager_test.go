@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgCursor(t *testing.T) {
+	c := &msgCursor{hlc: gregor.NewHLC(100005, 3), msgID: []byte("msg")}
+	c2, err := decodeMsgCursor(c.encode())
+	require.Nil(t, err, "no error from decodeMsgCursor")
+	require.Equal(t, c.hlc, c2.hlc, "same HLC")
+	require.Equal(t, c.msgID, c2.msgID, "same MsgID")
+
+	c2, err = decodeMsgCursor(nil)
+	require.Nil(t, err, "no error for an empty cursor")
+	require.Nil(t, c2, "empty cursor means the beginning")
+
+	_, err = decodeMsgCursor([]byte("short"))
+	require.Equal(t, ErrBadCursor, err, "too short")
+}
+
+func TestInBandMessageIterator(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	eng := NewMemEngine(test.TestObjFactory{}, cl)
+	t0 := cl.Now()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		require.Nil(t, eng.ConsumeMessage(makeCreation(t, id, id)), "no error from ConsumeMessage")
+		cl.Advance(time.Second)
+	}
+
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("replay user"))
+	it := NewInBandMessageIterator(eng, u, nil, timeOrOffset(t0), 2)
+	var bodies []string
+	for {
+		m, err := it.Next()
+		require.Nil(t, err, "no error from Next")
+		if m == nil {
+			break
+		}
+		bodies = append(bodies, string(m.ToStateUpdateMessage().Creation().Body().Bytes()))
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, bodies, "all messages in order")
+
+	_, _, err := eng.InBandMessagesPage(u, nil, nil, nil, 0)
+	require.Equal(t, ErrBadPageLimit, err, "zero page limit")
+}
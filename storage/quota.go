@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrBadQuotaPolicy is returned when a quota policy can't be parsed.
+type ErrBadQuotaPolicy string
+
+func (e ErrBadQuotaPolicy) Error() string { return "bad quota policy: " + string(e) }
+
+// QuotaPolicy says what an engine does with a creation that would take a
+// user over one of its item quotas.
+type QuotaPolicy int
+
+const (
+	// QuotaReject rejects the message with a gregor.ErrQuotaExceeded.
+	QuotaReject QuotaPolicy = iota
+	// QuotaDismissOldest makes room for the new Item by dismissing the
+	// user's oldest live Items, those in the new Item's category first if
+	// that's the quota it would exceed.
+	QuotaDismissOldest
+)
+
+// String returns p in the format ParseQuotaPolicy reads.
+func (p QuotaPolicy) String() string {
+	if p == QuotaDismissOldest {
+		return "dismiss-oldest"
+	}
+	return "reject"
+}
+
+// ParseQuotaPolicy parses "reject" or "dismiss-oldest". An empty string
+// means QuotaReject.
+func ParseQuotaPolicy(s string) (QuotaPolicy, error) {
+	switch s {
+	case "", "reject":
+		return QuotaReject, nil
+	case "dismiss-oldest":
+		return QuotaDismissOldest, nil
+	}
+	return QuotaReject, ErrBadQuotaPolicy(fmt.Sprintf("expected reject or dismiss-oldest, got %q", s))
+}
+
+// Quotas bound what each user can keep in an engine. MaxItems bounds the
+// number of live Items, those that haven't been dismissed for all devices
+// or expired, and MaxItemsPerCategory the number in any one category, with
+// Policy saying what happens to creations that would go over either.
+// MaxBodySize bounds the size of the Bodies given by creations and updates,
+// which are always rejected if they go over it. A bound of 0 means there's
+// none, which is the default for everything.
+//
+// Quotas are only checked as messages are consumed, so lowering them
+// doesn't dismiss anything until the user's next creation, and they don't
+// apply to messages replayed from a log or imported. With
+// QuotaDismissOldest, the dismissals are consumed as messages of their own,
+// just before the creation, so clients see them as they sync.
+type Quotas struct {
+	MaxItems            int
+	MaxItemsPerCategory int
+	MaxBodySize         int
+	Policy              QuotaPolicy
+}
+
+// IsZero returns true if q doesn't bound anything.
+func (q Quotas) IsZero() bool {
+	return q.MaxItems <= 0 && q.MaxItemsPerCategory <= 0 && q.MaxBodySize <= 0
+}
+
+// appliesTo returns true if q might have something to say about m, which
+// is worth checking before looking up the user's State.
+func (q Quotas) appliesTo(m gregor.InBandMessage) bool {
+	if q.IsZero() {
+		return false
+	}
+	sum := m.ToStateUpdateMessage()
+	if sum == nil {
+		return false
+	}
+	return sum.Creation() != nil || (q.MaxBodySize > 0 && sum.Update() != nil)
+}
+
+// bodyTooBig returns true if b is over the body size quota.
+func (q Quotas) bodyTooBig(b gregor.Body) bool {
+	return q.MaxBodySize > 0 && b != nil && len(b.Bytes()) > q.MaxBodySize
+}
+
+// liveItems is what Quotas.check needs to know about a user's live Items,
+// which engines answer from their indexes rather than by building the
+// user's whole State.
+type liveItems interface {
+	// count returns how many live Items the user has, or just how many
+	// are in the category c if inCategory is true.
+	count(c string, inCategory bool) (int, error)
+	// oldest returns up to n of the user's live Items, or of just those in
+	// the category c if inCategory is true, oldest first. Items with the
+	// same ctime are ordered by MsgID.
+	oldest(n int, c string, inCategory bool) ([]gregor.Item, error)
+}
+
+func categoryOf(i gregor.Item) string {
+	if i.Category() == nil {
+		return ""
+	}
+	return i.Category().String()
+}
+
+// check checks m against q, given live, the live Items of m's user as of
+// now. It returns a gregor.ErrQuotaExceeded if m should be rejected, and
+// otherwise the dismissals to consume before m to make room for it, if any.
+// The caller should have already checked that m isn't a replay, since a
+// replayed creation is already counted in live.
+func (q Quotas) check(f gregor.ObjFactory, now time.Time, live liveItems, m gregor.InBandMessage) ([]gregor.InBandMessage, error) {
+	sum := m.ToStateUpdateMessage()
+	if sum == nil {
+		return nil, nil
+	}
+	if up := sum.Update(); up != nil && q.bodyTooBig(up.Body()) {
+		return nil, gregor.ErrQuotaExceeded{Quota: gregor.QuotaBodySize, Limit: q.MaxBodySize}
+	}
+	i := sum.Creation()
+	if i == nil {
+		return nil, nil
+	}
+	if q.bodyTooBig(i.Body()) {
+		return nil, gregor.ErrQuotaExceeded{Quota: gregor.QuotaBodySize, Limit: q.MaxBodySize}
+	}
+	if q.MaxItems <= 0 && q.MaxItemsPerCategory <= 0 {
+		return nil, nil
+	}
+
+	c := categoryOf(i)
+	var victims []gregor.Item
+	dismissed := make(map[string]bool)
+	if q.MaxItemsPerCategory > 0 {
+		n, err := live.count(c, true)
+		if err != nil {
+			return nil, err
+		}
+		if excess := n - q.MaxItemsPerCategory + 1; excess > 0 {
+			if q.Policy != QuotaDismissOldest {
+				return nil, gregor.ErrQuotaExceeded{Quota: gregor.QuotaCategoryItems, Limit: q.MaxItemsPerCategory, Category: c}
+			}
+			if victims, err = live.oldest(excess, c, true); err != nil {
+				return nil, err
+			}
+			for _, v := range victims {
+				dismissed[msgIDtoString(v.Metadata().MsgID())] = true
+			}
+		}
+	}
+	if q.MaxItems > 0 {
+		n, err := live.count(c, false)
+		if err != nil {
+			return nil, err
+		}
+		if excess := n - len(victims) - q.MaxItems + 1; excess > 0 {
+			if q.Policy != QuotaDismissOldest {
+				return nil, gregor.ErrQuotaExceeded{Quota: gregor.QuotaItems, Limit: q.MaxItems}
+			}
+			// The oldest Items might include those already dismissed to
+			// make room in the category, so skip over them.
+			oldest, err := live.oldest(excess+len(victims), c, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range oldest {
+				if excess == 0 {
+					break
+				}
+				if !dismissed[msgIDtoString(l.Metadata().MsgID())] {
+					victims = append(victims, l)
+					excess--
+				}
+			}
+		}
+	}
+
+	var ret []gregor.InBandMessage
+	md := m.Metadata()
+	for _, v := range victims {
+		mid, err := quotaDismissalID(f, md.MsgID(), v.Metadata().MsgID())
+		if err != nil {
+			return nil, err
+		}
+		d, err := f.MakeDismissalByID(md.UID(), mid, nil, now, v.Metadata().MsgID())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// quotaDismissalID makes the MsgID of the message that dismisses the Item
+// target to make room for the one created by the message m. It's derived
+// from both, so that retrying m after a failure replays the dismissal
+// rather than making another.
+func quotaDismissalID(f gregor.ObjFactory, m gregor.MsgID, target gregor.MsgID) (gregor.MsgID, error) {
+	d := digester{sha256.New()}
+	d.string("quota")
+	d.byter(m)
+	d.byter(target)
+	return f.MakeMsgID(d.h.Sum(nil)[:16])
+}
+
+// quotaSetter is implemented by engines that can enforce Quotas.
+type quotaSetter interface {
+	SetQuotas(q Quotas)
+}
+
+var _ quotaSetter = (*MemEngine)(nil)
+var _ quotaSetter = (*SQLEngine)(nil)
+var _ quotaSetter = (*KVEngine)(nil)
+var _ quotaSetter = (*ShardedEngine)(nil)
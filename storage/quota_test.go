@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuotaPolicy(t *testing.T) {
+	for _, p := range []QuotaPolicy{QuotaReject, QuotaDismissOldest} {
+		parsed, err := ParseQuotaPolicy(p.String())
+		require.Nil(t, err, "no error from ParseQuotaPolicy")
+		require.Equal(t, p, parsed, "round trip")
+	}
+	p, err := ParseQuotaPolicy("")
+	require.Nil(t, err, "no error from an empty policy")
+	require.Equal(t, QuotaReject, p, "reject by default")
+	_, err = ParseQuotaPolicy("dismiss-newest")
+	require.IsType(t, ErrBadQuotaPolicy(""), err, "bad policy")
+	require.True(t, Quotas{Policy: QuotaDismissOldest}.IsZero(), "no bounds")
+}
+
+type quotaEngine interface {
+	gregor.StateMachine
+	quotaSetter
+}
+
+func makeQuotaCreation(t *testing.T, msgID string, category string, body string) gregor.Message {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("quota user"))
+	m, _ := of.MakeMsgID([]byte(msgID))
+	c, _ := of.MakeCategory(category)
+	b, _ := of.MakeBody([]byte(body))
+	i, err := of.MakeItem(u, m, nil, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+// testQuotas checks that eng enforces its quotas under both policies. It
+// leaves eng without quotas.
+func testQuotas(t *testing.T, eng quotaEngine, cl clockwork.FakeClock) {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("quota user"))
+	defer eng.SetQuotas(Quotas{})
+	create := func(id string, category string) error {
+		cl.Advance(time.Second)
+		return eng.ConsumeMessage(makeQuotaCreation(t, id, category, id))
+	}
+	bodies := func() []string {
+		ret := stateBodies(t, eng, []gregor.UID{u})
+		sort.Strings(ret)
+		return ret
+	}
+
+	eng.SetQuotas(Quotas{MaxItems: 3, MaxItemsPerCategory: 2, MaxBodySize: 10})
+	require.Nil(t, create("a1", "a"), "no error under quota")
+	require.Nil(t, create("a2", "a"), "no error under quota")
+	require.Nil(t, create("b1", "b"), "no error under quota")
+	require.Equal(t, gregor.ErrQuotaExceeded{Quota: gregor.QuotaCategoryItems, Limit: 2, Category: "a"},
+		create("a3", "a"), "too many in category a")
+	require.Equal(t, gregor.ErrQuotaExceeded{Quota: gregor.QuotaItems, Limit: 3},
+		create("c1", "c"), "too many items")
+	require.Equal(t, gregor.ErrQuotaExceeded{Quota: gregor.QuotaBodySize, Limit: 10},
+		eng.ConsumeMessage(makeQuotaCreation(t, "big", "b", "0123456789x")), "body too big")
+	require.Nil(t, create("a1", "a"), "replays aren't counted again")
+	require.Equal(t, []string{"a1", "a2", "b1"}, bodies(), "nothing over quota was kept")
+
+	m, _ := of.MakeMsgID([]byte("d1"))
+	d, _ := of.MakeMsgID([]byte("a1"))
+	ibm, err := of.MakeDismissalByID(u, m, nil, time.Time{}, d)
+	require.Nil(t, err, "no error from MakeDismissalByID")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	require.Nil(t, eng.ConsumeMessage(msg), "no error from dismissal")
+	require.Nil(t, create("c1", "c"), "room after a dismissal")
+	require.Equal(t, []string{"a2", "b1", "c1"}, bodies(), "c1 kept")
+
+	eng.SetQuotas(Quotas{MaxItems: 3, MaxItemsPerCategory: 2, MaxBodySize: 10, Policy: QuotaDismissOldest})
+	require.Nil(t, create("a3", "a"), "no error when dismissing")
+	require.Equal(t, []string{"a3", "b1", "c1"}, bodies(), "oldest item dismissed")
+	require.Nil(t, create("a4", "a"), "no error when dismissing")
+	require.Equal(t, []string{"a3", "a4", "c1"}, bodies(), "oldest item dismissed")
+	require.Nil(t, create("a5", "a"), "no error when dismissing")
+	require.Equal(t, []string{"a4", "a5", "c1"}, bodies(), "oldest item in the category dismissed")
+	require.Nil(t, create("a5", "a"), "no error from replay")
+	require.Equal(t, []string{"a4", "a5", "c1"}, bodies(), "replay dismisses nothing")
+	require.Equal(t, gregor.ErrQuotaExceeded{Quota: gregor.QuotaBodySize, Limit: 10},
+		eng.ConsumeMessage(makeQuotaCreation(t, "big", "b", "0123456789x")), "big bodies still rejected")
+	require.Equal(t, []string{"a4", "a5", "c1"}, bodies(), "nothing dismissed for a rejected item")
+
+	// c1 is the oldest item, and makes room in category c, so the next
+	// oldest, a4, makes room overall.
+	eng.SetQuotas(Quotas{MaxItems: 2, MaxItemsPerCategory: 1, Policy: QuotaDismissOldest})
+	require.Nil(t, create("c2", "c"), "no error when dismissing")
+	require.Equal(t, []string{"a5", "c2"}, bodies(), "oldest items in the category and overall dismissed")
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrMsgIDConflict is returned by ConsumeMessage when a message reuses the
+// MsgID of one we've already consumed, but with different contents. Exact
+// replays of a message are accepted and ignored.
+type ErrMsgIDConflict struct {
+	UID   gregor.UID
+	MsgID gregor.MsgID
+}
+
+func (e ErrMsgIDConflict) Error() string {
+	return fmt.Sprintf("message %s for user %s conflicts with an earlier message with the same ID",
+		hexEnc(e.MsgID), hexEnc(e.UID))
+}
+
+// digester feeds the parts of a message into a hash, each prefixed with its
+// length so that different messages can't run together into the same input.
+type digester struct {
+	h hash.Hash
+}
+
+func (d digester) bytes(b []byte) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+	d.h.Write(n[:])
+	d.h.Write(b)
+}
+
+func (d digester) byter(b byter) {
+	if b == nil {
+		d.bytes(nil)
+		return
+	}
+	d.bytes(b.Bytes())
+}
+
+func (d digester) string(s string) { d.bytes([]byte(s)) }
+
+func (d digester) int(i int64) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(i))
+	d.h.Write(n[:])
+}
+
+func (d digester) timeOrOffset(t gregor.TimeOrOffset) {
+	switch {
+	case t == nil:
+		d.string("")
+	case t.Time() != nil:
+		d.string("t")
+		d.int(t.Time().UnixNano())
+	case t.Offset() != nil:
+		d.string("o")
+		d.int(int64(*t.Offset()))
+	default:
+		d.string("")
+	}
+}
+
+// messageDigest returns a hex-encoded hash of everything in m that's set by
+// its sender. The ctime is left out, since it's usually stamped on the way
+// in, and a replayed message would otherwise never match the original.
+func messageDigest(m gregor.InBandMessage) string {
+	d := digester{sha256.New()}
+	md := m.Metadata()
+	d.byter(md.UID())
+	d.byter(md.MsgID())
+	d.byter(md.DeviceID())
+	d.int(int64(md.InBandMsgType()))
+
+	if sum := m.ToStateUpdateMessage(); sum != nil {
+		if c := sum.Creation(); c != nil {
+			d.string("c")
+			d.string(c.Category().String())
+			d.byter(c.Body())
+			d.timeOrOffset(c.DTime())
+			nts := c.NotifyTimes()
+			d.int(int64(len(nts)))
+			for _, nt := range nts {
+				d.timeOrOffset(nt)
+			}
+		}
+		if dis := sum.Dismissal(); dis != nil {
+			d.string("d")
+			ids := dis.MsgIDsToDismiss()
+			d.int(int64(len(ids)))
+			for _, id := range ids {
+				d.byter(id)
+			}
+			rs := dis.RangesToDismiss()
+			d.int(int64(len(rs)))
+			for _, r := range rs {
+				d.string(r.Category().String())
+				d.timeOrOffset(r.EndTime())
+			}
+			// Only mixed in when present, so that digests already stored
+			// for other dismissals stay the same.
+			if fds := dis.MsgIDsToDismissForDevice(); len(fds) > 0 {
+				d.string("f")
+				d.int(int64(len(fds)))
+				for _, fd := range fds {
+					d.byter(fd.MsgID())
+					d.byter(fd.DeviceID())
+				}
+			}
+		}
+		if up := sum.Update(); up != nil {
+			d.string("u")
+			d.byter(up.MsgID())
+			if b := up.Body(); b != nil {
+				d.string("b")
+				d.byter(b)
+			} else {
+				d.string("")
+			}
+			d.timeOrOffset(up.DTime())
+		}
+	}
+	return hex.EncodeToString(d.h.Sum(nil))
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func makeCreation(t *testing.T, msgID string, body string) gregor.Message {
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("replay user"))
+	m, _ := of.MakeMsgID([]byte(msgID))
+	c, _ := of.MakeCategory("foos")
+	b, _ := of.MakeBody([]byte(body))
+	i, err := of.MakeItem(u, m, nil, time.Time{}, c, nil, b)
+	require.Nil(t, err, "no error from MakeItem")
+	ibm, err := of.MakeInBandMessageFromItem(i)
+	require.Nil(t, err, "no error from MakeInBandMessageFromItem")
+	msg, err := of.MakeMessageFromInBandMessage(ibm)
+	require.Nil(t, err, "no error from MakeMessageFromInBandMessage")
+	return msg
+}
+
+func testReplayConflict(t *testing.T, sm gregor.StateMachine) {
+	require.Nil(t, sm.ConsumeMessage(makeCreation(t, "r1", "a")), "no error from first message")
+	require.Nil(t, sm.ConsumeMessage(makeCreation(t, "r1", "a")), "no error from replay")
+	err := sm.ConsumeMessage(makeCreation(t, "r1", "b"))
+	require.IsType(t, ErrMsgIDConflict{}, err, "conflicting replay")
+	require.Equal(t, []byte("r1"), err.(ErrMsgIDConflict).MsgID.Bytes(), "conflict on the right MsgID")
+}
+
+func TestMessageDigest(t *testing.T) {
+	a := makeCreation(t, "r1", "a").ToInBandMessage()
+	require.Equal(t, messageDigest(a), messageDigest(makeCreation(t, "r1", "a").ToInBandMessage()), "same digest")
+	require.NotEqual(t, messageDigest(a), messageDigest(makeCreation(t, "r1", "b").ToInBandMessage()), "different body")
+	require.NotEqual(t, messageDigest(a), messageDigest(makeCreation(t, "r2", "a").ToInBandMessage()), "different MsgID")
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"fmt"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// UserStore is implemented by storage engines that can list, export, import
+// and delete whole users, which is what's needed to move users between
+// shards.
+type UserStore interface {
+	gregor.StateMachine
+	UserExporter
+	Users() ([]gregor.UID, error)
+	DeleteUser(u gregor.UID) error
+}
+
+var _ UserStore = (*SQLEngine)(nil)
+
+var _ UserStore = (*MemEngine)(nil)
+
+// ErrMoveMismatch is returned by MoveUser if the user's state didn't come
+// out the same after copying, in which case the original is left in place.
+type ErrMoveMismatch string
+
+func (e ErrMoveMismatch) Error() string { return "state mismatch after copying user " + string(e) }
+
+// CopyUser copies user u from one engine to another by exporting and
+// importing them, so messages keep their original ctimes, Items keep the
+// reminders that haven't been sent yet, and the out-of-band messages queued
+// for u come along. Since replays are no-ops and queued messages that are
+// already there are skipped, it's safe to copy the same user more than
+// once.
+func CopyUser(u gregor.UID, from, to UserExporter) error {
+	e, err := from.Export(u)
+	if err != nil {
+		return err
+	}
+	return to.Import(e)
+}
+
+func stateMsgIDs(sm gregor.StateMachine, u gregor.UID) ([][]byte, error) {
+	s, err := sm.State(u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.Items()
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]byte
+	for _, i := range items {
+		ret = append(ret, i.Metadata().MsgID().Bytes())
+	}
+	return ret, nil
+}
+
+func sameMsgIDs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, m := range a {
+		seen[string(m)]++
+	}
+	for _, m := range b {
+		if seen[string(m)] == 0 {
+			return false
+		}
+		seen[string(m)]--
+	}
+	return true
+}
+
+// MoveUser copies user u from one store to another, checks that the user's
+// current state came across intact, and then deletes the original.
+func MoveUser(u gregor.UID, from, to UserStore) error {
+	if err := CopyUser(u, from, to); err != nil {
+		return err
+	}
+	before, err := stateMsgIDs(from, u)
+	if err != nil {
+		return err
+	}
+	after, err := stateMsgIDs(to, u)
+	if err != nil {
+		return err
+	}
+	if !sameMsgIDs(before, after) {
+		return ErrMoveMismatch(hexEnc(u))
+	}
+	return from.DeleteUser(u)
+}
+
+// Reshard moves every user stored in one of from's shards that belongs on
+// a different shard in to. Shards are compared by identity, so from and to
+// should share engines for the shards they have in common, as they do when
+// opened together with OpenShardMaps. It calls logf, if non-nil, for each
+// user moved, and returns how many were.
+func Reshard(from, to *ShardedEngine, logf func(f string, args ...interface{})) (int, error) {
+	moved := 0
+	seen := make(map[gregor.StateMachine]bool)
+	for i, shard := range from.shards {
+		if seen[shard] {
+			continue
+		}
+		seen[shard] = true
+		src, ok := shard.(UserStore)
+		if !ok {
+			return moved, ErrShardMissingFeature("listing users")
+		}
+		users, err := src.Users()
+		if err != nil {
+			return moved, err
+		}
+		for _, u := range users {
+			dst, ok := to.ShardFor(u).(UserStore)
+			if !ok {
+				return moved, ErrShardMissingFeature("listing users")
+			}
+			if dst == src {
+				continue
+			}
+			if err := MoveUser(u, src, dst); err != nil {
+				return moved, fmt.Errorf("moving user %s off of shard %d: %s", hexEnc(u), i, err)
+			}
+			if logf != nil {
+				logf("moved user %s off of shard %d\n", hexEnc(u), i)
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -1,12 +1,9 @@
 package storage
 
-var schema = []string{
-
-	`DROP TABLE IF EXISTS dismissals_by_time`,
-	`DROP TABLE IF EXISTS dismissals_by_id`,
-	`DROP TABLE IF EXISTS reminders`,
-	`DROP TABLE IF EXISTS items`,
-	`DROP TABLE IF EXISTS messages`,
+// mysqlBaseSchema is the MySQL schema as of version 1, before we started
+// tracking schema versions. Later changes should be added as new migrations,
+// rather than by editing these statements.
+var mysqlBaseSchema = []string{
 
 	`CREATE TABLE messages (
 		uid   CHAR(16) NOT NULL,
@@ -56,6 +53,122 @@ var schema = []string{
 	)`,
 }
 
+// sqliteBaseSchema is the SQLite equivalent of mysqlBaseSchema. Times are
+// stored as INTEGER microseconds since the epoch, as written by
+// sqliteTimeWriter. Don't declare them as DATETIME, or the SQLite driver will
+// try to interpret them as seconds.
+var sqliteBaseSchema = []string{
+
+	`CREATE TABLE messages (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		ctime INTEGER NOT NULL,
+		devid TEXT,
+		mtype INTEGER NOT NULL, -- "specify for 'Update' or 'Sync' types",
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE TABLE items (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		category TEXT NOT NULL,
+		dtime INTEGER,
+		body BLOB,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE INDEX user_order ON items (uid, category)`,
+
+	`CREATE INDEX cleanup_order ON items (uid, dtime)`,
+
+	`CREATE TABLE reminders (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		ntime INTEGER NOT NULL,
+		PRIMARY KEY(uid, msgid, ntime)
+	)`,
+
+	`CREATE TABLE dismissals_by_id (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		dmsgid TEXT NOT NULL, -- "the message IDs to dismiss",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid)
+	)`,
+
+	`CREATE TABLE dismissals_by_time (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		category TEXT NOT NULL,
+		dtime INTEGER NOT NULL, -- "throw out matching events before dtime",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, category, dtime)
+	)`,
+}
+
+// postgresBaseSchema is the PostgreSQL equivalent of mysqlBaseSchema.
+var postgresBaseSchema = []string{
+
+	`CREATE TABLE messages (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		ctime TIMESTAMP(6) WITH TIME ZONE NOT NULL,
+		devid TEXT,
+		mtype INTEGER NOT NULL, -- "specify for 'Update' or 'Sync' types",
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE TABLE items (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		category VARCHAR(128) NOT NULL,
+		dtime TIMESTAMP(6) WITH TIME ZONE,
+		body BYTEA,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE INDEX user_order ON items (uid, category)`,
+
+	`CREATE INDEX cleanup_order ON items (uid, dtime)`,
+
+	`CREATE TABLE reminders (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		ntime TIMESTAMP(6) WITH TIME ZONE NOT NULL,
+		PRIMARY KEY(uid, msgid, ntime)
+	)`,
+
+	`CREATE TABLE dismissals_by_id (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		dmsgid TEXT NOT NULL, -- "the message IDs to dismiss",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid)
+	)`,
+
+	`CREATE TABLE dismissals_by_time (
+		uid   TEXT NOT NULL,
+		msgid TEXT NOT NULL,
+		category VARCHAR(128) NOT NULL,
+		dtime TIMESTAMP(6) WITH TIME ZONE NOT NULL, -- "throw out matching events before dtime",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, category, dtime)
+	)`,
+}
+
+// Schema returns the statements needed to create the latest version of
+// the schema in an empty database for the given engine. Use Migrate to
+// create or upgrade a database that might already contain data.
 func Schema(engine string) []string {
-	return schema
+	ms, err := migrations(engine)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, m := range ms {
+		ret = append(ret, m.stmts...)
+	}
+	return ret
 }
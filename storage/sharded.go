@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	gregor "github.com/keybase/gregor"
+)
+
+var ErrNoShards = errors.New("no shards given")
+var ErrNoUID = errors.New("message has no UID to route by")
+
+// ErrShardMissingFeature is returned when a ShardedEngine is asked to do
+// something that one of its shards doesn't support.
+type ErrShardMissingFeature string
+
+func (e ErrShardMissingFeature) Error() string { return "shard doesn't support " + string(e) }
+
+// ShardedEngine is a StateMachine that spreads users over several shards,
+// usually SQLEngines on different databases. Each user lives entirely on one
+// shard, picked by a stable hash of their UID, so that no query ever needs
+// to look at more than one shard except for those that span all users, like
+// Reminders and Prune.
+type ShardedEngine struct {
+	shards    []gregor.StateMachine
+	overrides map[string]int
+}
+
+// NewShardedEngine makes a ShardedEngine over the given shards. The order
+// of the shards matters, since it determines where each user lives.
+// overrides, which may be nil, pins users, given by hex-encoded UID, to a
+// shard other than the one their UID hashes to.
+func NewShardedEngine(shards []gregor.StateMachine, overrides map[string]int) (*ShardedEngine, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	for u, i := range overrides {
+		if i < 0 || i >= len(shards) {
+			return nil, ErrBadShardMap("override for " + u + " is out of range")
+		}
+	}
+	return &ShardedEngine{shards: shards, overrides: overrides}, nil
+}
+
+var _ gregor.StateMachine = (*ShardedEngine)(nil)
+
+var _ gregor.ReminderStore = (*ShardedEngine)(nil)
+
+var _ gregor.Pruner = (*ShardedEngine)(nil)
+
+var _ gregor.InBandMessagePager = (*ShardedEngine)(nil)
+
+var _ gregor.SyncCheckpointer = (*ShardedEngine)(nil)
+
+var _ gregor.StateDiffer = (*ShardedEngine)(nil)
+
+var _ gregor.CategoryStater = (*ShardedEngine)(nil)
+
+var _ gregor.OutOfBandQueue = (*ShardedEngine)(nil)
+
+// jumpHash is Lamping and Veach's jump consistent hash, which maps key
+// to one of n buckets such that growing n only moves about 1/n of all keys.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// shardIndex returns which of n shards the user u lives on.
+func shardIndex(u gregor.UID, n int, overrides map[string]int) int {
+	if i, found := overrides[hexEnc(u)]; found {
+		return i
+	}
+	h := fnv.New64a()
+	h.Write(u.Bytes())
+	return jumpHash(h.Sum64(), n)
+}
+
+// ShardFor returns the shard that the user u lives on.
+func (s *ShardedEngine) ShardFor(u gregor.UID) gregor.StateMachine {
+	return s.shards[shardIndex(u, len(s.shards), s.overrides)]
+}
+
+func (s *ShardedEngine) ConsumeMessage(m gregor.Message) error {
+	u := gregor.UIDFromMessage(m)
+	if u == nil {
+		// Like the other engines, drop out-of-band messages that
+		// there's no one to queue for.
+		if m.ToOutOfBandMessage() != nil {
+			return nil
+		}
+		return ErrNoUID
+	}
+	return s.ShardFor(u).ConsumeMessage(m)
+}
+
+func (s *ShardedEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) (gregor.State, error) {
+	return s.ShardFor(u).State(u, d, t)
+}
+
+func (s *ShardedEngine) InBandMessagesSince(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) ([]gregor.InBandMessage, error) {
+	return s.ShardFor(u).InBandMessagesSince(u, d, t)
+}
+
+func (s *ShardedEngine) InBandMessagesPage(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, cursor []byte, limit int) ([]gregor.InBandMessage, []byte, error) {
+	p, ok := s.ShardFor(u).(gregor.InBandMessagePager)
+	if !ok {
+		return nil, nil, ErrShardMissingFeature("paging")
+	}
+	return p.InBandMessagesPage(u, d, t, cursor, limit)
+}
+
+func (s *ShardedEngine) InBandMessagesSinceSync(u gregor.UID, d gregor.DeviceID, sync gregor.MsgID) ([]gregor.InBandMessage, error) {
+	sc, ok := s.ShardFor(u).(gregor.SyncCheckpointer)
+	if !ok {
+		return nil, ErrShardMissingFeature("sync checkpoints")
+	}
+	return sc.InBandMessagesSinceSync(u, d, sync)
+}
+
+func (s *ShardedEngine) StateInCategory(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) (gregor.State, error) {
+	cs, ok := s.ShardFor(u).(gregor.CategoryStater)
+	if !ok {
+		return nil, ErrShardMissingFeature("category states")
+	}
+	return cs.StateInCategory(u, d, t, c)
+}
+
+func (s *ShardedEngine) StateDiff(u gregor.UID, d gregor.DeviceID, from, to gregor.TimeOrOffset) ([]gregor.Item, []gregor.MsgID, error) {
+	sd, ok := s.ShardFor(u).(gregor.StateDiffer)
+	if !ok {
+		return nil, nil, ErrShardMissingFeature("state diffs")
+	}
+	return sd.StateDiff(u, d, from, to)
+}
+
+func (s *ShardedEngine) QueuedOutOfBandMessages(u gregor.UID) ([]gregor.OutOfBandMessage, error) {
+	q, ok := s.ShardFor(u).(gregor.OutOfBandQueue)
+	if !ok {
+		return nil, ErrShardMissingFeature("out-of-band queues")
+	}
+	return q.QueuedOutOfBandMessages(u)
+}
+
+// SetOOBRetention sets the out-of-band retention on each shard that can
+// queue messages.
+func (s *ShardedEngine) SetOOBRetention(r OOBRetention) {
+	for _, shard := range s.shards {
+		if rs, ok := shard.(oobRetentionSetter); ok {
+			rs.SetOOBRetention(r)
+		}
+	}
+}
+
+// SetQuotas sets the quotas on each shard that can enforce them. Since each
+// user lives on one shard, they're enforced per user just the same.
+func (s *ShardedEngine) SetQuotas(q Quotas) {
+	for _, shard := range s.shards {
+		if qs, ok := shard.(quotaSetter); ok {
+			qs.SetQuotas(q)
+		}
+	}
+}
+
+// Reminders returns the due reminders from all shards, in order of when
+// they're due.
+func (s *ShardedEngine) Reminders(before time.Time) ([]gregor.Reminder, error) {
+	var ret []gregor.Reminder
+	for _, shard := range s.shards {
+		rs, ok := shard.(gregor.ReminderStore)
+		if !ok {
+			return nil, ErrShardMissingFeature("reminders")
+		}
+		rems, err := rs.Reminders(before)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rems...)
+	}
+	sort.Stable(remindersByTime(ret))
+	return ret, nil
+}
+
+func (s *ShardedEngine) DeleteReminder(r gregor.Reminder) error {
+	rs, ok := s.ShardFor(r.Item().Metadata().UID()).(gregor.ReminderStore)
+	if !ok {
+		return ErrShardMissingFeature("reminders")
+	}
+	return rs.DeleteReminder(r)
+}
+
+// Prune prunes each shard in turn.
+func (s *ShardedEngine) Prune(before time.Time) error {
+	for _, shard := range s.shards {
+		p, ok := shard.(gregor.Pruner)
+		if !ok {
+			return ErrShardMissingFeature("pruning")
+		}
+		if err := p.Prune(before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBodyKeys sets the body keys on each shard that can encrypt bodies.
+func (s *ShardedEngine) SetBodyKeys(kp KeyProvider) {
+	for _, shard := range s.shards {
+		if r, ok := shard.(BodyKeyRotator); ok {
+			r.SetBodyKeys(kp)
+		}
+	}
+}
+
+// RotateBodyKeys rotates the body keys on each shard in turn, and returns
+// how many bodies were re-encrypted in all.
+func (s *ShardedEngine) RotateBodyKeys() (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		r, ok := shard.(BodyKeyRotator)
+		if !ok {
+			return total, ErrShardMissingFeature("body encryption")
+		}
+		n, err := r.RotateBodyKeys()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *ShardedEngine) Export(u gregor.UID) (*UserExport, error) {
+	ue, ok := s.ShardFor(u).(UserExporter)
+	if !ok {
+		return nil, ErrShardMissingFeature("export")
+	}
+	return ue.Export(u)
+}
+
+func (s *ShardedEngine) Import(e *UserExport) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	ue, ok := s.ShardFor(e.uid()).(UserExporter)
+	if !ok {
+		return ErrShardMissingFeature("import")
+	}
+	return ue.Import(e)
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+	test "github.com/keybase/gregor/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemShards(cl clockwork.Clock, n int) []gregor.StateMachine {
+	var ret []gregor.StateMachine
+	for i := 0; i < n; i++ {
+		ret = append(ret, NewMemEngine(test.TestObjFactory{}, cl))
+	}
+	return ret
+}
+
+func TestShardedEngine(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	eng, err := NewShardedEngine(newMemShards(cl, 3), nil)
+	require.Nil(t, err, "no error from NewShardedEngine")
+	eng.SetOOBRetention(testOOBRetention)
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachinePrune(t, eng, cl)
+	test.TestStateMachineReplay(t, eng, cl)
+	test.TestStateMachineReorder(t, eng, cl)
+	test.TestStateMachinePaging(t, eng, cl)
+	test.TestStateMachineSync(t, eng, cl)
+	test.TestStateMachineStateDiff(t, eng, cl)
+	test.TestStateMachineCategories(t, eng, cl)
+	test.TestStateMachineOutOfBand(t, eng, cl)
+	test.TestStateMachineDeviceDismissal(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	test.TestStateMachineHLC(t, eng, cl)
+	testQuotas(t, eng, cl)
+}
+
+func TestShardedSqliteEngine(t *testing.T) {
+	var shards []ShardConfig
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("./gregor_shard%d.db", i)
+		os.Remove(name)
+		defer os.Remove(name)
+		shards = append(shards, ShardConfig{Engine: "sqlite3", DSN: name})
+	}
+	cl := clockwork.NewFakeClock()
+	eng, dbs, err := (&ShardMap{Shards: shards}).Open(test.TestObjFactory{}, cl)
+	require.Nil(t, err, "no error opening shards")
+	for _, db := range dbs {
+		defer db.Close()
+	}
+	test.TestStateMachineAllDevices(t, eng, cl)
+	test.TestStateMachinePerDevice(t, eng, cl)
+
+	// Move a user from one SQL shard to the other by hand.
+	of := test.TestObjFactory{}
+	src, dst := eng.shards[0].(UserStore), eng.shards[1].(UserStore)
+	u := makeUIDs(1)[0]
+	c, _ := of.MakeCategory("foos")
+	dtime := cl.Now().Add(time.Hour)
+	for i, dt := range []*time.Time{nil, &dtime} {
+		m, _ := of.MakeMsgID([]byte(fmt.Sprintf("m%d", i)))
+		b, _ := of.MakeBody([]byte(fmt.Sprintf("item %d", i)))
+		item, _ := of.MakeItem(u, m, nil, cl.Now(), c, dt, b)
+		ibm, _ := of.MakeInBandMessageFromItem(item)
+		msg, _ := of.MakeMessageFromInBandMessage(ibm)
+		require.Nil(t, src.ConsumeMessage(msg), "no error from ConsumeMessage")
+	}
+	require.Nil(t, MoveUser(u, src, dst), "no error from MoveUser")
+	ids, err := stateMsgIDs(dst, u)
+	require.Nil(t, err, "no error from State")
+	require.Equal(t, 2, len(ids), "both items moved")
+	ids, err = stateMsgIDs(src, u)
+	require.Nil(t, err, "no error from State")
+	require.Equal(t, 0, len(ids), "nothing left behind")
+
+	// The expiry came along too.
+	later := timeOrOffset(cl.Now().Add(2 * time.Hour))
+	st, err := dst.State(u, nil, later)
+	require.Nil(t, err, "no error from State")
+	items, _ := st.Items()
+	require.Equal(t, 1, len(items), "one item expired")
+}
+
+func TestMoveUserRemindersAndOOB(t *testing.T) {
+	name := "./gregor_move.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := createDb("sqlite3", name)
+	if db != nil {
+		defer db.Close()
+	}
+	require.Nil(t, err, "no error from createDb")
+	cl := clockwork.NewFakeClock()
+	mem := NewMemEngine(test.TestObjFactory{}, cl)
+	mem.SetOOBRetention(testOOBRetention)
+	sqlEng := newTestSQLEngine(t, db, cl, nil)
+
+	// A user with an Item that has one reminder that's gone out and one
+	// that hasn't, and an out-of-band message waiting for them.
+	of := test.TestObjFactory{}
+	oob := makeOutOfBand(t, "kbfs.favorites", "queued")
+	u := oob.ToOutOfBandMessage().UID()
+	m, _ := of.MakeMsgID([]byte("reminded"))
+	c, _ := of.MakeCategory("foos")
+	b, _ := of.MakeBody([]byte("remind me"))
+	item, _ := of.MakeItem(u, m, nil, cl.Now(), c, nil, b)
+	ibm, _ := of.MakeInBandMessageFromItem(item)
+	rec := newMsgRecord(ibm, cl.Now())
+	sent, pending := cl.Now().Add(time.Minute), cl.Now().Add(time.Hour)
+	rec.setNotifyTimes([]time.Time{sent, pending})
+	require.Nil(t, mem.Import(newUserExport(u, cl.Now(), []*msgRecord{rec})), "no error from Import")
+	require.Nil(t, mem.ConsumeMessage(oob), "no error from ConsumeMessage")
+	cl.Advance(2 * time.Minute)
+	rems, err := mem.Reminders(cl.Now())
+	require.Nil(t, err, "no error from Reminders")
+	require.Equal(t, 1, len(rems), "first reminder is due")
+	require.Nil(t, mem.DeleteReminder(rems[0]), "no error from DeleteReminder")
+
+	check := func(s UserStore, where string) {
+		rems, err := s.(gregor.ReminderStore).Reminders(pending)
+		require.Nil(t, err, "no error from Reminders")
+		require.Equal(t, 1, len(rems), "only the pending reminder %s", where)
+		require.True(t, pending.Equal(rems[0].RemindTime()), "pending reminder %s", where)
+		q, err := s.(gregor.OutOfBandQueue).QueuedOutOfBandMessages(u)
+		require.Nil(t, err, "no error from QueuedOutOfBandMessages")
+		require.Equal(t, 1, len(q), "one queued message %s", where)
+		require.Equal(t, "queued", string(q[0].Body().Bytes()), "queued message %s", where)
+	}
+
+	require.Nil(t, MoveUser(u, mem, sqlEng), "no error from MoveUser")
+	check(sqlEng, "in SQL")
+	users, err := mem.Users()
+	require.Nil(t, err, "no error from Users")
+	require.Equal(t, 0, len(users), "nothing left behind")
+
+	mem2 := NewMemEngine(test.TestObjFactory{}, cl)
+	mem2.SetOOBRetention(testOOBRetention)
+	require.Nil(t, MoveUser(u, sqlEng, mem2), "no error from MoveUser")
+	check(mem2, "back in memory")
+	users, err = sqlEng.Users()
+	require.Nil(t, err, "no error from Users")
+	require.Equal(t, 0, len(users), "nothing left behind in SQL")
+
+	// Copying a user twice doesn't queue their messages twice.
+	for i := 0; i < 2; i++ {
+		require.Nil(t, CopyUser(u, mem2, sqlEng), "no error from CopyUser")
+		require.Nil(t, CopyUser(u, mem2, mem), "no error from CopyUser")
+	}
+	check(sqlEng, "after copying twice to SQL")
+	check(mem, "after copying twice to memory")
+}
+
+func makeUIDs(n int) []gregor.UID {
+	var ret []gregor.UID
+	for i := 0; i < n; i++ {
+		u, _ := test.TestObjFactory{}.MakeUID([]byte(fmt.Sprintf("user%d", i)))
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+func TestShardIndex(t *testing.T) {
+	counts := make([]int, 5)
+	for _, u := range makeUIDs(1000) {
+		require.Equal(t, 0, shardIndex(u, 1, nil), "only one shard")
+		before := shardIndex(u, 4, nil)
+		after := shardIndex(u, 5, nil)
+		require.True(t, after == before || after == 4, "users only move to the new shard")
+		counts[after]++
+	}
+	for i, n := range counts {
+		require.True(t, n > 100, "shard %d got a fair share of users", i)
+	}
+
+	u := makeUIDs(1)[0]
+	require.Equal(t, 3, shardIndex(u, 5, map[string]int{hexEnc(u): 3}), "overrides win")
+}
+
+func TestReshard(t *testing.T) {
+	cl := clockwork.NewFakeClock()
+	of := test.TestObjFactory{}
+	shards := newMemShards(cl, 3)
+	from, err := NewShardedEngine(shards[:2], nil)
+	require.Nil(t, err, "no error from NewShardedEngine")
+	to, err := NewShardedEngine(shards, nil)
+	require.Nil(t, err, "no error from NewShardedEngine")
+
+	users := makeUIDs(50)
+	c, _ := of.MakeCategory("foos")
+	for i, u := range users {
+		for j := 0; j < 3; j++ {
+			m, _ := of.MakeMsgID([]byte(fmt.Sprintf("m%d", j)))
+			b, _ := of.MakeBody([]byte(fmt.Sprintf("user %d item %d", i, j)))
+			item, err := of.MakeItem(u, m, nil, cl.Now(), c, nil, b)
+			require.Nil(t, err, "no error from MakeItem")
+			ibm, _ := of.MakeInBandMessageFromItem(item)
+			msg, _ := of.MakeMessageFromInBandMessage(ibm)
+			require.Nil(t, from.ConsumeMessage(msg), "no error from ConsumeMessage")
+		}
+	}
+
+	moved, err := Reshard(from, to, nil)
+	require.Nil(t, err, "no error from Reshard")
+	require.True(t, moved > 0, "some users moved")
+	require.True(t, moved < len(users), "not all users moved")
+
+	for _, u := range users {
+		ids, err := stateMsgIDs(to, u)
+		require.Nil(t, err, "no error from State")
+		require.Equal(t, 3, len(ids), "all of the user's items are on the right shard")
+	}
+	movedTo, err := shards[2].(UserStore).Users()
+	require.Nil(t, err, "no error from Users")
+	require.Equal(t, moved, len(movedTo), "everyone moved to the new shard")
+	for i := 0; i < 2; i++ {
+		left, err := shards[i].(UserStore).Users()
+		require.Nil(t, err, "no error from Users")
+		for _, u := range left {
+			require.Equal(t, shards[i], to.ShardFor(u), "only users that belong are left")
+		}
+	}
+
+	moved, err = Reshard(from, to, nil)
+	require.Nil(t, err, "no error from Reshard")
+	require.Equal(t, 0, moved, "nothing left to move")
+}
+
+func TestReadShardMap(t *testing.T) {
+	m, err := ReadShardMap(strings.NewReader(`{"shards": [{"engine": "sqlite3", "dsn": "a.db"}, {"engine": "mysql", "dsn": "b"}],
+		"overrides": {"aabb": 1}}`))
+	require.Nil(t, err, "no error from ReadShardMap")
+	require.Equal(t, 2, len(m.Shards), "two shards")
+	u, _ := test.TestObjFactory{}.MakeUID([]byte{0xaa, 0xbb})
+	require.Equal(t, 1, m.ShardIndex(u), "override applies")
+
+	for _, bad := range []string{
+		`{"shards": [`,
+		`{"shards": []}`,
+		`{"shards": [{"engine": "sqlite3", "dsn": "a.db"}], "overrides": {"aabb": 1}}`,
+	} {
+		_, err = ReadShardMap(strings.NewReader(bad))
+		require.IsType(t, ErrBadShardMap(""), err, "bad shard map %s", bad)
+	}
+	_, err = ReadShardMap(strings.NewReader(`{"shards": [{"engine": "oracle", "dsn": "a"}]}`))
+	require.IsType(t, ErrUnknownEngine(""), err, "unknown engine")
+}
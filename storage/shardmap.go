@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+
+	"github.com/jonboulle/clockwork"
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrBadShardMap is returned for shard maps that don't make sense.
+type ErrBadShardMap string
+
+func (e ErrBadShardMap) Error() string { return "bad shard map: " + string(e) }
+
+// ShardConfig says how to connect to one SQL shard. Engine is a
+// database/sql driver name like "mysql", and DSN is passed to sql.Open as
+// is, so MySQL DSNs should include parseTime=true.
+type ShardConfig struct {
+	Engine string `json:"engine"`
+	DSN    string `json:"dsn"`
+}
+
+// ShardMap is the configuration for a ShardedEngine, typically read from a
+// JSON file like:
+//
+//	{
+//	  "shards": [
+//	    {"engine": "mysql", "dsn": "gregor:pw@tcp(db0:3306)/gregor?parseTime=true"},
+//	    {"engine": "mysql", "dsn": "gregor:pw@tcp(db1:3306)/gregor?parseTime=true"}
+//	  ],
+//	  "overrides": {"0a1b2c3d4e5f6071": 1}
+//	}
+//
+// The order of the shards determines which users live where, so shards
+// should only ever be added to the end. Overrides pin users, given by
+// hex-encoded UID, to a particular shard.
+type ShardMap struct {
+	Shards    []ShardConfig  `json:"shards"`
+	Overrides map[string]int `json:"overrides,omitempty"`
+}
+
+// ReadShardMap reads and checks a JSON shard map from r.
+func ReadShardMap(r io.Reader) (*ShardMap, error) {
+	var m ShardMap
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, ErrBadShardMap(err.Error())
+	}
+	if len(m.Shards) == 0 {
+		return nil, ErrBadShardMap("no shards")
+	}
+	for _, c := range m.Shards {
+		if _, err := lookupDialect(c.Engine); err != nil {
+			return nil, err
+		}
+	}
+	for u, i := range m.Overrides {
+		if i < 0 || i >= len(m.Shards) {
+			return nil, ErrBadShardMap("override for " + u + " is out of range")
+		}
+	}
+	return &m, nil
+}
+
+// ShardIndex returns the index of the shard the user u lives on.
+func (m *ShardMap) ShardIndex(u gregor.UID) int {
+	return shardIndex(u, len(m.Shards), m.Overrides)
+}
+
+// Open opens the shard's database and brings its schema up to date.
+func (c ShardConfig) Open() (*sql.DB, error) {
+	db, err := sql.Open(c.Engine, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := Migrate(db, c.Engine); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Open connects to all of the shards in the map, and returns a
+// ShardedEngine over them, along with the databases, which the caller
+// should close when done.
+func (m *ShardMap) Open(of gregor.ObjFactory, cl clockwork.Clock) (*ShardedEngine, []*sql.DB, error) {
+	engs, dbs, err := OpenShardMaps(of, cl, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return engs[0], dbs, nil
+}
+
+// OpenShardMaps is like Open, but for several maps at once, such as the
+// before and after of a resharding. Shards that appear in more than one
+// map share a single connection and SQLEngine.
+func OpenShardMaps(of gregor.ObjFactory, cl clockwork.Clock, maps ...*ShardMap) ([]*ShardedEngine, []*sql.DB, error) {
+	var dbs []*sql.DB
+	closeAll := func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}
+	opened := make(map[ShardConfig]*SQLEngine)
+	var ret []*ShardedEngine
+	for _, m := range maps {
+		var shards []gregor.StateMachine
+		for _, c := range m.Shards {
+			eng, found := opened[c]
+			if !found {
+				db, err := c.Open()
+				if err != nil {
+					closeAll()
+					return nil, nil, err
+				}
+				dbs = append(dbs, db)
+				if eng, err = NewSQLEngineFor(c.Engine, db, of, cl); err != nil {
+					closeAll()
+					return nil, nil, err
+				}
+				opened[c] = eng
+			}
+			shards = append(shards, eng)
+		}
+		s, err := NewShardedEngine(shards, m.Overrides)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, dbs, nil
+}
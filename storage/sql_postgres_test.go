@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+// Test with: POSTGRES_DSN=postgres://gregor@localhost/gregor_test?sslmode=disable go test
+func TestPostgresEngine(t *testing.T) {
+	name := os.Getenv("POSTGRES_DSN")
+	if name == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	testEngine(t, "postgres", name)
+}
+
+func TestPostgresRebind(t *testing.T) {
+	require.Equal(t, "SELECT 1", rebind(bindDollar, "SELECT 1"), "no placeholders")
+	require.Equal(t, "$1", rebind(bindDollar, "?"), "just a placeholder")
+	require.Equal(t, "($1,$2)", rebind(bindDollar, "(?,?)"), "adjacent placeholders")
+
+	// Placeholders are numbered across all of a query's pieces.
+	q := &queryBuilder{stw: postgresTimeWriter{}, bt: bindDollar}
+	q.Build("UPDATE items SET dtime=? WHERE uid=?", 1, 2)
+	q.Build("AND msgid IN (?, ?)", 3, 4)
+	require.Equal(t, "UPDATE items SET dtime=$1 WHERE uid=$2 AND msgid IN ($3, $4)", q.Query(), "numbered placeholders")
+	require.Equal(t, []interface{}{1, 2, 3, 4}, q.Args(), "args in order")
+}
+
+func TestPostgresTimeWriter(t *testing.T) {
+	now := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	cl := clockwork.NewFakeClockAt(now)
+	build := func(cl clockwork.Clock, f func(q *queryBuilder)) (string, []interface{}) {
+		q := &queryBuilder{clock: cl, stw: postgresTimeWriter{}, bt: bindDollar}
+		f(q)
+		return q.Query(), q.Args()
+	}
+
+	qry, args := build(nil, func(q *queryBuilder) { q.Now() })
+	require.Equal(t, "NOW()", qry, "the server's clock without a fake one")
+	require.Nil(t, args, "no args for NOW()")
+
+	qry, args = build(cl, func(q *queryBuilder) { q.Now() })
+	require.Equal(t, "CAST($1 AS TIMESTAMPTZ)", qry, "the fake clock's time")
+	require.Equal(t, []interface{}{now}, args, "now as an arg")
+
+	qry, args = build(cl, func(q *queryBuilder) { q.TimeOrOffset(nil) })
+	require.Equal(t, "NULL", qry, "no time")
+	require.Nil(t, args, "no args for NULL")
+
+	then := now.Add(time.Hour)
+	qry, args = build(cl, func(q *queryBuilder) { q.TimeOrOffset(&timeOrOffsetRecord{Time_: &then}) })
+	require.Equal(t, "$1", qry, "an absolute time")
+	require.Equal(t, []interface{}{then}, args, "the time as an arg")
+
+	d := 1500 * time.Millisecond
+	qry, args = build(cl, func(q *queryBuilder) { q.TimeOrOffset(&timeOrOffsetRecord{Offset_: &d}) })
+	require.Equal(t, "( CAST($1 AS TIMESTAMPTZ) + CAST($2 AS INTERVAL))", qry, "an offset from now")
+	require.Equal(t, []interface{}{now, "1500000 microseconds"}, args, "now and the offset as args")
+
+	qry, _ = build(cl, func(q *queryBuilder) { q.TimeOrOffset(&timeOrOffsetRecord{}) })
+	require.Equal(t, "NULL", qry, "neither a time nor an offset")
+
+	require.Equal(t, then, postgresTimeWriter{}.TimeArg(then), "times are passed through")
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"database/sql"
 	"encoding/hex"
 	"errors"
+	"strconv"
 	"time"
 
 	gregor "github.com/keybase/gregor"
@@ -97,14 +99,27 @@ func (i *inBandMsgTypeScanner) Scan(src interface{}) error {
 	if src == nil {
 		return nil
 	}
-	if raw, ok := src.(int); ok {
-		t := gregor.InBandMsgType(raw)
-		switch t {
-		case gregor.InBandMsgTypeUpdate, gregor.InBandMsgTypeSync:
-			i.t = t
-		default:
+	var t gregor.InBandMsgType
+	switch raw := src.(type) {
+	case int:
+		t = gregor.InBandMsgType(raw)
+	case int64:
+		t = gregor.InBandMsgType(raw)
+	case []byte:
+		// MySQL's text protocol hands back integers as strings.
+		n, err := strconv.Atoi(string(raw))
+		if err != nil {
 			return ErrBadScan
 		}
+		t = gregor.InBandMsgType(n)
+	default:
+		return ErrBadScan
+	}
+	switch t {
+	case gregor.InBandMsgTypeUpdate, gregor.InBandMsgTypeSync:
+		i.t = t
+	default:
+		return ErrBadScan
 	}
 	return nil
 }
@@ -136,9 +151,33 @@ func (c categoryScanner) Category() gregor.Category {
 
 func (c categoryScanner) IsSet() bool { return c.isSet }
 
-type bodyScanner struct {
+type systemScanner struct {
 	o gregor.ObjFactory
-	b gregor.Body
+	s gregor.System
+}
+
+func (s *systemScanner) Scan(src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	str, err := toString(src)
+	if err != nil {
+		return err
+	}
+	s.s, err = s.o.MakeSystem(str)
+	return err
+}
+
+func (s systemScanner) System() gregor.System { return s.s }
+
+// bodyScanner scans bodies, decrypting them with keys if keyID holds the
+// ID of the key they were encrypted with. Since Scan fills in columns in
+// order, the key ID has to be selected before the body.
+type bodyScanner struct {
+	o     gregor.ObjFactory
+	b     gregor.Body
+	keys  KeyProvider
+	keyID *sql.NullString
 }
 
 func (b *bodyScanner) Scan(src interface{}) error {
@@ -147,6 +186,11 @@ func (b *bodyScanner) Scan(src interface{}) error {
 	}
 	if raw, ok := src.([]byte); ok {
 		var err error
+		if b.keyID != nil && b.keyID.Valid {
+			if raw, err = openBody(b.keys, b.keyID.String, raw); err != nil {
+				return err
+			}
+		}
 		b.b, err = b.o.MakeBody(raw)
 		return err
 	}
@@ -168,6 +212,11 @@ func (t *timeScanner) Scan(src interface{}) error {
 		t.t = tm
 	case int64:
 		t.t = time.Unix(tm/1000000, (tm%1000000)*1000)
+	case []byte:
+		// MySQL returns DATETIMEs as strings if parseTime isn't set in the DSN.
+		var err error
+		t.t, err = time.Parse(mysqlTimeFormat, string(tm))
+		return err
 	default:
 		return ErrBadScan
 	}
@@ -17,16 +17,65 @@ func sqlWrapper(s string) string {
 }
 
 type SQLEngine struct {
-	driver     *sql.DB
-	objFactory gregor.ObjFactory
-	clock      clockwork.Clock
-	stw        sqlTimeWriter
+	driver       *sql.DB
+	objFactory   gregor.ObjFactory
+	clock        clockwork.Clock
+	stw          sqlTimeWriter
+	bt           bindType
+	oobRetention OOBRetention
+	bodyKeys     KeyProvider
+	quotas       Quotas
 }
 
 func NewSQLEngine(d *sql.DB, of gregor.ObjFactory, stw sqlTimeWriter, cl clockwork.Clock) *SQLEngine {
 	return &SQLEngine{driver: d, objFactory: of, stw: stw, clock: cl}
 }
 
+// SetOOBRetention sets how long OutOfBandMessages are queued for. It should
+// be called before the engine is put to use.
+func (s *SQLEngine) SetOOBRetention(r OOBRetention) {
+	s.oobRetention = r
+}
+
+// SetBodyKeys makes the engine encrypt the bodies it stores with keys from
+// kp, and decrypt them when reading them back. Bodies stored before then
+// stay in the clear until RotateBodyKeys is run. It should be called before
+// the engine is put to use.
+func (s *SQLEngine) SetBodyKeys(kp KeyProvider) {
+	s.bodyKeys = kp
+}
+
+// SetQuotas sets the quotas that the engine enforces as it consumes
+// messages. The check runs in the transaction that consumes the message,
+// so an Item it lets through and the dismissals that made room for it are
+// committed together or not at all. The count is a plain read, though, so
+// under MySQL's default REPEATABLE READ isolation, creations for one user
+// that commit at the same time can each miss the others and take the user
+// a little over their item quotas. SQLite's transactions are serializable,
+// so there the quotas hold exactly. It should be called before the engine
+// is put to use.
+func (s *SQLEngine) SetQuotas(q Quotas) {
+	s.quotas = q
+}
+
+// encryptBody encrypts body for storage if the engine has body keys. It
+// returns the ID of the key to store alongside it, or nil if it's to be
+// stored in the clear.
+func (s *SQLEngine) encryptBody(body []byte) (interface{}, []byte, error) {
+	if s.bodyKeys == nil || body == nil {
+		return nil, body, nil
+	}
+	id, sealed, err := sealBody(s.bodyKeys, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, sealed, nil
+}
+
+func (s *SQLEngine) newBodyScanner(keyID *sql.NullString) bodyScanner {
+	return bodyScanner{o: s.objFactory, keys: s.bodyKeys, keyID: keyID}
+}
+
 type builder interface {
 	Build(s string, args ...interface{})
 }
@@ -42,6 +91,7 @@ type queryBuilder struct {
 	qry   []string
 	clock clockwork.Clock
 	stw   sqlTimeWriter
+	bt    bindType
 }
 
 func (q *queryBuilder) Now() {
@@ -66,7 +116,7 @@ func (q *queryBuilder) Build(f string, args ...interface{}) {
 	q.args = append(q.args, args...)
 }
 
-func (q *queryBuilder) Query() string       { return strings.Join(q.qry, " ") }
+func (q *queryBuilder) Query() string       { return rebind(q.bt, strings.Join(q.qry, " ")) }
 func (q *queryBuilder) Args() []interface{} { return q.args }
 
 func (q *queryBuilder) Exec(tx *sql.Tx) error {
@@ -92,22 +142,29 @@ type byter interface {
 	Bytes() []byte
 }
 
+func (s *SQLEngine) rebind(q string) string { return rebind(s.bt, q) }
+
 func (s *SQLEngine) newQueryBuilder() *queryBuilder {
-	return &queryBuilder{clock: s.clock, stw: s.stw}
+	return &queryBuilder{clock: s.clock, stw: s.stw, bt: s.bt}
 }
 
-func (s *SQLEngine) consumeCreation(tx *sql.Tx, u gregor.UID, i gregor.Item) error {
+func (s *SQLEngine) consumeCreation(tx *sql.Tx, u gregor.UID, i gregor.Item, ctime time.Time) error {
 	md := i.Metadata()
+	keyID, body, err := s.encryptBody(i.Body().Bytes())
+	if err != nil {
+		return err
+	}
 	qb := s.newQueryBuilder()
-	qb.Build("INSERT INTO items(uid, msgid, category, body, dtime) VALUES(?,?,?,?,",
+	qb.Build("INSERT INTO items(uid, msgid, category, body_key, body, dtime) VALUES(?,?,?,?,?,",
 		hexEnc(u),
 		hexEnc(md.MsgID()),
 		i.Category().String(),
-		i.Body().Bytes(),
+		keyID,
+		body,
 	)
 	qb.TimeOrOffset(i.DTime())
 	qb.Build(")")
-	err := qb.Exec(tx)
+	err = qb.Exec(tx)
 	if err != nil {
 		return err
 	}
@@ -117,7 +174,7 @@ func (s *SQLEngine) consumeCreation(tx *sql.Tx, u gregor.UID, i gregor.Item) err
 			continue
 		}
 		nqb := s.newQueryBuilder()
-		nqb.Build("INSERT INTO items(uid, msgid, ntime) VALUES(?,?,", hexEnc(u), hexEnc(md.MsgID()))
+		nqb.Build("INSERT INTO reminders(uid, msgid, ntime) VALUES(?,?,", hexEnc(u), hexEnc(md.MsgID()))
 		nqb.TimeOrOffset(t)
 		nqb.Build(")")
 		err = nqb.Exec(tx)
@@ -125,16 +182,167 @@ func (s *SQLEngine) consumeCreation(tx *sql.Tx, u gregor.UID, i gregor.Item) err
 			return err
 		}
 	}
-	return nil
+
+	if err = s.applyItemUpdates(tx, u, md.MsgID()); err != nil {
+		return err
+	}
+	return s.applyEarlierDismissals(tx, u, md.MsgID(), i.Category(), ctime, gregor.OrderingHLC(md, ctime))
+}
+
+// earliestDismissal returns the earliest time that the item mid, in the
+// category c and created at ctime with the HLC h, was dismissed for all
+// devices, or nil if it hasn't been.
+func (s *SQLEngine) earliestDismissal(tx *sql.Tx, hexUID string, hexMID string, c string, ctime time.Time, h gregor.HLC) (*time.Time, error) {
+	var byID, byTime timeScanner
+	row := tx.QueryRow(s.rebind(`SELECT MIN(m.ctime) FROM dismissals_by_id AS di
+		INNER JOIN messages AS m ON (di.uid=m.uid AND di.msgid=m.msgid)
+		WHERE di.uid=? AND di.dmsgid=?`), hexUID, hexMID)
+	if err := row.Scan(&byID); err != nil {
+		return nil, err
+	}
+	qb := s.newQueryBuilder()
+	qb.Build(`SELECT MIN(m.ctime) FROM dismissals_by_time AS dt
+		INNER JOIN messages AS m ON (dt.uid=m.uid AND dt.msgid=m.msgid)
+		WHERE dt.uid=? AND (dt.dtime>=? OR (dt.hlc>0 AND dt.hlc>=?)) AND dt.category IN (`, hexUID, qb.TimeArg(ctime), int64(h))
+	for j, p := range gregor.CategoryPatterns(c) {
+		if j > 0 {
+			qb.Build(",")
+		}
+		qb.Build("?", p)
+	}
+	qb.Build(")")
+	row = tx.QueryRow(qb.Query(), qb.Args()...)
+	if err := row.Scan(&byTime); err != nil {
+		return nil, err
+	}
+
+	ret := byID.TimeOrNil()
+	if t := byTime.TimeOrNil(); t != nil && (ret == nil || t.Before(*ret)) {
+		ret = t
+	}
+	return ret, nil
+}
+
+// applyEarlierDismissals dismisses the newly-created item mid if we've
+// already consumed a dismissal that targets it, which happens when messages
+// arrive out of order.
+func (s *SQLEngine) applyEarlierDismissals(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, c gregor.Category, ctime time.Time, h gregor.HLC) error {
+	hexUID := hexEnc(u)
+	dtime, err := s.earliestDismissal(tx, hexUID, hexEnc(mid), c.String(), ctime, h)
+	if err != nil || dtime == nil {
+		return err
+	}
+	return s.dismissItemAt(tx, hexUID, hexEnc(mid), *dtime)
+}
+
+// consumeUpdate records the update up, carried by the message mid that
+// arrived at ctime, and applies it to the item it targets if we have it.
+// Otherwise it's applied when the item arrives.
+func (s *SQLEngine) consumeUpdate(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, up gregor.ItemUpdate, ctime time.Time) error {
+	if up.MsgID() == nil {
+		return nil
+	}
+	au := newAppliedUpdate(up, mid, ctime)
+	qb := s.newQueryBuilder()
+	var keyID, body, dtime interface{}
+	if au.Body != nil {
+		var sealed []byte
+		var err error
+		if keyID, sealed, err = s.encryptBody([]byte(au.Body)); err != nil {
+			return err
+		}
+		body = sealed
+	}
+	if au.DTime != nil {
+		dtime = qb.TimeArg(*au.DTime)
+	}
+	qb.Build("INSERT INTO item_updates(uid, msgid, umsgid, body_key, body, dtime) VALUES(?,?,?,?,?,?)",
+		hexEnc(u), hexEnc(mid), hexEnc(up.MsgID()), keyID, body, dtime)
+	if err := qb.Exec(tx); err != nil {
+		return err
+	}
+	return s.applyItemUpdates(tx, u, up.MsgID())
+}
+
+// latestItemUpdate selects the given columns of the latest update that sets
+// the field in the given column for an item, skipping updates older than
+// the item. Ties in ctime are broken by MsgID, as in
+// appliedUpdate.supersedes.
+const latestItemUpdate = `SELECT %[1]s FROM item_updates AS iu
+	INNER JOIN messages AS m ON (iu.uid=m.uid AND iu.msgid=m.msgid)
+	WHERE iu.uid=? AND iu.umsgid=? AND iu.%[2]s IS NOT NULL AND m.ctime>=?
+	ORDER BY m.ctime DESC, m.msgid DESC LIMIT 1`
+
+// applyItemUpdates sets the body and dtime of the item mid to those of the
+// latest updates to each, if there are any. An item that was dismissed
+// before the update says it expires stays dismissed as of then.
+func (s *SQLEngine) applyItemUpdates(tx *sql.Tx, u gregor.UID, mid gregor.MsgID) error {
+	hexUID, hexMID := hexEnc(u), hexEnc(mid)
+	var category string
+	var ctime timeScanner
+	var h int64
+	err := tx.QueryRow(s.rebind(`SELECT i.category, m.ctime, m.hlc FROM items AS i
+		INNER JOIN messages AS m ON (i.uid=m.uid AND i.msgid=m.msgid)
+		WHERE i.uid=? AND i.msgid=?`), hexUID, hexMID).Scan(&category, &ctime, &h)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctimeArg := s.newQueryBuilder().TimeArg(ctime.Time())
+
+	// The body is copied over as is, still encrypted if it was.
+	var keyID sql.NullString
+	var body []byte
+	err = tx.QueryRow(s.rebind(fmt.Sprintf(latestItemUpdate, "iu.body_key, iu.body", "body")), hexUID, hexMID, ctimeArg).Scan(&keyID, &body)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	default:
+		if _, err = tx.Exec(s.rebind("UPDATE items SET body_key=?, body=? WHERE uid=? AND msgid=?"), keyID, body, hexUID, hexMID); err != nil {
+			return err
+		}
+	}
+
+	var dtime timeScanner
+	err = tx.QueryRow(s.rebind(fmt.Sprintf(latestItemUpdate, "iu.dtime", "dtime")), hexUID, hexMID, ctimeArg).Scan(&dtime)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	etime := dtime.Time()
+	dismissed, err := s.earliestDismissal(tx, hexUID, hexMID, category, ctime.Time(), gregor.HLC(h))
+	if err != nil {
+		return err
+	}
+	if dismissed != nil && dismissed.Before(etime) {
+		etime = *dismissed
+	}
+	qb := s.newQueryBuilder()
+	qb.Build("UPDATE items SET dtime=? WHERE uid=? AND msgid=?", qb.TimeArg(etime), hexUID, hexMID)
+	return qb.Exec(tx)
+}
+
+// dismissItemAt sets the dtime of the given item to dtime, unless it was
+// already set to go away before then.
+func (s *SQLEngine) dismissItemAt(tx *sql.Tx, hexUID string, hexMID string, dtime time.Time) error {
+	qb := s.newQueryBuilder()
+	qb.Build("UPDATE items SET dtime=? WHERE uid=? AND msgid=? AND (dtime IS NULL OR dtime>?)",
+		qb.TimeArg(dtime), hexUID, hexMID, qb.TimeArg(dtime))
+	return qb.Exec(tx)
 }
 
 func (s *SQLEngine) consumeMsgIDsToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, dmids []gregor.MsgID, ctime time.Time) error {
-	ins, err := tx.Prepare("INSERT INTO dismissals_by_id(uid, msgid, dmsgid) VALUES(?, ?, ?)")
+	ins, err := tx.Prepare(s.rebind("INSERT INTO dismissals_by_id(uid, msgid, dmsgid) VALUES(?, ?, ?)"))
 	if err != nil {
 		return err
 	}
 	defer ins.Close()
-	upd, err := tx.Prepare("UPDATE items SET dtime=? WHERE uid=? AND msgid=?")
+	upd, err := tx.Prepare(s.rebind("UPDATE items SET dtime=? WHERE uid=? AND msgid=? AND (dtime IS NULL OR dtime>?)"))
 	if err != nil {
 		return err
 	}
@@ -149,7 +357,7 @@ func (s *SQLEngine) consumeMsgIDsToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.
 		if err != nil {
 			return err
 		}
-		_, err = upd.Exec(ctimeArg, hexUID, hexEnc(dmid))
+		_, err = upd.Exec(ctimeArg, hexUID, hexEnc(dmid), ctimeArg)
 		if err != nil {
 			return err
 		}
@@ -157,8 +365,30 @@ func (s *SQLEngine) consumeMsgIDsToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.
 	return err
 }
 
+func (s *SQLEngine) consumeMsgIDsToDismissForDevice(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, fds []gregor.MsgIDForDevice, ctime time.Time) error {
+	ins, err := tx.Prepare(s.rebind("INSERT INTO dismissals_by_device(uid, msgid, dmsgid, devid, dtime) VALUES(?, ?, ?, ?, ?)"))
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	ctimeArg := s.newQueryBuilder().TimeArg(ctime)
+	hexUID := hexEnc(u)
+	hexMID := hexEnc(mid)
+
+	for _, fd := range fds {
+		if fd.MsgID() == nil || fd.DeviceID() == nil {
+			continue
+		}
+		if _, err = ins.Exec(hexUID, hexMID, hexEnc(fd.MsgID()), hexEnc(fd.DeviceID()), ctimeArg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *SQLEngine) ctimeFromMessage(tx *sql.Tx, u gregor.UID, mid gregor.MsgID) (time.Time, error) {
-	row := tx.QueryRow("SELECT ctime FROM messages WHERE uid=? AND msgid=?", hexEnc(u), hexEnc(mid))
+	row := tx.QueryRow(s.rebind("SELECT ctime FROM messages WHERE uid=? AND msgid=?"), hexEnc(u), hexEnc(mid))
 	var ctime timeScanner
 	if err := row.Scan(&ctime); err != nil {
 		return time.Time{}, err
@@ -166,10 +396,30 @@ func (s *SQLEngine) ctimeFromMessage(tx *sql.Tx, u gregor.UID, mid gregor.MsgID)
 	return ctime.Time(), nil
 }
 
-func (s *SQLEngine) consumeRangesToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, mrs []gregor.MsgRange, ctime time.Time) error {
+// buildCategory adds the condition that the column col holds the category
+// c, or one under it if c is a wildcard. Every category under a wildcard's
+// prefix sorts between the prefix and the prefix with its final dot
+// replaced by the next character, a slash, so the condition is a range
+// that can use an index on col.
+func buildCategory(qb *queryBuilder, col string, c string) {
+	prefix, ok := gregor.CategoryPrefix(c)
+	if !ok {
+		qb.Build(col+"=?", c)
+		return
+	}
+	qb.Build("("+col+">=? AND "+col+"<?)", prefix, prefix[:len(prefix)-1]+"/")
+}
+
+// consumeRangesToDismiss records the ranges mrs dismissed by the message
+// mid, which arrived at ctime stamped with the HLC h, and dismisses the
+// items in them. The hlc column holds each range's HLC bound, or 0 if it
+// doesn't have one, as described for rangeHLC.
+func (s *SQLEngine) consumeRangesToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.MsgID, mrs []gregor.MsgRange, ctime time.Time, h gregor.HLC) error {
 	for _, mr := range mrs {
+		bound := rangeHLC(toTime(ctime, mr.EndTime()), ctime, h)
 		qb := s.newQueryBuilder()
-		qb.Build("INSERT INTO dismissals_by_time(uid, msgid, category, dtime) VALUES (?,?,?,", hexEnc(u), hexEnc(mid), mr.Category().String())
+		qb.Build("INSERT INTO dismissals_by_time(uid, msgid, category, hlc, dtime) VALUES (?,?,?,?,",
+			hexEnc(u), hexEnc(mid), mr.Category().String(), int64(bound))
 		qb.TimeOrOffset(mr.EndTime())
 		qb.Build(")")
 		if err := qb.Exec(tx); err != nil {
@@ -178,10 +428,15 @@ func (s *SQLEngine) consumeRangesToDismiss(tx *sql.Tx, u gregor.UID, mid gregor.
 
 		// set dtime in items to the ctime of the dismissal message:
 		qbu := s.newQueryBuilder()
-		qbu.Build("UPDATE items SET dtime=? WHERE uid=? AND category=? AND msgid IN (SELECT msgid FROM messages WHERE uid=? AND ctime<=",
-			qbu.TimeArg(ctime), hexEnc(u), mr.Category().String(), hexEnc(u))
+		qbu.Build("UPDATE items SET dtime=? WHERE uid=? AND", qbu.TimeArg(ctime), hexEnc(u))
+		buildCategory(qbu, "category", mr.Category().String())
+		qbu.Build("AND (dtime IS NULL OR dtime>?) AND msgid IN (SELECT msgid FROM messages WHERE uid=? AND (ctime<=",
+			qbu.TimeArg(ctime), hexEnc(u))
 		qbu.TimeOrOffset(mr.EndTime())
-		qbu.Build(")")
+		if !bound.IsZero() {
+			qbu.Build("OR hlc<=?", int64(bound))
+		}
+		qbu.Build("))")
 		if err := qbu.Exec(tx); err != nil {
 			return err
 		}
@@ -199,16 +454,40 @@ func checkMetadataForInsert(m gregor.Metadata) error {
 	return nil
 }
 
-func (s *SQLEngine) consumeInBandMessageMetadata(tx *sql.Tx, md gregor.Metadata, t gregor.InBandMsgType) error {
+// isReplay returns true if we've already consumed a message with the given
+// metadata and digest, or ErrMsgIDConflict if we've consumed a different
+// message with the same MsgID. Messages from before we kept digests are
+// assumed to match.
+func (s *SQLEngine) isReplay(tx *sql.Tx, md gregor.Metadata, digest string) (bool, error) {
+	var stored sql.NullString
+	err := tx.QueryRow(s.rebind("SELECT digest FROM messages WHERE uid=? AND msgid=?"),
+		hexEnc(md.UID()), hexEnc(md.MsgID())).Scan(&stored)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	case stored.Valid && stored.String != digest:
+		return false, ErrMsgIDConflict{UID: md.UID(), MsgID: md.MsgID()}
+	}
+	return true, nil
+}
+
+// consumeInBandMessageMetadata writes out the message's metadata, and returns
+// its ctime, which the DB fills in if the message didn't come with one.
+func (s *SQLEngine) consumeInBandMessageMetadata(tx *sql.Tx, md gregor.Metadata, t gregor.InBandMsgType, digest string) (time.Time, error) {
 	if err := checkMetadataForInsert(md); err != nil {
-		return err
+		return time.Time{}, err
 	}
 	if t != gregor.InBandMsgTypeUpdate && t != gregor.InBandMsgTypeSync {
-		return fmt.Errorf("bad metadata: unrecognized msg type")
+		return time.Time{}, fmt.Errorf("bad metadata: unrecognized msg type")
 	}
+	// Messages without an HLC of their own are ordered by their ctime, which
+	// we might not know until the DB has filled it in.
+	h := gregor.OrderingHLC(md, md.CTime())
 	qb := s.newQueryBuilder()
-	qb.Build("INSERT INTO messages(uid, msgid, mtype, devid, ctime) VALUES(?, ?, ?, ?,",
-		hexEnc(md.UID()), hexEnc(md.MsgID()), int(t), hexEncOrNull(md.DeviceID()))
+	qb.Build("INSERT INTO messages(uid, msgid, mtype, devid, digest, hlc, ctime) VALUES(?, ?, ?, ?, ?, ?,",
+		hexEnc(md.UID()), hexEnc(md.MsgID()), int(t), hexEncOrNull(md.DeviceID()), digest, int64(h))
 	if md.CTime().IsZero() {
 		qb.Now()
 	} else {
@@ -216,42 +495,207 @@ func (s *SQLEngine) consumeInBandMessageMetadata(tx *sql.Tx, md gregor.Metadata,
 	}
 	qb.Build(")")
 	if err := qb.Exec(tx); err != nil {
-		return err
+		return time.Time{}, err
 	}
 
 	if !md.CTime().IsZero() {
-		return nil
+		return md.CTime(), nil
 	}
 
 	// get the inserted ctime
 	ctime, err := s.ctimeFromMessage(tx, md.UID(), md.MsgID())
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 	md.SetCTime(ctime)
+	if h.IsZero() {
+		_, err = tx.Exec(s.rebind("UPDATE messages SET hlc=? WHERE uid=? AND msgid=?"),
+			int64(gregor.HLCFromTime(ctime)), hexEnc(md.UID()), hexEnc(md.MsgID()))
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
 
-	return nil
+	return ctime, nil
 }
 
 func (s *SQLEngine) ConsumeMessage(m gregor.Message) error {
 	switch {
 	case m.ToInBandMessage() != nil:
 		return s.consumeInBandMessage(m.ToInBandMessage())
+	case m.ToOutOfBandMessage() != nil:
+		return s.consumeOutOfBandMessage(m.ToOutOfBandMessage())
 	default:
 		return nil
 	}
 }
 
+// enforceQuotas checks m, which isn't a replay, against the engine's
+// quotas, and consumes any dismissals needed to make room for it, all in
+// tx.
+func (s *SQLEngine) enforceQuotas(tx *sql.Tx, m gregor.InBandMessage) error {
+	if !s.quotas.appliesTo(m) {
+		return nil
+	}
+	live := sqlLiveItems{s: s, tx: tx, u: m.Metadata().UID()}
+	ds, err := s.quotas.check(s.objFactory, nowTime(s.clock), live, m)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if err := s.consumeStateUpdate(tx, d.ToStateUpdateMessage(), messageDigest(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlLiveItems answers Quotas.check's questions about the user u's live
+// Items as of now with queries in tx.
+type sqlLiveItems struct {
+	s  *SQLEngine
+	tx *sql.Tx
+	u  gregor.UID
+}
+
+var _ liveItems = sqlLiveItems{}
+
+// build adds the conditions that the Item i is the user's, is live, and,
+// if inCategory is true, is in the category c.
+func (l sqlLiveItems) build(qb *queryBuilder, c string, inCategory bool) {
+	qb.Build("WHERE i.uid=? AND", hexEnc(l.u))
+	buildInStateAt(qb, nil, nil)
+	if inCategory {
+		qb.Build("AND i.category=?", c)
+	}
+}
+
+func (l sqlLiveItems) count(c string, inCategory bool) (int, error) {
+	qb := l.s.newQueryBuilder()
+	qb.Build("SELECT COUNT(*) FROM items AS i")
+	l.build(qb, c, inCategory)
+	var n int
+	if err := l.tx.QueryRow(qb.Query(), qb.Args()...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l sqlLiveItems) oldest(n int, c string, inCategory bool) ([]gregor.Item, error) {
+	qb := l.s.newQueryBuilder()
+	qb.Build(`SELECT ` + itemColumns + `
+	          FROM items AS i
+	          INNER JOIN messages AS m ON (i.uid=m.uid AND i.msgid=m.msgid)`)
+	l.build(qb, c, inCategory)
+	qb.Build("ORDER BY m.ctime ASC, i.msgid ASC LIMIT ?", n)
+	rows, err := l.tx.Query(qb.Query(), qb.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []gregor.Item
+	for rows.Next() {
+		i, err := l.s.rowToItem(l.u, rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, i)
+	}
+	return ret, rows.Err()
+}
+
+// consumeOutOfBandMessage queues m if its System has a retention set, and
+// otherwise ignores it.
+func (s *SQLEngine) consumeOutOfBandMessage(m gregor.OutOfBandMessage) error {
+	ttl := s.oobRetention.For(m.System())
+	if ttl <= 0 || m.UID() == nil || m.System() == nil {
+		return nil
+	}
+	now := nowTime(s.clock)
+	var body []byte
+	if m.Body() != nil {
+		body = m.Body().Bytes()
+	}
+	keyID, body, err := s.encryptBody(body)
+	if err != nil {
+		return err
+	}
+	qb := s.newQueryBuilder()
+	qb.Build("INSERT INTO oob_messages(uid, sys, body_key, body, ctime, etime) VALUES(?,?,?,?,?,?)",
+		hexEnc(m.UID()), m.System().String(), keyID, body, qb.TimeArg(now), qb.TimeArg(now.Add(ttl)))
+	_, err = s.driver.Exec(qb.Query(), qb.Args()...)
+	return err
+}
+
+// QueuedOutOfBandMessages returns the out-of-band messages queued for u that
+// haven't expired yet, oldest first.
+func (s *SQLEngine) QueuedOutOfBandMessages(u gregor.UID) ([]gregor.OutOfBandMessage, error) {
+	qb := s.newQueryBuilder()
+	qb.Build("SELECT sys, body_key, body FROM oob_messages WHERE uid=? AND etime >", hexEnc(u))
+	qb.AddTime(nowTime(s.clock))
+	qb.Build("ORDER BY ctime, id")
+	rows, err := s.driver.Query(qb.Query(), qb.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []gregor.OutOfBandMessage
+	for rows.Next() {
+		system := systemScanner{o: s.objFactory}
+		var keyID sql.NullString
+		body := s.newBodyScanner(&keyID)
+		if err := rows.Scan(&system, &keyID, &body); err != nil {
+			return nil, err
+		}
+		oobm, err := s.objFactory.MakeOutOfBandMessage(u, system.System(), body.Body())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, oobm)
+	}
+	return ret, rows.Err()
+}
+
 func (s *SQLEngine) consumeInBandMessage(m gregor.InBandMessage) error {
 	switch {
 	case m.ToStateUpdateMessage() != nil:
-		return s.consumeStateUpdateMessage(m.ToStateUpdateMessage())
+		return s.consumeStateUpdateMessage(m, m.ToStateUpdateMessage())
+	case m.ToStateSyncMessage() != nil:
+		return s.consumeStateSyncMessage(m)
 	default:
 		return nil
 	}
 }
 
-func (s *SQLEngine) consumeStateUpdateMessage(m gregor.StateUpdateMessage) (err error) {
+// consumeStateSyncMessage stores a sync message, which has nothing but
+// metadata, so that it can be replayed and used as a checkpoint.
+func (s *SQLEngine) consumeStateSyncMessage(m gregor.InBandMessage) (err error) {
+	tx, err := s.driver.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	md := m.Metadata()
+	if err = checkMetadataForInsert(md); err != nil {
+		return err
+	}
+	digest := messageDigest(m)
+	replay, err := s.isReplay(tx, md, digest)
+	if err != nil || replay {
+		return err
+	}
+	_, err = s.consumeInBandMessageMetadata(tx, md, gregor.InBandMsgTypeSync, digest)
+	return err
+}
+
+func (s *SQLEngine) consumeStateUpdateMessage(ibm gregor.InBandMessage, m gregor.StateUpdateMessage) (err error) {
 	tx, err := s.driver.Begin()
 	if err != nil {
 		return err
@@ -265,19 +709,46 @@ func (s *SQLEngine) consumeStateUpdateMessage(m gregor.StateUpdateMessage) (err
 	}()
 
 	md := m.Metadata()
-	if err = s.consumeInBandMessageMetadata(tx, md, gregor.InBandMsgTypeUpdate); err != nil {
+	if err = checkMetadataForInsert(md); err != nil {
+		return err
+	}
+	digest := messageDigest(ibm)
+	replay, err := s.isReplay(tx, md, digest)
+	if err != nil || replay {
+		return err
+	}
+	if err = s.enforceQuotas(tx, ibm); err != nil {
+		return err
+	}
+	return s.consumeStateUpdate(tx, m, digest)
+}
+
+// consumeStateUpdate consumes m, which isn't a replay and has the given
+// digest, in tx.
+func (s *SQLEngine) consumeStateUpdate(tx *sql.Tx, m gregor.StateUpdateMessage, digest string) error {
+	md := m.Metadata()
+	ctime, err := s.consumeInBandMessageMetadata(tx, md, gregor.InBandMsgTypeUpdate, digest)
+	if err != nil {
 		return err
 	}
 	if m.Creation() != nil {
-		if err = s.consumeCreation(tx, md.UID(), m.Creation()); err != nil {
+		if err = s.consumeCreation(tx, md.UID(), m.Creation(), ctime); err != nil {
 			return err
 		}
 	}
 	if m.Dismissal() != nil {
-		if err = s.consumeMsgIDsToDismiss(tx, md.UID(), md.MsgID(), m.Dismissal().MsgIDsToDismiss(), md.CTime()); err != nil {
+		if err = s.consumeMsgIDsToDismiss(tx, md.UID(), md.MsgID(), m.Dismissal().MsgIDsToDismiss(), ctime); err != nil {
+			return err
+		}
+		if err = s.consumeRangesToDismiss(tx, md.UID(), md.MsgID(), m.Dismissal().RangesToDismiss(), ctime, gregor.HLCOf(md)); err != nil {
+			return err
+		}
+		if err = s.consumeMsgIDsToDismissForDevice(tx, md.UID(), md.MsgID(), m.Dismissal().MsgIDsToDismissForDevice(), ctime); err != nil {
 			return err
 		}
-		if err = s.consumeRangesToDismiss(tx, md.UID(), md.MsgID(), m.Dismissal().RangesToDismiss(), md.CTime()); err != nil {
+	}
+	if m.Update() != nil {
+		if err = s.consumeUpdate(tx, md.UID(), md.MsgID(), m.Update(), ctime); err != nil {
 			return err
 		}
 	}
@@ -289,10 +760,11 @@ func (s *SQLEngine) rowToItem(u gregor.UID, rows *sql.Rows) (gregor.Item, error)
 	deviceID := deviceIDScanner{o: s.objFactory}
 	msgID := msgIDScanner{o: s.objFactory}
 	category := categoryScanner{o: s.objFactory}
-	body := bodyScanner{o: s.objFactory}
+	var keyID sql.NullString
+	body := s.newBodyScanner(&keyID)
 	var dtime timeScanner
 	var ctime timeScanner
-	if err := rows.Scan(&msgID, &deviceID, &category, &dtime, &body, &ctime); err != nil {
+	if err := rows.Scan(&msgID, &deviceID, &category, &dtime, &keyID, &body, &ctime); err != nil {
 		return nil, err
 	}
 	return s.objFactory.MakeItem(u, msgID.MsgID(), deviceID.DeviceID(), ctime.Time(), category.Category(), dtime.TimeOrNil(), body.Body())
@@ -306,32 +778,75 @@ func (s *SQLEngine) State(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset
 	return s.objFactory.MakeState(items)
 }
 
-func (s *SQLEngine) items(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, m gregor.MsgID) ([]gregor.Item, error) {
-	qry := `SELECT i.msgid, m.devid, i.category, i.dtime, i.body, m.ctime
-	        FROM items AS i
-	        INNER JOIN messages AS m ON (i.uid=m.uid AND i.msgid=m.msgid)
-	        WHERE i.uid=? AND (i.dtime IS NULL OR i.dtime > `
-	qb := s.newQueryBuilder()
-	qb.Build(qry, hexEnc(u))
-	if t != nil {
-		qb.TimeOrOffset(t)
-	} else {
-		qb.Now()
+func (s *SQLEngine) StateInCategory(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) (gregor.State, error) {
+	items, err := s.items(u, d, t, c)
+	if err != nil {
+		return nil, err
 	}
-	qb.Build(")")
+	return s.objFactory.MakeState(items)
+}
+
+// itemColumns are the columns that rowToItem scans.
+const itemColumns = `i.msgid, m.devid, i.category, i.dtime, i.body_key, i.body, m.ctime`
+
+// buildForDevice adds the condition that the Item created by the message m
+// is meant for the device d, if it's not nil.
+func buildForDevice(qb *queryBuilder, d gregor.DeviceID) {
 	if d != nil {
 		// A "NULL" devid in this case means that the Item/message is intended for all
 		// devices. So include that as well.
 		qb.Build("AND (m.devid=? OR m.devid IS NULL)", hexEnc(d))
 	}
+}
+
+// buildInStateAt adds the condition that the Item i, created by the message
+// m, hasn't been dismissed for the device d at time t, or now if t is nil,
+// and, if t isn't nil, that it had been created by then.
+func buildInStateAt(qb *queryBuilder, d gregor.DeviceID, t gregor.TimeOrOffset) {
+	at := func() {
+		if t != nil {
+			qb.TimeOrOffset(t)
+		} else {
+			qb.Now()
+		}
+	}
+	qb.Build("(i.dtime IS NULL OR i.dtime >")
+	at()
+	qb.Build(")")
+	if d != nil {
+		qb.Build(`AND NOT EXISTS (SELECT 1 FROM dismissals_by_device AS dd
+		          WHERE dd.uid=i.uid AND dd.dmsgid=i.msgid AND dd.devid=? AND dd.dtime <=`, hexEnc(d))
+		at()
+		qb.Build(")")
+	}
 	if t != nil {
 		qb.Build("AND m.ctime <=")
 		qb.TimeOrOffset(t)
 	}
-	if m != nil {
-		qb.Build("AND i.msgid=?", hexEnc(m))
+}
+
+// items returns the Items in the State of device d at time t, or just those
+// in the category c if it's not nil.
+func (s *SQLEngine) items(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c gregor.Category) ([]gregor.Item, error) {
+	qry := `SELECT ` + itemColumns + `
+	        FROM items AS i
+	        INNER JOIN messages AS m ON (i.uid=m.uid AND i.msgid=m.msgid)
+	        WHERE i.uid=? AND`
+	qb := s.newQueryBuilder()
+	qb.Build(qry, hexEnc(u))
+	buildInStateAt(qb, d, t)
+	buildForDevice(qb, d)
+	if c != nil {
+		qb.Build("AND")
+		buildCategory(qb, "i.category", c.String())
 	}
 	qb.Build("ORDER BY m.ctime ASC")
+	return s.queryItems(u, qb)
+}
+
+// queryItems runs the query in qb, which selects itemColumns, and returns
+// the Items of the user u that it finds.
+func (s *SQLEngine) queryItems(u gregor.UID, qb *queryBuilder) ([]gregor.Item, error) {
 	stmt, err := s.driver.Prepare(qb.Query())
 	if err != nil {
 		return nil, err
@@ -352,6 +867,46 @@ func (s *SQLEngine) items(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset
 	return items, nil
 }
 
+// newDiffQuery makes a query for the columns cols of the Items of the user
+// u that are in the State of device d at time in, but not at time out.
+func (s *SQLEngine) newDiffQuery(cols string, u gregor.UID, d gregor.DeviceID, in, out gregor.TimeOrOffset) *queryBuilder {
+	qry := `SELECT ` + cols + `
+	        FROM items AS i
+	        INNER JOIN messages AS m ON (i.uid=m.uid AND i.msgid=m.msgid)
+	        WHERE i.uid=? AND`
+	qb := s.newQueryBuilder()
+	qb.Build(qry, hexEnc(u))
+	buildInStateAt(qb, d, in)
+	qb.Build("AND NOT (")
+	buildInStateAt(qb, d, out)
+	qb.Build(")")
+	buildForDevice(qb, d)
+	qb.Build("ORDER BY m.ctime ASC")
+	return qb
+}
+
+func (s *SQLEngine) StateDiff(u gregor.UID, d gregor.DeviceID, from, to gregor.TimeOrOffset) ([]gregor.Item, []gregor.MsgID, error) {
+	added, err := s.queryItems(u, s.newDiffQuery(itemColumns, u, d, to, from))
+	if err != nil {
+		return nil, nil, err
+	}
+	qb := s.newDiffQuery("i.msgid", u, d, from, to)
+	rows, err := s.driver.Query(qb.Query(), qb.Args()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var removed []gregor.MsgID
+	for rows.Next() {
+		msgID := msgIDScanner{o: s.objFactory}
+		if err := rows.Scan(&msgID); err != nil {
+			return nil, nil, err
+		}
+		removed = append(removed, msgID.MsgID())
+	}
+	return added, removed, rows.Err()
+}
+
 func (s *SQLEngine) rowToMetadata(rows *sql.Rows) (gregor.Metadata, error) {
 	var ctime time.Time
 	uid := uidScanner{o: s.objFactory}
@@ -393,61 +948,249 @@ func (s *SQLEngine) inBandMetadataSince(u gregor.UID, t gregor.TimeOrOffset) ([]
 	return ret, nil
 }
 
-func (s *SQLEngine) rowToInBandMessage(u gregor.UID, rows *sql.Rows) (gregor.InBandMessage, error) {
-	msgID := msgIDScanner{o: s.objFactory}
+// rowToInBandMessage makes the message, or the part of it, in the current
+// row, and stamps it with its HLC if the ObjFactory's messages can carry
+// one. It returns the HLC too, since they might not.
+func (s *SQLEngine) rowToInBandMessage(u gregor.UID, rows *sql.Rows) (gregor.InBandMessage, gregor.HLC, error) {
+	ibm, h, err := s.rowToUnstampedInBandMessage(u, rows)
+	if err != nil || ibm == nil {
+		return nil, 0, err
+	}
+	if setter, ok := ibm.(gregor.HLCSetter); ok && !h.IsZero() {
+		setter.SetHLC(h)
+	}
+	return ibm, h, nil
+}
+
+func (s *SQLEngine) rowToUnstampedInBandMessage(u gregor.UID, rows *sql.Rows) (gregor.InBandMessage, gregor.HLC, error) {
+	msgID := msgIDScanner{o: s.objFactory}
 	devID := deviceIDScanner{o: s.objFactory}
 	var ctime timeScanner
+	var h int64
 	var mtype inBandMsgTypeScanner
 	category := categoryScanner{o: s.objFactory}
-	body := bodyScanner{o: s.objFactory}
+	var keyID sql.NullString
+	body := s.newBodyScanner(&keyID)
+	var iDTime timeScanner
 	dCategory := categoryScanner{o: s.objFactory}
 	var dTime timeScanner
 	dMsgID := msgIDScanner{o: s.objFactory}
+	ddMsgID := msgIDScanner{o: s.objFactory}
+	ddDevID := deviceIDScanner{o: s.objFactory}
+	uMsgID := msgIDScanner{o: s.objFactory}
+	var uKeyID sql.NullString
+	uBody := s.newBodyScanner(&uKeyID)
+	var uDTime timeScanner
 
-	if err := rows.Scan(&msgID, &devID, &ctime, &mtype, &category, &body, &dCategory, &dTime, &dMsgID); err != nil {
-		return nil, err
+	if err := rows.Scan(&msgID, &devID, &ctime, &h, &mtype, &category, &keyID, &body, &iDTime, &dCategory, &dTime, &dMsgID,
+		&ddMsgID, &ddDevID, &uMsgID, &uKeyID, &uBody, &uDTime); err != nil {
+		return nil, 0, err
 	}
 
+	var ibm gregor.InBandMessage
+	var err error
 	switch {
 	case category.IsSet():
-		i, err := s.objFactory.MakeItem(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), category.Category(), nil, body.Body())
-		if err != nil {
-			return nil, err
+		var i gregor.Item
+		if i, err = s.objFactory.MakeItem(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), category.Category(), iDTime.TimeOrNil(), body.Body()); err != nil {
+			return nil, 0, err
 		}
-		return s.objFactory.MakeInBandMessageFromItem(i)
+		ibm, err = s.objFactory.MakeInBandMessageFromItem(i)
 	case dCategory.IsSet() && dTime.TimeOrNil() != nil:
-		return s.objFactory.MakeDismissalByRange(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), dCategory.Category(), dTime.Time())
+		ibm, err = s.objFactory.MakeDismissalByRange(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), dCategory.Category(), dTime.Time())
 	case dMsgID.MsgID() != nil:
-		return s.objFactory.MakeDismissalByID(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), dMsgID.MsgID())
+		ibm, err = s.objFactory.MakeDismissalByID(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), dMsgID.MsgID())
+	case ddMsgID.MsgID() != nil && ddDevID.DeviceID() != nil:
+		ibm, err = s.objFactory.MakeDismissalByIDForDevice(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), ddMsgID.MsgID(), ddDevID.DeviceID())
+	case uMsgID.MsgID() != nil:
+		ibm, err = s.objFactory.MakeItemUpdate(u, msgID.MsgID(), devID.DeviceID(), ctime.Time(), uMsgID.MsgID(), uBody.Body(), uDTime.TimeOrNil())
 	case mtype.InBandMsgType() == gregor.InBandMsgTypeSync:
-		return s.objFactory.MakeStateSyncMessage(u, msgID.MsgID(), devID.DeviceID(), ctime.Time())
+		ibm, err = s.objFactory.MakeStateSyncMessage(u, msgID.MsgID(), devID.DeviceID(), ctime.Time())
 	}
-
-	return nil, nil
+	return ibm, gregor.HLC(h), err
 }
 
 func (s *SQLEngine) InBandMessagesSince(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset) ([]gregor.InBandMessage, error) {
-	qry := `SELECT m.msgid, m.devid, m.ctime, m.mtype,
-               i.category, i.body,
-               dt.category, dt.dtime,
-               di.dmsgid
-	        FROM messages AS m
-	        LEFT JOIN items AS i ON (m.uid=i.UID AND m.msgid=i.msgid)
-	        LEFT JOIN dismissals_by_time AS dt ON (m.uid=dt.uid AND m.msgid=dt.msgid)
-	        LEFT JOIN dismissals_by_id AS di ON (m.uid=di.uid AND m.msgid=di.msgid)
-	        WHERE m.uid=? AND (i.dtime IS NULL OR i.dtime > `
+	msgs, _, err := s.inBandMessages(u, d, t, nil, 0)
+	return msgs, err
+}
+
+// InBandMessagesPage returns a page of the messages InBandMessagesSince
+// would return.
+func (s *SQLEngine) InBandMessagesPage(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, cursor []byte, limit int) ([]gregor.InBandMessage, []byte, error) {
+	if limit <= 0 {
+		return nil, nil, ErrBadPageLimit
+	}
+	c, err := decodeMsgCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs, last, err := s.inBandMessages(u, d, t, c, limit)
+	if err != nil || len(msgs) == 0 {
+		return nil, nil, err
+	}
+	return msgs, nextCursor(len(msgs), limit, last), nil
+}
+
+// inBandMessages returns messages for u since t, in HLC order, after the
+// cursor c if it's non-nil, and no more than limit of them if it's
+// positive, along with the cursor for the last of them. We pick out the
+// messages first and then join in their contents. A dismissal can span
+// several rows of each of the dismissals tables, so each of those is
+// joined in separately, and the rows of a message are merged together, to
+// keep the rows of one table from multiplying those of the others.
+func (s *SQLEngine) inBandMessages(u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c *msgCursor, limit int) ([]gregor.InBandMessage, *msgCursor, error) {
 	qb := s.newQueryBuilder()
-	qb.Build(qry, hexEnc(u))
+	joins := []struct {
+		cols, join string
+	}{
+		{`i.category, i.body_key, i.body, i.dtime, NULL, NULL, NULL, NULL, NULL,
+		  iu.umsgid, iu.body_key, iu.body, iu.dtime`,
+			`LEFT JOIN items AS i ON (m.uid=i.uid AND m.msgid=i.msgid)
+			 LEFT JOIN item_updates AS iu ON (m.uid=iu.uid AND m.msgid=iu.msgid)`},
+		{`NULL, NULL, NULL, NULL, dt.category, dt.dtime, NULL, NULL, NULL, NULL, NULL, NULL, NULL`,
+			`INNER JOIN dismissals_by_time AS dt ON (m.uid=dt.uid AND m.msgid=dt.msgid)`},
+		{`NULL, NULL, NULL, NULL, NULL, NULL, di.dmsgid, NULL, NULL, NULL, NULL, NULL, NULL`,
+			`INNER JOIN dismissals_by_id AS di ON (m.uid=di.uid AND m.msgid=di.msgid)`},
+		{`NULL, NULL, NULL, NULL, NULL, NULL, NULL, dd.dmsgid, dd.devid, NULL, NULL, NULL, NULL`,
+			`INNER JOIN dismissals_by_device AS dd ON (m.uid=dd.uid AND m.msgid=dd.msgid)`},
+	}
+	for n, j := range joins {
+		if n > 0 {
+			qb.Build("UNION ALL")
+		}
+		qb.Build("SELECT m.msgid, m.devid, m.ctime, m.hlc, m.mtype, " + j.cols + " FROM")
+		s.buildInBandMessageFilter(qb, u, d, t, c, limit)
+		qb.Build("AS m " + j.join)
+	}
+	qb.Build("ORDER BY 4 ASC, 1 ASC")
+	stmt, err := s.driver.Prepare(qb.Query())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(qb.Args()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ret []gregor.InBandMessage
+	var last *msgCursor
+	lookup := make(map[string]gregor.InBandMessage)
+	for rows.Next() {
+		ibm, h, err := s.rowToInBandMessage(u, rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ibm == nil {
+			continue
+		}
+		msgIDString := hexEnc(ibm.Metadata().MsgID())
+		if ibm2 := lookup[msgIDString]; ibm2 != nil {
+			if err = ibm2.Merge(ibm); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			ret = append(ret, ibm)
+			lookup[msgIDString] = ibm
+			last = newMsgCursor(h, ibm.Metadata().MsgID())
+		}
+	}
+	return ret, last, rows.Err()
+}
+
+// buildInBandMessageFilter builds the subquery that picks out the messages
+// for inBandMessages.
+func (s *SQLEngine) buildInBandMessageFilter(qb *queryBuilder, u gregor.UID, d gregor.DeviceID, t gregor.TimeOrOffset, c *msgCursor, limit int) {
+	qb.Build(`(SELECT uid, msgid, devid, ctime, hlc, mtype FROM messages
+	          WHERE uid=? AND NOT EXISTS
+	            (SELECT 1 FROM items WHERE items.uid=messages.uid AND items.msgid=messages.msgid AND items.dtime <=`, hexEnc(u))
+	qb.Now()
+	qb.Build(")")
+	qb.Build(`AND NOT EXISTS (SELECT 1 FROM item_updates AS iu
+	          INNER JOIN items ON (items.uid=iu.uid AND items.msgid=iu.umsgid)
+	          WHERE iu.uid=messages.uid AND iu.msgid=messages.msgid AND items.dtime <=`)
 	qb.Now()
 	qb.Build(")")
 	if d != nil {
-		qb.Build("AND (m.devid=? OR m.devid IS NULL)", hexEnc(d))
+		qb.Build("AND (devid=? OR devid IS NULL)", hexEnc(d))
+		qb.Build(`AND NOT EXISTS (SELECT 1 FROM dismissals_by_device AS dd
+		          WHERE dd.uid=messages.uid AND dd.dmsgid=messages.msgid AND dd.devid=? AND dd.dtime <=`, hexEnc(d))
+		qb.Now()
+		qb.Build(")")
+		qb.Build(`AND NOT EXISTS (SELECT 1 FROM item_updates AS iu
+		          INNER JOIN dismissals_by_device AS dd ON (dd.uid=iu.uid AND dd.dmsgid=iu.umsgid)
+		          WHERE iu.uid=messages.uid AND iu.msgid=messages.msgid AND dd.devid=? AND dd.dtime <=`, hexEnc(d))
+		qb.Now()
+		qb.Build(")")
 	}
 
-	qb.Build("AND m.ctime >= ")
+	qb.Build("AND ctime >= ")
 	qb.TimeOrOffset(t)
 
-	qb.Build("ORDER BY m.ctime ASC")
+	if c != nil {
+		qb.Build("AND (hlc > ? OR (hlc = ? AND msgid > ?))",
+			int64(c.hlc), int64(c.hlc), hex.EncodeToString(c.msgID))
+	}
+	qb.Build("ORDER BY hlc ASC, msgid ASC")
+	if limit > 0 {
+		qb.Build("LIMIT ?", limit)
+	}
+	qb.Build(")")
+}
+
+// InBandMessagesSinceSync returns the messages since the sync message sync,
+// or ErrUnknownSyncMarker if there's no such sync message for u.
+func (s *SQLEngine) InBandMessagesSinceSync(u gregor.UID, d gregor.DeviceID, sync gregor.MsgID) ([]gregor.InBandMessage, error) {
+	var ctime timeScanner
+	var mtype inBandMsgTypeScanner
+	err := s.driver.QueryRow(s.rebind("SELECT ctime, mtype FROM messages WHERE uid=? AND msgid=?"),
+		hexEnc(u), hexEnc(sync)).Scan(&ctime, &mtype)
+	if err == sql.ErrNoRows || (err == nil && mtype.InBandMsgType() != gregor.InBandMsgTypeSync) {
+		return nil, ErrUnknownSyncMarker{UID: u, MsgID: sync}
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs, _, err := s.inBandMessages(u, d, timeOrOffset(ctime.Time()), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return withoutMsgID(msgs, sync), nil
+}
+
+func (s *SQLEngine) rowToReminder(rows *sql.Rows) (gregor.Reminder, error) {
+	uid := uidScanner{o: s.objFactory}
+	deviceID := deviceIDScanner{o: s.objFactory}
+	msgID := msgIDScanner{o: s.objFactory}
+	category := categoryScanner{o: s.objFactory}
+	var keyID sql.NullString
+	body := s.newBodyScanner(&keyID)
+	var dtime timeScanner
+	var ctime timeScanner
+	var ntime timeScanner
+	if err := rows.Scan(&uid, &msgID, &deviceID, &category, &dtime, &keyID, &body, &ctime, &ntime); err != nil {
+		return nil, err
+	}
+	i, err := s.objFactory.MakeItem(uid.UID(), msgID.MsgID(), deviceID.DeviceID(), ctime.Time(), category.Category(), dtime.TimeOrNil(), body.Body())
+	if err != nil {
+		return nil, err
+	}
+	return s.objFactory.MakeReminder(i, ntime.Time())
+}
+
+func (s *SQLEngine) Reminders(before time.Time) ([]gregor.Reminder, error) {
+	qry := `SELECT i.uid, i.msgid, m.devid, i.category, i.dtime, i.body_key, i.body, m.ctime, r.ntime
+	        FROM reminders AS r
+	        INNER JOIN items AS i ON (r.uid=i.uid AND r.msgid=i.msgid)
+	        INNER JOIN messages AS m ON (r.uid=m.uid AND r.msgid=m.msgid)
+	        WHERE (i.dtime IS NULL OR i.dtime > `
+	qb := s.newQueryBuilder()
+	qb.Build(qry)
+	qb.Now()
+	qb.Build(") AND r.ntime <=")
+	qb.AddTime(before)
+	qb.Build("ORDER BY r.ntime ASC")
 	stmt, err := s.driver.Prepare(qb.Query())
 	if err != nil {
 		return nil, err
@@ -457,24 +1200,511 @@ func (s *SQLEngine) InBandMessagesSince(u gregor.UID, d gregor.DeviceID, t grego
 	if err != nil {
 		return nil, err
 	}
-	var ret []gregor.InBandMessage
-	lookup := make(map[string]gregor.InBandMessage)
+	var ret []gregor.Reminder
 	for rows.Next() {
-		ibm, err := s.rowToInBandMessage(u, rows)
+		r, err := s.rowToReminder(rows)
 		if err != nil {
 			return nil, err
 		}
-		msgIDString := hexEnc(ibm.Metadata().MsgID())
-		if ibm2 := lookup[msgIDString]; ibm2 != nil {
-			if err = ibm2.Merge(ibm); err != nil {
-				return nil, err
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func (s *SQLEngine) DeleteReminder(r gregor.Reminder) error {
+	md := r.Item().Metadata()
+	qb := s.newQueryBuilder()
+	qb.Build("DELETE FROM reminders WHERE uid=? AND msgid=? AND ntime=?",
+		hexEnc(md.UID()), hexEnc(md.MsgID()), qb.TimeArg(r.RemindTime()))
+	stmt, err := s.driver.Prepare(qb.Query())
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(qb.Args()...)
+	return err
+}
+
+// Prune permanently deletes Items that were dismissed or expired at or
+// before the given time, along with their reminders, and any dismissals or
+// other messages that arrived before then and no longer affect live Items.
+// Those that might still affect Items that arrive late are kept for
+// gregor.OrphanRetention longer. Devices that last synced before this point will have to fetch the full
+// State rather than replay InBandMessagesSince. Queued out-of-band messages
+// that expired at or before the given time are deleted too.
+func (s *SQLEngine) Prune(before time.Time) (err error) {
+	tx, err := s.driver.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// Dismissals and updates whose targets never arrived have no row in
+	// messages for their targets, and are kept until orphanBefore instead,
+	// as are range dismissals. Their targets' rows are only deleted by the
+	// last statement, so the targets pruned here still count as arrived.
+	orphanBefore := before.Add(-gregor.OrphanRetention)
+	stmts := []struct {
+		qry   string
+		times []time.Time
+	}{
+		{`DELETE FROM reminders WHERE EXISTS
+		   (SELECT 1 FROM items AS i WHERE i.uid=reminders.uid AND i.msgid=reminders.msgid AND i.dtime <= ?)`,
+			[]time.Time{before}},
+		{`DELETE FROM items WHERE dtime <= ?`, []time.Time{before}},
+		{`DELETE FROM dismissals_by_device WHERE dtime <= ?
+		   AND NOT EXISTS (SELECT 1 FROM items AS i WHERE i.uid=dismissals_by_device.uid AND i.msgid=dismissals_by_device.dmsgid)
+		   AND (dtime <= ? OR EXISTS (SELECT 1 FROM messages AS t WHERE t.uid=dismissals_by_device.uid AND t.msgid=dismissals_by_device.dmsgid))`,
+			[]time.Time{before, orphanBefore}},
+		{`DELETE FROM dismissals_by_id WHERE EXISTS
+		   (SELECT 1 FROM messages AS m WHERE m.uid=dismissals_by_id.uid AND m.msgid=dismissals_by_id.msgid AND m.ctime <= ?
+		     AND (m.ctime <= ? OR EXISTS (SELECT 1 FROM messages AS t WHERE t.uid=dismissals_by_id.uid AND t.msgid=dismissals_by_id.dmsgid)))`,
+			[]time.Time{before, orphanBefore}},
+		{`DELETE FROM dismissals_by_time WHERE EXISTS
+		   (SELECT 1 FROM messages AS m WHERE m.uid=dismissals_by_time.uid AND m.msgid=dismissals_by_time.msgid AND m.ctime <= ?)`,
+			[]time.Time{orphanBefore}},
+		{`DELETE FROM item_updates WHERE EXISTS
+		   (SELECT 1 FROM messages AS m WHERE m.uid=item_updates.uid AND m.msgid=item_updates.msgid AND m.ctime <= ?
+		     AND (m.ctime <= ? OR EXISTS (SELECT 1 FROM messages AS t WHERE t.uid=item_updates.uid AND t.msgid=item_updates.umsgid)))
+		   AND NOT EXISTS (SELECT 1 FROM items AS i WHERE i.uid=item_updates.uid AND i.msgid=item_updates.umsgid)`,
+			[]time.Time{before, orphanBefore}},
+		{`DELETE FROM messages WHERE ctime <= ?
+		   AND NOT EXISTS (SELECT 1 FROM items AS i WHERE i.uid=messages.uid AND i.msgid=messages.msgid)
+		   AND NOT EXISTS (SELECT 1 FROM dismissals_by_id AS di WHERE di.uid=messages.uid AND di.msgid=messages.msgid)
+		   AND NOT EXISTS (SELECT 1 FROM dismissals_by_time AS dt WHERE dt.uid=messages.uid AND dt.msgid=messages.msgid)
+		   AND NOT EXISTS (SELECT 1 FROM dismissals_by_device AS dd WHERE dd.uid=messages.uid AND dd.msgid=messages.msgid)
+		   AND NOT EXISTS (SELECT 1 FROM item_updates AS iu WHERE iu.uid=messages.uid AND iu.msgid=messages.msgid)`,
+			[]time.Time{before}},
+		{`DELETE FROM oob_messages WHERE etime <= ?`, []time.Time{before}},
+	}
+	for _, stmt := range stmts {
+		qb := s.newQueryBuilder()
+		var args []interface{}
+		for _, t := range stmt.times {
+			args = append(args, qb.TimeArg(t))
+		}
+		qb.Build(sqlWrapper(stmt.qry), args...)
+		if err = qb.Exec(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Users returns all the users that have messages stored.
+func (s *SQLEngine) Users() ([]gregor.UID, error) {
+	rows, err := s.driver.Query("SELECT DISTINCT uid FROM messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []gregor.UID
+	for rows.Next() {
+		uid := uidScanner{o: s.objFactory}
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		ret = append(ret, uid.UID())
+	}
+	return ret, rows.Err()
+}
+
+// DeleteUser deletes everything stored for the user u.
+func (s *SQLEngine) DeleteUser(u gregor.UID) (err error) {
+	tx, err := s.driver.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	for _, table := range []string{"reminders", "items", "dismissals_by_id", "dismissals_by_time", "dismissals_by_device", "item_updates", "messages", "oob_messages"} {
+		if _, err = tx.Exec(s.rebind("DELETE FROM "+table+" WHERE uid=?"), hexEnc(u)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyTables are the tables that have encrypted bodies, along with the
+// columns that identify their rows.
+var bodyTables = []struct {
+	table string
+	key   string
+}{
+	{"items", "uid, msgid"},
+	{"item_updates", "uid, msgid"},
+	{"oob_messages", "id"},
+}
+
+// bodyKeyRotationBatch is how many rows RotateBodyKeys re-encrypts in each
+// transaction.
+const bodyKeyRotationBatch = 100
+
+// RotateBodyKeys re-encrypts every stored body that isn't encrypted with
+// the current key, including those stored in the clear, and returns how
+// many it did. Once it's done, old keys are no longer needed. It's safe to
+// run while the engine is in use, as long as everything using the database
+// has the current key.
+func (s *SQLEngine) RotateBodyKeys() (int, error) {
+	if s.bodyKeys == nil {
+		return 0, ErrNoBodyKeys
+	}
+	current, _, err := s.bodyKeys.CurrentBodyKey()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, t := range bodyTables {
+		for {
+			n, err := s.rotateBodyKeysBatch(t.table, t.key, current)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n < bodyKeyRotationBatch {
+				break
 			}
+		}
+	}
+	return total, nil
+}
+
+// rotateBodyKeysBatch re-encrypts up to bodyKeyRotationBatch bodies in table,
+// whose rows are identified by the comma-separated key columns, that aren't
+// encrypted with the key current.
+func (s *SQLEngine) rotateBodyKeysBatch(table string, key string, current string) (n int, err error) {
+	tx, err := s.driver.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
 		} else {
-			ret = append(ret, ibm)
-			lookup[msgIDString] = ibm
+			err = tx.Commit()
 		}
+	}()
+
+	keyCols := strings.Split(key, ", ")
+	rows, err := tx.Query(s.rebind(fmt.Sprintf(`SELECT %s, body_key, body FROM %s
+		WHERE body IS NOT NULL AND (body_key IS NULL OR body_key<>?) LIMIT ?`, key, table)),
+		current, bodyKeyRotationBatch)
+	if err != nil {
+		return 0, err
 	}
-	return ret, nil
+	// Key columns are scanned as strings, and not as whatever the driver
+	// hands back, so that they compare equal when passed back in.
+	type row struct {
+		key  []string
+		body []byte
+	}
+	var todo []row
+	for rows.Next() {
+		r := row{key: make([]string, len(keyCols))}
+		dest := make([]interface{}, len(keyCols))
+		for i := range dest {
+			dest[i] = &r.key[i]
+		}
+		var keyID sql.NullString
+		var body []byte
+		if err = rows.Scan(append(dest, &keyID, &body)...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if keyID.Valid {
+			if body, err = openBody(s.bodyKeys, keyID.String, body); err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		r.body = body
+		todo = append(todo, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update := s.rebind(fmt.Sprintf("UPDATE %s SET body_key=?, body=? WHERE %s=?",
+		table, strings.Join(keyCols, "=? AND ")))
+	for _, r := range todo {
+		id, sealed, err := sealBody(s.bodyKeys, r.body)
+		if err != nil {
+			return 0, err
+		}
+		args := []interface{}{id, sealed}
+		for _, k := range r.key {
+			args = append(args, k)
+		}
+		if _, err = tx.Exec(update, args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
 }
 
 var _ gregor.StateMachine = (*SQLEngine)(nil)
+var _ gregor.ReminderStore = (*SQLEngine)(nil)
+
+var _ gregor.Pruner = (*SQLEngine)(nil)
+
+var _ gregor.InBandMessagePager = (*SQLEngine)(nil)
+
+var _ gregor.SyncCheckpointer = (*SQLEngine)(nil)
+
+var _ gregor.StateDiffer = (*SQLEngine)(nil)
+
+var _ gregor.CategoryStater = (*SQLEngine)(nil)
+
+var _ gregor.OutOfBandQueue = (*SQLEngine)(nil)
+
+// exportRows runs the query qry for the user u, and calls fn on each row.
+func (s *SQLEngine) exportRows(qry string, u gregor.UID, fn func(rows *sql.Rows) error) error {
+	rows, err := s.driver.Query(s.rebind(qry), hexEnc(u))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Export returns the messages in u's log. We don't keep the messages as
+// they came, so they're put back together from what we've stored: Items
+// come with their current Body and DTime, and the reminders that haven't
+// been sent yet. The out-of-band messages queued for u that haven't expired
+// come along too.
+func (s *SQLEngine) Export(u gregor.UID) (*UserExport, error) {
+	var msgs [](*msgRecord)
+	byMsgID := make(map[string]*msgRecord)
+	err := s.exportRows("SELECT msgid, devid, ctime, hlc, mtype FROM messages WHERE uid=? ORDER BY hlc, msgid", u, func(rows *sql.Rows) error {
+		msgID := msgIDScanner{o: s.objFactory}
+		devID := deviceIDScanner{o: s.objFactory}
+		var ctime timeScanner
+		var h int64
+		var mtype inBandMsgTypeScanner
+		if err := rows.Scan(&msgID, &devID, &ctime, &h, &mtype); err != nil {
+			return err
+		}
+		rec := &msgRecord{
+			UID_:      toRecBytes(u),
+			MsgID_:    toRecBytes(msgID.MsgID()),
+			DeviceID_: toRecBytes(devID.DeviceID()),
+			CTime_:    ctime.Time(),
+			MsgType_:  mtype.InBandMsgType(),
+			HLC_:      gregor.HLC(h),
+		}
+		msgs = append(msgs, rec)
+		byMsgID[hexEnc(rec.MsgID_)] = rec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// find returns the message a row belongs to, scanning the row's MsgID
+	// first and then the rest of its columns into dest.
+	find := func(rows *sql.Rows, dest ...interface{}) (*msgRecord, error) {
+		var msgID string
+		if err := rows.Scan(append([]interface{}{&msgID}, dest...)...); err != nil {
+			return nil, err
+		}
+		return byMsgID[msgID], nil
+	}
+
+	err = s.exportRows("SELECT msgid, category, body_key, body, dtime FROM items WHERE uid=?", u, func(rows *sql.Rows) error {
+		var category string
+		var keyID sql.NullString
+		body := s.newBodyScanner(&keyID)
+		var dtime timeScanner
+		rec, err := find(rows, &category, &keyID, &body, &dtime)
+		if err != nil || rec == nil {
+			return err
+		}
+		rec.Creation_ = &itemRecord{Category_: recString(category), Body_: toRecBytes(body.Body())}
+		if t := dtime.TimeOrNil(); t != nil {
+			rec.Creation_.DTime_ = newTimeOrOffsetRecord(timeOrOffset(*t))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.exportRows("SELECT msgid, ntime FROM reminders WHERE uid=? ORDER BY ntime", u, func(rows *sql.Rows) error {
+		var ntime timeScanner
+		rec, err := find(rows, &ntime)
+		if err != nil || rec == nil || rec.Creation_ == nil {
+			return err
+		}
+		rec.Creation_.NotifyTimes_ = append(rec.Creation_.NotifyTimes_, newTimeOrOffsetRecord(timeOrOffset(ntime.Time())))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.exportRows("SELECT msgid, dmsgid FROM dismissals_by_id WHERE uid=?", u, func(rows *sql.Rows) error {
+		dmsgID := msgIDScanner{o: s.objFactory}
+		rec, err := find(rows, &dmsgID)
+		if err != nil || rec == nil {
+			return err
+		}
+		d := rec.dismissal()
+		d.MsgIDs_ = append(d.MsgIDs_, toRecBytes(dmsgID.MsgID()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.exportRows("SELECT msgid, category, dtime FROM dismissals_by_time WHERE uid=?", u, func(rows *sql.Rows) error {
+		var category string
+		var dtime timeScanner
+		rec, err := find(rows, &category, &dtime)
+		if err != nil || rec == nil {
+			return err
+		}
+		d := rec.dismissal()
+		d.Ranges_ = append(d.Ranges_, rangeRecord{
+			Category_: recString(category),
+			EndTime_:  newTimeOrOffsetRecord(timeOrOffset(dtime.Time())),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.exportRows("SELECT msgid, dmsgid, devid FROM dismissals_by_device WHERE uid=?", u, func(rows *sql.Rows) error {
+		dmsgID := msgIDScanner{o: s.objFactory}
+		devID := deviceIDScanner{o: s.objFactory}
+		rec, err := find(rows, &dmsgID, &devID)
+		if err != nil || rec == nil {
+			return err
+		}
+		d := rec.dismissal()
+		d.ForDevices_ = append(d.ForDevices_, msgIDForDeviceRecord{
+			MsgID_:    toRecBytes(dmsgID.MsgID()),
+			DeviceID_: toRecBytes(devID.DeviceID()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.exportRows("SELECT msgid, umsgid, body_key, body, dtime FROM item_updates WHERE uid=?", u, func(rows *sql.Rows) error {
+		umsgID := msgIDScanner{o: s.objFactory}
+		var keyID sql.NullString
+		body := s.newBodyScanner(&keyID)
+		var dtime timeScanner
+		rec, err := find(rows, &umsgID, &keyID, &body, &dtime)
+		if err != nil || rec == nil {
+			return err
+		}
+		rec.Update_ = &itemUpdateRecord{MsgID_: toRecBytes(umsgID.MsgID()), Body_: toRecBytes(body.Body())}
+		if t := dtime.TimeOrNil(); t != nil {
+			rec.Update_.DTime_ = newTimeOrOffsetRecord(timeOrOffset(*t))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	oob, err := s.queuedOOBRecords(u)
+	if err != nil {
+		return nil, err
+	}
+	e := newUserExport(u, s.clock.Now(), msgs)
+	e.OutOfBand = oob
+	return e, nil
+}
+
+// queuedOOBRecords returns the out-of-band messages queued for u that
+// haven't expired yet, oldest first.
+func (s *SQLEngine) queuedOOBRecords(u gregor.UID) ([](*oobRecord), error) {
+	qb := s.newQueryBuilder()
+	qb.Build("SELECT sys, body_key, body, ctime, etime FROM oob_messages WHERE uid=? AND etime >", hexEnc(u))
+	qb.AddTime(nowTime(s.clock))
+	qb.Build("ORDER BY ctime, id")
+	rows, err := s.driver.Query(qb.Query(), qb.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret [](*oobRecord)
+	for rows.Next() {
+		var system string
+		var keyID sql.NullString
+		body := s.newBodyScanner(&keyID)
+		var ctime, etime timeScanner
+		if err := rows.Scan(&system, &keyID, &body, &ctime, &etime); err != nil {
+			return nil, err
+		}
+		ret = append(ret, &oobRecord{
+			UID_:    toRecBytes(u),
+			System_: recString(system),
+			Body_:   toRecBytes(body.Body()),
+			CTime:   ctime.Time(),
+			ETime:   etime.Time(),
+		})
+	}
+	return ret, rows.Err()
+}
+
+// Import consumes the messages in e, as if they'd just arrived with their
+// original ctimes, and queues its out-of-band messages that aren't queued
+// already.
+func (s *SQLEngine) Import(e *UserExport) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	for _, rec := range e.Messages {
+		if err := s.consumeInBandMessage(rec); err != nil {
+			return err
+		}
+	}
+	if len(e.OutOfBand) == 0 {
+		return nil
+	}
+	queued, err := s.queuedOOBRecords(e.uid())
+	if err != nil {
+		return err
+	}
+	now := nowTime(s.clock)
+	for _, r := range e.OutOfBand {
+		if !r.ETime.After(now) || hasOOBRecord(queued, r) {
+			continue
+		}
+		keyID, body, err := s.encryptBody(r.Body_)
+		if err != nil {
+			return err
+		}
+		qb := s.newQueryBuilder()
+		qb.Build("INSERT INTO oob_messages(uid, sys, body_key, body, ctime, etime) VALUES(?,?,?,?,?,?)",
+			e.UID, string(r.System_), keyID, body, qb.TimeArg(r.CTime), qb.TimeArg(r.ETime))
+		if _, err := s.driver.Exec(qb.Query(), qb.Args()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasOOBRecord(l [](*oobRecord), r *oobRecord) bool {
+	for _, q := range l {
+		if q.sameAs(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -6,9 +6,11 @@ import (
 	"github.com/jonboulle/clockwork"
 	test "github.com/keybase/gregor/test"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 )
 
 func createDb(engine string, name string) (*sql.DB, error) {
@@ -16,24 +18,10 @@ func createDb(engine string, name string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return db, err
-	}
-	schema := Schema(engine)
-	for _, stmt := range schema {
-		if _, err = tx.Exec(stmt); err != nil {
-			return db, err
-		}
-	}
-
-	if err = tx.Commit(); err != nil {
-		return db, err
-	}
-	return db, nil
+	return db, Migrate(db, engine)
 }
 
-func testEngine(t *testing.T, engine string, name string, w sqlTimeWriter) {
+func testEngine(t *testing.T, engine string, name string) {
 	db, err := createDb(engine, name)
 	if db != nil {
 		defer db.Close()
@@ -42,15 +30,214 @@ func testEngine(t *testing.T, engine string, name string, w sqlTimeWriter) {
 		t.Fatal(err)
 	}
 	cl := clockwork.NewFakeClock()
-	eng := NewSQLEngine(db, test.TestObjFactory{}, w, cl)
+	eng, err := NewSQLEngineFor(engine, db, test.TestObjFactory{}, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.SetOOBRetention(testOOBRetention)
 	test.TestStateMachineAllDevices(t, eng, cl)
 	test.TestStateMachinePerDevice(t, eng, cl)
+	test.TestStateMachineReminders(t, eng, cl)
+	test.TestStateMachinePrune(t, eng, cl)
+	test.TestStateMachineReplay(t, eng, cl)
+	test.TestStateMachineReorder(t, eng, cl)
+	test.TestStateMachinePaging(t, eng, cl)
+	test.TestStateMachineSync(t, eng, cl)
+	test.TestStateMachineStateDiff(t, eng, cl)
+	test.TestStateMachineCategories(t, eng, cl)
+	test.TestStateMachineOutOfBand(t, eng, cl)
+	test.TestStateMachineDeviceDismissal(t, eng, cl)
+	test.TestStateMachineItemUpdate(t, eng, cl)
+	test.TestStateMachineHLC(t, eng, cl)
+	testQuotas(t, eng, cl)
+	testReplayConflict(t, eng)
 }
 
 func TestSqliteEngine(t *testing.T) {
 	name := "./gregor.db"
 	os.Remove(name)
-	testEngine(t, "sqlite3", "./gregor.db", sqliteTimeWriter{})
+	testEngine(t, "sqlite3", "./gregor.db")
+}
+
+func TestMigrate(t *testing.T) {
+	name := "./gregor_migrate.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := createDb("sqlite3", name)
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, _ := migrations("sqlite3")
+	latest := ms[len(ms)-1].version
+	v, err := schemaVersion(db)
+	require.Nil(t, err, "no error from schemaVersion")
+	require.Equal(t, latest, v, "at the latest version")
+
+	_, err = db.Exec("INSERT INTO messages(uid, msgid, ctime, mtype) VALUES('aa', 'bb', 1, 1)")
+	require.Nil(t, err, "no error inserting a message")
+
+	// Migrating again must be a no-op that preserves our data.
+	require.Nil(t, Migrate(db, "sqlite3"), "no error from a second Migrate")
+	var n int
+	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&n), "no error counting")
+	require.Equal(t, 1, n, "message survived migration")
+	v, err = schemaVersion(db)
+	require.Nil(t, err, "no error from schemaVersion")
+	require.Equal(t, latest, v, "still at the latest version")
+
+	require.IsType(t, ErrUnknownEngine(""), Migrate(db, "oracle"), "unknown engine")
+
+	// sqliteTimeWriter writes microseconds, and timeScanner expects to get
+	// them back as integers, not as times misinterpreted by the driver.
+	var ctime interface{}
+	require.Nil(t, db.QueryRow("SELECT ctime FROM messages").Scan(&ctime), "no error scanning ctime")
+	require.IsType(t, int64(0), ctime, "ctime comes back as an integer")
+}
+
+// unversionedSchema is the schema that we set up databases of every engine
+// with before we had migrations, as it was then.
+var unversionedSchema = []string{
+
+	`DROP TABLE IF EXISTS dismissals_by_time`,
+	`DROP TABLE IF EXISTS dismissals_by_id`,
+	`DROP TABLE IF EXISTS reminders`,
+	`DROP TABLE IF EXISTS items`,
+	`DROP TABLE IF EXISTS messages`,
+
+	`CREATE TABLE messages (
+		uid   CHAR(16) NOT NULL,
+		msgid CHAR(16) NOT NULL,
+		ctime DATETIME(6) NOT NULL,
+		devid CHAR(16),
+		mtype INTEGER UNSIGNED NOT NULL, -- "specify for 'Update' or 'Sync' types",
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE TABLE items (
+		uid   CHAR(16) NOT NULL,
+		msgid CHAR(16) NOT NULL,
+		category VARCHAR(128) NOT NULL,
+		dtime DATETIME(6),
+		body BLOB,
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid)
+	)`,
+
+	`CREATE INDEX user_order ON items (uid, category)`,
+
+	`CREATE INDEX cleanup_order ON items (uid, dtime)`,
+
+	`CREATE TABLE reminders (
+		uid   CHAR(16) NOT NULL,
+		msgid CHAR(16) NOT NULL,
+		ntime DATETIME(6) NOT NULL,
+		PRIMARY KEY(uid, msgid, ntime)
+	)`,
+
+	`CREATE TABLE dismissals_by_id (
+		uid   CHAR(16) NOT NULL,
+		msgid CHAR(16) NOT NULL,
+		dmsgid CHAR(16) NOT NULL, -- "the message IDs to dismiss",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, dmsgid)
+	)`,
+
+	`CREATE TABLE dismissals_by_time (
+		uid   CHAR(16) NOT NULL,
+		msgid CHAR(16) NOT NULL,
+		category VARCHAR(128) NOT NULL,
+		dtime DATETIME(6) NOT NULL, -- "throw out matching events before dtime",
+		FOREIGN KEY(uid, msgid) REFERENCES messages (uid, msgid),
+		PRIMARY KEY(uid, msgid, category, dtime)
+	)`,
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	name := "./gregor_unversioned.db"
+	os.Remove(name)
+	defer os.Remove(name)
+	db, err := sql.Open("sqlite3", name)
+	require.Nil(t, err, "no error from Open")
+	defer db.Close()
+
+	// Set up a database the old way, without a schema_version table, and
+	// with the DATETIME columns that we used to use for all engines. Times
+	// were written as microseconds, but might have been written as text by
+	// hand.
+	for _, stmt := range unversionedSchema {
+		_, err = db.Exec(stmt)
+		require.Nil(t, err, "no error creating the base schema")
+	}
+	of := test.TestObjFactory{}
+	u, _ := of.MakeUID([]byte("unversioned user"))
+	m1, _ := of.MakeMsgID([]byte("unversioned 1"))
+	m2, _ := of.MakeMsgID([]byte("unversioned 2"))
+	t1 := time.Date(2016, 1, 2, 15, 4, 5, 123456000, time.UTC)
+	t2 := time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC)
+	future := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, q := range []struct {
+		stmt string
+		args []interface{}
+	}{
+		{"INSERT INTO messages(uid, msgid, ctime, mtype) VALUES(?, ?, ?, 1)", []interface{}{hexEnc(u), hexEnc(m1), timeInUnix(t1)}},
+		{"INSERT INTO messages(uid, msgid, ctime, mtype) VALUES(?, ?, '2016-01-03 00:00:00.000000', 1)", []interface{}{hexEnc(u), hexEnc(m2)}},
+		{"INSERT INTO items(uid, msgid, category, dtime, body) VALUES(?, ?, 'c', NULL, 'one')", []interface{}{hexEnc(u), hexEnc(m1)}},
+		{"INSERT INTO items(uid, msgid, category, dtime, body) VALUES(?, ?, 'c', '2030-01-01 00:00:00', 'two')", []interface{}{hexEnc(u), hexEnc(m2)}},
+		{"INSERT INTO reminders(uid, msgid, ntime) VALUES(?, ?, '2016-01-03T00:00:00Z')", []interface{}{hexEnc(u), hexEnc(m2)}},
+	} {
+		_, err = db.Exec(q.stmt, q.args...)
+		require.Nil(t, err, "no error inserting old data")
+	}
+
+	require.Nil(t, Migrate(db, "sqlite3"), "no error from Migrate")
+	v, err := schemaVersion(db)
+	require.Nil(t, err, "no error from schemaVersion")
+	ms, _ := migrations("sqlite3")
+	require.Equal(t, ms[len(ms)-1].version, v, "at the latest version")
+	require.True(t, hasSQLiteIndex(t, db, "reminder_order"), "adopted database gets reminder_order")
+	require.True(t, hasSQLiteIndex(t, db, "cleanup_order"), "rebuilt items table keeps its indexes")
+
+	tx, err := db.Begin()
+	require.Nil(t, err, "no error from Begin")
+	defer tx.Rollback()
+	for _, tc := range sqliteTimeColumns {
+		_, types, err := sqliteColumns(tx, tc.table)
+		require.Nil(t, err, "no error reading columns of %s", tc.table)
+		require.Equal(t, "INTEGER", types[tc.column], "%s.%s is an INTEGER now", tc.table, tc.column)
+	}
+	var ntime interface{}
+	require.Nil(t, tx.QueryRow("SELECT ntime FROM reminders").Scan(&ntime), "no error scanning ntime")
+	require.Equal(t, timeInUnix(t2), ntime, "text ntime converted to microseconds")
+	tx.Rollback()
+
+	cl := clockwork.NewFakeClockAt(t2.Add(time.Hour))
+	eng, err := NewSQLEngineFor("sqlite3", db, of, cl)
+	require.Nil(t, err, "no error from NewSQLEngineFor")
+	st, err := eng.State(u, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, err := st.Items()
+	require.Nil(t, err, "no error from Items")
+	require.Equal(t, 2, len(items), "both items survived")
+	require.Equal(t, "one", string(items[0].Body().Bytes()), "oldest item first")
+	require.True(t, t1.Equal(items[0].Metadata().CTime()), "integer ctime read back")
+	require.True(t, t2.Equal(items[1].Metadata().CTime()), "text ctime converted")
+	require.True(t, future.Equal(*items[1].DTime().Time()), "text dtime converted")
+}
+
+func hasSQLiteIndex(t *testing.T, db *sql.DB, name string) bool {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name=?", name).Scan(&n)
+	require.Nil(t, err, "no error looking for index %s", name)
+	return n > 0
+}
+
+func TestRebind(t *testing.T) {
+	q := "SELECT a FROM b WHERE c=? AND d IN (?, ?)"
+	require.Equal(t, q, rebind(bindQuestion, q), "question marks left alone")
+	require.Equal(t, "SELECT a FROM b WHERE c=$1 AND d IN ($2, $3)", rebind(bindDollar, q), "numbered placeholders")
 }
 
 // Test with: MYSQL_DSN=gregor:@/gregor_test?parseTime=true go test
@@ -70,5 +257,5 @@ func TestMySQLEngine(t *testing.T) {
 	query := u.Query()
 	query.Set("parseTime", "true")
 	u.RawQuery = query.Encode()
-	testEngine(t, "mysql", u.String(), mysqlTimeWriter{})
+	testEngine(t, "mysql", u.String())
 }
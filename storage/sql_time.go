@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 	gregor "github.com/keybase/gregor"
 )
 
+// mysqlTimeFormat is how MySQL formats DATETIME(6) values as strings.
+const mysqlTimeFormat = "2006-01-02 15:04:05.999999"
+
 type mysqlTimeWriter struct{}
 
 func (m mysqlTimeWriter) Now(b builder, cl clockwork.Clock) {
@@ -81,3 +85,35 @@ func (m sqliteTimeWriter) TimeOrOffset(b builder, cl clockwork.Clock, too gregor
 func (m sqliteTimeWriter) TimeArg(t time.Time) interface{} {
 	return timeInUnix(t)
 }
+
+type postgresTimeWriter struct{}
+
+func (p postgresTimeWriter) Now(b builder, cl clockwork.Clock) {
+	if cl == nil {
+		b.Build("NOW()")
+	} else {
+		b.Build("CAST(? AS TIMESTAMPTZ)", cl.Now())
+	}
+}
+
+func (p postgresTimeWriter) TimeOrOffset(b builder, cl clockwork.Clock, too gregor.TimeOrOffset) {
+	if too == nil {
+		b.Build("NULL")
+		return
+	}
+	if t := too.Time(); t != nil {
+		b.Build("?", *t)
+		return
+	}
+	if d := too.Offset(); d != nil {
+		b.Build("(")
+		p.Now(b, cl)
+		b.Build("+ CAST(? AS INTERVAL))", fmt.Sprintf("%d microseconds", d.Nanoseconds()/1000))
+		return
+	}
+	b.Build("NULL")
+}
+
+func (p postgresTimeWriter) TimeArg(t time.Time) interface{} {
+	return t
+}
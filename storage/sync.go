@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+
+	gregor "github.com/keybase/gregor"
+)
+
+// ErrUnknownSyncMarker is returned by InBandMessagesSinceSync when there's no
+// sync message with the given MsgID for the user, either because it never
+// existed, it wasn't a sync message, or it's since been pruned. The device
+// should fall back to fetching the full state.
+type ErrUnknownSyncMarker struct {
+	UID   gregor.UID
+	MsgID gregor.MsgID
+}
+
+func (e ErrUnknownSyncMarker) Error() string {
+	return fmt.Sprintf("no sync message %s for user %s", hexEnc(e.MsgID), hexEnc(e.UID))
+}
+
+// withoutMsgID returns msgs, less the message with the given MsgID.
+func withoutMsgID(msgs []gregor.InBandMessage, m gregor.MsgID) []gregor.InBandMessage {
+	var ret []gregor.InBandMessage
+	for _, msg := range msgs {
+		if !bytes.Equal(msgIDBytes(msg.Metadata().MsgID()), m.Bytes()) {
+			ret = append(ret, msg)
+		}
+	}
+	return ret
+}
@@ -1,9 +1,11 @@
 package test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -37,15 +39,29 @@ type testMsgRange struct {
 }
 
 type testDismissal struct {
-	ids    []gregor.MsgID
-	ranges []testMsgRange
+	ids        []gregor.MsgID
+	ranges     []testMsgRange
+	forDevices []testMsgIDForDevice
 }
 
-type testMetadata struct {
-	u gregor.UID
+type testMsgIDForDevice struct {
 	m gregor.MsgID
 	d gregor.DeviceID
-	t time.Time
+}
+
+type testItemUpdate struct {
+	m     gregor.MsgID
+	body  gregor.Body
+	dtime gregor.TimeOrOffset
+}
+
+type testMetadata struct {
+	u     gregor.UID
+	m     gregor.MsgID
+	d     gregor.DeviceID
+	t     time.Time
+	mtype gregor.InBandMsgType
+	hlc   gregor.HLC
 }
 
 type testSyncMessage testMetadata
@@ -55,10 +71,23 @@ type testInBandMessage struct {
 	i *testItem
 	d *testDismissal
 	s *testSyncMessage
+	u *testItemUpdate
+}
+
+type testOutOfBandMessage struct {
+	u gregor.UID
+	s gregor.System
+	b gregor.Body
 }
 
 type testMessage struct {
 	i *testInBandMessage
+	o *testOutOfBandMessage
+}
+
+type testReminder struct {
+	i gregor.Item
+	t time.Time
 }
 
 type TestObjFactory struct{}
@@ -111,16 +140,42 @@ func (f TestObjFactory) MakeDismissalByID(uid gregor.UID, msgid gregor.MsgID, de
 	return &testInBandMessage{m: md, d: td}, nil
 }
 
+func (f TestObjFactory) MakeDismissalByIDForDevice(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, d gregor.MsgID, dd gregor.DeviceID) (gregor.InBandMessage, error) {
+	md := newTestMetadata(uid, msgid, devid, ctime)
+	td := &testDismissal{
+		forDevices: []testMsgIDForDevice{{m: d, d: dd}},
+	}
+	return &testInBandMessage{m: md, d: td}, nil
+}
+
+func (f TestObjFactory) MakeItemUpdate(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, target gregor.MsgID, body gregor.Body, dtime *time.Time) (gregor.InBandMessage, error) {
+	md := newTestMetadata(uid, msgid, devid, ctime)
+	tu := &testItemUpdate{m: target, body: body}
+	if dtime != nil {
+		tu.dtime = timeToTimeOrOffset(*dtime)
+	}
+	return &testInBandMessage{m: md, u: tu}, nil
+}
+
 func (f TestObjFactory) MakeStateSyncMessage(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time) (gregor.InBandMessage, error) {
 	md := newTestMetadata(uid, msgid, devid, ctime)
+	md.mtype = gregor.InBandMsgTypeSync
 	return &testInBandMessage{m: md, s: (*testSyncMessage)(md)}, nil
 }
 
 func (f TestObjFactory) MakeState(i []gregor.Item) (gregor.State, error) {
 	return testState(i), nil
 }
+func (f TestObjFactory) MakeSystem(s string) (gregor.System, error) {
+	return testSystem(s), nil
+}
+func (f TestObjFactory) MakeOutOfBandMessage(uid gregor.UID, system gregor.System, body gregor.Body) (gregor.OutOfBandMessage, error) {
+	return &testOutOfBandMessage{u: uid, s: system, b: body}, nil
+}
 func (f TestObjFactory) MakeMetadata(uid gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time, i gregor.InBandMsgType) (gregor.Metadata, error) {
-	return newTestMetadata(uid, msgid, devid, ctime), nil
+	md := newTestMetadata(uid, msgid, devid, ctime)
+	md.mtype = i
+	return md, nil
 }
 
 var errBadType = errors.New("bad type in cast")
@@ -133,9 +188,29 @@ func (f TestObjFactory) MakeInBandMessageFromItem(i gregor.Item) (gregor.InBandM
 	return &testInBandMessage{m: ti.m, i: ti}, nil
 }
 
+func (f TestObjFactory) MakeMessageFromInBandMessage(i gregor.InBandMessage) (gregor.Message, error) {
+	ti, ok := i.(*testInBandMessage)
+	if !ok {
+		return nil, errBadType
+	}
+	return testMessage{i: ti}, nil
+}
+
+func (f TestObjFactory) MakeMessageFromOutOfBandMessage(o gregor.OutOfBandMessage) (gregor.Message, error) {
+	to, ok := o.(*testOutOfBandMessage)
+	if !ok {
+		return nil, errBadType
+	}
+	return testMessage{o: to}, nil
+}
+
+func (f TestObjFactory) MakeReminder(i gregor.Item, t time.Time) (gregor.Reminder, error) {
+	return testReminder{i: i, t: t}, nil
+}
+
 func newTestMetadata(u gregor.UID, msgid gregor.MsgID, devid gregor.DeviceID, ctime time.Time) *testMetadata {
 	return &testMetadata{
-		u: u, m: msgid, d: devid, t: ctime,
+		u: u, m: msgid, d: devid, t: ctime, mtype: gregor.InBandMsgTypeUpdate,
 	}
 }
 
@@ -150,7 +225,8 @@ func (t *testMetadata) CTime() time.Time                    { return t.t }
 func (t *testMetadata) SetCTime(x time.Time)                { t.t = x }
 func (t *testMetadata) DeviceID() gregor.DeviceID           { return t.d }
 func (t *testMetadata) UID() gregor.UID                     { return t.u }
-func (t *testMetadata) InBandMsgType() gregor.InBandMsgType { return gregor.InBandMsgTypeUpdate }
+func (t *testMetadata) InBandMsgType() gregor.InBandMsgType { return t.mtype }
+func (t *testMetadata) HLC() gregor.HLC                     { return t.hlc }
 
 func (t *testItem) DTime() gregor.TimeOrOffset         { return t.dtime }
 func (t *testItem) NotifyTimes() []gregor.TimeOrOffset { return t.nTimes }
@@ -158,14 +234,30 @@ func (t *testItem) Body() gregor.Body                  { return t.body }
 func (t *testItem) Category() gregor.Category          { return t.cat }
 func (t *testItem) Metadata() gregor.Metadata          { return t.m }
 
+func (t testReminder) Item() gregor.Item     { return t.i }
+func (t testReminder) RemindTime() time.Time { return t.t }
+
 func (t testMsgRange) EndTime() gregor.TimeOrOffset { return t.e }
 func (t testMsgRange) Category() gregor.Category    { return t.c }
 
 func (t *testSyncMessage) Metadata() gregor.Metadata { return (*testMetadata)(t) }
 
-func (t testInBandMessage) Metadata() gregor.Metadata                       { return t.m }
-func (t testInBandMessage) ToStateSyncMessage() gregor.StateSyncMessage     { return t.s }
-func (t testInBandMessage) ToStateUpdateMessage() gregor.StateUpdateMessage { return t }
+func (t testInBandMessage) Metadata() gregor.Metadata { return t.m }
+func (t testInBandMessage) SetHLC(h gregor.HLC)       { t.m.hlc = h }
+
+func (t testInBandMessage) ToStateSyncMessage() gregor.StateSyncMessage {
+	if t.s == nil {
+		return nil
+	}
+	return t.s
+}
+
+func (t testInBandMessage) ToStateUpdateMessage() gregor.StateUpdateMessage {
+	if t.s != nil {
+		return nil
+	}
+	return t
+}
 
 func (t testInBandMessage) Dismissal() gregor.Dismissal {
 	if t.d == nil {
@@ -180,8 +272,15 @@ func (t testInBandMessage) Creation() gregor.Item {
 	return t.i
 }
 
-func (t testInBandMessage) Merge(m2 gregor.InBandMessage) error {
-	t2, ok := m2.(testInBandMessage)
+func (t testInBandMessage) Update() gregor.ItemUpdate {
+	if t.u == nil {
+		return nil
+	}
+	return t.u
+}
+
+func (t *testInBandMessage) Merge(m2 gregor.InBandMessage) error {
+	t2, ok := m2.(*testInBandMessage)
 	if !ok {
 		return fmt.Errorf("bad merge; wrong type: %T", m2)
 	}
@@ -196,11 +295,32 @@ func (t testInBandMessage) Merge(m2 gregor.InBandMessage) error {
 	} else if t2.d != nil {
 		t.d.ids = append(t.d.ids, t2.d.ids...)
 		t.d.ranges = append(t.d.ranges, t2.d.ranges...)
+		t.d.forDevices = append(t.d.forDevices, t2.d.forDevices...)
+	}
+	if t.u != nil && t2.u != nil {
+		return errors.New("clash of updates")
+	}
+	if t.u == nil {
+		t.u = t2.u
 	}
 	return nil
 }
 
 func (t *testDismissal) MsgIDsToDismiss() []gregor.MsgID { return t.ids }
+func (t *testDismissal) MsgIDsToDismissForDevice() []gregor.MsgIDForDevice {
+	var ret []gregor.MsgIDForDevice
+	for _, m := range t.forDevices {
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func (t testMsgIDForDevice) MsgID() gregor.MsgID       { return t.m }
+func (t testMsgIDForDevice) DeviceID() gregor.DeviceID { return t.d }
+
+func (t *testItemUpdate) MsgID() gregor.MsgID        { return t.m }
+func (t *testItemUpdate) Body() gregor.Body          { return t.body }
+func (t *testItemUpdate) DTime() gregor.TimeOrOffset { return t.dtime }
 
 func (t testTimeOrOffset) Time() *time.Time       { return t.t }
 func (t testTimeOrOffset) Offset() *time.Duration { return t.d }
@@ -210,8 +330,22 @@ func (t testDeviceID) Bytes() []byte              { return t }
 func (t testCategory) String() string             { return string(t) }
 func (t testSystem) String() string               { return string(t) }
 
-func (m testMessage) ToInBandMessage() gregor.InBandMessage       { return m.i }
-func (m testMessage) ToOutOfBandMessage() gregor.OutOfBandMessage { return nil }
+func (m testMessage) ToInBandMessage() gregor.InBandMessage {
+	if m.i == nil {
+		return nil
+	}
+	return m.i
+}
+func (m testMessage) ToOutOfBandMessage() gregor.OutOfBandMessage {
+	if m.o == nil {
+		return nil
+	}
+	return m.o
+}
+
+func (t *testOutOfBandMessage) UID() gregor.UID       { return t.u }
+func (t *testOutOfBandMessage) System() gregor.System { return t.s }
+func (t *testOutOfBandMessage) Body() gregor.Body     { return t.b }
 
 func (t *testDismissal) RangesToDismiss() []gregor.MsgRange {
 	var ret []gregor.MsgRange
@@ -228,7 +362,7 @@ func (t testState) Items() ([]gregor.Item, error) {
 func (t testState) ItemsInCategory(c gregor.Category) ([]gregor.Item, error) {
 	var ret []gregor.Item
 	for _, item := range t {
-		if item.Category().String() == c.String() {
+		if gregor.CategoryMatches(c.String(), item.Category().String()) {
 			ret = append(ret, item)
 		}
 	}
@@ -236,7 +370,9 @@ func (t testState) ItemsInCategory(c gregor.Category) ([]gregor.Item, error) {
 }
 
 var _ gregor.Item = (*testItem)(nil)
-var _ gregor.InBandMessage = testInBandMessage{}
+var _ gregor.InBandMessage = (*testInBandMessage)(nil)
+var _ gregor.HLCSetter = (*testInBandMessage)(nil)
+var _ gregor.HLCMetadata = (*testMetadata)(nil)
 
 func assertNItems(t *testing.T, sm gregor.StateMachine, u gregor.UID, d gregor.DeviceID, too gregor.TimeOrOffset, n int) {
 	state, err := sm.State(u, d, too)
@@ -284,20 +420,34 @@ func timeToTimeOrOffset(t time.Time) gregor.TimeOrOffset {
 }
 
 func newCreation(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, c gregor.Category, data string, dtime gregor.TimeOrOffset) gregor.Message {
-	md := &testMetadata{u: u, m: m, d: d}
+	md := newTestMetadata(u, m, d, time.Time{})
 	item := &testItem{m: md, dtime: dtime, body: testBody(data), cat: c}
 	return testMessage{i: &testInBandMessage{m: md, i: item}}
 }
 
+func newCreationWithReminders(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, c gregor.Category, data string, ntimes []gregor.TimeOrOffset) gregor.Message {
+	md := newTestMetadata(u, m, d, time.Time{})
+	item := &testItem{m: md, nTimes: ntimes, body: testBody(data), cat: c}
+	return testMessage{i: &testInBandMessage{m: md, i: item}}
+}
+
 func newDismissalByIDs(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, ids []gregor.MsgID) gregor.Message {
-	md := &testMetadata{u: u, m: m, d: d}
-	dismissal := &testDismissal{ids: ids}
-	ret := testMessage{i: &testInBandMessage{m: md, d: dismissal}}
-	return ret
+	return newDismissal(u, m, d, &testDismissal{ids: ids})
+}
+
+func newDismissal(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, dismissal *testDismissal) gregor.Message {
+	md := newTestMetadata(u, m, d, time.Time{})
+	return testMessage{i: &testInBandMessage{m: md, d: dismissal}}
+}
+
+func newSyncMessage(u gregor.UID, m gregor.MsgID, d gregor.DeviceID) gregor.Message {
+	md := newTestMetadata(u, m, d, time.Time{})
+	md.mtype = gregor.InBandMsgTypeSync
+	return testMessage{i: &testInBandMessage{m: md, s: (*testSyncMessage)(md)}}
 }
 
 func newDismissalByCategory(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, c gregor.Category, e gregor.TimeOrOffset) gregor.Message {
-	md := &testMetadata{u: u, m: m, d: d}
+	md := newTestMetadata(u, m, d, time.Time{})
 	dismissal := &testDismissal{ranges: []testMsgRange{{c: c, e: e}}}
 	ret := testMessage{i: &testInBandMessage{m: md, d: dismissal}}
 	return ret
@@ -482,3 +632,862 @@ func TestStateMachinePerDevice(t *testing.T, sm gregor.StateMachine, fc clockwor
 	}
 	assert5(nil)
 }
+
+// remindersForUser returns the reminders due at t that belong to user u, since
+// a ReminderStore might contain reminders for other users too.
+func remindersForUser(t *testing.T, rs gregor.ReminderStore, u gregor.UID, tm time.Time) []gregor.Reminder {
+	all, err := rs.Reminders(tm)
+	require.Nil(t, err, "no error from Reminders()")
+	var ret []gregor.Reminder
+	for _, r := range all {
+		if bytes.Equal(r.Item().Metadata().UID().Bytes(), u.Bytes()) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func TestStateMachineReminders(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	rs, ok := sm.(gregor.ReminderStore)
+	require.True(t, ok, "state machine is a ReminderStore")
+
+	u1 := makeUID()
+	c1 := testCategory("foos")
+	m1 := makeMsgID()
+	m2 := makeMsgID()
+	consumeMessage(t, "m1", sm,
+		newCreationWithReminders(u1, m1, nil, c1, "f1", []gregor.TimeOrOffset{makeOffset(10), makeOffset(20)}),
+	)
+	consumeMessage(t, "m2", sm,
+		newCreationWithReminders(u1, m2, nil, c1, "f2", []gregor.TimeOrOffset{makeOffset(5)}),
+	)
+	require.Len(t, remindersForUser(t, rs, u1, fc.Now()), 0, "no reminders due yet")
+
+	fc.Advance(time.Duration(6) * time.Second)
+	rems := remindersForUser(t, rs, u1, fc.Now())
+	require.Len(t, rems, 1, "one reminder due")
+	require.Equal(t, []byte("f2"), rems[0].Item().Body().Bytes(), "reminder for f2")
+
+	// Once f2 is dismissed, there's no need to remind anyone about it.
+	consumeMessage(t, "d1", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m2}))
+	require.Len(t, remindersForUser(t, rs, u1, fc.Now()), 0, "dismissed items have no reminders")
+
+	fc.Advance(time.Duration(10) * time.Second)
+	rems = remindersForUser(t, rs, u1, fc.Now())
+	require.Len(t, rems, 1, "one reminder due")
+	require.Equal(t, []byte("f1"), rems[0].Item().Body().Bytes(), "reminder for f1")
+	require.Nil(t, rs.DeleteReminder(rems[0]), "no error from DeleteReminder()")
+	require.Len(t, remindersForUser(t, rs, u1, fc.Now()), 0, "delivered reminders are gone")
+
+	fc.Advance(time.Duration(10) * time.Second)
+	rems = remindersForUser(t, rs, u1, fc.Now())
+	require.Len(t, rems, 1, "second reminder for f1 is due")
+	require.Equal(t, []byte("f1"), rems[0].Item().Body().Bytes(), "reminder for f1")
+	require.Nil(t, rs.DeleteReminder(rems[0]), "no error from DeleteReminder()")
+}
+
+func TestStateMachinePrune(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	p, ok := sm.(gregor.Pruner)
+	require.True(t, ok, "state machine is a Pruner")
+
+	t0 := fc.Now()
+	u1 := makeUID()
+	c1 := testCategory("foos")
+	m2 := makeMsgID()
+	m4 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, makeMsgID(), nil, c1, "f1", nil))
+	consumeMessage(t, "m2", sm, newCreation(u1, m2, nil, c1, "f2", nil))
+	consumeMessage(t, "m3", sm, newCreation(u1, makeMsgID(), nil, c1, "f3", makeOffset(1)))
+	fc.Advance(time.Second)
+	consumeMessage(t, "d1", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m2}))
+	fc.Advance(time.Duration(2) * time.Second)
+	cutoff := fc.Now()
+
+	// m4 is dismissed after the cutoff, so it has to survive the prune.
+	fc.Advance(time.Second)
+	consumeMessage(t, "m4", sm, newCreation(u1, m4, nil, c1, "f4", nil))
+	fc.Advance(time.Second)
+	consumeMessage(t, "d2", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m4}))
+
+	msgs, err := sm.InBandMessagesSince(u1, nil, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, 3, len(msgs), "f1 and both dismissals before pruning")
+
+	require.Nil(t, p.Prune(cutoff), "no error from Prune")
+	require.Nil(t, p.Prune(cutoff), "pruning twice is harmless")
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f1"})
+
+	// d1 only mattered to m2, which is gone now, so it doesn't get
+	// replayed anymore; f1 is still live, and d2 is after the cutoff.
+	msgs, err = sm.InBandMessagesSince(u1, nil, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, 2, len(msgs), "f1 and d2 after pruning")
+	require.Equal(t, []byte("f1"), msgs[0].ToStateUpdateMessage().Creation().Body().Bytes(), "f1 survived")
+	require.Equal(t, m4, msgs[1].ToStateUpdateMessage().Dismissal().MsgIDsToDismiss()[0], "d2 survived")
+
+	// The state machine still works as usual after a prune.
+	consumeMessage(t, "m5", sm, newCreation(u1, makeMsgID(), nil, c1, "f5", nil))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f1", "f5"})
+
+	// Dismissals and updates of Items that haven't arrived yet survive a
+	// prune, so that the Items are still dismissed or updated when they
+	// arrive late...
+	u2 := makeUID()
+	m6, m7, m8 := makeMsgID(), makeMsgID(), makeMsgID()
+	t1 := fc.Now()
+	fc.Advance(time.Second)
+	consumeMessage(t, "d6", sm, newDismissalByIDs(u2, makeMsgID(), nil, []gregor.MsgID{m6}))
+	consumeMessage(t, "d7", sm, newDismissalByIDs(u2, makeMsgID(), nil, []gregor.MsgID{m7}))
+	consumeMessage(t, "u8", sm, newItemUpdate(u2, makeMsgID(), m8, testBody("f8 updated"), nil))
+	fc.Advance(time.Second)
+	require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	consumeMessage(t, "m6", sm, withCTime(newCreation(u2, m6, nil, c1, "f6", nil), t1))
+	consumeMessage(t, "m8", sm, withCTime(newCreation(u2, m8, nil, c1, "f8", nil), t1))
+	assertBodiesInCategory(t, sm, u2, nil, nil, c1, []string{"f8 updated"})
+
+	// ...but only for OrphanRetention, after which they're forgotten.
+	fc.Advance(gregor.OrphanRetention)
+	require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	consumeMessage(t, "m7", sm, withCTime(newCreation(u2, m7, nil, c1, "f7", nil), t1.Add(time.Millisecond)))
+	assertBodiesInCategory(t, sm, u2, nil, nil, c1, []string{"f8 updated", "f7"})
+}
+
+func TestStateMachineReplay(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	t0 := fc.Now()
+	u1 := makeUID()
+	c1 := testCategory("foos")
+	m1 := makeMsgID()
+	d1 := makeMsgID()
+
+	// Replays of a message, say from a client retrying after a dropped
+	// connection, shouldn't produce any duplicates.
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	fc.Advance(time.Second)
+	consumeMessage(t, "m1 replay", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f1"})
+
+	consumeMessage(t, "m2", sm, newCreation(u1, makeMsgID(), nil, c1, "f2", nil))
+	consumeMessage(t, "d1", sm, newDismissalByIDs(u1, d1, nil, []gregor.MsgID{m1}))
+	consumeMessage(t, "d1 replay", sm, newDismissalByIDs(u1, d1, nil, []gregor.MsgID{m1}))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f2"})
+
+	// A replay mustn't undo the dismissal either.
+	consumeMessage(t, "m1 late replay", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f2"})
+
+	msgs, err := sm.InBandMessagesSince(u1, nil, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, 2, len(msgs), "f2 and d1, once each")
+
+	// Reusing a MsgID for different content is an error, and doesn't
+	// change anything.
+	err = sm.ConsumeMessage(newCreation(u1, m1, nil, c1, "f3", nil))
+	require.NotNil(t, err, "error from a conflicting replay")
+	err = sm.ConsumeMessage(newDismissalByIDs(u1, d1, nil, []gregor.MsgID{makeMsgID()}))
+	require.NotNil(t, err, "error from a conflicting replay")
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f2"})
+}
+
+// withCTime sets an explicit ctime on m, as if it were stamped by whoever
+// sent it, so that it means the same thing whenever it's consumed.
+func withCTime(m gregor.Message, t time.Time) gregor.Message {
+	m.ToInBandMessage().Metadata().SetCTime(t)
+	return m
+}
+
+// orderings returns all n! permutations of 0..n-1, so it's only practical
+// for small n.
+func orderings(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var ret [][]int
+	for _, p := range orderings(n - 1) {
+		for i := 0; i <= len(p); i++ {
+			q := make([]int, 0, n)
+			q = append(q, p[:i]...)
+			q = append(q, n-1)
+			q = append(q, p[i:]...)
+			ret = append(ret, q)
+		}
+	}
+	return ret
+}
+
+func TestStateMachineReorder(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	t0 := fc.Now()
+	fc.Advance(time.Minute)
+	at := func(secs int) time.Time { return t0.Add(time.Duration(secs) * time.Second) }
+	c1 := testCategory("foos")
+	c2 := testCategory("bars")
+	m1 := makeMsgID()
+	m2 := makeMsgID()
+	m3 := makeMsgID()
+	m4 := makeMsgID()
+	d1 := makeMsgID()
+	d2 := makeMsgID()
+	d3 := makeMsgID()
+
+	f1 := func(u gregor.UID) gregor.Message { return withCTime(newCreation(u, m1, nil, c1, "f1", nil), at(1)) }
+	f2 := func(u gregor.UID) gregor.Message { return withCTime(newCreation(u, m2, nil, c1, "f2", nil), at(2)) }
+	b1 := func(u gregor.UID) gregor.Message { return withCTime(newCreation(u, m3, nil, c2, "b1", nil), at(3)) }
+	dismissF1 := func(u gregor.UID) gregor.Message {
+		return withCTime(newDismissalByIDs(u, d1, nil, []gregor.MsgID{m1}), at(4))
+	}
+	dismissFoos := func(u gregor.UID) gregor.Message {
+		return withCTime(newDismissalByCategory(u, d2, nil, c1, timeToTimeOrOffset(at(3))), at(5))
+	}
+	f3 := func(u gregor.UID) gregor.Message { return withCTime(newCreation(u, m4, nil, c1, "f3", nil), at(6)) }
+	// A later dismissal of f1 shouldn't bring it back in the meantime.
+	redismissF1 := func(u gregor.UID) gregor.Message {
+		return withCTime(newDismissalByIDs(u, d3, nil, []gregor.MsgID{m1}), at(7))
+	}
+
+	type check struct {
+		t      gregor.TimeOrOffset
+		bodies []string
+	}
+	// Each case is consumed in every order, which is why they're kept
+	// down to four messages each.
+	cases := []struct {
+		msgs   []func(gregor.UID) gregor.Message
+		checks []check
+	}{
+		{
+			[]func(gregor.UID) gregor.Message{f1, dismissF1, f3, redismissF1},
+			[]check{
+				{timeToTimeOrOffset(at(3)), []string{"f1"}},
+				{timeToTimeOrOffset(at(4)), nil},
+				{timeToTimeOrOffset(at(6)), []string{"f3"}},
+				{nil, []string{"f3"}},
+			},
+		},
+		{
+			[]func(gregor.UID) gregor.Message{f1, f2, b1, dismissFoos},
+			[]check{
+				{timeToTimeOrOffset(at(4)), []string{"b1", "f1", "f2"}},
+				{timeToTimeOrOffset(at(5)), []string{"b1"}},
+				{nil, []string{"b1"}},
+			},
+		},
+		{
+			[]func(gregor.UID) gregor.Message{f1, dismissF1, dismissFoos, f3},
+			[]check{
+				{timeToTimeOrOffset(at(3)), []string{"f1"}},
+				{timeToTimeOrOffset(at(4)), nil},
+				{timeToTimeOrOffset(at(5)), nil},
+				{timeToTimeOrOffset(at(6)), []string{"f3"}},
+				{nil, []string{"f3"}},
+			},
+		},
+	}
+
+	for n, c := range cases {
+		for _, order := range orderings(len(c.msgs)) {
+			u := makeUID()
+			for _, i := range order {
+				consumeMessage(t, fmt.Sprintf("case %d, message %d of %v", n, i, order), sm, c.msgs[i](u))
+			}
+			for _, check := range c.checks {
+				state, err := sm.State(u, nil, check.t)
+				require.Nil(t, err, "no error from State()")
+				items, err := state.Items()
+				require.Nil(t, err, "no error from Items()")
+				var bodies []string
+				for _, i := range items {
+					bodies = append(bodies, string(i.Body().Bytes()))
+				}
+				sort.Strings(bodies)
+				require.Equal(t, check.bodies, bodies, "right items for case %d in order %v", n, order)
+			}
+		}
+	}
+}
+
+func TestStateMachinePaging(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	p, ok := sm.(gregor.InBandMessagePager)
+	require.True(t, ok, "state machine is an InBandMessagePager")
+
+	t0 := fc.Now()
+	u1 := makeUID()
+	c1 := testCategory("foos")
+	m1 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	fc.Advance(time.Second)
+	// Messages with the same ctime are ordered by MsgID.
+	consumeMessage(t, "m2", sm, newCreation(u1, makeMsgID(), nil, c1, "f2", nil))
+	consumeMessage(t, "m3", sm, newCreation(u1, makeMsgID(), nil, c1, "f3", nil))
+	consumeMessage(t, "m4", sm, newCreation(u1, makeMsgID(), nil, c1, "f4", nil))
+	fc.Advance(time.Second)
+	// d1 dismisses several things of each kind, only one of which exists,
+	// but it's still one message.
+	d1 := makeMsgID()
+	consumeMessage(t, "d1", sm, newDismissal(u1, d1, nil, &testDismissal{
+		ids: []gregor.MsgID{m1, makeMsgID()},
+		ranges: []testMsgRange{
+			{c: testCategory("bars"), e: timeToTimeOrOffset(t0)},
+			{c: testCategory("bazs"), e: timeToTimeOrOffset(t0)},
+		},
+		forDevices: []testMsgIDForDevice{
+			{m: makeMsgID(), d: makeDeviceID()},
+			{m: makeMsgID(), d: makeDeviceID()},
+		},
+	}))
+	fc.Advance(time.Second)
+	consumeMessage(t, "m5", sm, newCreation(u1, makeMsgID(), nil, c1, "f5", nil))
+
+	all, err := sm.InBandMessagesSince(u1, nil, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, 5, len(all), "4 live items and a dismissal")
+	assertCompoundDismissal := func(msgs []gregor.InBandMessage) {
+		m := findMessage(msgs, d1)
+		require.NotNil(t, m, "d1 is there")
+		d := m.ToStateUpdateMessage().Dismissal()
+		require.Equal(t, 2, len(d.MsgIDsToDismiss()), "d1 has both its MsgIDs, once each")
+		require.Equal(t, 2, len(d.RangesToDismiss()), "d1 has both its ranges, once each")
+		require.Equal(t, 2, len(d.MsgIDsToDismissForDevice()), "d1 has both its device dismissals, once each")
+	}
+	assertCompoundDismissal(all)
+
+	var msgIDs []string
+	var paged []gregor.InBandMessage
+	var cursor []byte
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 3, "5 messages fit in 3 pages")
+		var page []gregor.InBandMessage
+		page, cursor, err = p.InBandMessagesPage(u1, nil, timeToTimeOrOffset(t0), cursor, 2)
+		require.Nil(t, err, "no error from InBandMessagesPage")
+		require.True(t, len(page) <= 2, "no more than 2 per page")
+		for _, m := range page {
+			msgIDs = append(msgIDs, fmt.Sprintf("%x", m.Metadata().MsgID().Bytes()))
+		}
+		paged = append(paged, page...)
+		if cursor == nil {
+			break
+		}
+	}
+	assertCompoundDismissal(paged)
+
+	require.Equal(t, len(all), len(msgIDs), "got all the messages")
+	require.NotContains(t, msgIDs, fmt.Sprintf("%x", m1.Bytes()), "the dismissed f1 isn't there")
+	require.True(t, sort.StringsAreSorted(msgIDs[:3]), "same-ctime messages ordered by MsgID")
+	var allIDs []string
+	for _, m := range all {
+		allIDs = append(allIDs, fmt.Sprintf("%x", m.Metadata().MsgID().Bytes()))
+	}
+	sort.Strings(allIDs)
+	sorted := append([]string{}, msgIDs...)
+	sort.Strings(sorted)
+	require.Equal(t, allIDs, sorted, "same messages paged as all at once")
+
+	_, _, err = p.InBandMessagesPage(u1, nil, timeToTimeOrOffset(t0), []byte("bad"), 2)
+	require.NotNil(t, err, "error from a bad cursor")
+}
+
+// withHLC stamps m with h, as if by the HLClock of whoever sent it.
+func withHLC(m gregor.Message, h gregor.HLC) gregor.Message {
+	m.ToInBandMessage().(gregor.HLCSetter).SetHLC(h)
+	return m
+}
+
+// stampedBy stamps m with an HLC from c, and the ctime of c's wall clock.
+func stampedBy(m gregor.Message, c *gregor.HLClock, wall func() time.Time) gregor.Message {
+	return withCTime(withHLC(m, c.Now()), wall())
+}
+
+func TestStateMachineHLC(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	p, ok := sm.(gregor.InBandMessagePager)
+	require.True(t, ok, "state machine is an InBandMessagePager")
+
+	// Messages come by way of two servers, one with a clock that's five
+	// seconds ahead. States are looked at once all their ctimes have
+	// passed.
+	aheadWall := func() time.Time { return fc.Now().Add(5 * time.Second) }
+	ahead := gregor.NewHLClock(aheadWall)
+	behind := gregor.NewHLClock(fc.Now)
+
+	t0 := fc.Now()
+	then := timeToTimeOrOffset(t0.Add(time.Minute))
+	u1 := makeUID()
+	c1 := testCategory("hlc.dismissed")
+	c2 := testCategory("hlc.kept")
+	consumeMessage(t, "m1", sm, stampedBy(newCreation(u1, makeMsgID(), nil, c1, "f1", nil), ahead, aheadWall))
+	late := stampedBy(newCreation(u1, makeMsgID(), nil, c1, "f2", nil), ahead, aheadWall)
+	mA := makeMsgID()
+	consumeMessage(t, "mA", sm, stampedBy(newCreation(u1, mA, nil, c2, "fA", nil), ahead, aheadWall))
+	assertBodiesInCategory(t, sm, u1, nil, then, c1, []string{"f1"})
+
+	// The client that dismisses c1 has seen everything so far, so the
+	// dismissal covers it, even though it has a ctime after the range ends.
+	fc.Advance(time.Second)
+	require.True(t, behind.Observe(gregor.HLCOf(findMessage(mustMessages(t, sm, u1, t0), mA).Metadata())), "observed mA")
+	d1 := makeMsgID()
+	consumeMessage(t, "d1", sm, stampedBy(newDismissalByCategory(u1, d1, nil, c1, timeToTimeOrOffset(fc.Now())), behind, fc.Now))
+	assertBodiesInCategory(t, sm, u1, nil, then, c1, []string{})
+
+	// So does a message the dismisser saw that arrives late.
+	consumeMessage(t, "late", sm, late)
+	assertBodiesInCategory(t, sm, u1, nil, then, c1, []string{})
+
+	// But not those that come after it.
+	mB := makeMsgID()
+	consumeMessage(t, "mB", sm, stampedBy(newCreation(u1, mB, nil, c2, "fB", nil), behind, fc.Now))
+	fc.Advance(time.Second)
+	m3 := makeMsgID()
+	consumeMessage(t, "m3", sm, stampedBy(newCreation(u1, m3, nil, c1, "f3", nil), behind, fc.Now))
+	assertBodiesInCategory(t, sm, u1, nil, then, c1, []string{"f3"})
+	assertNItemsInCategory(t, sm, u1, nil, then, c2, 2)
+
+	// Messages are ordered by HLC, not ctime, which would put mA last.
+	var want []string
+	for _, m := range []gregor.MsgID{mA, d1, mB, m3} {
+		want = append(want, fmt.Sprintf("%x", m.Bytes()))
+	}
+	var got []string
+	for _, m := range mustMessages(t, sm, u1, t0) {
+		got = append(got, fmt.Sprintf("%x", m.Metadata().MsgID().Bytes()))
+	}
+	require.Equal(t, want, got, "messages in HLC order")
+
+	got = nil
+	var cursor []byte
+	for {
+		page, next, err := p.InBandMessagesPage(u1, nil, timeToTimeOrOffset(t0), cursor, 1)
+		require.Nil(t, err, "no error from InBandMessagesPage")
+		for _, m := range page {
+			got = append(got, fmt.Sprintf("%x", m.Metadata().MsgID().Bytes()))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	require.Equal(t, want, got, "pages in HLC order")
+}
+
+func mustMessages(t *testing.T, sm gregor.StateMachine, u gregor.UID, since time.Time) []gregor.InBandMessage {
+	msgs, err := sm.InBandMessagesSince(u, nil, timeToTimeOrOffset(since))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	return msgs
+}
+
+// hexMsgIDs returns the sorted hex encodings of the given MsgIDs.
+func hexMsgIDs(ids ...gregor.MsgID) []string {
+	var ret []string
+	for _, id := range ids {
+		ret = append(ret, fmt.Sprintf("%x", id.Bytes()))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func msgIDsOf(msgs []gregor.InBandMessage) []string {
+	var ids []gregor.MsgID
+	for _, m := range msgs {
+		ids = append(ids, m.Metadata().MsgID())
+	}
+	return hexMsgIDs(ids...)
+}
+
+func TestStateMachineSync(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	sc, ok := sm.(gregor.SyncCheckpointer)
+	require.True(t, ok, "state machine is a SyncCheckpointer")
+
+	t0 := fc.Now()
+	u1 := makeUID()
+	d1 := makeDeviceID()
+	d2 := makeDeviceID()
+	c1 := testCategory("foos")
+	m1 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	fc.Advance(time.Second)
+	s1 := makeMsgID()
+	consumeMessage(t, "s1", sm, newSyncMessage(u1, s1, d1))
+	fc.Advance(time.Second)
+	m2 := makeMsgID()
+	consumeMessage(t, "m2", sm, newCreation(u1, m2, nil, c1, "f2", nil))
+	m3 := makeMsgID()
+	consumeMessage(t, "m3", sm, newCreation(u1, m3, d2, c1, "f3", nil))
+	fc.Advance(time.Second)
+	d := makeMsgID()
+	consumeMessage(t, "d", sm, newDismissalByIDs(u1, d, nil, []gregor.MsgID{m1}))
+	fc.Advance(time.Second)
+
+	// Sync messages are stored and replayed, to the devices they're for.
+	msgs, err := sm.InBandMessagesSince(u1, d1, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, hexMsgIDs(s1, m2, d), msgIDsOf(msgs), "sync message replayed")
+	for _, m := range msgs {
+		if bytes.Equal(m.Metadata().MsgID().Bytes(), s1.Bytes()) {
+			require.NotNil(t, m.ToStateSyncMessage(), "replayed as a sync message")
+			require.Nil(t, m.ToStateUpdateMessage(), "not as an update")
+		}
+	}
+	msgs, err = sm.InBandMessagesSince(u1, d2, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.NotContains(t, msgIDsOf(msgs), fmt.Sprintf("%x", s1.Bytes()), "other devices don't see it")
+
+	// A replayed sync message is ignored, like any other.
+	consumeMessage(t, "s1 again", sm, newSyncMessage(u1, s1, d1))
+
+	// Everything since the marker, but not the marker itself, and not the
+	// dismissed m1.
+	msgs, err = sc.InBandMessagesSinceSync(u1, nil, s1)
+	require.Nil(t, err, "no error from InBandMessagesSinceSync")
+	require.Equal(t, hexMsgIDs(m2, m3, d), msgIDsOf(msgs), "messages since the sync marker")
+	msgs, err = sc.InBandMessagesSinceSync(u1, d1, s1)
+	require.Nil(t, err, "no error from InBandMessagesSinceSync")
+	require.Equal(t, 2, len(msgs), "m3 is for another device")
+
+	s2 := makeMsgID()
+	consumeMessage(t, "s2", sm, newSyncMessage(u1, s2, d1))
+	msgs, err = sc.InBandMessagesSinceSync(u1, d1, s2)
+	require.Nil(t, err, "no error from InBandMessagesSinceSync")
+	require.Equal(t, 0, len(msgs), "nothing since the latest marker")
+
+	_, err = sc.InBandMessagesSinceSync(u1, d1, makeMsgID())
+	require.NotNil(t, err, "error from an unknown marker")
+	_, err = sc.InBandMessagesSinceSync(u1, d1, m2)
+	require.NotNil(t, err, "error from a marker that isn't a sync message")
+	_, err = sc.InBandMessagesSinceSync(makeUID(), d1, s1)
+	require.NotNil(t, err, "error from another user's marker")
+}
+
+func newOutOfBandMessage(u gregor.UID, system string, body string) gregor.Message {
+	return testMessage{o: &testOutOfBandMessage{u: u, s: testSystem(system), b: testBody(body)}}
+}
+
+func oobBodies(t *testing.T, q gregor.OutOfBandQueue, u gregor.UID) []string {
+	msgs, err := q.QueuedOutOfBandMessages(u)
+	require.Nil(t, err, "no error from QueuedOutOfBandMessages")
+	var ret []string
+	for _, m := range msgs {
+		require.Equal(t, u.Bytes(), m.UID().Bytes(), "message for the right user")
+		ret = append(ret, m.System().String()+":"+string(m.Body().Bytes()))
+	}
+	return ret
+}
+
+// TestStateMachineOutOfBand checks that sm queues OutOfBandMessages. It
+// must have been set up to keep messages for the "kbfs.favorites" system
+// for an hour, and not to keep messages for any other system.
+func TestStateMachineOutOfBand(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	q, ok := sm.(gregor.OutOfBandQueue)
+	require.True(t, ok, "state machine is an OutOfBandQueue")
+
+	u1 := makeUID()
+	u2 := makeUID()
+	require.Equal(t, 0, len(oobBodies(t, q, u1)), "nothing queued yet")
+
+	consumeMessage(t, "o1", sm, newOutOfBandMessage(u1, "kbfs.favorites", "o1"))
+	consumeMessage(t, "o2", sm, newOutOfBandMessage(u1, "kbfs.other", "o2"))
+	fc.Advance(30 * time.Minute)
+	consumeMessage(t, "o3", sm, newOutOfBandMessage(u1, "kbfs.favorites", "o3"))
+	consumeMessage(t, "o4", sm, newOutOfBandMessage(u2, "kbfs.favorites", "o4"))
+	require.Equal(t, []string{"kbfs.favorites:o1", "kbfs.favorites:o3"}, oobBodies(t, q, u1),
+		"messages with a retention are queued, oldest first")
+	require.Equal(t, []string{"kbfs.favorites:o4"}, oobBodies(t, q, u2), "queues are per user")
+
+	// There's no one to queue a message without a UID for, so it's dropped.
+	consumeMessage(t, "o5", sm, newOutOfBandMessage(nil, "kbfs.favorites", "o5"))
+
+	// Messages are still there after they've been fetched, but not after
+	// they expire.
+	require.Equal(t, 2, len(oobBodies(t, q, u1)), "fetching doesn't dequeue")
+	fc.Advance(45 * time.Minute)
+	require.Equal(t, []string{"kbfs.favorites:o3"}, oobBodies(t, q, u1), "o1 expired")
+
+	// Pruning forgets expired messages for good, and leaves the rest.
+	p, ok := sm.(gregor.Pruner)
+	require.True(t, ok, "state machine is a Pruner")
+	require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	require.Equal(t, []string{"kbfs.favorites:o3"}, oobBodies(t, q, u1), "unexpired message survives Prune")
+	fc.Advance(time.Hour)
+	require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	require.Equal(t, 0, len(oobBodies(t, q, u1)), "everything expired")
+	require.Equal(t, 0, len(oobBodies(t, q, u2)), "everything expired")
+}
+
+func newDismissalByIDForDevice(u gregor.UID, m gregor.MsgID, d gregor.DeviceID, id gregor.MsgID, dd gregor.DeviceID) gregor.Message {
+	md := newTestMetadata(u, m, d, time.Time{})
+	dismissal := &testDismissal{forDevices: []testMsgIDForDevice{{m: id, d: dd}}}
+	return testMessage{i: &testInBandMessage{m: md, d: dismissal}}
+}
+
+// TestStateMachineDeviceDismissal checks that Items can be dismissed for a
+// single device, and stay put for all the others.
+func TestStateMachineDeviceDismissal(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	t0 := fc.Now()
+	u1 := makeUID()
+	d1 := makeDeviceID()
+	d2 := makeDeviceID()
+	c1 := testCategory("foos")
+
+	m1 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	m2 := makeMsgID()
+	consumeMessage(t, "m2", sm, newCreation(u1, m2, nil, c1, "f2", nil))
+	fc.Advance(time.Second)
+	t1 := fc.Now()
+	dm1 := makeMsgID()
+	consumeMessage(t, "dm1", sm, newDismissalByIDForDevice(u1, dm1, d1, m1, d1))
+	fc.Advance(time.Second)
+
+	assertBodiesInCategory(t, sm, u1, d1, nil, c1, []string{"f2"})
+	assertBodiesInCategory(t, sm, u1, d2, nil, c1, []string{"f1", "f2"})
+	assertBodiesInCategory(t, sm, u1, makeDeviceID(), nil, c1, []string{"f1", "f2"})
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"f1", "f2"})
+	assertNItems(t, sm, u1, d1, timeToTimeOrOffset(t0), 2)
+	assertNItems(t, sm, u1, d1, timeToTimeOrOffset(t1), 1)
+
+	// The creation of m1 is no longer replayed to d1, but the dismissal is,
+	// since it came from there.
+	msgs, err := sm.InBandMessagesSince(u1, d1, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, hexMsgIDs(m2, dm1), msgIDsOf(msgs), "replayed to d1")
+	fds := msgs[1].ToStateUpdateMessage().Dismissal().MsgIDsToDismissForDevice()
+	require.Equal(t, 1, len(fds), "replayed with its device dismissal")
+	require.Equal(t, m1.Bytes(), fds[0].MsgID().Bytes(), "right item")
+	require.Equal(t, d1.Bytes(), fds[0].DeviceID().Bytes(), "right device")
+	msgs, err = sm.InBandMessagesSince(u1, d2, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	require.Equal(t, hexMsgIDs(m1, m2), msgIDsOf(msgs), "replayed to d2")
+
+	// A dismissal for a device that shows up before its item still applies.
+	m3 := makeMsgID()
+	consumeMessage(t, "dm3", sm, newDismissalByIDForDevice(u1, makeMsgID(), d2, m3, d2))
+	fc.Advance(time.Second)
+	consumeMessage(t, "m3", sm, newCreation(u1, m3, nil, c1, "f3", nil))
+	assertBodiesInCategory(t, sm, u1, d1, nil, c1, []string{"f2", "f3"})
+	assertBodiesInCategory(t, sm, u1, d2, nil, c1, []string{"f1", "f2"})
+
+	// Pruning leaves items that are still live for some devices alone.
+	p, ok := sm.(gregor.Pruner)
+	require.True(t, ok, "state machine is a Pruner")
+	fc.Advance(time.Second)
+	require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	assertBodiesInCategory(t, sm, u1, d1, nil, c1, []string{"f2", "f3"})
+	assertBodiesInCategory(t, sm, u1, d2, nil, c1, []string{"f1", "f2"})
+
+	// Dismissing for all devices still works on top of that.
+	consumeMessage(t, "d", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m1, m3}))
+	assertBodiesInCategory(t, sm, u1, d1, nil, c1, []string{"f2"})
+	assertBodiesInCategory(t, sm, u1, d2, nil, c1, []string{"f2"})
+}
+
+func newItemUpdate(u gregor.UID, m gregor.MsgID, target gregor.MsgID, body gregor.Body, dtime gregor.TimeOrOffset) gregor.Message {
+	md := newTestMetadata(u, m, nil, time.Time{})
+	update := &testItemUpdate{m: target, body: body, dtime: dtime}
+	return testMessage{i: &testInBandMessage{m: md, u: update}}
+}
+
+func findMessage(msgs []gregor.InBandMessage, m gregor.MsgID) gregor.InBandMessage {
+	for _, msg := range msgs {
+		if bytes.Equal(msg.Metadata().MsgID().Bytes(), m.Bytes()) {
+			return msg
+		}
+	}
+	return nil
+}
+
+func TestStateMachineItemUpdate(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	t0 := fc.Now()
+	u1 := makeUID()
+	c1 := testCategory("followers")
+
+	m1 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "3 new followers", nil))
+	m2 := makeMsgID()
+	consumeMessage(t, "m2", sm, newCreation(u1, m2, nil, c1, "other", nil))
+	fc.Advance(time.Second)
+
+	// The body is replaced in place, and the item keeps its MsgID.
+	u1m1 := makeMsgID()
+	consumeMessage(t, "u1m1", sm, newItemUpdate(u1, u1m1, m1, testBody("4 new followers"), nil))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"4 new followers", "other"})
+	st, err := sm.State(u1, nil, nil)
+	require.Nil(t, err, "no error from State")
+	items, err := st.Items()
+	require.Nil(t, err, "no error from Items")
+	for _, i := range items {
+		if string(i.Body().Bytes()) == "4 new followers" {
+			require.Equal(t, m1.Bytes(), i.Metadata().MsgID().Bytes(), "same MsgID after the update")
+		}
+	}
+	fc.Advance(time.Second)
+
+	// Updates older than the latest one lose, whatever order they arrive in.
+	consumeMessage(t, "stale", sm, withCTime(newItemUpdate(u1, makeMsgID(), m1, testBody("stale"), nil), t0))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"4 new followers", "other"})
+	consumeMessage(t, "future", sm, withCTime(newItemUpdate(u1, makeMsgID(), m1, testBody("6 new followers"), nil), t0.Add(time.Minute)))
+	consumeMessage(t, "older", sm, newItemUpdate(u1, makeMsgID(), m1, testBody("5 new followers"), nil))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"6 new followers", "other"})
+
+	// An update that shows up before its item still applies, as long as it's
+	// newer than the item.
+	m3 := makeMsgID()
+	consumeMessage(t, "u1m3", sm, newItemUpdate(u1, makeMsgID(), m3, testBody("late"), nil))
+	fc.Advance(time.Second)
+	consumeMessage(t, "m3", sm, withCTime(newCreation(u1, m3, nil, c1, "early", nil), t0.Add(time.Second)))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"6 new followers", "other", "late"})
+
+	// Updates can bring an item's expiry forward or push it back, without
+	// touching its body.
+	m4 := makeMsgID()
+	consumeMessage(t, "m4", sm, newCreation(u1, m4, nil, c1, "expiring", makeOffset(2)))
+	u1m4 := makeMsgID()
+	consumeMessage(t, "u1m4", sm, newItemUpdate(u1, u1m4, m4, nil, makeOffset(3600)))
+	consumeMessage(t, "u1m2", sm, newItemUpdate(u1, makeMsgID(), m2, nil, makeOffset(1)))
+	fc.Advance(3 * time.Second)
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"6 new followers", "late", "expiring"})
+
+	// Dismissals win over updates to an item's expiry.
+	consumeMessage(t, "dm3", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m3}))
+	consumeMessage(t, "u2m3", sm, newItemUpdate(u1, makeMsgID(), m3, testBody("later"), makeOffset(3600)))
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"6 new followers", "expiring"})
+
+	// Updates to live items are replayed, and survive pruning, but those to
+	// items that are gone aren't, once they're pruned. Engines that don't
+	// prune keep replaying everything.
+	p, pruned := sm.(gregor.Pruner)
+	if pruned {
+		require.Nil(t, p.Prune(fc.Now()), "no error from Prune")
+	}
+	msgs, err := sm.InBandMessagesSince(u1, nil, timeToTimeOrOffset(t0))
+	require.Nil(t, err, "no error from InBandMessagesSince")
+	msg := findMessage(msgs, u1m4)
+	require.NotNil(t, msg, "update to m4 is replayed")
+	up := msg.ToStateUpdateMessage().Update()
+	require.NotNil(t, up, "replayed as an update")
+	require.Equal(t, m4.Bytes(), up.MsgID().Bytes(), "right item")
+	require.Nil(t, up.Body(), "body left alone")
+	require.NotNil(t, up.DTime(), "with a dtime")
+	require.NotNil(t, findMessage(msgs, u1m1), "update to m1 is replayed")
+	require.Equal(t, "4 new followers", string(findMessage(msgs, u1m1).ToStateUpdateMessage().Update().Body().Bytes()), "right body")
+	for _, msg := range msgs {
+		if up := msg.ToStateUpdateMessage().Update(); up != nil && pruned {
+			require.NotEqual(t, m2.Bytes(), up.MsgID().Bytes(), "no updates to m2")
+			require.NotEqual(t, m3.Bytes(), up.MsgID().Bytes(), "no updates to m3")
+		}
+	}
+	assertBodiesInCategory(t, sm, u1, nil, nil, c1, []string{"6 new followers", "expiring"})
+}
+
+// assertStateDiff checks the StateDiff for the device d from from to to.
+func assertStateDiff(t *testing.T, sd gregor.StateDiffer, u gregor.UID, d gregor.DeviceID, from, to gregor.TimeOrOffset, added []gregor.MsgID, removed []gregor.MsgID) {
+	items, ids, err := sd.StateDiff(u, d, from, to)
+	require.Nil(t, err, "no error from StateDiff")
+	var itemIDs []gregor.MsgID
+	for _, i := range items {
+		itemIDs = append(itemIDs, i.Metadata().MsgID())
+	}
+	require.Equal(t, hexMsgIDs(added...), hexMsgIDs(itemIDs...), "right items added")
+	require.Equal(t, hexMsgIDs(removed...), hexMsgIDs(ids...), "right items removed")
+}
+
+func TestStateMachineStateDiff(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	sd, ok := sm.(gregor.StateDiffer)
+	require.True(t, ok, "state machine is a StateDiffer")
+	u1 := makeUID()
+	d1 := makeDeviceID()
+	d2 := makeDeviceID()
+	c1 := testCategory("foos")
+
+	t0 := timeToTimeOrOffset(fc.Now())
+	fc.Advance(time.Second)
+	m1 := makeMsgID()
+	consumeMessage(t, "m1", sm, newCreation(u1, m1, nil, c1, "f1", nil))
+	m2 := makeMsgID()
+	consumeMessage(t, "m2", sm, newCreation(u1, m2, d1, c1, "f2", nil))
+	t1 := timeToTimeOrOffset(fc.Now())
+
+	fc.Advance(time.Second)
+	m3 := makeMsgID()
+	consumeMessage(t, "m3", sm, newCreation(u1, m3, nil, c1, "f3", nil))
+	consumeMessage(t, "dm1", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m1}))
+	m4 := makeMsgID()
+	consumeMessage(t, "m4", sm, newCreation(u1, m4, nil, c1, "f4", nil))
+	consumeMessage(t, "dm4", sm, newDismissalByIDs(u1, makeMsgID(), nil, []gregor.MsgID{m4}))
+	t2 := timeToTimeOrOffset(fc.Now())
+
+	fc.Advance(time.Second)
+	consumeMessage(t, "dm2", sm, newDismissalByIDForDevice(u1, makeMsgID(), d1, m2, d1))
+	m5 := makeMsgID()
+	consumeMessage(t, "m5", sm, newCreation(u1, m5, nil, c1, "f5", makeOffset(1)))
+	fc.Advance(2 * time.Second)
+
+	assertStateDiff(t, sd, u1, nil, t0, t1, []gregor.MsgID{m1, m2}, nil)
+	assertStateDiff(t, sd, u1, nil, t1, t1, nil, nil)
+
+	// m4 came and went, and m5 has expired.
+	assertStateDiff(t, sd, u1, nil, t1, nil, []gregor.MsgID{m3}, []gregor.MsgID{m1})
+	assertStateDiff(t, sd, u1, d1, t1, nil, []gregor.MsgID{m3}, []gregor.MsgID{m1, m2})
+	assertStateDiff(t, sd, u1, d1, t1, t2, []gregor.MsgID{m3}, []gregor.MsgID{m1})
+	assertStateDiff(t, sd, u1, d2, t1, nil, []gregor.MsgID{m3}, []gregor.MsgID{m1})
+	assertStateDiff(t, sd, u1, d2, t0, nil, []gregor.MsgID{m3}, nil)
+
+	// Going back in time works too.
+	assertStateDiff(t, sd, u1, nil, t2, t1, []gregor.MsgID{m1}, []gregor.MsgID{m3})
+
+	// Added items are as they are in the State.
+	items, _, err := sd.StateDiff(u1, d2, t1, nil)
+	require.Nil(t, err, "no error from StateDiff")
+	require.Equal(t, 1, len(items), "one item added")
+	require.Equal(t, "f3", string(items[0].Body().Bytes()), "right body")
+	require.Equal(t, c1.String(), items[0].Category().String(), "right category")
+
+	assertStateDiff(t, sd, makeUID(), nil, t0, nil, nil, nil)
+}
+
+// assertBodiesInCategoryState checks the bodies in the part of the State in
+// the category c, as fetched by StateInCategory.
+func assertBodiesInCategoryState(t *testing.T, cs gregor.CategoryStater, u gregor.UID, c gregor.Category, expected []string) {
+	state, err := cs.StateInCategory(u, nil, nil, c)
+	require.Nil(t, err, "no error from StateInCategory()")
+	it, err := state.Items()
+	require.Nil(t, err, "no error from Items()")
+	actual := make([]string, 0)
+	for _, a := range it {
+		actual = append(actual, string(a.Body().Bytes()))
+	}
+	require.Equal(t, expected, actual, "the right values in category %s", c)
+}
+
+func TestStateMachineCategories(t *testing.T, sm gregor.StateMachine, fc clockwork.FakeClock) {
+	cs, ok := sm.(gregor.CategoryStater)
+	require.True(t, ok, "state machine is a CategoryStater")
+	u1 := makeUID()
+	create := func(c string, body string) {
+		fc.Advance(time.Second)
+		consumeMessage(t, body, sm, newCreation(u1, makeMsgID(), nil, testCategory(c), body, nil))
+	}
+	create("user.joined", "joined")
+	create("user.proof.broken", "broken")
+	create("user", "user")
+	create("username", "username")
+	create("kbfs.tlf", "tlf")
+
+	assertBodiesInCategory(t, sm, u1, nil, nil, testCategory("user.*"), []string{"joined", "broken"})
+	assertBodiesInCategory(t, sm, u1, nil, nil, testCategory("user.proof.*"), []string{"broken"})
+	assertBodiesInCategory(t, sm, u1, nil, nil, testCategory("user"), []string{"user"})
+	assertNItemsInCategory(t, sm, u1, nil, nil, testCategory("user.joined.*"), 0)
+	assertBodiesInCategoryState(t, cs, u1, testCategory("user.*"), []string{"joined", "broken"})
+	assertBodiesInCategoryState(t, cs, u1, testCategory("user.proof.*"), []string{"broken"})
+	assertBodiesInCategoryState(t, cs, u1, testCategory("user"), []string{"user"})
+	assertBodiesInCategoryState(t, cs, u1, testCategory("kbfs.tlf"), []string{"tlf"})
+	assertBodiesInCategoryState(t, cs, u1, testCategory("nothing.*"), []string{})
+	assertNItems(t, sm, u1, nil, nil, 5)
+
+	// A range dismissal over a wildcard dismisses everything under it, up
+	// to its end, including Items that arrive late.
+	fc.Advance(time.Second)
+	end := fc.Now()
+	fc.Advance(time.Second)
+	consumeMessage(t, "dr", sm, newDismissalByCategory(u1, makeMsgID(), nil, testCategory("user.*"), timeToTimeOrOffset(end)))
+	late := withCTime(newCreation(u1, makeMsgID(), nil, testCategory("user.proof.added"), "late", nil), end)
+	consumeMessage(t, "late", sm, late)
+	create("user.joined", "after")
+	assertBodiesInCategory(t, sm, u1, nil, nil, testCategory("user.*"), []string{"after"})
+	assertBodiesInCategoryState(t, cs, u1, testCategory("user.*"), []string{"after"})
+	assertNItems(t, sm, u1, nil, nil, 4)
+}